@@ -0,0 +1,250 @@
+package lib
+
+import (
+	"bufio"
+	"bytes"
+	"io/ioutil"
+	"net"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/rs/zerolog"
+)
+
+// Actions of access control rules.
+const (
+	ACLAllow = "allow"
+	ACLDeny  = "deny"
+)
+
+// aclRule allows or denies the clients of a network.
+type aclRule struct {
+	allow   bool
+	network *net.IPNet
+}
+
+// parseACLRules parses rules of the form 'allow <cidr>'
+// or 'deny <cidr>', one per line. Empty lines and
+// comments (starting with '#') are skipped.
+func parseACLRules(lines []string) (rules []aclRule, err error) {
+	for _, line := range lines {
+		if ndx := strings.Index(line, "#"); ndx >= 0 {
+			line = line[:ndx]
+		}
+
+		fields := strings.Fields(line)
+		if len(fields) == 0 {
+			continue
+		}
+
+		if len(fields) != 2 {
+			err = errors.Errorf("malformed rule '%s'", strings.TrimSpace(line))
+			return
+		}
+
+		var rule aclRule
+
+		switch fields[0] {
+		case ACLAllow:
+			rule.allow = true
+		case ACLDeny:
+		default:
+			err = errors.Errorf("unknown action '%s' in rule '%s'",
+				fields[0], strings.TrimSpace(line))
+			return
+		}
+
+		rule.network, err = ParseCIDR(fields[1])
+		if err != nil {
+			return
+		}
+
+		rules = append(rules, rule)
+	}
+
+	return
+}
+
+// matchACLRules retrieves whether the first rule that
+// matches 'ip' allows it, if any does.
+func matchACLRules(rules []aclRule, ip net.IP) (allow, matched bool) {
+	for _, rule := range rules {
+		if rule.network.Contains(ip) {
+			return rule.allow, true
+		}
+	}
+
+	return
+}
+
+// acl decides which clients can connect to a frontend:
+// the inline rules are evaluated first, then the ones
+// of each file in order, with the first match winning.
+// Clients matching no rule get the default action.
+type acl struct {
+	rules        []aclRule
+	files        []*aclFile
+	defaultAllow bool
+}
+
+func newACL(cfg ACL, logger zerolog.Logger) (a *acl, err error) {
+	if len(cfg.Rules) == 0 && len(cfg.Files) == 0 {
+		return
+	}
+
+	if cfg.Default == "" {
+		cfg.Default = ACLAllow
+	}
+
+	a = &acl{}
+
+	switch cfg.Default {
+	case ACLAllow:
+		a.defaultAllow = true
+	case ACLDeny:
+	default:
+		err = errors.Errorf("unknown default acl action '%s'", cfg.Default)
+		return
+	}
+
+	a.rules, err = parseACLRules(cfg.Rules)
+	if err != nil {
+		return
+	}
+
+	for _, path := range cfg.Files {
+		file := newACLFile(path, logger)
+
+		// files must be valid at startup, while
+		// failing to reload them keeps their previous
+		// rules.
+		_, err = file.load()
+		if err != nil {
+			return
+		}
+
+		a.files = append(a.files, file)
+	}
+
+	return
+}
+
+// allows retrieves whether connections from 'client'
+// are allowed. Clients other than TCP and UDP ones
+// (e.g., unix sockets) are always allowed.
+func (a *acl) allows(client net.Addr) bool {
+	ip := addrIP(client)
+	if ip == nil {
+		return true
+	}
+
+	allow, matched := matchACLRules(a.rules, ip)
+	if matched {
+		return allow
+	}
+
+	for _, file := range a.files {
+		allow, matched = matchACLRules(file.loaded(), ip)
+		if matched {
+			return allow
+		}
+	}
+
+	return a.defaultAllow
+}
+
+// aclFile holds the rules of a file, reloading them as
+// it gets rewritten.
+type aclFile struct {
+	path         string
+	pollInterval time.Duration
+	debounce     time.Duration
+	logger       zerolog.Logger
+
+	mu      sync.Mutex
+	content []byte
+	rules   atomic.Value
+}
+
+func newACLFile(path string, logger zerolog.Logger) *aclFile {
+	f := &aclFile{
+		path:         path,
+		pollInterval: defaultFilePollInterval,
+		debounce:     defaultFileDebounce,
+		logger: logger.With().
+			Str("acl", path).
+			Logger(),
+	}
+
+	f.rules.Store([]aclRule(nil))
+	return f
+}
+
+func (f *aclFile) loaded() []aclRule {
+	return f.rules.Load().([]aclRule)
+}
+
+// load reads the rules of the file, retrieving whether
+// they changed.
+func (f *aclFile) load() (changed bool, err error) {
+	data, err := ioutil.ReadFile(f.path)
+	if err != nil {
+		err = errors.Wrapf(err, "couldn't read acl file %s", f.path)
+		return
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if f.content != nil && bytes.Equal(data, f.content) {
+		return
+	}
+
+	var (
+		lines   []string
+		scanner = bufio.NewScanner(bytes.NewReader(data))
+	)
+
+	for scanner.Scan() {
+		lines = append(lines, scanner.Text())
+	}
+
+	rules, err := parseACLRules(lines)
+	if err != nil {
+		err = errors.Wrapf(err, "malformed acl file %s", f.path)
+		return
+	}
+
+	f.content = data
+	f.rules.Store(rules)
+	changed = true
+	return
+}
+
+// refresh reloads the file, keeping the previous rules
+// if it can't be read or parsed.
+func (f *aclFile) refresh() {
+	changed, err := f.load()
+	if err != nil {
+		f.logger.Error().
+			Err(err).
+			Msg("keeping previous acl rules")
+		return
+	}
+
+	if changed {
+		f.logger.Info().
+			Int("rules", len(f.loaded())).
+			Msg("acl reloaded")
+	}
+}
+
+func (f *aclFile) run(done <-chan struct{}) {
+	followFile(f.path, f.pollInterval, f.debounce, done, f.logger, func() time.Duration {
+		f.refresh()
+		return 0
+	})
+}
@@ -0,0 +1,173 @@
+package lib
+
+import (
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/rs/zerolog"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseACLRules(t *testing.T) {
+	var testCases = []struct {
+		description string
+		lines       []string
+		expected    int
+		shouldFail  bool
+	}{
+		{"empty", nil, 0, false},
+		{"comments and blanks", []string{"# rules", "", "  allow 10.0.0.0/8 # internal"}, 1, false},
+		{"plain ips", []string{"deny 10.0.0.1", "allow 2001:db8::1"}, 2, false},
+		{"unknown action", []string{"reject 10.0.0.1"}, 0, true},
+		{"malformed cidr", []string{"allow 10.0.0.0/33"}, 0, true},
+		{"missing cidr", []string{"allow"}, 0, true},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.description, func(t *testing.T) {
+			rules, err := parseACLRules(tc.lines)
+			if tc.shouldFail {
+				assert.Error(t, err)
+				return
+			}
+
+			assert.NoError(t, err)
+			assert.Len(t, rules, tc.expected)
+		})
+	}
+}
+
+func TestACLAllows(t *testing.T) {
+	dir, err := ioutil.TempDir("", "acl")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	file := filepath.Join(dir, "acl")
+	assert.NoError(t, ioutil.WriteFile(file, []byte("allow 192.168.0.0/16\n"), 0644))
+
+	var testCases = []struct {
+		description string
+		cfg         ACL
+		client      net.Addr
+		expected    bool
+	}{
+		{
+			description: "first match wins",
+			cfg:         ACL{Rules: []string{"deny 10.0.0.1", "allow 10.0.0.0/8"}},
+			client:      &net.TCPAddr{IP: net.ParseIP("10.0.0.1")},
+			expected:    false,
+		},
+		{
+			description: "later match",
+			cfg:         ACL{Rules: []string{"deny 10.0.0.1", "allow 10.0.0.0/8"}},
+			client:      &net.TCPAddr{IP: net.ParseIP("10.0.0.2")},
+			expected:    true,
+		},
+		{
+			description: "default allow",
+			cfg:         ACL{Rules: []string{"deny 10.0.0.0/8"}},
+			client:      &net.TCPAddr{IP: net.ParseIP("172.16.0.1")},
+			expected:    true,
+		},
+		{
+			description: "default deny",
+			cfg:         ACL{Rules: []string{"allow 10.0.0.0/8"}, Default: ACLDeny},
+			client:      &net.TCPAddr{IP: net.ParseIP("172.16.0.1")},
+			expected:    false,
+		},
+		{
+			description: "rules from files",
+			cfg:         ACL{Files: []string{file}, Default: ACLDeny},
+			client:      &net.TCPAddr{IP: net.ParseIP("192.168.1.1")},
+			expected:    true,
+		},
+		{
+			description: "inline rules before files",
+			cfg:         ACL{Rules: []string{"deny 192.168.1.1"}, Files: []string{file}},
+			client:      &net.TCPAddr{IP: net.ParseIP("192.168.1.1")},
+			expected:    false,
+		},
+		{
+			description: "unix clients",
+			cfg:         ACL{Default: ACLDeny, Rules: []string{"deny 0.0.0.0/0"}},
+			client:      &net.UnixAddr{Name: "@", Net: "unix"},
+			expected:    true,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.description, func(t *testing.T) {
+			a, err := newACL(tc.cfg, zerolog.Nop())
+			assert.NoError(t, err)
+			assert.Equal(t, tc.expected, a.allows(tc.client))
+		})
+	}
+}
+
+func TestACLFileReloads(t *testing.T) {
+	dir, err := ioutil.TempDir("", "acl")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	var (
+		path   = filepath.Join(dir, "acl")
+		client = &net.TCPAddr{IP: net.ParseIP("10.0.0.1")}
+		done   = make(chan struct{})
+	)
+	defer close(done)
+
+	writeAtomically(t, path, "deny 10.0.0.1\n")
+
+	a, err := newACL(ACL{Files: []string{path}}, zerolog.Nop())
+	assert.NoError(t, err)
+	assert.False(t, a.allows(client))
+
+	file := a.files[0]
+	file.debounce = 10 * time.Millisecond
+	file.pollInterval = 10 * time.Millisecond
+	go file.run(done)
+
+	// gives the watch some time to be set up.
+	time.Sleep(50 * time.Millisecond)
+
+	writeAtomically(t, path, "allow 10.0.0.1\n")
+	assert.True(t, waitFor(2*time.Second, func() bool {
+		return a.allows(client)
+	}))
+
+	// malformed files keep the previous rules.
+	writeAtomically(t, path, "deny 10.0.0.1/99\n")
+	time.Sleep(200 * time.Millisecond)
+	assert.True(t, a.allows(client))
+}
+
+func TestNewACLFailsOnInvalidFiles(t *testing.T) {
+	_, err := newACL(ACL{Files: []string{"/inexistent/acl"}}, zerolog.Nop())
+	assert.Error(t, err)
+
+	_, err = newACL(ACL{Rules: []string{"allow 10.0.0.1"}, Default: "drop"}, zerolog.Nop())
+	assert.Error(t, err)
+}
+
+func TestLoadBalancerDeniesConnections(t *testing.T) {
+	lb, addresses := startLimitedLoadBalancer(t, LoadBalancerConfig{},
+		Frontend{Name: "a", ACL: ACL{Rules: []string{"deny 127.0.0.1"}}},
+		Frontend{Name: "b", ACL: ACL{Rules: []string{"allow 127.0.0.0/8"}, Default: ACLDeny}},
+	)
+
+	denied, served := dialEcho(t, addresses[0])
+	defer denied.Close()
+	assert.False(t, served)
+
+	allowed, served := dialEcho(t, addresses[1])
+	defer allowed.Close()
+	assert.True(t, served)
+
+	stats := lb.Stats()
+	assert.Equal(t, uint64(1), stats.Frontends[0].Denied)
+	assert.Equal(t, uint64(0), stats.Frontends[1].Denied)
+}
@@ -0,0 +1,205 @@
+package lib
+
+import (
+	"encoding/json"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// listenAdmin starts the admin HTTP interface, which
+// exposes the stats of all frontends and backends and
+// allows changing their bandwidth limits, draining
+// servers and capturing connections.
+func (lb *LoadBalancer) listenAdmin() (err error) {
+	lb.logger.Info().
+		Str("address", lb.adminAddress).
+		Msg("admin listening")
+
+	ln, err := net.Listen("tcp", lb.adminAddress)
+	if err != nil {
+		err = errors.Wrapf(err,
+			"couldn't listen on admin address %s", lb.adminAddress)
+		return
+	}
+
+	lb.adminServer = &http.Server{
+		Handler: lb.adminHandler(),
+	}
+
+	go func() {
+		err := lb.adminServer.Serve(ln)
+		if err != nil && err != http.ErrServerClosed {
+			lb.logger.Error().
+				Err(err).
+				Msg("admin interface errored")
+		}
+	}()
+
+	return
+}
+
+func (lb *LoadBalancer) adminHandler() http.Handler {
+	var mux = http.NewServeMux()
+
+	mux.HandleFunc("/stats", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		writeJson(w, lb.Stats())
+	})
+
+	mux.HandleFunc("/bandwidth/frontends/", func(w http.ResponseWriter, r *http.Request) {
+		var (
+			name = strings.TrimPrefix(r.URL.Path, "/bandwidth/frontends/")
+			cfg  FrontendBandwidth
+		)
+
+		if lb.frontend(name) == nil {
+			http.NotFound(w, r)
+			return
+		}
+
+		switch r.Method {
+		case http.MethodGet:
+		case http.MethodPut:
+			err := json.NewDecoder(r.Body).Decode(&cfg)
+			if err == nil {
+				err = lb.SetFrontendBandwidth(name, cfg)
+			}
+
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+		default:
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		cfg, _ = lb.FrontendBandwidth(name)
+		writeJson(w, cfg)
+	})
+
+	mux.HandleFunc("/bandwidth/backends/", func(w http.ResponseWriter, r *http.Request) {
+		var (
+			name = strings.TrimPrefix(r.URL.Path, "/bandwidth/backends/")
+			cfg  Bandwidth
+		)
+
+		if lb.backend(name) == nil {
+			http.NotFound(w, r)
+			return
+		}
+
+		switch r.Method {
+		case http.MethodGet:
+		case http.MethodPut:
+			err := json.NewDecoder(r.Body).Decode(&cfg)
+			if err == nil {
+				err = lb.SetServerBandwidth(name, cfg)
+			}
+
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+		default:
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		cfg, _ = lb.ServerBandwidth(name)
+		writeJson(w, cfg)
+	})
+
+	mux.HandleFunc("/drain/backends/", func(w http.ResponseWriter, r *http.Request) {
+		var (
+			name    = strings.TrimPrefix(r.URL.Path, "/drain/backends/")
+			address = r.URL.Query().Get("server")
+			req     struct {
+				Draining bool   `json:"draining"`
+				Timeout  string `json:"timeout"`
+			}
+		)
+
+		if lb.backend(name) == nil {
+			http.NotFound(w, r)
+			return
+		}
+
+		switch r.Method {
+		case http.MethodGet:
+		case http.MethodPut:
+			var timeout time.Duration
+
+			err := json.NewDecoder(r.Body).Decode(&req)
+			if err == nil && req.Timeout != "" {
+				timeout, err = time.ParseDuration(req.Timeout)
+			}
+
+			if err == nil {
+				err = lb.SetDraining(name, address, req.Draining, timeout)
+			}
+
+			if errors.Cause(err) == errUnknownServer {
+				http.NotFound(w, r)
+				return
+			}
+
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+		default:
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		statuses, err := lb.DrainStatus(name, address)
+		if err != nil {
+			http.NotFound(w, r)
+			return
+		}
+
+		writeJson(w, statuses)
+	})
+
+	mux.HandleFunc("/capture", func(w http.ResponseWriter, r *http.Request) {
+		var cfg Capture
+
+		switch r.Method {
+		case http.MethodGet:
+		case http.MethodPut:
+			err := json.NewDecoder(r.Body).Decode(&cfg)
+			if err == nil {
+				err = lb.SetCapture(cfg)
+			}
+
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+		default:
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		writeJson(w, lb.Capture())
+	})
+
+	return mux
+}
+
+func writeJson(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+
+	encoder := json.NewEncoder(w)
+	encoder.SetIndent("", "  ")
+	encoder.Encode(v)
+}
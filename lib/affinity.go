@@ -0,0 +1,202 @@
+package lib
+
+import (
+	"container/list"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	defaultAffinityMaxEntries = 100000
+)
+
+// AffinityEntry pins the connections of a client IP to
+// a server until it expires.
+type AffinityEntry struct {
+	Client  string    `json:"client"`
+	Server  string    `json:"server"`
+	Expires time.Time `json:"expires"`
+}
+
+// affinityTable remembers the server each client IP was
+// last sent to. Entries expire 'ttl' after their last
+// use and the table is bounded, evicting the least
+// recently used ones. As every use extends the ttl, the
+// least recently used entries are also the first ones
+// to expire.
+type affinityTable struct {
+	ttl        time.Duration
+	maxEntries int
+
+	mu      sync.Mutex
+	entries map[string]*list.Element
+	lru     *list.List
+}
+
+func newAffinityTable(cfg Affinity) (t *affinityTable, err error) {
+	if cfg.TTL < 0 || cfg.MaxEntries < 0 {
+		err = errors.Errorf("ttl and max entries must not be negative")
+		return
+	}
+
+	if cfg.TTL == 0 {
+		if cfg.MaxEntries != 0 {
+			err = errors.Errorf("affinity requires a ttl")
+		}
+
+		return
+	}
+
+	if cfg.MaxEntries == 0 {
+		cfg.MaxEntries = defaultAffinityMaxEntries
+	}
+
+	t = &affinityTable{
+		ttl:        cfg.TTL,
+		maxEntries: cfg.MaxEntries,
+		entries:    map[string]*list.Element{},
+		lru:        list.New(),
+	}
+	return
+}
+
+// affinityKey retrieves the key of the entry of a
+// client, empty for those without an IP (e.g., unix
+// sockets).
+func affinityKey(client net.Addr) string {
+	ip := addrIP(client)
+	if ip == nil {
+		return ""
+	}
+
+	return ip.String()
+}
+
+// lookup retrieves the server remembered for a client,
+// if any.
+func (t *affinityTable) lookup(client string, now time.Time) (server string, ok bool) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	elem, ok := t.entries[client]
+	if !ok {
+		return
+	}
+
+	entry := elem.Value.(*AffinityEntry)
+	if !now.Before(entry.Expires) {
+		t.remove(elem)
+		ok = false
+		return
+	}
+
+	server = entry.Server
+	return
+}
+
+// remember pins a client to a server for another ttl.
+func (t *affinityTable) remember(client, server string, now time.Time) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	t.set(client, server, now.Add(t.ttl), now)
+}
+
+// set stores an entry, dropping the expired ones and,
+// if the table is full, the least recently used one.
+// It must be called with the table locked.
+func (t *affinityTable) set(client, server string, expires, now time.Time) {
+	if elem, ok := t.entries[client]; ok {
+		entry := elem.Value.(*AffinityEntry)
+		entry.Server = server
+		entry.Expires = expires
+		t.lru.MoveToFront(elem)
+		return
+	}
+
+	for t.lru.Len() != 0 {
+		oldest := t.lru.Back()
+		if t.lru.Len() < t.maxEntries && now.Before(oldest.Value.(*AffinityEntry).Expires) {
+			break
+		}
+
+		t.remove(oldest)
+	}
+
+	t.entries[client] = t.lru.PushFront(&AffinityEntry{
+		Client:  client,
+		Server:  server,
+		Expires: expires,
+	})
+}
+
+func (t *affinityTable) remove(elem *list.Element) {
+	t.lru.Remove(elem)
+	delete(t.entries, elem.Value.(*AffinityEntry).Client)
+}
+
+func (t *affinityTable) len() int {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	return t.lru.Len()
+}
+
+// export retrieves the entries that didn't expire yet,
+// least recently used first.
+func (t *affinityTable) export(now time.Time) (entries []AffinityEntry) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	for elem := t.lru.Back(); elem != nil; elem = elem.Prev() {
+		entry := elem.Value.(*AffinityEntry)
+		if now.Before(entry.Expires) {
+			entries = append(entries, *entry)
+		}
+	}
+
+	return
+}
+
+// restore adds entries retrieved by export, keeping
+// their order. Expirations are capped to the ttl in case
+// it got shorter since they were exported.
+func (t *affinityTable) restore(entries []AffinityEntry, now time.Time) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	for _, entry := range entries {
+		if entry.Client == "" || entry.Server == "" || !now.Before(entry.Expires) {
+			continue
+		}
+
+		expires := entry.Expires
+		if max := now.Add(t.ttl); expires.After(max) {
+			expires = max
+		}
+
+		t.set(entry.Client, entry.Server, expires, now)
+	}
+}
+
+// sticky retrieves the server among 'servers' that a
+// client is pinned to, if any. It must be called with
+// the backend locked.
+func (b *backend) sticky(key string, servers []*server, now time.Time) *server {
+	address, ok := b.affinity.lookup(key, now)
+	if !ok {
+		return nil
+	}
+
+	for _, s := range servers {
+		if s.address == address {
+			b.affinityHits++
+			return s
+		}
+	}
+
+	return nil
+}
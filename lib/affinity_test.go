@@ -0,0 +1,195 @@
+package lib
+
+import (
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/rs/zerolog"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestNewAffinityTable(t *testing.T) {
+	var testCases = []struct {
+		description string
+		config      Affinity
+		enabled     bool
+		shouldFail  bool
+	}{
+		{"disabled", Affinity{}, false, false},
+		{"enabled", Affinity{TTL: time.Minute}, true, false},
+		{"max entries without ttl", Affinity{MaxEntries: 10}, false, true},
+		{"negative", Affinity{TTL: -time.Minute}, false, true},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.description, func(t *testing.T) {
+			table, err := newAffinityTable(tc.config)
+			if tc.shouldFail {
+				assert.Error(t, err)
+				return
+			}
+
+			assert.NoError(t, err)
+			assert.Equal(t, tc.enabled, table != nil)
+		})
+	}
+}
+
+func TestAffinityTableExpiresAndEvicts(t *testing.T) {
+	var now = time.Now()
+
+	table, err := newAffinityTable(Affinity{TTL: time.Minute, MaxEntries: 2})
+	assert.NoError(t, err)
+
+	table.remember("10.0.0.1", "a", now)
+	table.remember("10.0.0.2", "b", now.Add(10*time.Second))
+
+	server, ok := table.lookup("10.0.0.1", now.Add(30*time.Second))
+	assert.True(t, ok)
+	assert.Equal(t, "a", server)
+
+	// remembering again extends the ttl.
+	table.remember("10.0.0.1", "a", now.Add(30*time.Second))
+	_, ok = table.lookup("10.0.0.1", now.Add(80*time.Second))
+	assert.True(t, ok)
+
+	_, ok = table.lookup("10.0.0.2", now.Add(80*time.Second))
+	assert.False(t, ok)
+	assert.Equal(t, 1, table.len())
+
+	// the least recently used entry gets evicted.
+	table.remember("10.0.0.2", "b", now.Add(80*time.Second))
+	table.remember("10.0.0.3", "c", now.Add(80*time.Second))
+	assert.Equal(t, 2, table.len())
+
+	_, ok = table.lookup("10.0.0.1", now.Add(80*time.Second))
+	assert.False(t, ok)
+}
+
+func TestAffinityTableExportAndRestore(t *testing.T) {
+	var now = time.Now()
+
+	table, err := newAffinityTable(Affinity{TTL: time.Hour})
+	assert.NoError(t, err)
+
+	table.remember("10.0.0.1", "a", now.Add(-50*time.Minute))
+	table.remember("10.0.0.2", "b", now.Add(-10*time.Minute))
+	table.remember("10.0.0.3", "c", now.Add(-70*time.Minute))
+
+	entries := table.export(now)
+	assert.Equal(t, []AffinityEntry{
+		{Client: "10.0.0.1", Server: "a", Expires: now.Add(10 * time.Minute)},
+		{Client: "10.0.0.2", Server: "b", Expires: now.Add(50 * time.Minute)},
+	}, entries)
+
+	restored, err := newAffinityTable(Affinity{TTL: 20 * time.Minute, MaxEntries: 2})
+	assert.NoError(t, err)
+
+	restored.remember("10.0.0.4", "d", now)
+	restored.restore(append(entries, AffinityEntry{Client: "10.0.0.5"}), now)
+
+	// the restored entries are the most recent ones
+	// and get their expiration capped.
+	assert.Equal(t, []AffinityEntry{
+		{Client: "10.0.0.1", Server: "a", Expires: now.Add(10 * time.Minute)},
+		{Client: "10.0.0.2", Server: "b", Expires: now.Add(20 * time.Minute)},
+	}, restored.export(now))
+}
+
+func TestBackendAffinity(t *testing.T) {
+	var (
+		client  = &net.TCPAddr{IP: net.ParseIP("10.0.0.1"), Port: 1000}
+		servers = []Server{{Address: "a:80"}, {Address: "b:80"}, {Address: "c:80"}}
+	)
+
+	b, err := newBackend(Backend{
+		Name:     "app",
+		Servers:  servers,
+		Affinity: Affinity{TTL: time.Minute},
+	}, nil, zerolog.Nop())
+	assert.NoError(t, err)
+
+	pinned := pickAddress(b, client)
+	for port := 1001; port < 1010; port++ {
+		assert.Equal(t, pinned, pickAddress(b, &net.TCPAddr{IP: client.IP, Port: port}))
+	}
+
+	assert.Equal(t, uint64(9), b.stats().AffinityHits)
+	assert.Equal(t, 1, b.stats().AffinityEntries)
+
+	// clients pinned to servers that go away get
+	// pinned to another one.
+	var remaining []Server
+	for _, cfg := range servers {
+		if cfg.Address != pinned {
+			remaining = append(remaining, cfg)
+		}
+	}
+
+	_, _, err = b.update(staticSource, remaining)
+	assert.NoError(t, err)
+
+	repinned := pickAddress(b, client)
+	assert.NotEqual(t, pinned, repinned)
+	assert.Equal(t, repinned, pickAddress(b, client))
+
+	// and stay there once it comes back.
+	_, _, err = b.update(staticSource, servers)
+	assert.NoError(t, err)
+	assert.Equal(t, repinned, pickAddress(b, client))
+
+	// unhealthy servers are skipped as well.
+	b.mu.Lock()
+	for _, s := range b.servers {
+		if s.address == repinned {
+			s.unhealthy = 1
+		}
+	}
+	b.mu.Unlock()
+
+	assert.NotEqual(t, repinned, pickAddress(b, client))
+}
+
+func TestLoadBalancerKeepsAffinityAcrossRestarts(t *testing.T) {
+	dir, err := ioutil.TempDir("", "state")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	var (
+		stateFile = filepath.Join(dir, "state.json")
+		client    = &net.TCPAddr{IP: net.ParseIP("10.0.0.1"), Port: 1000}
+		config    = LoadBalancerConfig{
+			StateFile: stateFile,
+			Frontends: []Frontend{{Name: "a", Address: freeAddress(t), Backend: "app"}},
+			Backends: []Backend{{
+				Name:     "app",
+				Servers:  []Server{{Address: "a:80"}, {Address: "b:80"}, {Address: "c:80"}},
+				Affinity: Affinity{TTL: time.Minute},
+			}},
+		}
+	)
+
+	var pinned []string
+	for i := 0; i < 3; i++ {
+		lb, err := NewLoadBalancer(config)
+		assert.NoError(t, err)
+
+		// without the state, round-robin would send the
+		// client to the second server.
+		pickAddress(lb.backends[0], &net.TCPAddr{IP: net.ParseIP("10.0.0.2")})
+		pinned = append(pinned, pickAddress(lb.backends[0], client))
+		assert.NoError(t, lb.Stop())
+	}
+
+	assert.Equal(t, pinned[0], pinned[1])
+	assert.Equal(t, pinned[0], pinned[2])
+
+	// broken state files don't prevent starting.
+	assert.NoError(t, ioutil.WriteFile(stateFile, []byte("garbage"), 0644))
+	_, err = NewLoadBalancer(config)
+	assert.NoError(t, err)
+}
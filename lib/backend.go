@@ -0,0 +1,672 @@
+package lib
+
+import (
+	"net"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/rs/zerolog"
+)
+
+const (
+	defaultConnectTimeout = 10 * time.Second
+	staticSource          = "static"
+)
+
+// connection is something being served by a server:
+// either a TCP proxy or a UDP flow.
+type connection interface {
+	Stats() (to, from IoStats)
+	Close() error
+}
+
+type server struct {
+	address          string
+	proxyProtocol    string
+	proxyProtocolSNI bool
+	weight           int
+	priority         int
+	backup           bool
+
+	// maxConnections caps the connections (slots) that
+	// the server handles at once. Zero means no cap.
+	// Slots are taken when the server gets picked and
+	// are only touched with the backend locked.
+	maxConnections int
+	slots          int
+
+	// unhealthy is set when the server fails its health
+	// checks. successes and failures count the
+	// consecutive results of the checks.
+	unhealthy uint32
+	successes int
+	failures  int
+
+	// draining is set while the server gets no new
+	// connections and drained once it has none left.
+	// drainTimer closes the remaining ones, if set.
+	draining   uint32
+	drained    uint32
+	drainTimer *time.Timer
+
+	// breaker stops the server from getting connections
+	// while dialing it fails, nil when disabled.
+	breaker *circuitBreaker
+
+	// config and source tell where the server came
+	// from so that it can be matched on updates.
+	config Server
+	source string
+
+	// effectiveWeight is the weight (scaled by
+	// weightScale) that strategies balance with, while
+	// currentWeight is the running weight used by the
+	// smooth weighted round-robin strategy. They're only
+	// touched with the backend locked.
+	effectiveWeight int
+	currentWeight   int
+
+	// rampStart is the unix time in nanoseconds at which
+	// the server started its slow start. Zero when it
+	// never had one.
+	rampStart int64
+
+	mu               sync.Mutex
+	activeProxies    map[connection]struct{}
+	totalConnections uint64
+	totalRx          uint64
+	totalTx          uint64
+	totalRxThrottled time.Duration
+	totalTxThrottled time.Duration
+
+	// upload and download shape the traffic to and from
+	// the server across all of its connections.
+	upload   *Throttle
+	download *Throttle
+}
+
+func newServer(cfg Server) (s *server, err error) {
+	if cfg.Address == "" {
+		err = errors.Errorf("server must have an address")
+		return
+	}
+
+	err = ValidateProxyProtocolVersion(cfg.ProxyProtocol)
+	if err != nil {
+		err = errors.Wrapf(err,
+			"invalid configuration for server %s", cfg.Address)
+		return
+	}
+
+	if cfg.ProxyProtocolSNI && cfg.ProxyProtocol != ProxyProtocolV2 {
+		err = errors.Errorf("server %s can only send the sni "+
+			"with the proxy protocol v2", cfg.Address)
+		return
+	}
+
+	if cfg.Weight < 0 {
+		err = errors.Errorf("server %s must not have a negative weight",
+			cfg.Address)
+		return
+	}
+
+	if cfg.Weight == 0 {
+		cfg.Weight = 1
+	}
+
+	if cfg.MaxConnections < 0 {
+		err = errors.Errorf("server %s must not have negative max connections",
+			cfg.Address)
+		return
+	}
+
+	s = &server{
+		config:           cfg,
+		address:          cfg.Address,
+		proxyProtocol:    cfg.ProxyProtocol,
+		proxyProtocolSNI: cfg.ProxyProtocolSNI,
+		weight:           cfg.Weight,
+		effectiveWeight:  cfg.Weight * weightScale,
+		priority:         cfg.Priority,
+		backup:           cfg.Backup,
+		maxConnections:   cfg.MaxConnections,
+		activeProxies:    map[connection]struct{}{},
+	}
+	return
+}
+
+func (s *server) track(conn connection) {
+	s.mu.Lock()
+	s.activeProxies[conn] = struct{}{}
+	s.totalConnections++
+	s.mu.Unlock()
+}
+
+// untrack removes a finished connection from the list
+// of active ones, accounting the bytes it transferred.
+func (s *server) untrack(conn connection) {
+	var toStats, fromStats = conn.Stats()
+
+	s.mu.Lock()
+	delete(s.activeProxies, conn)
+	s.totalTx += toStats.Tx
+	s.totalRx += fromStats.Rx
+	s.totalTxThrottled += toStats.Throttled
+	s.totalRxThrottled += fromStats.Throttled
+	s.mu.Unlock()
+}
+
+func (s *server) activeConnections() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return len(s.activeProxies)
+}
+
+func (s *server) stats() (stats ServerStats) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	stats = ServerStats{
+		Address:           s.address,
+		Source:            s.source,
+		Weight:            s.weight,
+		Priority:          s.priority,
+		Backup:            s.backup,
+		Healthy:           s.healthy(),
+		Draining:          s.isDraining(),
+		Drained:           s.isDrained(),
+		MaxConnections:    s.maxConnections,
+		ActiveConnections: len(s.activeProxies),
+		TotalConnections:  s.totalConnections,
+		Rx:                s.totalRx,
+		Tx:                s.totalTx,
+		RxThrottled:       s.totalRxThrottled,
+		TxThrottled:       s.totalTxThrottled,
+	}
+
+	stats.Circuit, stats.CircuitTrips = s.breaker.stats()
+
+	for conn := range s.activeProxies {
+		toStats, fromStats := conn.Stats()
+		stats.Tx += toStats.Tx
+		stats.Rx += fromStats.Rx
+		stats.TxThrottled += toStats.Throttled
+		stats.RxThrottled += fromStats.Throttled
+	}
+
+	return
+}
+
+// backend is a named pool of servers sharing a
+// balancing strategy. Servers come from sources (the
+// static configuration or discovery providers) which
+// can be updated while connections are being served.
+type backend struct {
+	name         string
+	strategyName string
+	strategy     strategy
+	network      string
+	dialer       net.Dialer
+	healthCheck  HealthCheck
+	slowStart    time.Duration
+	drainTimeout time.Duration
+	logger       zerolog.Logger
+
+	// serverBandwidth holds the rates that the throttles
+	// of each server follow.
+	serverBandwidth bandwidthRates
+
+	// circuitBreaker configures the breaker of each
+	// server.
+	circuitBreaker CircuitBreaker
+
+	// affinity pins clients to the server they were last
+	// sent to, nil when disabled. affinityHits counts the
+	// connections that went to a pinned server.
+	affinity     *affinityTable
+	affinityHits uint64
+
+	discoverers []discoverer
+	done        chan struct{}
+
+	// started is set once the servers known at startup
+	// were added, so that the ones added later get a
+	// slow start.
+	started uint32
+
+	mu          sync.Mutex
+	servers     []*server
+	sources     map[string][]*server
+	sourceNames []string
+
+	// activeTier names the tier connections were last
+	// sent to so that failovers can be logged.
+	activeTier string
+
+	// queue holds the connections waiting for a server
+	// to have a free slot, in arrival order.
+	maxQueue       int
+	queueTimeout   time.Duration
+	queue          []*queuedConnection
+	totalQueued    uint64
+	totalQueueWait time.Duration
+	rejected       uint64
+}
+
+func newBackend(cfg Backend, resolver Resolver, logger zerolog.Logger) (b *backend, err error) {
+	var (
+		static          []Server
+		serverBandwidth bandwidthRates
+	)
+
+	if cfg.Strategy == "" {
+		cfg.Strategy = StrategyRoundRobin
+	}
+
+	if cfg.ConnectTimeout == 0 {
+		cfg.ConnectTimeout = defaultConnectTimeout
+	}
+
+	if cfg.Network == "" {
+		cfg.Network = "tcp"
+	}
+
+	err = validateNetwork(cfg.Network)
+	if err != nil {
+		err = errors.Wrapf(err,
+			"invalid configuration for backend %s", cfg.Name)
+		return
+	}
+
+	if cfg.MaxQueue == 0 {
+		cfg.MaxQueue = defaultMaxQueue
+	}
+
+	if cfg.QueueTimeout == 0 {
+		cfg.QueueTimeout = defaultQueueTimeout
+	}
+
+	if cfg.SlowStart < 0 || cfg.DrainTimeout < 0 {
+		err = errors.Errorf("backend %s must not have a negative slow start "+
+			"nor drain timeout", cfg.Name)
+		return
+	}
+
+	err = validateHealthCheck(&cfg.HealthCheck)
+	if err != nil {
+		err = errors.Wrapf(err,
+			"invalid configuration for backend %s", cfg.Name)
+		return
+	}
+
+	serverBandwidth, err = newBandwidthRates(cfg.ServerBandwidth)
+	if err != nil {
+		err = errors.Wrapf(err,
+			"invalid configuration for backend %s", cfg.Name)
+		return
+	}
+
+	err = validateCircuitBreaker(&cfg.CircuitBreaker)
+	if err != nil {
+		err = errors.Wrapf(err,
+			"invalid configuration for backend %s", cfg.Name)
+		return
+	}
+
+	b = &backend{
+		name:            cfg.Name,
+		strategyName:    cfg.Strategy,
+		network:         cfg.Network,
+		healthCheck:     cfg.HealthCheck,
+		slowStart:       cfg.SlowStart,
+		drainTimeout:    cfg.DrainTimeout,
+		serverBandwidth: serverBandwidth,
+		circuitBreaker:  cfg.CircuitBreaker,
+		maxQueue:        cfg.MaxQueue,
+		queueTimeout:    cfg.QueueTimeout,
+		sources:         map[string][]*server{},
+		done:            make(chan struct{}),
+		dialer: net.Dialer{
+			Timeout:       cfg.ConnectTimeout,
+			FallbackDelay: cfg.HappyEyeballsDelay,
+		},
+		logger: logger.With().
+			Str("backend", cfg.Name).
+			Logger(),
+	}
+
+	b.strategy, err = newStrategy(cfg.Strategy)
+	if err != nil {
+		err = errors.Wrapf(err,
+			"invalid configuration for backend %s", cfg.Name)
+		return
+	}
+
+	b.affinity, err = newAffinityTable(cfg.Affinity)
+	if err != nil {
+		err = errors.Wrapf(err,
+			"invalid affinity for backend %s", cfg.Name)
+		return
+	}
+
+	for _, serverCfg := range cfg.Servers {
+		_, err = newServer(serverCfg)
+		if err != nil {
+			err = errors.Wrapf(err,
+				"invalid configuration for backend %s", cfg.Name)
+			return
+		}
+
+		err = b.checkTier(serverCfg)
+		if err != nil {
+			return
+		}
+
+		if isSrvAddress(serverCfg.Address) {
+			b.discoverers = append(b.discoverers, newSrvDiscoverer(
+				b, serverCfg, resolver, cfg.ResolveInterval))
+			continue
+		}
+
+		if cfg.ResolveInterval > 0 && isHostname(serverCfg.Address) {
+			b.discoverers = append(b.discoverers, newDnsDiscoverer(
+				b, serverCfg, resolver, cfg.ResolveInterval))
+			continue
+		}
+
+		static = append(static, serverCfg)
+	}
+
+	_, _, err = b.update(staticSource, static)
+	return
+}
+
+// start populates the servers that come from discovery
+// providers and keeps them updated until stop is called.
+func (b *backend) start() {
+	for _, d := range b.discoverers {
+		d.refresh()
+		go d.run(b.done)
+	}
+
+	if b.healthCheck.Interval > 0 {
+		go b.checkHealth()
+	}
+
+	atomic.StoreUint32(&b.started, 1)
+}
+
+func (b *backend) stop() {
+	select {
+	case <-b.done:
+	default:
+		close(b.done)
+	}
+}
+
+// update replaces the servers provided by 'source' with
+// the ones described by 'configs'. Servers whose
+// configuration didn't change are kept so that their
+// stats and connections are preserved; the ones that
+// went away keep serving their established connections
+// but don't get new ones. Servers start or stop
+// draining as their configuration says so.
+func (b *backend) update(source string, configs []Server) (added, removed []string, err error) {
+	var servers = make([]*server, 0, len(configs))
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	var existing = map[Server]*server{}
+	for _, s := range b.sources[source] {
+		existing[s.config.identity()] = s
+	}
+
+	for _, cfg := range configs {
+		// the tiers of SRV targets follow their records,
+		// which get looked up again, rather than checks.
+		if !isSrvAddress(source) {
+			err = b.checkTier(cfg)
+			if err != nil {
+				return
+			}
+		}
+
+		s, ok := existing[cfg.identity()]
+		if ok {
+			delete(existing, cfg.identity())
+
+			if cfg.Drain && !s.config.Drain {
+				b.drain(s, b.drainTimeout)
+			} else if !cfg.Drain && s.config.Drain {
+				b.undrain(s)
+			}
+
+			s.config = cfg
+			servers = append(servers, s)
+			continue
+		}
+
+		s, err = newServer(cfg)
+		if err != nil {
+			return
+		}
+
+		if atomic.LoadUint32(&b.started) != 0 {
+			s.startRamp(b.slowStart)
+		}
+
+		s.source = source
+		s.upload = NewThrottle(b.serverBandwidth.upload)
+		s.download = NewThrottle(b.serverBandwidth.download)
+		s.breaker = newCircuitBreaker(b.circuitBreaker)
+		servers = append(servers, s)
+		added = append(added, s.address)
+
+		if cfg.Drain {
+			b.drain(s, b.drainTimeout)
+		}
+	}
+
+	for _, s := range existing {
+		removed = append(removed, s.address)
+	}
+
+	if _, ok := b.sources[source]; !ok {
+		b.sourceNames = append(b.sourceNames, source)
+	}
+
+	b.sources[source] = servers
+	b.servers = b.servers[:0:0]
+	for _, name := range b.sourceNames {
+		b.servers = append(b.servers, b.sources[name]...)
+	}
+
+	b.dispatch()
+
+	sort.Strings(added)
+	sort.Strings(removed)
+	return
+}
+
+// checkTier makes sure that servers of failover tiers
+// come with health checks: without them, nothing would
+// ever tell that the servers of the previous tiers are
+// down.
+func (b *backend) checkTier(cfg Server) error {
+	if (cfg.Backup || cfg.Priority != 0) && b.healthCheck.Interval == 0 {
+		return errors.Errorf("server %s of a failover tier requires "+
+			"health checks in backend %s", cfg.Address, b.name)
+	}
+
+	return nil
+}
+
+// updateAndLog updates a source, logging the servers
+// that were added or removed, if any.
+func (b *backend) updateAndLog(source string, configs []Server) {
+	added, removed, err := b.update(source, configs)
+	if err != nil {
+		b.logger.Error().
+			Err(err).
+			Str("source", source).
+			Msg("couldn't update servers")
+		return
+	}
+
+	if len(added) == 0 && len(removed) == 0 {
+		return
+	}
+
+	b.logger.Info().
+		Str("source", source).
+		Strs("added", added).
+		Strs("removed", removed).
+		Msg("servers changed")
+}
+
+// pick selects the server that should handle a
+// connection coming from 'client' among the healthy
+// ones of the first tier, skipping the saturated ones.
+// With affinity, clients go to the server they're
+// pinned to as long as it's among those, getting pinned
+// to whatever the strategy picks otherwise. 'saturated'
+// tells whether there were servers to pick from but all
+// of them were saturated. Picking a server whose
+// circuit is half-open takes one of its trials. It must
+// be called with the backend locked.
+func (b *backend) pick(client net.Addr) (s *server, saturated bool) {
+	servers := tier(b.servers)
+
+	name := "none"
+	if len(servers) != 0 {
+		name = servers[0].tierName()
+	}
+
+	if name != b.activeTier {
+		if b.activeTier != "" {
+			b.logger.Warn().
+				Str("from", b.activeTier).
+				Str("to", name).
+				Msg("tier changed")
+		}
+
+		b.activeTier = name
+	}
+
+	var available = make([]*server, 0, len(servers))
+	for _, s := range servers {
+		if !s.saturated() {
+			available = append(available, s)
+		}
+	}
+
+	if len(available) == 0 {
+		saturated = len(servers) != 0
+		return
+	}
+
+	now := time.Now()
+
+	key := affinityKey(client)
+	if b.affinity != nil && key != "" {
+		s = b.sticky(key, available, now)
+		if s == nil {
+			s = b.pickByStrategy(available, client, now)
+		}
+
+		b.affinity.remember(key, s.address, now)
+	} else {
+		s = b.pickByStrategy(available, client, now)
+	}
+
+	s.breaker.acquire(now)
+	return
+}
+
+func (b *backend) pickByStrategy(servers []*server, client net.Addr, now time.Time) *server {
+	for _, s := range servers {
+		s.effectiveWeight = s.rampedWeight(now, b.slowStart)
+	}
+
+	return b.strategy.pick(servers, client)
+}
+
+// tier retrieves the healthy servers of the first
+// tier: primaries come before backups and, among
+// those, lower priorities come first. Draining servers
+// and the ones whose circuit doesn't admit connections
+// are left out.
+func tier(servers []*server) (selected []*server) {
+	var now = time.Now()
+
+	for _, s := range servers {
+		if !s.healthy() || s.isDraining() || !s.breaker.admits(now) {
+			continue
+		}
+
+		if len(selected) != 0 && selected[0].precedes(s) {
+			continue
+		}
+
+		if len(selected) != 0 && s.precedes(selected[0]) {
+			selected = selected[:0]
+		}
+
+		selected = append(selected, s)
+	}
+
+	return
+}
+
+// dial connects to a server. Hostnames resolving to
+// both IPv4 and IPv6 addresses are dialed following
+// RFC 6555 (happy eyeballs): the primary family is
+// tried first and, if it doesn't connect within the
+// fallback delay, the other family races it. The result
+// must be reported through observeDial.
+func (b *backend) dial(s *server) (net.Conn, error) {
+	network, address := resolveNetwork(b.network, s.address)
+	return b.dialer.Dial(network, address)
+}
+
+// dialPacket creates the UDP socket used by a flow to
+// exchange datagrams with a server. As with dial, the
+// result must be reported through observeDial.
+func (b *backend) dialPacket(s *server) (net.Conn, error) {
+	return b.dialer.Dial(packetNetwork(b.network), s.address)
+}
+
+func (b *backend) stats() (stats BackendStats) {
+	b.mu.Lock()
+	var servers = append([]*server{}, b.servers...)
+	stats = BackendStats{
+		Name:           b.name,
+		Strategy:       b.strategyName,
+		Servers:        make([]ServerStats, len(servers)),
+		QueueDepth:     len(b.queue),
+		TotalQueued:    b.totalQueued,
+		TotalQueueWait: b.totalQueueWait,
+		Rejected:       b.rejected,
+		AffinityHits:   b.affinityHits,
+	}
+	b.mu.Unlock()
+
+	if b.affinity != nil {
+		stats.AffinityEntries = b.affinity.len()
+	}
+
+	now := time.Now()
+
+	for ndx, s := range servers {
+		stats.Servers[ndx] = s.stats()
+		stats.Servers[ndx].EffectiveWeight =
+			float64(s.rampedWeight(now, b.slowStart)) / weightScale
+	}
+
+	return
+}
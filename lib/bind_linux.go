@@ -0,0 +1,27 @@
+//go:build linux
+// +build linux
+
+package lib
+
+import (
+	"syscall"
+
+	"github.com/pkg/errors"
+)
+
+// bindToDevice restricts a socket to the network
+// interface named 'iface' (SO_BINDTODEVICE).
+func bindToDevice(iface string) func(network, address string, c syscall.RawConn) error {
+	return func(network, address string, c syscall.RawConn) (err error) {
+		controlErr := c.Control(func(fd uintptr) {
+			err = syscall.SetsockoptString(int(fd),
+				syscall.SOL_SOCKET, syscall.SO_BINDTODEVICE, iface)
+		})
+		if controlErr != nil {
+			return controlErr
+		}
+
+		return errors.Wrapf(err,
+			"couldn't bind socket to interface %s", iface)
+	}
+}
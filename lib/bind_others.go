@@ -0,0 +1,17 @@
+//go:build !linux
+// +build !linux
+
+package lib
+
+import (
+	"syscall"
+
+	"github.com/pkg/errors"
+)
+
+func bindToDevice(iface string) func(network, address string, c syscall.RawConn) error {
+	return func(network, address string, c syscall.RawConn) error {
+		return errors.Errorf(
+			"binding to interface %s is only supported on linux", iface)
+	}
+}
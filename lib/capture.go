@@ -0,0 +1,535 @@
+package lib
+
+import (
+	"bufio"
+	"encoding/binary"
+	"io"
+	"math/rand"
+	"net"
+	"os"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/rs/zerolog"
+)
+
+// Formats of capture files.
+const (
+	CaptureFormatPcapng = "pcapng"
+	CaptureFormatFramed = "framed"
+)
+
+const (
+	defaultCaptureMaxConnectionBytes = 1024 * 1024
+	defaultCaptureMaxBytes           = 100 * 1024 * 1024
+
+	// captureQueueSize bounds the chunks of a connection
+	// waiting to be written to its capture file.
+	captureQueueSize = 256
+
+	// captureFramedMagic starts the files of the framed
+	// format.
+	captureFramedMagic = "L4CAP001"
+)
+
+// captureExtensions hold the extension of the files of
+// each format.
+var captureExtensions = map[string]string{
+	CaptureFormatPcapng: ".pcapng",
+	CaptureFormatFramed: ".frames",
+}
+
+// captureWriter writes the traffic of a connection in
+// the format of a capture file.
+type captureWriter interface {
+	start(ts time.Time) error
+	write(ts time.Time, payload []byte, toUpstream bool) error
+	finish(ts time.Time) error
+}
+
+// validateCapture sets the defaults of a capture
+// configuration, retrieving the client networks it
+// selects.
+func validateCapture(cfg *Capture) (clients []*net.IPNet, err error) {
+	if cfg.Format == "" {
+		cfg.Format = CaptureFormatPcapng
+	}
+
+	if captureExtensions[cfg.Format] == "" {
+		err = errors.Errorf("unknown capture format '%s'", cfg.Format)
+		return
+	}
+
+	if cfg.Sample < 0 || cfg.Sample > 1 {
+		err = errors.Errorf("capture sample must be between 0 and 1")
+		return
+	}
+
+	if cfg.Sample == 0 {
+		cfg.Sample = 1
+	}
+
+	if cfg.MaxConnectionBytes < 0 || cfg.MaxBytes < 0 {
+		err = errors.Errorf("capture limits must not be negative")
+		return
+	}
+
+	if cfg.MaxConnectionBytes == 0 {
+		cfg.MaxConnectionBytes = defaultCaptureMaxConnectionBytes
+	}
+
+	if cfg.MaxBytes == 0 {
+		cfg.MaxBytes = defaultCaptureMaxBytes
+	}
+
+	clients, err = ParseCIDRs(cfg.Clients)
+	if err != nil {
+		err = errors.Wrapf(err, "invalid capture clients")
+		return
+	}
+
+	return
+}
+
+// capturer decides which connections get captured,
+// accounting the bytes captured against the overall
+// limit.
+type capturer struct {
+	logger zerolog.Logger
+
+	mu        sync.Mutex
+	cfg       Capture
+	clients   []*net.IPNet
+	remaining int64
+
+	active      int64
+	connections uint64
+	bytes       uint64
+	truncated   uint64
+}
+
+func newCapturer(cfg Capture, logger zerolog.Logger) (c *capturer, err error) {
+	clients, err := validateCapture(&cfg)
+	if err != nil {
+		return
+	}
+
+	if cfg.Directory != "" {
+		err = os.MkdirAll(cfg.Directory, 0755)
+		if err != nil {
+			err = errors.Wrapf(err,
+				"couldn't create capture directory %s", cfg.Directory)
+			return
+		}
+	}
+
+	c = &capturer{
+		cfg:       cfg,
+		clients:   clients,
+		remaining: cfg.MaxBytes,
+		logger: logger.With().
+			Str("component", "capture").
+			Logger(),
+	}
+	return
+}
+
+// set changes which connections get captured and the
+// limits of the captures, renewing the overall limit.
+// Connections already being captured go on with the
+// previous one. The directory and the format can only
+// be set on startup, so that files can't be written
+// anywhere else: empty ones keep the current ones.
+func (c *capturer) set(cfg Capture) (err error) {
+	current := c.config()
+
+	if cfg.Directory == "" {
+		cfg.Directory = current.Directory
+	}
+
+	if cfg.Format == "" {
+		cfg.Format = current.Format
+	}
+
+	if cfg.Directory != current.Directory || cfg.Format != current.Format {
+		err = errors.Errorf("capture directory and format can't be changed at runtime")
+		return
+	}
+
+	clients, err := validateCapture(&cfg)
+	if err != nil {
+		return
+	}
+
+	c.mu.Lock()
+	c.cfg = cfg
+	c.clients = clients
+	c.remaining = cfg.MaxBytes
+	c.mu.Unlock()
+	return
+}
+
+func (c *capturer) config() Capture {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return c.cfg
+}
+
+// selects tells whether a connection from 'client' to
+// 'upstream' gets captured.
+func (c *capturer) selects(client net.Addr, upstream string) bool {
+	if c.remaining <= 0 || c.cfg.Directory == "" {
+		return false
+	}
+
+	if len(c.clients) > 0 && !cidrsContain(c.clients, addrIP(client)) {
+		return false
+	}
+
+	if len(c.cfg.Upstreams) > 0 {
+		var found bool
+		for _, address := range c.cfg.Upstreams {
+			found = found || address == upstream
+		}
+
+		if !found {
+			return false
+		}
+	}
+
+	return c.cfg.Sample >= 1 || rand.Float64() < c.cfg.Sample
+}
+
+// start begins capturing the connection 'conn' proxied
+// to 'upstream' if it's selected, retrieving nil
+// otherwise. The file is named after the id of the
+// connection.
+func (c *capturer) start(id string, conn net.Conn, upstream string) *captureStream {
+	if c == nil {
+		return nil
+	}
+
+	c.mu.Lock()
+	var (
+		cfg      = c.cfg
+		selected = c.selects(conn.RemoteAddr(), upstream)
+	)
+	c.mu.Unlock()
+
+	if !selected {
+		return nil
+	}
+
+	var path = filepath.Join(cfg.Directory, id+captureExtensions[cfg.Format])
+
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		c.logger.Error().
+			Err(err).
+			Msg("couldn't create capture file")
+		return nil
+	}
+
+	var (
+		buffered = bufio.NewWriter(file)
+		s        = &captureStream{
+			capturer:  c,
+			file:      file,
+			buffered:  buffered,
+			path:      path,
+			chunks:    make(chan capturedChunk, captureQueueSize),
+			remaining: cfg.MaxConnectionBytes,
+		}
+	)
+
+	if cfg.Format == CaptureFormatFramed {
+		s.writer = &framedWriter{w: buffered}
+	} else {
+		s.writer = newPcapngWriter(buffered, conn.RemoteAddr(), conn.LocalAddr())
+	}
+
+	err = s.writer.start(time.Now())
+	if err != nil {
+		c.logger.Error().
+			Err(err).
+			Str("file", path).
+			Msg("couldn't start capture")
+		file.Close()
+		return nil
+	}
+
+	atomic.AddUint64(&c.connections, 1)
+	atomic.AddInt64(&c.active, 1)
+
+	c.logger.Info().
+		Str("id", id).
+		Str("remote", conn.RemoteAddr().String()).
+		Str("upstream", upstream).
+		Str("file", path).
+		Msg("capturing connection")
+
+	go s.run()
+	return s
+}
+
+// reserve takes up to 'n' bytes out of the overall
+// limit, retrieving how many were granted.
+func (c *capturer) reserve(n int64) int64 {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if n > c.remaining {
+		n = c.remaining
+	}
+
+	if n < 0 {
+		n = 0
+	}
+
+	c.remaining -= n
+	return n
+}
+
+// refund gives back bytes reserved that didn't get
+// captured.
+func (c *capturer) refund(n int64) {
+	c.mu.Lock()
+	c.remaining += n
+	c.mu.Unlock()
+}
+
+func (c *capturer) stats() (stats CaptureStats) {
+	if c == nil {
+		return
+	}
+
+	c.mu.Lock()
+	stats.RemainingBytes = c.remaining
+	c.mu.Unlock()
+
+	stats.ActiveConnections = atomic.LoadInt64(&c.active)
+	stats.Connections = atomic.LoadUint64(&c.connections)
+	stats.Bytes = atomic.LoadUint64(&c.bytes)
+	stats.Truncated = atomic.LoadUint64(&c.truncated)
+	return
+}
+
+// captureStream writes the bytes transferred by a proxy
+// to the capture file of its connection, stopping once
+// the limits are reached. The file gets written to on
+// its own goroutine, so that a slow disk never slows
+// down the connection being proxied: once the chunks
+// queued overflow, the rest of them are dropped, as a
+// capture with gaps would be misleading.
+type captureStream struct {
+	capturer *capturer
+	file     *os.File
+	buffered *bufio.Writer
+	path     string
+	writer   captureWriter
+	chunks   chan capturedChunk
+
+	mu        sync.Mutex
+	remaining int64
+	stopped   bool
+	closed    bool
+}
+
+// capturedChunk is a copy of the bytes transferred in
+// one of the directions.
+type capturedChunk struct {
+	ts         time.Time
+	payload    []byte
+	toUpstream bool
+}
+
+// Tap queues the bytes transferred in one of the
+// directions to be captured without ever blocking,
+// implementing Tap.
+func (s *captureStream) Tap(p []byte, toUpstream bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.stopped {
+		return
+	}
+
+	var n = int64(len(p))
+	if n > s.remaining {
+		n = s.remaining
+	}
+
+	n = s.capturer.reserve(n)
+	if n > 0 {
+		chunk := capturedChunk{
+			ts:         time.Now(),
+			payload:    append([]byte(nil), p[:n]...),
+			toUpstream: toUpstream,
+		}
+
+		select {
+		case s.chunks <- chunk:
+		default:
+			s.capturer.refund(n)
+			s.truncate("capture queue overflowed")
+			return
+		}
+
+		s.remaining -= n
+	}
+
+	if n < int64(len(p)) {
+		s.truncate("capture limit reached")
+	}
+}
+
+// truncate stops capturing the connection. It must be
+// called with the stream locked.
+func (s *captureStream) truncate(reason string) {
+	s.stopped = true
+	atomic.AddUint64(&s.capturer.truncated, 1)
+	s.capturer.logger.Info().
+		Str("file", s.path).
+		Msg(reason)
+}
+
+// Close stops capturing, letting the chunks already
+// queued be written before the file gets finished.
+func (s *captureStream) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if !s.closed {
+		s.stopped = true
+		s.closed = true
+		close(s.chunks)
+	}
+
+	return nil
+}
+
+// run writes the chunks queued until the stream gets
+// closed, finishing the file then.
+func (s *captureStream) run() {
+	var (
+		failed bool
+		err    error
+	)
+
+	defer atomic.AddInt64(&s.capturer.active, -1)
+
+	// once writing fails, the chunks left are drained so
+	// that Tap never blocks.
+	for chunk := range s.chunks {
+		if failed {
+			continue
+		}
+
+		writeErr := s.writer.write(chunk.ts, chunk.payload, chunk.toUpstream)
+		if writeErr != nil {
+			s.capturer.logger.Error().
+				Err(writeErr).
+				Str("file", s.path).
+				Msg("couldn't write capture")
+
+			s.mu.Lock()
+			s.stopped = true
+			s.mu.Unlock()
+
+			failed = true
+			continue
+		}
+
+		atomic.AddUint64(&s.capturer.bytes, uint64(len(chunk.payload)))
+	}
+
+	if !failed {
+		err = s.writer.finish(time.Now())
+	}
+
+	if err == nil {
+		err = s.buffered.Flush()
+	}
+
+	closeErr := s.file.Close()
+	if err == nil {
+		err = closeErr
+	}
+
+	if err != nil {
+		s.capturer.logger.Error().
+			Err(err).
+			Str("file", s.path).
+			Msg("couldn't finish capture")
+	}
+}
+
+// framedWriter writes captures in a simple format: a
+// magic string followed by a frame per chunk of bytes
+// transferred.
+type framedWriter struct {
+	w io.Writer
+}
+
+func (f *framedWriter) start(ts time.Time) (err error) {
+	_, err = io.WriteString(f.w, captureFramedMagic)
+	return
+}
+
+// write writes a frame: the timestamp in unix
+// nanoseconds (8 bytes), the direction (1 byte, 0 for
+// the bytes sent to the upstream and 1 for the ones
+// sent back), the length of the payload (4 bytes) and
+// the payload, all big endian.
+func (f *framedWriter) write(ts time.Time, payload []byte, toUpstream bool) (err error) {
+	var header = make([]byte, 13)
+
+	binary.BigEndian.PutUint64(header[0:], uint64(ts.UnixNano()))
+	if !toUpstream {
+		header[8] = 1
+	}
+	binary.BigEndian.PutUint32(header[9:], uint32(len(payload)))
+
+	_, err = f.w.Write(header)
+	if err != nil {
+		return
+	}
+
+	_, err = f.w.Write(payload)
+	return
+}
+
+func (f *framedWriter) finish(ts time.Time) error {
+	return nil
+}
+
+// Capture retrieves the current capture configuration.
+func (lb *LoadBalancer) Capture() Capture {
+	return lb.capturer.config()
+}
+
+// SetCapture changes which connections get captured and
+// the limits of the captures, renewing the overall one.
+// The directory and the format stay as configured.
+func (lb *LoadBalancer) SetCapture(cfg Capture) (err error) {
+	err = lb.capturer.set(cfg)
+	if err != nil {
+		return
+	}
+
+	cfg = lb.capturer.config()
+	lb.logger.Info().
+		Str("directory", cfg.Directory).
+		Str("format", cfg.Format).
+		Strs("clients", cfg.Clients).
+		Strs("upstreams", cfg.Upstreams).
+		Float64("sample", cfg.Sample).
+		Int64("max_connection_bytes", cfg.MaxConnectionBytes).
+		Int64("max_bytes", cfg.MaxBytes).
+		Msg("capture changed")
+	return
+}
@@ -0,0 +1,368 @@
+package lib
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/rs/zerolog"
+	"github.com/stretchr/testify/assert"
+)
+
+type captureFrame struct {
+	toUpstream bool
+	payload    string
+}
+
+// readFrames parses a capture file of the framed
+// format.
+func readFrames(t *testing.T, path string) (frames []captureFrame) {
+	content, err := ioutil.ReadFile(path)
+	assert.NoError(t, err)
+
+	if !assert.True(t, strings.HasPrefix(string(content), captureFramedMagic)) {
+		return
+	}
+
+	content = content[len(captureFramedMagic):]
+	for len(content) >= 13 {
+		length := int(binary.BigEndian.Uint32(content[9:]))
+		frames = append(frames, captureFrame{
+			toUpstream: content[8] == 0,
+			payload:    string(content[13 : 13+length]),
+		})
+		content = content[13+length:]
+	}
+
+	assert.Empty(t, content)
+	return
+}
+
+func TestValidateCapture(t *testing.T) {
+	var testCases = []struct {
+		description string
+		config      Capture
+		shouldFail  bool
+	}{
+		{
+			description: "defaults",
+		},
+		{
+			description: "unknown format",
+			config:      Capture{Format: "json"},
+			shouldFail:  true,
+		},
+		{
+			description: "bad client",
+			config:      Capture{Clients: []string{"10.0.0.0/40"}},
+			shouldFail:  true,
+		},
+		{
+			description: "negative limit",
+			config:      Capture{MaxBytes: -1},
+			shouldFail:  true,
+		},
+		{
+			description: "sample over 1",
+			config:      Capture{Sample: 2},
+			shouldFail:  true,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.description, func(t *testing.T) {
+			_, err := validateCapture(&tc.config)
+			if tc.shouldFail {
+				assert.Error(t, err)
+				return
+			}
+
+			assert.NoError(t, err)
+			assert.Equal(t, CaptureFormatPcapng, tc.config.Format)
+			assert.Equal(t, float64(1), tc.config.Sample)
+		})
+	}
+}
+
+func TestCapturerSelectsConnections(t *testing.T) {
+	var (
+		client = &net.TCPAddr{IP: net.ParseIP("10.1.1.1"), Port: 4000}
+		other  = &net.TCPAddr{IP: net.ParseIP("192.168.1.1"), Port: 4000}
+	)
+
+	var testCases = []struct {
+		description string
+		config      Capture
+		client      net.Addr
+		upstream    string
+		expected    bool
+	}{
+		{
+			description: "no directory",
+			config:      Capture{},
+			client:      client,
+			expected:    false,
+		},
+		{
+			description: "every connection",
+			config:      Capture{Directory: "captures"},
+			client:      client,
+			expected:    true,
+		},
+		{
+			description: "client in cidr",
+			config:      Capture{Directory: "captures", Clients: []string{"10.0.0.0/8"}},
+			client:      client,
+			expected:    true,
+		},
+		{
+			description: "client not in cidr",
+			config:      Capture{Directory: "captures", Clients: []string{"10.0.0.0/8"}},
+			client:      other,
+			expected:    false,
+		},
+		{
+			description: "upstream",
+			config:      Capture{Directory: "captures", Upstreams: []string{"a:80"}},
+			client:      client,
+			upstream:    "a:80",
+			expected:    true,
+		},
+		{
+			description: "other upstream",
+			config:      Capture{Directory: "captures", Upstreams: []string{"a:80"}},
+			client:      client,
+			upstream:    "b:80",
+			expected:    false,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.description, func(t *testing.T) {
+			if tc.config.Directory != "" {
+				tc.config.Directory = filepath.Join(t.TempDir(), tc.config.Directory)
+			}
+
+			c, err := newCapturer(tc.config, zerolog.Nop())
+			assert.NoError(t, err)
+			assert.Equal(t, tc.expected, c.selects(tc.client, tc.upstream))
+		})
+	}
+}
+
+func TestCaptureStreamLimits(t *testing.T) {
+	var testCases = []struct {
+		description string
+		config      Capture
+		expected    []captureFrame
+		truncated   uint64
+	}{
+		{
+			description: "no limits reached",
+			expected: []captureFrame{
+				{toUpstream: true, payload: "ping"},
+				{toUpstream: false, payload: "pong"},
+				{toUpstream: true, payload: "ping"},
+			},
+		},
+		{
+			description: "connection limit",
+			config:      Capture{MaxConnectionBytes: 6},
+			expected: []captureFrame{
+				{toUpstream: true, payload: "ping"},
+				{toUpstream: false, payload: "po"},
+			},
+			truncated: 1,
+		},
+		{
+			description: "overall limit",
+			config:      Capture{MaxBytes: 9},
+			expected: []captureFrame{
+				{toUpstream: true, payload: "ping"},
+				{toUpstream: false, payload: "pong"},
+				{toUpstream: true, payload: "p"},
+			},
+			truncated: 1,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.description, func(t *testing.T) {
+			tc.config.Directory = t.TempDir()
+			tc.config.Format = CaptureFormatFramed
+
+			c, err := newCapturer(tc.config, zerolog.Nop())
+			assert.NoError(t, err)
+
+			client, server := net.Pipe()
+			defer server.Close()
+			defer client.Close()
+
+			s := c.start("conn", client, "a:80")
+			if !assert.NotNil(t, s) {
+				return
+			}
+
+			s.Tap([]byte("ping"), true)
+			s.Tap([]byte("pong"), false)
+			s.Tap([]byte("ping"), true)
+			assert.NoError(t, s.Close())
+			waitCaptures(t, c)
+
+			assert.Equal(t, tc.expected,
+				readFrames(t, filepath.Join(tc.config.Directory, "conn.frames")))
+
+			stats := c.stats()
+			assert.Equal(t, uint64(1), stats.Connections)
+			assert.Equal(t, int64(0), stats.ActiveConnections)
+			assert.Equal(t, tc.truncated, stats.Truncated)
+		})
+	}
+}
+
+// waitCaptures waits for the files being captured to be
+// finished.
+func waitCaptures(t *testing.T, c *capturer) {
+	assert.True(t, waitFor(time.Second, func() bool {
+		return c.stats().ActiveConnections == 0
+	}))
+}
+
+// blockingCaptureWriter holds writes up until it gets
+// released.
+type blockingCaptureWriter struct {
+	framedWriter
+	release chan struct{}
+}
+
+func (w *blockingCaptureWriter) write(ts time.Time, payload []byte, toUpstream bool) error {
+	<-w.release
+	return w.framedWriter.write(ts, payload, toUpstream)
+}
+
+func TestCaptureStreamDropsOverflow(t *testing.T) {
+	var directory = t.TempDir()
+
+	c, err := newCapturer(Capture{
+		Directory: directory,
+		Format:    CaptureFormatFramed,
+	}, zerolog.Nop())
+	assert.NoError(t, err)
+
+	client, server := net.Pipe()
+	defer server.Close()
+	defer client.Close()
+
+	s := c.start("conn", client, "a:80")
+	if !assert.NotNil(t, s) {
+		return
+	}
+
+	// set before any chunk gets queued, and so before
+	// the writer looks at it.
+	writer := &blockingCaptureWriter{
+		framedWriter: *s.writer.(*framedWriter),
+		release:      make(chan struct{}),
+	}
+	s.writer = writer
+
+	tapped := make(chan struct{})
+	go func() {
+		for i := 0; i < captureQueueSize+10; i++ {
+			s.Tap([]byte("ping"), true)
+		}
+		close(tapped)
+	}()
+
+	select {
+	case <-tapped:
+	case <-time.After(2 * time.Second):
+		t.Fatal("tapping blocked on the capture file")
+	}
+
+	close(writer.release)
+	assert.NoError(t, s.Close())
+	waitCaptures(t, c)
+
+	frames := readFrames(t, filepath.Join(directory, "conn.frames"))
+	assert.True(t, len(frames) >= captureQueueSize && len(frames) < captureQueueSize+10)
+
+	stats := c.stats()
+	assert.Equal(t, uint64(1), stats.Truncated)
+	assert.Equal(t, uint64(4*len(frames)), stats.Bytes)
+	assert.Equal(t, defaultCaptureMaxBytes-int64(4*len(frames)), stats.RemainingBytes)
+}
+
+func TestLoadBalancerCapturesConnections(t *testing.T) {
+	var directory = t.TempDir()
+
+	lb, addresses := startLimitedLoadBalancer(t, LoadBalancerConfig{
+		Capture: Capture{
+			Directory: directory,
+			Format:    CaptureFormatFramed,
+		},
+	}, Frontend{Name: "a"})
+
+	echo(t, addresses[0], []byte("hello"))
+
+	var files []string
+	assert.True(t, waitFor(time.Second, func() bool {
+		files, _ = filepath.Glob(filepath.Join(directory, "*.frames"))
+		return len(files) == 1 && lb.Stats().Capture.ActiveConnections == 0
+	}))
+
+	if assert.Len(t, files, 1) {
+		assert.Equal(t, []captureFrame{
+			{toUpstream: true, payload: "hello"},
+			{toUpstream: false, payload: "hello"},
+		}, readFrames(t, files[0]))
+	}
+
+	// capturing other clients leaves this one out.
+	var (
+		recorder = httptest.NewRecorder()
+		request  = httptest.NewRequest(http.MethodPut, "/capture",
+			strings.NewReader(`{"directory": "`+directory+`", "clients": ["10.0.0.0/8"]}`))
+		cfg Capture
+	)
+
+	lb.adminHandler().ServeHTTP(recorder, request)
+	assert.Equal(t, http.StatusOK, recorder.Code)
+	assert.NoError(t, json.NewDecoder(recorder.Body).Decode(&cfg))
+	assert.Equal(t, directory, cfg.Directory)
+	assert.Equal(t, CaptureFormatFramed, cfg.Format)
+	assert.Equal(t, []string{"10.0.0.0/8"}, cfg.Clients)
+
+	echo(t, addresses[0], []byte("hello"))
+	time.Sleep(100 * time.Millisecond)
+
+	stats := lb.Stats().Capture
+	assert.Equal(t, uint64(1), stats.Connections)
+	assert.Equal(t, uint64(10), stats.Bytes)
+
+	// the directory and the format are only set on
+	// startup.
+	elsewhere := filepath.Join(t.TempDir(), "elsewhere")
+	for _, body := range []string{
+		`{"format": "xml"}`,
+		`{"format": "pcapng"}`,
+		`{"directory": "` + elsewhere + `"}`,
+	} {
+		recorder = httptest.NewRecorder()
+		request = httptest.NewRequest(http.MethodPut, "/capture", strings.NewReader(body))
+		lb.adminHandler().ServeHTTP(recorder, request)
+		assert.Equal(t, http.StatusBadRequest, recorder.Code)
+	}
+
+	_, err := os.Stat(elsewhere)
+	assert.True(t, os.IsNotExist(err))
+	assert.Equal(t, directory, lb.Capture().Directory)
+}
@@ -0,0 +1,83 @@
+package lib
+
+import (
+	"net"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// ParseCIDRs parses a list of networks in CIDR
+// notation. Plain IPs are accepted as well, being
+// interpreted as single-address networks.
+func ParseCIDRs(cidrs []string) (nets []*net.IPNet, err error) {
+	nets = make([]*net.IPNet, 0, len(cidrs))
+
+	for _, cidr := range cidrs {
+		var ipNet *net.IPNet
+
+		ipNet, err = ParseCIDR(cidr)
+		if err != nil {
+			return
+		}
+
+		nets = append(nets, ipNet)
+	}
+
+	return
+}
+
+func ParseCIDR(cidr string) (ipNet *net.IPNet, err error) {
+	cidr = strings.TrimSpace(cidr)
+
+	if !strings.Contains(cidr, "/") {
+		ip := net.ParseIP(cidr)
+		if ip == nil {
+			err = errors.Errorf("malformed ip or cidr '%s'", cidr)
+			return
+		}
+
+		if ip.To4() != nil {
+			ipNet = &net.IPNet{IP: ip.To4(), Mask: net.CIDRMask(32, 32)}
+		} else {
+			ipNet = &net.IPNet{IP: ip, Mask: net.CIDRMask(128, 128)}
+		}
+
+		return
+	}
+
+	_, ipNet, err = net.ParseCIDR(cidr)
+	if err != nil {
+		err = errors.Wrapf(err, "malformed cidr '%s'", cidr)
+		return
+	}
+
+	return
+}
+
+// addrIP retrieves the IP of TCP and UDP addresses,
+// returning nil for any other kind of address.
+func addrIP(addr net.Addr) net.IP {
+	switch a := addr.(type) {
+	case *net.TCPAddr:
+		return a.IP
+	case *net.UDPAddr:
+		return a.IP
+	}
+
+	return nil
+}
+
+func cidrsContain(nets []*net.IPNet, ip net.IP) bool {
+	if ip == nil {
+		return false
+	}
+
+	for _, ipNet := range nets {
+		if ipNet.Contains(ip) {
+			return true
+		}
+	}
+
+	return false
+}
@@ -0,0 +1,282 @@
+package lib
+
+import (
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// States of the circuit breakers of servers.
+const (
+	CircuitClosed   = "closed"
+	CircuitOpen     = "open"
+	CircuitHalfOpen = "half-open"
+)
+
+const (
+	defaultCircuitWindow           = 10 * time.Second
+	defaultCircuitMinRequests      = 10
+	defaultCircuitOpenTimeout      = 30 * time.Second
+	defaultCircuitHalfOpenRequests = 1
+	circuitBuckets                 = 10
+)
+
+func validateCircuitBreaker(cfg *CircuitBreaker) (err error) {
+	if cfg.Window < 0 || cfg.MinRequests < 0 || cfg.ConsecutiveFailures < 0 ||
+		cfg.OpenTimeout < 0 || cfg.HalfOpenRequests < 0 {
+		err = errors.Errorf("circuit breaker settings must not be negative")
+		return
+	}
+
+	if cfg.ErrorRate < 0 || cfg.ErrorRate > 1 {
+		err = errors.Errorf("circuit breaker error rate must be between 0 and 1")
+		return
+	}
+
+	if cfg.Window == 0 {
+		cfg.Window = defaultCircuitWindow
+	}
+
+	if cfg.Window < circuitBuckets*time.Millisecond {
+		err = errors.Errorf("circuit breaker window must be at least %s",
+			circuitBuckets*time.Millisecond)
+		return
+	}
+
+	if cfg.MinRequests == 0 {
+		cfg.MinRequests = defaultCircuitMinRequests
+	}
+
+	if cfg.OpenTimeout == 0 {
+		cfg.OpenTimeout = defaultCircuitOpenTimeout
+	}
+
+	if cfg.HalfOpenRequests == 0 {
+		cfg.HalfOpenRequests = defaultCircuitHalfOpenRequests
+	}
+
+	return
+}
+
+func (cfg CircuitBreaker) enabled() bool {
+	return cfg.ErrorRate > 0 || cfg.ConsecutiveFailures > 0
+}
+
+// circuitBucket counts the dials of a slice of the
+// rolling window.
+type circuitBucket struct {
+	epoch     int64
+	successes int
+	failures  int
+}
+
+// circuitBreaker stops a server from getting
+// connections once dialing it fails too much. After
+// being open for a while it lets a few trial
+// connections through (half-open): the circuit closes if
+// all of them succeed and opens again otherwise.
+type circuitBreaker struct {
+	cfg CircuitBreaker
+
+	mu          sync.Mutex
+	state       string
+	openedAt    time.Time
+	buckets     [circuitBuckets]circuitBucket
+	consecutive int
+	trials      int
+	succeeded   int
+	trips       uint64
+}
+
+// newCircuitBreaker creates a breaker out of a
+// validated configuration, retrieving nil if it's
+// disabled.
+func newCircuitBreaker(cfg CircuitBreaker) *circuitBreaker {
+	if !cfg.enabled() {
+		return nil
+	}
+
+	return &circuitBreaker{
+		cfg:   cfg,
+		state: CircuitClosed,
+	}
+}
+
+// admits tells whether a connection can be sent to the
+// server: open circuits admit one once their timeout
+// expires and half-open ones as long as trials are
+// left, without changing their state.
+func (c *circuitBreaker) admits(now time.Time) bool {
+	if c == nil {
+		return true
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	switch c.state {
+	case CircuitOpen:
+		return now.Sub(c.openedAt) >= c.cfg.OpenTimeout
+	case CircuitHalfOpen:
+		return c.trials+c.succeeded < c.cfg.HalfOpenRequests
+	}
+
+	return true
+}
+
+// acquire accounts a connection sent to the server,
+// which is a trial one if the circuit is half-open
+// (moving open circuits whose timeout expired to
+// half-open). It's called while picking, with the
+// backend locked, so that concurrent picks can't get
+// past admits before the trial is counted. The result
+// of dialing must then be observed.
+func (c *circuitBreaker) acquire(now time.Time) {
+	if c == nil {
+		return
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.state == CircuitOpen && now.Sub(c.openedAt) >= c.cfg.OpenTimeout {
+		c.state = CircuitHalfOpen
+		c.trials = 0
+		c.succeeded = 0
+	}
+
+	if c.state == CircuitHalfOpen {
+		c.trials++
+	}
+}
+
+// observe accounts the result of dialing the server,
+// retrieving the state of the circuit if it changed.
+func (c *circuitBreaker) observe(success bool, now time.Time) (changed string) {
+	if c == nil {
+		return
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	switch c.state {
+	case CircuitHalfOpen:
+		if c.trials > 0 {
+			c.trials--
+		}
+
+		if !success {
+			c.open(now)
+			changed = c.state
+			return
+		}
+
+		c.succeeded++
+		if c.succeeded >= c.cfg.HalfOpenRequests {
+			c.close()
+			changed = c.state
+		}
+	case CircuitClosed:
+		c.record(success, now)
+		if c.shouldTrip(now) {
+			c.open(now)
+			changed = c.state
+		}
+	}
+
+	return
+}
+
+func (c *circuitBreaker) record(success bool, now time.Time) {
+	var (
+		epoch  = now.UnixNano() / int64(c.cfg.Window/circuitBuckets)
+		bucket = &c.buckets[epoch%circuitBuckets]
+	)
+
+	if bucket.epoch != epoch {
+		*bucket = circuitBucket{epoch: epoch}
+	}
+
+	if success {
+		bucket.successes++
+		c.consecutive = 0
+		return
+	}
+
+	bucket.failures++
+	c.consecutive++
+}
+
+func (c *circuitBreaker) shouldTrip(now time.Time) bool {
+	if c.cfg.ConsecutiveFailures > 0 && c.consecutive >= c.cfg.ConsecutiveFailures {
+		return true
+	}
+
+	if c.cfg.ErrorRate == 0 {
+		return false
+	}
+
+	var (
+		epoch               = now.UnixNano() / int64(c.cfg.Window/circuitBuckets)
+		successes, failures int
+	)
+
+	for _, bucket := range c.buckets {
+		if epoch-bucket.epoch < circuitBuckets {
+			successes += bucket.successes
+			failures += bucket.failures
+		}
+	}
+
+	total := successes + failures
+	return total >= c.cfg.MinRequests &&
+		float64(failures)/float64(total) >= c.cfg.ErrorRate
+}
+
+func (c *circuitBreaker) open(now time.Time) {
+	c.state = CircuitOpen
+	c.openedAt = now
+	c.trips++
+}
+
+func (c *circuitBreaker) close() {
+	c.state = CircuitClosed
+	c.buckets = [circuitBuckets]circuitBucket{}
+	c.consecutive = 0
+}
+
+func (c *circuitBreaker) stats() (state string, trips uint64) {
+	if c == nil {
+		return
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return c.state, c.trips
+}
+
+// observeDial accounts the result of dialing a server
+// for a connection, both for its circuit breaker and
+// for its health.
+func (b *backend) observeDial(s *server, err error) {
+	switch s.breaker.observe(err == nil, time.Now()) {
+	case CircuitOpen:
+		b.logger.Warn().
+			Err(err).
+			Str("upstream", s.address).
+			Msg("circuit opened")
+	case CircuitClosed:
+		b.logger.Info().
+			Str("upstream", s.address).
+			Msg("circuit closed")
+
+		b.mu.Lock()
+		b.dispatch()
+		b.mu.Unlock()
+	}
+
+	b.observe(s, err)
+}
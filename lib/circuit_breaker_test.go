@@ -0,0 +1,239 @@
+package lib
+
+import (
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/rs/zerolog"
+	"github.com/stretchr/testify/assert"
+)
+
+func newTestCircuitBreaker(t *testing.T, cfg CircuitBreaker) *circuitBreaker {
+	assert.NoError(t, validateCircuitBreaker(&cfg))
+	return newCircuitBreaker(cfg)
+}
+
+func TestCircuitBreakerTrips(t *testing.T) {
+	var testCases = []struct {
+		description string
+		config      CircuitBreaker
+		results     []bool
+		expected    string
+	}{
+		{
+			description: "consecutive failures",
+			config:      CircuitBreaker{ConsecutiveFailures: 3},
+			results:     []bool{false, false, false},
+			expected:    CircuitOpen,
+		},
+		{
+			description: "interrupted failures",
+			config:      CircuitBreaker{ConsecutiveFailures: 3},
+			results:     []bool{false, false, true, false, false},
+			expected:    CircuitClosed,
+		},
+		{
+			description: "error rate",
+			config:      CircuitBreaker{ErrorRate: 0.5, MinRequests: 4},
+			results:     []bool{true, false, true, false},
+			expected:    CircuitOpen,
+		},
+		{
+			description: "error rate below min requests",
+			config:      CircuitBreaker{ErrorRate: 0.5, MinRequests: 4},
+			results:     []bool{false, false, false},
+			expected:    CircuitClosed,
+		},
+		{
+			description: "error rate below threshold",
+			config:      CircuitBreaker{ErrorRate: 0.5, MinRequests: 4},
+			results:     []bool{true, true, true, false, true, false},
+			expected:    CircuitClosed,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.description, func(t *testing.T) {
+			var (
+				breaker = newTestCircuitBreaker(t, tc.config)
+				now     = time.Now()
+			)
+
+			for _, success := range tc.results {
+				breaker.observe(success, now)
+			}
+
+			state, _ := breaker.stats()
+			assert.Equal(t, tc.expected, state)
+		})
+	}
+}
+
+func TestCircuitBreakerWindowRolls(t *testing.T) {
+	var (
+		breaker = newTestCircuitBreaker(t, CircuitBreaker{
+			Window:      time.Second,
+			ErrorRate:   0.5,
+			MinRequests: 4,
+		})
+		now = time.Now()
+	)
+
+	breaker.observe(false, now)
+	breaker.observe(false, now)
+	breaker.observe(false, now)
+
+	// the failures fell out of the window.
+	later := now.Add(2 * time.Second)
+	for i := 0; i < 3; i++ {
+		assert.Equal(t, "", breaker.observe(false, later))
+	}
+
+	assert.Equal(t, CircuitOpen, breaker.observe(false, later.Add(500*time.Millisecond)))
+}
+
+func TestCircuitBreakerHalfOpen(t *testing.T) {
+	var (
+		breaker = newTestCircuitBreaker(t, CircuitBreaker{
+			ConsecutiveFailures: 1,
+			OpenTimeout:         time.Minute,
+			HalfOpenRequests:    2,
+		})
+		now = time.Now()
+	)
+
+	assert.Equal(t, CircuitOpen, breaker.observe(false, now))
+	assert.False(t, breaker.admits(now.Add(30*time.Second)))
+
+	// half-open admits a limited number of trials. Only
+	// dialing moves the circuit there.
+	now = now.Add(time.Minute)
+	assert.True(t, breaker.admits(now))
+	state, _ := breaker.stats()
+	assert.Equal(t, CircuitOpen, state)
+
+	for i := 0; i < 2; i++ {
+		assert.True(t, breaker.admits(now))
+		breaker.acquire(now)
+	}
+	assert.False(t, breaker.admits(now))
+
+	// a failed trial opens the circuit again.
+	assert.Equal(t, "", breaker.observe(true, now))
+	assert.Equal(t, CircuitOpen, breaker.observe(false, now))
+	assert.False(t, breaker.admits(now))
+
+	now = now.Add(time.Minute)
+	for i := 0; i < 2; i++ {
+		assert.True(t, breaker.admits(now))
+		breaker.acquire(now)
+	}
+
+	assert.Equal(t, "", breaker.observe(true, now))
+	assert.Equal(t, CircuitClosed, breaker.observe(true, now))
+	assert.True(t, breaker.admits(now))
+
+	state, trips := breaker.stats()
+	assert.Equal(t, CircuitClosed, state)
+	assert.Equal(t, uint64(2), trips)
+}
+
+func TestValidateCircuitBreaker(t *testing.T) {
+	for _, cfg := range []CircuitBreaker{
+		{ErrorRate: 1.5},
+		{ErrorRate: -0.5},
+		{ConsecutiveFailures: -1},
+		{ConsecutiveFailures: 1, Window: time.Millisecond},
+	} {
+		assert.Error(t, validateCircuitBreaker(&cfg), "%+v", cfg)
+	}
+
+	var cfg CircuitBreaker
+	assert.NoError(t, validateCircuitBreaker(&cfg))
+	assert.False(t, cfg.enabled())
+	assert.Nil(t, newCircuitBreaker(cfg))
+}
+
+func TestLoadBalancerOpensCircuits(t *testing.T) {
+	upstream, upstreamAddress := listenEcho(t, "tcp4", "127.0.0.1:0")
+	defer upstream.Close()
+
+	down := freeAddress(t)
+
+	lb := startLoadBalancer(t, LoadBalancerConfig{
+		Frontends: []Frontend{{Name: "a", Address: freeAddress(t), Backend: "echo"}},
+		Backends: []Backend{{
+			Name:           "echo",
+			CircuitBreaker: CircuitBreaker{ConsecutiveFailures: 1},
+			Servers: []Server{
+				{Address: down},
+				{Address: upstreamAddress},
+			},
+		}},
+	})
+
+	// the first connection goes to the server that's
+	// down, opening its circuit.
+	conn, served := dialEcho(t, lb.frontends[0].address)
+	conn.Close()
+	assert.False(t, served)
+
+	for i := 0; i < 4; i++ {
+		conn, served := dialEcho(t, lb.frontends[0].address)
+		conn.Close()
+		assert.True(t, served)
+	}
+
+	stats := lb.Stats().Backends[0].Servers
+	assert.Equal(t, CircuitOpen, stats[0].Circuit)
+	assert.Equal(t, uint64(1), stats[0].CircuitTrips)
+	assert.Equal(t, CircuitClosed, stats[1].Circuit)
+}
+
+func TestBackendLimitsConcurrentTrials(t *testing.T) {
+	b, err := newBackend(Backend{
+		Name: "app",
+		CircuitBreaker: CircuitBreaker{
+			ConsecutiveFailures: 1,
+			OpenTimeout:         10 * time.Millisecond,
+			HalfOpenRequests:    2,
+		},
+		Servers: []Server{{Address: "127.0.0.1:8080"}},
+	}, nil, zerolog.Nop())
+	assert.NoError(t, err)
+
+	s := b.tryAcquire(nil)
+	assert.NotNil(t, s)
+	b.observeDial(s, errors.New("connection refused"))
+	b.release(s)
+	assert.Nil(t, b.tryAcquire(nil))
+
+	time.Sleep(20 * time.Millisecond)
+
+	var (
+		wg       sync.WaitGroup
+		start    = make(chan struct{})
+		admitted int64
+	)
+
+	for i := 0; i < 50; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			<-start
+			if b.tryAcquire(nil) != nil {
+				atomic.AddInt64(&admitted, 1)
+			}
+		}()
+	}
+
+	close(start)
+	wg.Wait()
+
+	assert.Equal(t, int64(2), admitted)
+	state, _ := s.breaker.stats()
+	assert.Equal(t, CircuitHalfOpen, state)
+}
@@ -1,10 +1,684 @@
 package lib
 
+import (
+	"fmt"
+	"io/ioutil"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+	"gopkg.in/yaml.v2"
+)
+
+// DefaultName names the frontend and backend that are
+// created out of the single-service form of the
+// configuration (top-level port and servers).
+const DefaultName = "default"
+
 type Server struct {
+	Address       string `yaml:"address"`
+	ProxyProtocol string `yaml:"proxy_protocol"`
+	Weight        int    `yaml:"weight"`
+
+	// ProxyProtocolSNI sends the server name requested by
+	// TLS clients in the v2 PROXY protocol header. Dialing
+	// waits up to 200ms for the ClientHello, so it's only
+	// meant for servers whose clients speak first.
+	ProxyProtocolSNI bool `yaml:"proxy_protocol_sni"`
+
+	// Priority sets the failover tier of the server:
+	// connections only go to the healthy servers with the
+	// lowest priority. Defaults to 0, with other values
+	// requiring the health checks of the backend to be
+	// enabled.
+	Priority int `yaml:"priority"`
+
+	// Backup servers only get connections when none of
+	// the other servers are healthy. Among themselves,
+	// backups are tiered by priority as well. Requires
+	// the health checks of the backend to be enabled.
+	Backup bool `yaml:"backup"`
+
+	// MaxConnections caps the concurrent connections
+	// sent to the server. Once every server is at its
+	// cap, new connections wait in the backend queue.
+	// Zero means no cap.
+	MaxConnections int `yaml:"max_connections"`
+
+	// Drain stops sending new connections to the server
+	// while the established ones go on (e.g., before
+	// taking it down in a rolling deploy). Drains can
+	// also be started through the admin interface.
+	Drain bool `yaml:"drain"`
+}
+
+// Frontend describes a listener and the backend pool
+// that the connections accepted there are sent to.
+type Frontend struct {
+	Name    string `yaml:"name"`
 	Address string `yaml:"address"`
+	Backend string `yaml:"backend"`
+
+	// SocketMode, SocketOwner and SocketGroup set the
+	// permissions of the socket file when the address is
+	// a unix socket ('unix:/path'). The mode is given in
+	// octal (e.g., '0660') while owner and group accept
+	// either names or numeric ids.
+	SocketMode  string `yaml:"socket_mode"`
+	SocketOwner string `yaml:"socket_owner"`
+	SocketGroup string `yaml:"socket_group"`
+
+	// Protocol is either 'tcp' (default) or 'udp'. UDP
+	// frontends keep a flow per client address, pinning
+	// it to a server until it goes idle. The options that
+	// only apply to TCP are rejected for UDP frontends.
+	Protocol string `yaml:"protocol"`
+
+	// MaxFlows bounds the number of concurrent flows of
+	// a UDP frontend. Defaults to 10000.
+	MaxFlows int `yaml:"max_flows"`
+
+	// Network restricts the address family listened
+	// on: 'tcp' (default) listens on both IPv4 and IPv6
+	// when the address doesn't specify an IP, 'tcp4' and
+	// 'tcp6' listen on a single family. The same values
+	// apply to UDP frontends.
+	Network string `yaml:"network"`
+
+	// Interface binds the listener to a specific network
+	// interface (e.g., 'eth1'). Linux only.
+	Interface string `yaml:"interface"`
+
+	// IdleTimeout closes connections that didn't
+	// transfer any bytes in either direction for
+	// that long. Zero disables it for TCP while UDP
+	// flows default to 30s.
+	IdleTimeout time.Duration `yaml:"idle_timeout"`
+
+	// MaxConnections and MaxConnectionsPerClient bound
+	// the concurrent TCP connections of the frontend and
+	// of each client IP. Zero means no limit.
+	MaxConnections          int `yaml:"max_connections"`
+	MaxConnectionsPerClient int `yaml:"max_connections_per_client"`
+
+	// LimitAction is what happens to connections over
+	// the frontend or global limits: 'close' (default)
+	// accepts and closes them right away while 'wait'
+	// stops accepting until connections finish. Clients
+	// over their own limit are always closed.
+	LimitAction string `yaml:"limit_action"`
+
+	// RateLimit bounds the rate of new TCP connections.
+	RateLimit RateLimit `yaml:"rate_limit"`
+
+	// ACL restricts the clients allowed to connect (or
+	// to start a flow, for UDP frontends).
+	ACL ACL `yaml:"acl"`
+
+	// GeoIP routes or denies clients by country or
+	// autonomous system.
+	GeoIP GeoIP `yaml:"geoip"`
+
+	// Sniff routes connections by their first bytes,
+	// letting a port carry several protocols.
+	Sniff Sniff `yaml:"sniff"`
+
+	// HostRouting routes plaintext HTTP/1.x connections
+	// by the host they request.
+	HostRouting HostRouting `yaml:"host_routing"`
+
+	// Mirror copies the traffic of a sample of TCP
+	// connections to a shadow backend.
+	Mirror Mirror `yaml:"mirror"`
+
+	// Bandwidth shapes the traffic of TCP connections.
+	// It can be changed at runtime through the admin
+	// interface.
+	Bandwidth FrontendBandwidth `yaml:"bandwidth"`
+
+	AcceptProxyProtocol  bool          `yaml:"accept_proxy_protocol"`
+	ProxyProtocolTimeout time.Duration `yaml:"proxy_protocol_timeout"`
+	ProxyProtocolTrusted []string      `yaml:"proxy_protocol_trusted"`
+}
+
+// ACL lists rules of the form 'allow <cidr>' or 'deny
+// <cidr>' evaluated against the address of clients (the
+// one from the PROXY protocol header when accepted),
+// with the first matching rule winning. Connections
+// denied get closed right away.
+type ACL struct {
+	// Rules are evaluated before the ones of Files.
+	Rules []string `yaml:"rules"`
+
+	// Files hold rules one per line, with '#' starting
+	// comments. They're evaluated in order and reloaded
+	// whenever they change.
+	Files []string `yaml:"files"`
+
+	// Default is the action for clients that match no
+	// rule: 'allow' (default) or 'deny'.
+	Default string `yaml:"default"`
+}
+
+// GeoIP routes TCP clients by what MaxMind DB (MMDB)
+// files know about their IP. Rules have the form
+// '<field> in [<values>] -> <backend>', where field is
+// 'country' (ISO codes) or 'asn' and backend can be
+// 'deny' to close the connections. The first matching
+// rule wins and clients matching none go to the backend
+// of the frontend.
+type GeoIP struct {
+	// Databases are looked up in order, each filling
+	// the fields the previous ones didn't know about
+	// (e.g., a country and an ASN database). They're
+	// reloaded whenever they change.
+	Databases []string `yaml:"databases"`
+	Rules     []string `yaml:"rules"`
+
+	// CacheSize bounds the number of lookups cached.
+	// Defaults to 10000.
+	CacheSize int `yaml:"cache_size"`
+}
+
+// Sniff peeks the first bytes clients send (replaying
+// them to the server) and sends the connection to the
+// backend of the first route that matches them. Clients
+// that send nothing in time or match no route go to the
+// backend of the frontend.
+type Sniff struct {
+	// Timeout bounds the wait for the first bytes.
+	// Defaults to 1s.
+	Timeout time.Duration `yaml:"timeout"`
+
+	// MaxBytes bounds the bytes peeked. Defaults to
+	// 1024.
+	MaxBytes int `yaml:"max_bytes"`
+
+	Routes []SniffRoute `yaml:"routes"`
+}
+
+// SniffRoute matches connections with exactly one of
+// a built-in protocol detector ('tls', 'http', 'ssh',
+// 'proxy' or 'postgres-ssl'), a prefix of bytes or a
+// regex evaluated against the bytes received so far.
+// Regexes keep asking for more bytes until they match,
+// holding back the routes after them.
+type SniffRoute struct {
+	Protocol string `yaml:"protocol"`
+	Prefix   string `yaml:"prefix"`
+	Regex    string `yaml:"regex"`
+	Backend  string `yaml:"backend"`
+}
+
+// Mirror tees the bytes that clients send to a sample
+// of connections to a server of a shadow backend, whose
+// responses get discarded. The shadow never slows the
+// connections down: the bytes it can't keep up with are
+// buffered up to 'BufferSize', past which the mirroring
+// of the connection stops.
+type Mirror struct {
+	Backend string `yaml:"backend"`
+
+	// Sample is the fraction of connections mirrored,
+	// between 0 and 1. Defaults to 1 (all of them).
+	Sample float64 `yaml:"sample"`
+
+	// BufferSize bounds the bytes buffered per
+	// connection. Defaults to 1MiB.
+	BufferSize int `yaml:"buffer_size"`
+}
+
+// Capture records the traffic of selected TCP
+// connections, both directions with timestamps, to a
+// file per connection named after its id. Connections
+// get selected if their client is in one of 'Clients'
+// and their server is one of 'Upstreams' (either one
+// empty selecting every connection), out of which
+// 'Sample' are captured. It can be changed at runtime
+// through the admin interface, except for the directory
+// and the format.
+type Capture struct {
+	// Directory holds the capture files. Empty disables
+	// capturing.
+	Directory string `yaml:"directory" json:"directory"`
+
+	// Format is either 'pcapng' (the default), with
+	// synthesized TCP/IP headers, or 'framed': a magic
+	// string ("L4CAP001") followed by a frame per chunk
+	// of bytes made of its timestamp in unix nanoseconds
+	// (8 bytes), its direction (1 byte, 0 for client to
+	// server), its length (4 bytes) and the bytes, big
+	// endian.
+	Format string `yaml:"format" json:"format"`
+
+	Clients   []string `yaml:"clients" json:"clients"`
+	Upstreams []string `yaml:"upstreams" json:"upstreams"`
+
+	// Sample is the fraction of the connections selected
+	// that get captured. Defaults to 1 (all of them).
+	Sample float64 `yaml:"sample" json:"sample"`
+
+	// MaxConnectionBytes bounds the bytes captured of
+	// each connection. Defaults to 1MiB.
+	MaxConnectionBytes int64 `yaml:"max_connection_bytes" json:"max_connection_bytes"`
+
+	// MaxBytes bounds the bytes captured overall since
+	// capturing was last configured. Defaults to 100MiB.
+	MaxBytes int64 `yaml:"max_bytes" json:"max_bytes"`
+}
+
+// HostRouting peeks the request line and headers of
+// plaintext HTTP/1.x connections (replaying them to the
+// server) and sends each connection to the backend of
+// the first rule matching its host. The rest of the
+// connection is proxied without being inspected, so
+// keep-alive requests follow the first one. Clients
+// that don't speak HTTP, don't send the headers in time
+// or match no rule go to the backend of the frontend.
+type HostRouting struct {
+	// Timeout bounds the wait for the headers.
+	// Defaults to 1s.
+	Timeout time.Duration `yaml:"timeout"`
+
+	// MaxBytes bounds the bytes peeked. Defaults to
+	// 8192.
+	MaxBytes int `yaml:"max_bytes"`
+
+	Rules []HostRule `yaml:"rules"`
+}
+
+// HostRule matches hosts case-insensitively and without
+// their port, either exactly ('example.com') or by
+// suffix with a leading wildcard ('*.example.com'
+// matches 'a.example.com' and 'a.b.example.com' but not
+// 'example.com').
+type HostRule struct {
+	Host    string `yaml:"host"`
+	Backend string `yaml:"backend"`
+}
+
+// RateLimit bounds the rate of new connections of a
+// frontend per client network and for the whole
+// listener using token buckets.
+type RateLimit struct {
+	// Rate and Burst are the connections per second (and
+	// the bursts over it) allowed to each client. Zero
+	// disables per-client limits. Burst defaults to the
+	// rate.
+	Rate  float64 `yaml:"rate"`
+	Burst int     `yaml:"burst"`
+
+	// ClientPrefixV4 and ClientPrefixV6 group clients by
+	// network (e.g., 24 limits each /24 as a whole).
+	// Default to single addresses.
+	ClientPrefixV4 int `yaml:"client_prefix_v4"`
+	ClientPrefixV6 int `yaml:"client_prefix_v6"`
+
+	// GlobalRate and GlobalBurst limit all of the
+	// connections of the frontend. Zero disables it.
+	GlobalRate  float64 `yaml:"global_rate"`
+	GlobalBurst int     `yaml:"global_burst"`
+
+	// Action is what happens to connections over the
+	// limits: 'reject' (default) closes them right away,
+	// 'delay' holds them until they're within the rate
+	// (rejecting those that would wait over MaxDelay) and
+	// 'tarpit' holds them for Tarpit before closing.
+	// Connections being held don't take any of the
+	// frontend and global slots.
+	Action   string        `yaml:"action"`
+	MaxDelay time.Duration `yaml:"max_delay"`
+	Tarpit   time.Duration `yaml:"tarpit"`
+
+	// MaxTarpit bounds the connections held by the tarpit
+	// at once, closing the ones over it right away.
+	// Defaults to 1000.
+	MaxTarpit int `yaml:"max_tarpit"`
+
+	// MaxClients bounds the number of client buckets
+	// kept, evicting the least recently seen. Defaults
+	// to 10000.
+	MaxClients int `yaml:"max_clients"`
+}
+
+// Backend describes a named pool of servers and how
+// connections are distributed among them.
+type Backend struct {
+	Name           string        `yaml:"name"`
+	Strategy       string        `yaml:"strategy"`
+	ConnectTimeout time.Duration `yaml:"connect_timeout"`
+	Servers        []Server      `yaml:"servers"`
+
+	// Network restricts the address family used to reach
+	// the servers: 'tcp' (default), 'tcp4' or 'tcp6'.
+	Network string `yaml:"network"`
+
+	// ResolveInterval enables periodic resolution of the
+	// servers specified by hostname: each address found
+	// becomes a server of its own and the pool follows
+	// the changes. Zero leaves names to be resolved on
+	// every connection. It's also the interval at which
+	// SRV records ('srv:' servers) are looked up,
+	// defaulting to 30s for those.
+	ResolveInterval time.Duration `yaml:"resolve_interval"`
+
+	// MaxQueue bounds the connections waiting for a
+	// server below its max connections, which wait for
+	// QueueTimeout at most. Defaults to 100 and 10s.
+	MaxQueue     int           `yaml:"max_queue"`
+	QueueTimeout time.Duration `yaml:"queue_timeout"`
+
+	// SlowStart is the window during which servers that
+	// got added or recovered ramp their weight up
+	// linearly, starting from a tenth of it. Servers
+	// present at startup start with their full weight.
+	SlowStart time.Duration `yaml:"slow_start"`
+
+	// DrainTimeout closes the connections that servers
+	// still hold that long after they started draining.
+	// Zero lets them go on until they finish.
+	DrainTimeout time.Duration `yaml:"drain_timeout"`
+
+	// HealthCheck enables active checks of the servers
+	// so that failing ones stop getting connections.
+	HealthCheck HealthCheck `yaml:"health_check"`
+
+	// HappyEyeballsDelay is how long to wait for a
+	// connection to the preferred family of a hostname
+	// resolving to both IPv4 and IPv6 addresses before
+	// racing the other family. Defaults to 300ms and a
+	// negative value disables the fallback.
+	HappyEyeballsDelay time.Duration `yaml:"happy_eyeballs_delay"`
+
+	// ServerBandwidth caps the traffic of each server
+	// across all of its connections.
+	ServerBandwidth Bandwidth `yaml:"server_bandwidth"`
+
+	// Affinity pins clients to servers, surviving changes
+	// to the pool.
+	Affinity Affinity `yaml:"affinity"`
+
+	// CircuitBreaker stops sending connections to the
+	// servers that fail to be dialed.
+	CircuitBreaker CircuitBreaker `yaml:"circuit_breaker"`
+}
+
+// CircuitBreaker trips the circuit of a server (which
+// then gets no connections) when dialing it fails too
+// often within a rolling window. Once open for
+// OpenTimeout, the circuit is half-open: it admits
+// HalfOpenRequests trial connections, closing if all of
+// them succeed and opening again otherwise. Setting
+// ErrorRate or ConsecutiveFailures enables it.
+type CircuitBreaker struct {
+	// Window is the rolling window dials are counted in.
+	// Defaults to 10s.
+	Window time.Duration `yaml:"window"`
+
+	// ErrorRate (from 0 to 1) trips the circuit when
+	// that fraction of the dials in the window fails, as
+	// long as there were at least MinRequests (defaults
+	// to 10).
+	ErrorRate   float64 `yaml:"error_rate"`
+	MinRequests int     `yaml:"min_requests"`
+
+	// ConsecutiveFailures trips the circuit after that
+	// many dials in a row fail.
+	ConsecutiveFailures int `yaml:"consecutive_failures"`
+
+	// OpenTimeout defaults to 30s and HalfOpenRequests
+	// to 1.
+	OpenTimeout      time.Duration `yaml:"open_timeout"`
+	HalfOpenRequests int           `yaml:"half_open_requests"`
+}
+
+// Affinity remembers the server each client IP was sent
+// to so that its next connections go to the same one as
+// long as it's healthy (and not saturated). Clients are
+// forgotten once they don't connect for TTL. The table
+// is kept across graceful restarts through the state
+// file.
+type Affinity struct {
+	// TTL enables affinity when set.
+	TTL time.Duration `yaml:"ttl"`
+
+	// MaxEntries bounds the clients remembered, evicting
+	// the least recently seen ones. Defaults to 100000.
+	MaxEntries int `yaml:"max_entries"`
+}
+
+// Bandwidth caps traffic in bytes per second in each
+// direction: upload goes from clients to servers and
+// download from servers to clients. Zero means no
+// limit.
+type Bandwidth struct {
+	Upload   int64 `yaml:"upload" json:"upload"`
+	Download int64 `yaml:"download" json:"download"`
+}
+
+// FrontendBandwidth caps the traffic of each connection
+// and of all the connections of each client IP.
+type FrontendBandwidth struct {
+	PerConnection Bandwidth `yaml:"per_connection" json:"per_connection"`
+	PerClient     Bandwidth `yaml:"per_client" json:"per_client"`
+}
+
+// HealthCheck describes how servers are checked: a
+// server is considered down after 'Fall' consecutive
+// failed connection attempts and back up after 'Rise'
+// successful ones. Failures to connect to a server
+// when proxying count as well.
+type HealthCheck struct {
+	// Interval between checks. Zero disables them,
+	// along with the passive checks.
+	Interval time.Duration `yaml:"interval"`
+
+	// Timeout of each connection attempt. Defaults to
+	// 2s.
+	Timeout time.Duration `yaml:"timeout"`
+
+	// Rise defaults to 2 and Fall to 3.
+	Rise int `yaml:"rise"`
+	Fall int `yaml:"fall"`
+}
+
+// Discovery configures the providers that feed the
+// backend pools with servers at runtime.
+type Discovery struct {
+	File   FileDiscovery   `yaml:"file"`
+	Docker DockerDiscovery `yaml:"docker"`
+}
+
+// FileDiscovery watches a JSON or YAML file mapping
+// backend names to their servers, e.g.:
+//
+//	{ "web": [ { "address": "10.0.0.1:80", "weight": 2 } ] }
+//
+// Changes are applied as soon as the file stops
+// changing for 'Debounce'. Files rewritten in place
+// (rather than replaced through a rename) must also
+// keep the same content for 'Settle'.
+type FileDiscovery struct {
+	Path string `yaml:"path"`
+
+	// PollInterval is how often the file is checked for
+	// changes when inotify is not available. Defaults
+	// to 5s.
+	PollInterval time.Duration `yaml:"poll_interval"`
+
+	// Debounce is how long to wait for writes to settle
+	// before reading the file. Defaults to 200ms.
+	Debounce time.Duration `yaml:"debounce"`
+
+	// Settle is how long the content of a file rewritten
+	// in place must stay the same to be applied, so that
+	// writers pausing midway don't get a truncated file
+	// applied. Defaults to 1s.
+	Settle time.Duration `yaml:"settle"`
+}
+
+// DockerDiscovery follows the containers of a Docker
+// engine, adding those labeled with 'l4.pool' and
+// 'l4.port' to the backend named by the former.
+type DockerDiscovery struct {
+	// Socket is the path of the unix socket the engine
+	// API is served on (e.g., '/var/run/docker.sock').
+	Socket string `yaml:"socket"`
+}
+
+func (d Discovery) enabled() bool {
+	return d.File.Path != "" || d.Docker.Socket != ""
 }
 
 type Config struct {
+	Admin string `yaml:"admin"`
+
+	// MaxConnections bounds the concurrent connections
+	// of all frontends. Zero means no limit.
+	MaxConnections int `yaml:"max_connections"`
+
+	Frontends []Frontend `yaml:"frontends"`
+	Backends  []Backend  `yaml:"backends"`
+	Discovery Discovery  `yaml:"discovery"`
+
+	// StateFile keeps state (e.g., the affinity tables)
+	// across graceful restarts: it's written when
+	// stopping and read when starting.
+	StateFile string `yaml:"state_file"`
+
+	// Capture records the traffic of selected TCP
+	// connections to files.
+	Capture Capture `yaml:"capture"`
+
 	Port    int      `yaml:"port"`
 	Servers []Server `yaml:"servers"`
+
+	AcceptProxyProtocol  bool          `yaml:"accept_proxy_protocol"`
+	ProxyProtocolTimeout time.Duration `yaml:"proxy_protocol_timeout"`
+	ProxyProtocolTrusted []string      `yaml:"proxy_protocol_trusted"`
+}
+
+// LoadConfig reads and parses the YAML configuration
+// file located at 'path'.
+func LoadConfig(path string) (cfg Config, err error) {
+	content, err := ioutil.ReadFile(path)
+	if err != nil {
+		err = errors.Wrapf(err,
+			"couldn't read configuration file %s", path)
+		return
+	}
+
+	err = yaml.UnmarshalStrict(content, &cfg)
+	if err != nil {
+		err = errors.Wrapf(err,
+			"couldn't parse configuration file %s", path)
+		return
+	}
+
+	return
+}
+
+// Normalize turns the single-service form of the
+// configuration (top-level port and servers) into a
+// frontend and a backend named DefaultName.
+func (cfg *Config) Normalize() (err error) {
+	if len(cfg.Servers) == 0 {
+		return
+	}
+
+	if cfg.Port == 0 {
+		err = errors.Errorf("a port != 0 must be specified")
+		return
+	}
+
+	cfg.Frontends = append(cfg.Frontends, Frontend{
+		Name:                 DefaultName,
+		Address:              fmt.Sprintf(":%d", cfg.Port),
+		Backend:              DefaultName,
+		AcceptProxyProtocol:  cfg.AcceptProxyProtocol,
+		ProxyProtocolTimeout: cfg.ProxyProtocolTimeout,
+		ProxyProtocolTrusted: cfg.ProxyProtocolTrusted,
+	})
+
+	cfg.Backends = append(cfg.Backends, Backend{
+		Name:    DefaultName,
+		Servers: cfg.Servers,
+	})
+
+	cfg.Servers = nil
+	return
+}
+
+// validateNetwork verifies that 'network' is one of
+// the TCP networks supported by the net package.
+func validateNetwork(network string) (err error) {
+	switch network {
+	case "tcp", "tcp4", "tcp6":
+	default:
+		err = errors.Errorf("unknown network '%s'", network)
+	}
+
+	return
+}
+
+// packetNetwork retrieves the UDP counterpart of a TCP
+// network (e.g., 'udp6' for 'tcp6').
+func packetNetwork(network string) string {
+	return "udp" + strings.TrimPrefix(network, "tcp")
+}
+
+// validateTopology verifies that names are unique and
+// that every frontend points to an existing backend.
+func validateTopology(frontends []Frontend, backends []Backend) (err error) {
+	var (
+		frontendNames = map[string]bool{}
+		backendNames  = map[string]bool{}
+	)
+
+	if len(frontends) == 0 {
+		err = errors.Errorf("must specify at least one frontend")
+		return
+	}
+
+	for ndx, backend := range backends {
+		if backend.Name == "" {
+			err = errors.Errorf("backend %d must have a name", ndx)
+			return
+		}
+
+		if backendNames[backend.Name] {
+			err = errors.Errorf("duplicate backend %s", backend.Name)
+			return
+		}
+
+		backendNames[backend.Name] = true
+	}
+
+	for ndx, frontend := range frontends {
+		if frontend.Name == "" {
+			err = errors.Errorf("frontend %d must have a name", ndx)
+			return
+		}
+
+		if frontendNames[frontend.Name] {
+			err = errors.Errorf("duplicate frontend %s", frontend.Name)
+			return
+		}
+
+		if frontend.Address == "" {
+			err = errors.Errorf("frontend %s must have an address",
+				frontend.Name)
+			return
+		}
+
+		if !backendNames[frontend.Backend] {
+			err = errors.Errorf("frontend %s points to unknown backend '%s'",
+				frontend.Name, frontend.Backend)
+			return
+		}
+
+		frontendNames[frontend.Name] = true
+	}
+
+	return
 }
@@ -0,0 +1,68 @@
+package lib
+
+import (
+	"sort"
+	"time"
+
+	"github.com/rs/zerolog"
+)
+
+// discoverer keeps a source of servers up to date,
+// either for a single backend or for many at once.
+type discoverer interface {
+	// refresh updates the servers of the source once.
+	refresh()
+
+	// run refreshes the servers periodically until
+	// 'done' gets closed.
+	run(done <-chan struct{})
+}
+
+// refreshEvery refreshes a discoverer at a fixed
+// interval until 'done' gets closed.
+func refreshEvery(d discoverer, interval time.Duration, done <-chan struct{}) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-done:
+			return
+		case <-ticker.C:
+		}
+
+		d.refresh()
+	}
+}
+
+// applyEndpoints updates the servers that 'source'
+// provides to each backend. Backends missing from
+// 'endpoints' are left without servers from it.
+func applyEndpoints(backends map[string]*backend, source string, endpoints map[string][]Server, logger zerolog.Logger) {
+	for name := range endpoints {
+		if _, ok := backends[name]; !ok {
+			logger.Warn().
+				Str("backend", name).
+				Msg("endpoints refer to unknown backend")
+		}
+	}
+
+	var names = make([]string, 0, len(backends))
+	for name := range backends {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		backends[name].updateAndLog(source, endpoints[name])
+	}
+}
+
+// notify signals 'ch' without blocking, coalescing
+// notifications that haven't been consumed yet.
+func notify(ch chan struct{}) {
+	select {
+	case ch <- struct{}{}:
+	default:
+	}
+}
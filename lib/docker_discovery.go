@@ -0,0 +1,290 @@
+package lib
+
+import (
+	"context"
+	"encoding/json"
+	"net"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/rs/zerolog"
+)
+
+// Labels that containers carry to be discovered.
+const (
+	DockerLabelPool    = "l4.pool"
+	DockerLabelPort    = "l4.port"
+	DockerLabelNetwork = "l4.network"
+)
+
+const (
+	dockerDiscoverySource  = "docker"
+	dockerRequestTimeout   = 10 * time.Second
+	dockerMinRetryInterval = 1 * time.Second
+	dockerMaxRetryInterval = 30 * time.Second
+)
+
+// dockerContainer is the subset of the Docker Engine
+// API container representation used for discovery.
+type dockerContainer struct {
+	Id              string            `json:"Id"`
+	Labels          map[string]string `json:"Labels"`
+	NetworkSettings struct {
+		Networks map[string]struct {
+			IPAddress         string `json:"IPAddress"`
+			GlobalIPv6Address string `json:"GlobalIPv6Address"`
+		} `json:"Networks"`
+	} `json:"NetworkSettings"`
+}
+
+// dockerDiscovery feeds backends with the running
+// containers labeled with the name of the backend
+// ('l4.pool') and the port to reach them at
+// ('l4.port'). Containers attached to many networks
+// can pick one with 'l4.network'.
+type dockerDiscovery struct {
+	socket   string
+	backends map[string]*backend
+	client   *http.Client
+	logger   zerolog.Logger
+}
+
+func newDockerDiscovery(cfg DockerDiscovery, backends map[string]*backend, logger zerolog.Logger) *dockerDiscovery {
+	var dialer net.Dialer
+
+	return &dockerDiscovery{
+		socket:   cfg.Socket,
+		backends: backends,
+		client: &http.Client{
+			Transport: &http.Transport{
+				DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+					return dialer.DialContext(ctx, "unix", cfg.Socket)
+				},
+			},
+		},
+		logger: logger.With().
+			Str("discovery", "docker").
+			Str("socket", cfg.Socket).
+			Logger(),
+	}
+}
+
+// refresh lists the labeled containers and applies
+// them to the backends. When the engine can't be
+// reached the servers applied before are kept.
+func (d *dockerDiscovery) refresh() {
+	ctx, cancel := context.WithTimeout(context.Background(), dockerRequestTimeout)
+	defer cancel()
+
+	containers, err := d.list(ctx)
+	if err != nil {
+		d.logger.Error().
+			Err(err).
+			Msg("couldn't list containers")
+		return
+	}
+
+	applyEndpoints(d.backends, dockerDiscoverySource, d.endpoints(containers), d.logger)
+}
+
+// run follows the events stream of the engine,
+// refreshing the servers whenever a container starts
+// or stops. Broken streams are reestablished with an
+// exponential backoff, refreshing the servers again
+// once subscribed as events might have been missed in
+// the meantime.
+func (d *dockerDiscovery) run(done <-chan struct{}) {
+	var retryInterval = dockerMinRetryInterval
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	go func() {
+		<-done
+		cancel()
+	}()
+
+	for {
+		started := time.Now()
+
+		err := d.follow(ctx)
+		if ctx.Err() != nil {
+			return
+		}
+
+		if time.Since(started) > dockerMaxRetryInterval {
+			retryInterval = dockerMinRetryInterval
+		}
+
+		d.logger.Error().
+			Err(err).
+			Dur("retry_in", retryInterval).
+			Msg("lost docker events stream")
+
+		select {
+		case <-done:
+			return
+		case <-time.After(retryInterval):
+		}
+
+		retryInterval *= 2
+		if retryInterval > dockerMaxRetryInterval {
+			retryInterval = dockerMaxRetryInterval
+		}
+	}
+}
+
+// follow subscribes to the events stream, listing the
+// containers only then so that none that change in
+// between goes unnoticed, and consumes it until it
+// breaks or 'ctx' gets canceled.
+func (d *dockerDiscovery) follow(ctx context.Context) (err error) {
+	var filters = `{"type":["container"],"event":["start","die","stop","kill","pause","unpause"]}`
+
+	req, err := http.NewRequest(http.MethodGet,
+		"http://docker/events?filters="+url.QueryEscape(filters), nil)
+	if err != nil {
+		return
+	}
+
+	resp, err := d.client.Do(req.WithContext(ctx))
+	if err != nil {
+		err = errors.Wrapf(err, "couldn't connect to docker engine")
+		return
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		err = errors.Errorf("docker engine responded with status %d",
+			resp.StatusCode)
+		return
+	}
+
+	d.refresh()
+
+	decoder := json.NewDecoder(resp.Body)
+	for {
+		var event struct {
+			Action string `json:"Action"`
+			Actor  struct {
+				Attributes map[string]string `json:"Attributes"`
+			} `json:"Actor"`
+		}
+
+		err = decoder.Decode(&event)
+		if err != nil {
+			err = errors.Wrapf(err, "couldn't read docker event")
+			return
+		}
+
+		if _, ok := event.Actor.Attributes[DockerLabelPool]; !ok {
+			continue
+		}
+
+		d.logger.Debug().
+			Str("action", event.Action).
+			Msg("container changed")
+		d.refresh()
+	}
+}
+
+func (d *dockerDiscovery) list(ctx context.Context) (containers []dockerContainer, err error) {
+	var filters = `{"label":["` + DockerLabelPool + `"],"status":["running"]}`
+
+	req, err := http.NewRequest(http.MethodGet,
+		"http://docker/containers/json?filters="+url.QueryEscape(filters), nil)
+	if err != nil {
+		return
+	}
+
+	resp, err := d.client.Do(req.WithContext(ctx))
+	if err != nil {
+		err = errors.Wrapf(err, "couldn't connect to docker engine")
+		return
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		err = errors.Errorf("docker engine responded with status %d",
+			resp.StatusCode)
+		return
+	}
+
+	err = json.NewDecoder(resp.Body).Decode(&containers)
+	if err != nil {
+		err = errors.Wrapf(err, "couldn't decode containers")
+		return
+	}
+
+	return
+}
+
+// endpoints groups the containers by backend, turning
+// each into a server. Containers without a valid port
+// or an address are skipped.
+func (d *dockerDiscovery) endpoints(containers []dockerContainer) (endpoints map[string][]Server) {
+	endpoints = map[string][]Server{}
+
+	for _, container := range containers {
+		pool := container.Labels[DockerLabelPool]
+		port, err := strconv.ParseUint(container.Labels[DockerLabelPort], 10, 16)
+		if pool == "" || err != nil || port == 0 {
+			d.logger.Warn().
+				Str("container", container.Id).
+				Msg("container must be labeled with a pool and a valid port")
+			continue
+		}
+
+		ip := container.ip(container.Labels[DockerLabelNetwork])
+		if ip == "" {
+			d.logger.Warn().
+				Str("container", container.Id).
+				Msg("couldn't find container address")
+			continue
+		}
+
+		endpoints[pool] = append(endpoints[pool], Server{
+			Address: net.JoinHostPort(ip, strconv.Itoa(int(port))),
+		})
+	}
+
+	for _, servers := range endpoints {
+		sort.Slice(servers, func(i, j int) bool {
+			return servers[i].Address < servers[j].Address
+		})
+	}
+
+	return
+}
+
+// ip retrieves the address of the container in the
+// network named 'network' or, if empty, in the first
+// network (by name) it has an address in.
+func (c dockerContainer) ip(network string) string {
+	var names = make([]string, 0, len(c.NetworkSettings.Networks))
+	for name := range c.NetworkSettings.Networks {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		if network != "" && name != network {
+			continue
+		}
+
+		settings := c.NetworkSettings.Networks[name]
+		if settings.IPAddress != "" {
+			return settings.IPAddress
+		}
+
+		if settings.GlobalIPv6Address != "" {
+			return settings.GlobalIPv6Address
+		}
+	}
+
+	return ""
+}
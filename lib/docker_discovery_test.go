@@ -0,0 +1,218 @@
+package lib
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/rs/zerolog"
+	"github.com/stretchr/testify/assert"
+)
+
+// fakeDockerEngine stands in for the Docker Engine
+// API, serving a mutable list of containers and an
+// events stream on a unix socket.
+type fakeDockerEngine struct {
+	mu         sync.Mutex
+	containers string
+	events     chan string
+	socket     string
+
+	// requests holds the paths requested, in order.
+	requests []string
+}
+
+func startFakeDockerEngine(t *testing.T) *fakeDockerEngine {
+	engine := &fakeDockerEngine{
+		containers: `[]`,
+		events:     make(chan string),
+		socket:     filepath.Join(t.TempDir(), "docker.sock"),
+	}
+
+	ln, err := net.Listen("unix", engine.socket)
+	assert.NoError(t, err)
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/containers/json", func(w http.ResponseWriter, r *http.Request) {
+		engine.mu.Lock()
+		defer engine.mu.Unlock()
+
+		engine.requests = append(engine.requests, r.URL.Path)
+		fmt.Fprint(w, engine.containers)
+	})
+	mux.HandleFunc("/events", func(w http.ResponseWriter, r *http.Request) {
+		engine.mu.Lock()
+		engine.requests = append(engine.requests, r.URL.Path)
+		engine.mu.Unlock()
+
+		w.WriteHeader(http.StatusOK)
+		w.(http.Flusher).Flush()
+
+		for {
+			select {
+			case <-r.Context().Done():
+				return
+			case event := <-engine.events:
+				fmt.Fprintln(w, event)
+				w.(http.Flusher).Flush()
+			}
+		}
+	})
+
+	server := &http.Server{Handler: mux}
+	go server.Serve(ln)
+	t.Cleanup(func() { server.Close() })
+
+	return engine
+}
+
+func (e *fakeDockerEngine) setContainers(containers string) {
+	e.mu.Lock()
+	e.containers = containers
+	e.mu.Unlock()
+}
+
+func (e *fakeDockerEngine) requested() []string {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	return append([]string{}, e.requests...)
+}
+
+func dockerContainerJson(id, pool, port, network, ip string) string {
+	return fmt.Sprintf(`{
+		"Id": "%s",
+		"Labels": {"l4.pool": "%s", "l4.port": "%s"},
+		"NetworkSettings": {"Networks": {"%s": {"IPAddress": "%s"}}}
+	}`, id, pool, port, network, ip)
+}
+
+func newDockerDiscoveryTest(t *testing.T, socket string) (*dockerDiscovery, *backend) {
+	b, err := newBackend(Backend{Name: "web"}, nil, zerolog.Nop())
+	assert.NoError(t, err)
+
+	return newDockerDiscovery(DockerDiscovery{Socket: socket},
+		map[string]*backend{"web": b}, zerolog.Nop()), b
+}
+
+func TestDockerDiscoveryRefresh(t *testing.T) {
+	var testCases = []struct {
+		description string
+		containers  string
+		expected    []string
+	}{
+		{
+			description: "labeled containers",
+			containers: "[" +
+				dockerContainerJson("b", "web", "80", "bridge", "172.17.0.3") + "," +
+				dockerContainerJson("a", "web", "8080", "bridge", "172.17.0.2") + "]",
+			expected: []string{"172.17.0.2:8080", "172.17.0.3:80"},
+		},
+		{
+			description: "other pools",
+			containers: "[" +
+				dockerContainerJson("a", "db", "5432", "bridge", "172.17.0.2") + "]",
+			expected: nil,
+		},
+		{
+			description: "invalid port",
+			containers: "[" +
+				dockerContainerJson("a", "web", "http", "bridge", "172.17.0.2") + "]",
+			expected: nil,
+		},
+		{
+			description: "without address",
+			containers: "[" +
+				dockerContainerJson("a", "web", "80", "host", "") + "]",
+			expected: nil,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.description, func(t *testing.T) {
+			engine := startFakeDockerEngine(t)
+			engine.setContainers(tc.containers)
+
+			d, b := newDockerDiscoveryTest(t, engine.socket)
+			d.refresh()
+
+			assert.Equal(t, tc.expected, serverAddresses(b))
+		})
+	}
+}
+
+func TestDockerContainerIp(t *testing.T) {
+	var container dockerContainer
+	container.NetworkSettings.Networks = map[string]struct {
+		IPAddress         string `json:"IPAddress"`
+		GlobalIPv6Address string `json:"GlobalIPv6Address"`
+	}{
+		"backend":  {IPAddress: "10.0.1.2"},
+		"frontend": {IPAddress: "10.0.0.2"},
+		"v6":       {GlobalIPv6Address: "2001:db8::2"},
+	}
+
+	assert.Equal(t, "10.0.1.2", container.ip(""))
+	assert.Equal(t, "10.0.0.2", container.ip("frontend"))
+	assert.Equal(t, "2001:db8::2", container.ip("v6"))
+	assert.Equal(t, "", container.ip("unknown"))
+}
+
+func TestDockerDiscoveryFollowsEvents(t *testing.T) {
+	var done = make(chan struct{})
+	defer close(done)
+
+	engine := startFakeDockerEngine(t)
+	engine.setContainers("[" +
+		dockerContainerJson("a", "web", "80", "bridge", "172.17.0.2") + "]")
+
+	d, b := newDockerDiscoveryTest(t, engine.socket)
+	d.refresh()
+	go d.run(done)
+
+	assert.Equal(t, []string{"172.17.0.2:80"}, serverAddresses(b))
+
+	engine.setContainers("[" +
+		dockerContainerJson("a", "web", "80", "bridge", "172.17.0.2") + "," +
+		dockerContainerJson("b", "web", "80", "bridge", "172.17.0.3") + "]")
+
+	select {
+	case engine.events <- `{"Type": "container", "Action": "start", "Actor": {"Attributes": {"l4.pool": "web"}}}`:
+	case <-time.After(2 * time.Second):
+		t.Fatal("events stream not followed")
+	}
+
+	assert.True(t, waitFor(2*time.Second, func() bool {
+		return len(serverAddresses(b)) == 2
+	}))
+}
+
+func TestDockerDiscoveryListsOnceSubscribed(t *testing.T) {
+	var done = make(chan struct{})
+	defer close(done)
+
+	engine := startFakeDockerEngine(t)
+	engine.setContainers("[" +
+		dockerContainerJson("a", "web", "80", "bridge", "172.17.0.2") + "]")
+
+	d, b := newDockerDiscoveryTest(t, engine.socket)
+	d.refresh()
+
+	// started before subscribing, without any event
+	// telling about it.
+	engine.setContainers("[" +
+		dockerContainerJson("a", "web", "80", "bridge", "172.17.0.2") + "," +
+		dockerContainerJson("b", "web", "80", "bridge", "172.17.0.3") + "]")
+
+	go d.run(done)
+
+	assert.True(t, waitFor(2*time.Second, func() bool {
+		return len(serverAddresses(b)) == 2
+	}))
+	assert.Equal(t, []string{"/containers/json", "/events", "/containers/json"},
+		engine.requested())
+}
@@ -0,0 +1,230 @@
+package lib
+
+import (
+	"sync/atomic"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+var errUnknownServer = errors.New("unknown server")
+
+// DrainStatus tells whether a server is draining: it
+// gets no new connections while the established ones go
+// on. It's drained once none of them are left, at which
+// point it can be taken down.
+type DrainStatus struct {
+	Address           string `json:"address"`
+	Draining          bool   `json:"draining"`
+	Drained           bool   `json:"drained"`
+	ActiveConnections int    `json:"active_connections"`
+}
+
+// identity retrieves the configuration that tells
+// servers apart across updates: changing whether a
+// server drains keeps it (and its connections), as does
+// setting the default weight explicitly.
+func (cfg Server) identity() Server {
+	if cfg.Weight == 0 {
+		cfg.Weight = 1
+	}
+
+	cfg.Drain = false
+	return cfg
+}
+
+func (s *server) isDraining() bool {
+	return atomic.LoadUint32(&s.draining) != 0
+}
+
+func (s *server) isDrained() bool {
+	return atomic.LoadUint32(&s.drained) != 0
+}
+
+// closeConnections closes the established connections
+// of the server, retrieving how many there were.
+func (s *server) closeConnections() int {
+	s.mu.Lock()
+	var conns = make([]connection, 0, len(s.activeProxies))
+	for conn := range s.activeProxies {
+		conns = append(conns, conn)
+	}
+	s.mu.Unlock()
+
+	for _, conn := range conns {
+		conn.Close()
+	}
+
+	return len(conns)
+}
+
+// drain stops sending new connections to a server. If
+// 'timeout' is set, the connections still established
+// after it get closed. It must be called with the
+// backend locked.
+func (b *backend) drain(s *server, timeout time.Duration) {
+	if s.isDraining() {
+		return
+	}
+
+	atomic.StoreUint32(&s.draining, 1)
+	b.logger.Info().
+		Str("server", s.address).
+		Dur("timeout", timeout).
+		Msg("server draining")
+
+	if timeout > 0 {
+		s.drainTimer = time.AfterFunc(timeout, func() {
+			b.mu.Lock()
+			draining := s.isDraining() && !s.isDrained()
+			b.mu.Unlock()
+
+			if !draining {
+				return
+			}
+
+			b.logger.Info().
+				Str("server", s.address).
+				Int("connections", s.closeConnections()).
+				Msg("closing connections of draining server")
+		})
+	}
+
+	b.checkDrained(s)
+}
+
+// undrain lets a server get new connections again. It
+// must be called with the backend locked.
+func (b *backend) undrain(s *server) {
+	if !s.isDraining() {
+		return
+	}
+
+	if s.drainTimer != nil {
+		s.drainTimer.Stop()
+		s.drainTimer = nil
+	}
+
+	atomic.StoreUint32(&s.draining, 0)
+	atomic.StoreUint32(&s.drained, 0)
+	b.logger.Info().
+		Str("server", s.address).
+		Msg("server undrained")
+
+	b.dispatch()
+}
+
+// checkDrained marks a draining server as drained once
+// it holds no connections, logging it. It must be
+// called with the backend locked.
+func (b *backend) checkDrained(s *server) {
+	if !s.isDraining() || s.isDrained() || s.slots != 0 {
+		return
+	}
+
+	atomic.StoreUint32(&s.drained, 1)
+	b.logger.Info().
+		Str("server", s.address).
+		Msg("server drained")
+}
+
+// drainStatus retrieves the status of the servers of
+// the backend, or of the one at 'address' if set.
+func (b *backend) drainStatus(address string) (statuses []DrainStatus, err error) {
+	b.mu.Lock()
+	var servers = b.lookupServers(address)
+	b.mu.Unlock()
+
+	if len(servers) == 0 && address != "" {
+		err = errors.Wrapf(errUnknownServer, "backend %s has no server %s",
+			b.name, address)
+		return
+	}
+
+	for _, s := range servers {
+		statuses = append(statuses, DrainStatus{
+			Address:           s.address,
+			Draining:          s.isDraining(),
+			Drained:           s.isDrained(),
+			ActiveConnections: s.activeConnections(),
+		})
+	}
+
+	return
+}
+
+// setDraining drains (or undrains) the servers of the
+// backend, or the one at 'address' if set. A zero
+// timeout defaults to the one of the backend.
+func (b *backend) setDraining(address string, draining bool, timeout time.Duration) (err error) {
+	if timeout == 0 {
+		timeout = b.drainTimeout
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	var servers = b.lookupServers(address)
+	if len(servers) == 0 && address != "" {
+		err = errors.Wrapf(errUnknownServer, "backend %s has no server %s",
+			b.name, address)
+		return
+	}
+
+	for _, s := range servers {
+		if draining {
+			b.drain(s, timeout)
+		} else {
+			b.undrain(s)
+		}
+	}
+
+	return
+}
+
+// lookupServers retrieves every server or the ones at
+// 'address' if set. It must be called with the backend
+// locked.
+func (b *backend) lookupServers(address string) (servers []*server) {
+	for _, s := range b.servers {
+		if address == "" || s.address == address {
+			servers = append(servers, s)
+		}
+	}
+
+	return
+}
+
+// DrainStatus retrieves whether the servers of a
+// backend (or the one at 'address' if set) are draining
+// and whether they're done.
+func (lb *LoadBalancer) DrainStatus(name, address string) (statuses []DrainStatus, err error) {
+	b := lb.backend(name)
+	if b == nil {
+		err = errors.Errorf("unknown backend %s", name)
+		return
+	}
+
+	statuses, err = b.drainStatus(address)
+	return
+}
+
+// SetDraining drains (or undrains) the servers of a
+// backend, or the one at 'address' if set. Connections
+// still established after 'timeout' get closed, with
+// zero defaulting to the drain timeout of the backend.
+func (lb *LoadBalancer) SetDraining(name, address string, draining bool, timeout time.Duration) (err error) {
+	b := lb.backend(name)
+	if b == nil {
+		err = errors.Errorf("unknown backend %s", name)
+		return
+	}
+
+	if timeout < 0 {
+		err = errors.Errorf("timeout must not be negative")
+		return
+	}
+
+	err = b.setDraining(address, draining, timeout)
+	return
+}
@@ -0,0 +1,133 @@
+package lib
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/rs/zerolog"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestBackendDrainsServers(t *testing.T) {
+	b, err := newBackend(Backend{
+		Name:    "app",
+		Servers: []Server{{Address: "a:80"}, {Address: "b:80"}},
+	}, nil, zerolog.Nop())
+	assert.NoError(t, err)
+
+	s := b.tryAcquire(nil)
+	assert.Equal(t, "a:80", s.address)
+
+	assert.NoError(t, b.setDraining("a:80", true, 0))
+	assert.Error(t, b.setDraining("c:80", true, 0))
+
+	statuses, err := b.drainStatus("a:80")
+	assert.NoError(t, err)
+	assert.Equal(t, []DrainStatus{{Address: "a:80", Draining: true}}, statuses)
+
+	for i := 0; i < 4; i++ {
+		assert.Equal(t, "b:80", pickAddress(b, nil))
+	}
+
+	b.release(s)
+
+	statuses, err = b.drainStatus("")
+	assert.NoError(t, err)
+	assert.Equal(t, []DrainStatus{
+		{Address: "a:80", Draining: true, Drained: true},
+		{Address: "b:80"},
+	}, statuses)
+
+	assert.NoError(t, b.setDraining("", false, 0))
+
+	var picked = map[string]bool{}
+	for i := 0; i < 4; i++ {
+		picked[pickAddress(b, nil)] = true
+	}
+
+	assert.Equal(t, map[string]bool{"a:80": true, "b:80": true}, picked)
+}
+
+func TestBackendDrainsServersByConfig(t *testing.T) {
+	b, err := newBackend(Backend{
+		Name:    "app",
+		Servers: []Server{{Address: "a:80"}, {Address: "b:80", Drain: true}},
+	}, nil, zerolog.Nop())
+	assert.NoError(t, err)
+
+	assert.True(t, b.servers[1].isDrained())
+
+	var s = b.servers[0]
+
+	_, removed, err := b.update(staticSource, []Server{{Address: "a:80", Drain: true}, {Address: "b:80"}})
+	assert.NoError(t, err)
+	assert.Empty(t, removed)
+
+	// the servers are kept, changing whether they drain.
+	assert.True(t, s == b.servers[0])
+	assert.True(t, s.isDraining())
+	assert.False(t, b.servers[1].isDraining())
+	assert.Equal(t, "b:80", pickAddress(b, nil))
+}
+
+func TestLoadBalancerDrainsServers(t *testing.T) {
+	lb, addresses := startLimitedLoadBalancer(t, LoadBalancerConfig{}, Frontend{Name: "a"})
+
+	established, served := dialEcho(t, addresses[0])
+	defer established.Close()
+	assert.True(t, served)
+
+	drain := func(method, path, body string) (int, []DrainStatus) {
+		var (
+			recorder = httptest.NewRecorder()
+			request  = httptest.NewRequest(method, path, strings.NewReader(body))
+			statuses []DrainStatus
+		)
+
+		lb.adminHandler().ServeHTTP(recorder, request)
+		json.NewDecoder(recorder.Body).Decode(&statuses)
+		return recorder.Code, statuses
+	}
+
+	code, _ := drain(http.MethodPut, "/drain/backends/echo?server=unknown:80", `{"draining": true}`)
+	assert.Equal(t, http.StatusNotFound, code)
+
+	code, _ = drain(http.MethodPut, "/drain/backends/echo", `{"draining": true, "timeout": "bad"}`)
+	assert.Equal(t, http.StatusBadRequest, code)
+
+	code, statuses := drain(http.MethodPut, "/drain/backends/echo", `{"draining": true, "timeout": "500ms"}`)
+	assert.Equal(t, http.StatusOK, code)
+	if assert.Len(t, statuses, 1) {
+		assert.True(t, statuses[0].Draining)
+		assert.False(t, statuses[0].Drained)
+		assert.Equal(t, 1, statuses[0].ActiveConnections)
+	}
+
+	// new connections don't get served while the
+	// established one goes on.
+	conn, served := dialEcho(t, addresses[0])
+	conn.Close()
+	assert.False(t, served)
+
+	_, err := established.Write([]byte("ping"))
+	assert.NoError(t, err)
+	_, err = io.ReadFull(established, make([]byte, 4))
+	assert.NoError(t, err)
+
+	// until the timeout closes it.
+	established.SetReadDeadline(time.Now().Add(2 * time.Second))
+	_, err = established.Read(make([]byte, 1))
+	assert.Equal(t, io.EOF, err)
+
+	assert.True(t, waitFor(time.Second, func() bool {
+		_, statuses := drain(http.MethodGet, "/drain/backends/echo", "")
+		return len(statuses) == 1 && statuses[0].Drained
+	}))
+
+	assert.True(t, lb.Stats().Backends[0].Servers[0].Drained)
+}
@@ -6,6 +6,7 @@ import (
 	"io"
 	"net"
 	"strings"
+	"sync"
 	"testing"
 	"time"
 
@@ -18,6 +19,7 @@ import (
 // that was initiated.
 type DumbTcpServer struct {
 	w    io.Writer
+	mu   sync.Mutex
 	ln   net.Listener
 	port int
 }
@@ -32,19 +34,21 @@ func NewDumbTcpServer(w io.Writer) DumbTcpServer {
 
 func (s *DumbTcpServer) Listen() (err error) {
 	ln, err := net.Listen("tcp4", ":0")
-	defer ln.Close()
 	if err != nil {
 		return
 	}
+	defer ln.Close()
 
+	s.mu.Lock()
 	s.ln = ln
 	s.port = ln.Addr().(*net.TCPAddr).Port
+	s.mu.Unlock()
 
 	for {
 		conn, err := ln.Accept()
 		if err != nil {
 			if strings.Contains(err.Error(), "use of closed network connection") {
-				continue
+				return nil
 			}
 			fmt.Printf("listen errored: %+v\n", err)
 			continue
@@ -54,10 +58,16 @@ func (s *DumbTcpServer) Listen() (err error) {
 }
 
 func (s *DumbTcpServer) GetPort() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
 	return s.port
 }
 
 func (s *DumbTcpServer) Close() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
 	if s.ln != nil {
 		s.ln.Close()
 	}
@@ -0,0 +1,246 @@
+package lib
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/rs/zerolog"
+	"gopkg.in/yaml.v2"
+)
+
+const (
+	defaultFilePollInterval = 5 * time.Second
+	defaultFileDebounce     = 200 * time.Millisecond
+	defaultFileSettle       = 1 * time.Second
+)
+
+// fileDiscovery feeds backends with the servers listed
+// in a file, applying the changes as the file gets
+// rewritten.
+type fileDiscovery struct {
+	path         string
+	source       string
+	backends     map[string]*backend
+	pollInterval time.Duration
+	debounce     time.Duration
+	settle       time.Duration
+	logger       zerolog.Logger
+
+	// applied is the content last applied, letting
+	// writes that don't change anything be ignored.
+	// appliedFile tells whether later contents come
+	// from rewriting the same file in place, in which
+	// case they're pending until they settle.
+	applied      []byte
+	appliedFile  os.FileInfo
+	pending      []byte
+	pendingSince time.Time
+}
+
+func newFileDiscovery(cfg FileDiscovery, backends map[string]*backend, logger zerolog.Logger) *fileDiscovery {
+	if cfg.PollInterval == 0 {
+		cfg.PollInterval = defaultFilePollInterval
+	}
+
+	if cfg.Debounce == 0 {
+		cfg.Debounce = defaultFileDebounce
+	}
+
+	if cfg.Settle == 0 {
+		cfg.Settle = defaultFileSettle
+	}
+
+	return &fileDiscovery{
+		path:         cfg.Path,
+		source:       "file:" + cfg.Path,
+		backends:     backends,
+		pollInterval: cfg.PollInterval,
+		debounce:     cfg.Debounce,
+		settle:       cfg.Settle,
+		logger: logger.With().
+			Str("discovery", "file").
+			Str("path", cfg.Path).
+			Logger(),
+	}
+}
+
+// refresh reads the file and applies it to the
+// backends. Files that can't be read or parsed are
+// ignored, keeping the servers that were applied
+// before.
+func (d *fileDiscovery) refresh() {
+	d.update(time.Now())
+}
+
+// update reads the file, applying it unless it must
+// settle first: files replaced through a rename are
+// applied right away, while those rewritten in place
+// could still be truncated (yet parse) and are only
+// applied once their content stays the same for the
+// settle period. It retrieves how long to wait before
+// reading the file again for it to settle, if needed.
+func (d *fileDiscovery) update(now time.Time) (settleIn time.Duration) {
+	content, file, endpoints, err := d.read()
+	if err != nil {
+		d.logger.Error().
+			Err(err).
+			Msg("ignoring endpoints file")
+		return
+	}
+
+	if content == nil || bytes.Equal(content, d.applied) {
+		d.pending = nil
+		return
+	}
+
+	if d.appliedFile != nil && os.SameFile(file, d.appliedFile) {
+		if !bytes.Equal(content, d.pending) {
+			d.pending = content
+			d.pendingSince = now
+		}
+
+		if wait := d.settle - now.Sub(d.pendingSince); wait > 0 {
+			d.logger.Debug().Msg("endpoints file is settling")
+			settleIn = wait
+			return
+		}
+	}
+
+	applyEndpoints(d.backends, d.source, endpoints, d.logger)
+	d.applied = content
+	d.appliedFile = file
+	d.pending = nil
+	return
+}
+
+// read parses the file, making sure that it didn't
+// change while being read. A nil content means that
+// the file is still being written and should be read
+// later.
+func (d *fileDiscovery) read() (content []byte, file os.FileInfo, endpoints map[string][]Server, err error) {
+	before, err := os.Stat(d.path)
+	if err != nil {
+		return
+	}
+
+	data, err := ioutil.ReadFile(d.path)
+	if err != nil {
+		return
+	}
+
+	after, err := os.Stat(d.path)
+	if err != nil {
+		return
+	}
+
+	if len(data) == 0 || !sameFileState(before, after) ||
+		int64(len(data)) != after.Size() {
+		d.logger.Debug().Msg("endpoints file is being written")
+		return
+	}
+
+	// JSON being a subset of YAML, both get parsed
+	// by the YAML decoder.
+	err = yaml.UnmarshalStrict(data, &endpoints)
+	if err != nil {
+		err = errors.Wrapf(err, "malformed endpoints file")
+		return
+	}
+
+	for name, servers := range endpoints {
+		for _, cfg := range servers {
+			_, err = newServer(cfg)
+			if err != nil {
+				err = errors.Wrapf(err,
+					"invalid endpoints for backend %s", name)
+				return
+			}
+		}
+	}
+
+	content = data
+	file = after
+	return
+}
+
+// run waits for changes to the file, reading it once
+// writes settle down.
+func (d *fileDiscovery) run(done <-chan struct{}) {
+	followFile(d.path, d.pollInterval, d.debounce, done, d.logger, func() time.Duration {
+		return d.update(time.Now())
+	})
+}
+
+// followFile calls 'refresh' whenever a file changes,
+// once writes settle down for 'debounce', and again
+// after the delay that 'refresh' retrieves, if any.
+// Changes are noticed through inotify when available
+// and by polling every 'pollInterval' otherwise.
+func followFile(path string, pollInterval, debounce time.Duration, done <-chan struct{}, logger zerolog.Logger, refresh func() time.Duration) {
+	var settled <-chan time.Time
+
+	events, err := watchFile(path, done)
+	if err != nil {
+		logger.Warn().
+			Err(err).
+			Dur("interval", pollInterval).
+			Msg("couldn't watch file, polling instead")
+		events = pollFile(path, pollInterval, done)
+	}
+
+	for {
+		select {
+		case <-done:
+			return
+		case <-events:
+			settled = time.After(debounce)
+		case <-settled:
+			settled = nil
+			if retryIn := refresh(); retryIn > 0 {
+				settled = time.After(retryIn)
+			}
+		}
+	}
+}
+
+// pollFile notifies about changes to the size or
+// modification time of a file by checking it every
+// 'interval'.
+func pollFile(path string, interval time.Duration, done <-chan struct{}) <-chan struct{} {
+	var ch = make(chan struct{}, 1)
+
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+
+		last, _ := os.Stat(path)
+
+		for {
+			select {
+			case <-done:
+				return
+			case <-ticker.C:
+			}
+
+			current, _ := os.Stat(path)
+			if !sameFileState(last, current) {
+				notify(ch)
+			}
+
+			last = current
+		}
+	}()
+
+	return ch
+}
+
+func sameFileState(a, b os.FileInfo) bool {
+	if a == nil || b == nil {
+		return a == nil && b == nil
+	}
+
+	return a.Size() == b.Size() && a.ModTime().Equal(b.ModTime())
+}
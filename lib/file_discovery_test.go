@@ -0,0 +1,255 @@
+package lib
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/rs/zerolog"
+	"github.com/stretchr/testify/assert"
+)
+
+// waitFor polls 'condition' until it holds or the
+// timeout expires, retrieving whether it held.
+func waitFor(timeout time.Duration, condition func() bool) bool {
+	deadline := time.Now().Add(timeout)
+
+	for time.Now().Before(deadline) {
+		if condition() {
+			return true
+		}
+
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	return condition()
+}
+
+// writeAtomically replaces the content of a file by
+// renaming a temporary one over it.
+func writeAtomically(t *testing.T, path, content string) {
+	tmp := path + ".tmp"
+	assert.NoError(t, ioutil.WriteFile(tmp, []byte(content), 0644))
+	assert.NoError(t, os.Rename(tmp, path))
+}
+
+func newFileDiscoveryTest(t *testing.T, cfg FileDiscovery) (*fileDiscovery, *backend) {
+	b, err := newBackend(Backend{
+		Name:    "web",
+		Servers: []Server{{Address: "10.1.1.1:80"}},
+	}, nil, zerolog.Nop())
+	assert.NoError(t, err)
+
+	return newFileDiscovery(cfg, map[string]*backend{"web": b}, zerolog.Nop()), b
+}
+
+func TestFileDiscoveryRefresh(t *testing.T) {
+	var testCases = []struct {
+		description string
+		content     string
+		expected    []string
+	}{
+		{
+			description: "json",
+			content:     `{"web": [{"address": "10.0.0.1:80"}, {"address": "10.0.0.2:80", "weight": 2}]}`,
+			expected:    []string{"10.1.1.1:80", "10.0.0.1:80", "10.0.0.2:80"},
+		},
+		{
+			description: "yaml",
+			content:     "web:\n  - address: '10.0.0.3:80'\n",
+			expected:    []string{"10.1.1.1:80", "10.0.0.3:80"},
+		},
+		{
+			description: "unknown backends are ignored",
+			content:     `{"web": [{"address": "10.0.0.1:80"}], "db": [{"address": "10.0.0.9:5432"}]}`,
+			expected:    []string{"10.1.1.1:80", "10.0.0.1:80"},
+		},
+		{
+			description: "missing backends lose their servers",
+			content:     `{}`,
+			expected:    []string{"10.1.1.1:80"},
+		},
+		{
+			description: "partially written files are ignored",
+			content:     `{"web": [{"address": "10.0.0.1:80"}`,
+			expected:    []string{"10.1.1.1:80", "10.0.0.5:80"},
+		},
+		{
+			description: "empty files are ignored",
+			content:     ``,
+			expected:    []string{"10.1.1.1:80", "10.0.0.5:80"},
+		},
+		{
+			description: "invalid servers are ignored",
+			content:     `{"web": [{"address": "10.0.0.1:80", "weight": -1}]}`,
+			expected:    []string{"10.1.1.1:80", "10.0.0.5:80"},
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.description, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "endpoints.json")
+			d, b := newFileDiscoveryTest(t, FileDiscovery{Path: path})
+
+			writeAtomically(t, path, `{"web": [{"address": "10.0.0.5:80"}]}`)
+			d.refresh()
+
+			writeAtomically(t, path, tc.content)
+			d.refresh()
+
+			assert.Equal(t, tc.expected, serverAddresses(b))
+		})
+	}
+}
+
+func TestFileDiscoveryFollowsChanges(t *testing.T) {
+	var testCases = []struct {
+		description string
+		linuxOnly   bool
+		watch       func(path string, interval time.Duration, done <-chan struct{}) <-chan struct{}
+	}{
+		{
+			description: "inotify",
+			linuxOnly:   true,
+			watch: func(path string, interval time.Duration, done <-chan struct{}) <-chan struct{} {
+				events, err := watchFile(path, done)
+				assert.NoError(t, err)
+				return events
+			},
+		},
+		{
+			description: "polling",
+			watch:       pollFile,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.description, func(t *testing.T) {
+			if tc.linuxOnly && runtime.GOOS != "linux" {
+				t.Skip("only supported on linux")
+			}
+
+			var (
+				path = filepath.Join(t.TempDir(), "endpoints.yml")
+				done = make(chan struct{})
+			)
+			defer close(done)
+
+			writeAtomically(t, path, "web: []\n")
+
+			events := tc.watch(path, 20*time.Millisecond, done)
+
+			for _, content := range []string{
+				"web: [ { address: '10.0.0.1:80' } ]\n",
+				"web: [ { address: '10.0.0.2:80' }, { address: '10.0.0.3:80' } ]\n",
+			} {
+				time.Sleep(50 * time.Millisecond)
+				writeAtomically(t, path, content)
+
+				select {
+				case <-events:
+				case <-time.After(2 * time.Second):
+					t.Fatalf("change to %s not noticed",
+						strings.TrimSpace(content))
+				}
+			}
+		})
+	}
+}
+
+func TestFileDiscoveryRun(t *testing.T) {
+	var (
+		path = filepath.Join(t.TempDir(), "endpoints.json")
+		done = make(chan struct{})
+	)
+	defer close(done)
+
+	d, b := newFileDiscoveryTest(t, FileDiscovery{
+		Path:     path,
+		Debounce: 20 * time.Millisecond,
+	})
+
+	writeAtomically(t, path, `{"web": [{"address": "10.0.0.1:80"}]}`)
+	d.refresh()
+	go d.run(done)
+
+	time.Sleep(50 * time.Millisecond)
+	writeAtomically(t, path, `{"web": [{"address": "10.0.0.2:80"}]}`)
+
+	assert.True(t, waitFor(2*time.Second, func() bool {
+		addresses := serverAddresses(b)
+		return len(addresses) == 2 && addresses[1] == "10.0.0.2:80"
+	}))
+}
+
+func TestFileDiscoveryIgnoresTruncatedRewrites(t *testing.T) {
+	var (
+		path    = filepath.Join(t.TempDir(), "endpoints.yml")
+		content = "web:\n  - address: '10.0.0.1:80'\n  - address: '10.0.0.2:80'\n"
+		prefix  = "web:\n  - address: '10.0.0.1:80'\n"
+		now     = time.Now()
+	)
+
+	d, b := newFileDiscoveryTest(t, FileDiscovery{
+		Path:   path,
+		Settle: time.Second,
+	})
+
+	writeAtomically(t, path, "web:\n  - address: '10.0.0.5:80'\n")
+	assert.Equal(t, time.Duration(0), d.update(now))
+	assert.Equal(t, []string{"10.1.1.1:80", "10.0.0.5:80"}, serverAddresses(b))
+
+	// the file gets truncated and rewritten in place,
+	// with the writer pausing at a line boundary.
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_TRUNC, 0644)
+	assert.NoError(t, err)
+	defer file.Close()
+
+	_, err = file.WriteString(prefix)
+	assert.NoError(t, err)
+
+	assert.Equal(t, time.Second, d.update(now))
+	assert.Equal(t, 500*time.Millisecond, d.update(now.Add(500*time.Millisecond)))
+	assert.Equal(t, []string{"10.1.1.1:80", "10.0.0.5:80"}, serverAddresses(b))
+
+	// the content changed, so it must settle again.
+	_, err = file.WriteString(content[len(prefix):])
+	assert.NoError(t, err)
+
+	assert.Equal(t, time.Second, d.update(now.Add(900*time.Millisecond)))
+	assert.Equal(t, []string{"10.1.1.1:80", "10.0.0.5:80"}, serverAddresses(b))
+
+	assert.Equal(t, time.Duration(0), d.update(now.Add(2*time.Second)))
+	assert.Equal(t, []string{"10.1.1.1:80", "10.0.0.1:80", "10.0.0.2:80"},
+		serverAddresses(b))
+}
+
+func TestFileDiscoveryRunSettlesRewrites(t *testing.T) {
+	var (
+		path = filepath.Join(t.TempDir(), "endpoints.json")
+		done = make(chan struct{})
+	)
+	defer close(done)
+
+	d, b := newFileDiscoveryTest(t, FileDiscovery{
+		Path:     path,
+		Debounce: 20 * time.Millisecond,
+		Settle:   100 * time.Millisecond,
+	})
+
+	writeAtomically(t, path, `{"web": [{"address": "10.0.0.1:80"}]}`)
+	d.refresh()
+	go d.run(done)
+
+	time.Sleep(50 * time.Millisecond)
+	assert.NoError(t, ioutil.WriteFile(path, []byte(`{"web": [{"address": "10.0.0.2:80"}]}`), 0644))
+
+	assert.True(t, waitFor(2*time.Second, func() bool {
+		addresses := serverAddresses(b)
+		return len(addresses) == 2 && addresses[1] == "10.0.0.2:80"
+	}))
+}
@@ -0,0 +1,755 @@
+package lib
+
+import (
+	"context"
+	"io"
+	"net"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/rs/xid"
+	"github.com/rs/zerolog"
+)
+
+// Protocols that frontends can serve.
+const (
+	ProtocolTcp = "tcp"
+	ProtocolUdp = "udp"
+)
+
+const (
+	sniPeekTimeout = 200 * time.Millisecond
+)
+
+// frontend accepts connections on an address and
+// proxies them to the servers of its backend.
+type frontend struct {
+	name        string
+	address     string
+	protocol    string
+	network     string
+	iface       string
+	socket      unixSocketOptions
+	backend     *backend
+	idleTimeout time.Duration
+	logger      zerolog.Logger
+
+	acceptProxyProtocol  bool
+	proxyProtocolTimeout time.Duration
+	proxyProtocolTrusted []*net.IPNet
+
+	// mu guards the listener (or packet socket) against
+	// the frontend getting closed while it's being set.
+	mu                sync.Mutex
+	ln                net.Listener
+	closed            uint32
+	activeConnections int64
+	totalConnections  uint64
+
+	// global, limit and clients bound the concurrent
+	// connections of all frontends, of this one and of
+	// each client IP.
+	global           connectionLimit
+	limit            connectionLimit
+	clients          *clientLimit
+	limitAction      string
+	rejectedGlobal   uint64
+	rejectedFrontend uint64
+	rejectedClient   uint64
+	acceptWaits      uint64
+
+	// acl decides which clients can connect, nil when
+	// all of them can.
+	acl    *acl
+	denied uint64
+
+	// geoIP routes clients to other backends (or denies
+	// them) by their location, nil when not configured.
+	geoIP     *geoIP
+	geoRouted uint64
+	geoDenied uint64
+
+	// sniffer routes connections by their first bytes,
+	// nil when not configured.
+	sniffer        *sniffer
+	sniffMatched   uint64
+	sniffUnmatched uint64
+
+	// hostRouter routes HTTP connections by the host
+	// they request, nil when not configured.
+	hostRouter    *hostRouter
+	hostMatched   uint64
+	hostUnmatched uint64
+
+	// mirror tees the traffic of clients to a shadow
+	// backend, nil when not configured.
+	mirror *mirror
+
+	// capturer records the traffic of the connections
+	// selected. It's shared by all frontends.
+	capturer *capturer
+
+	// rateLimiter bounds the rate of new connections,
+	// nil when there are no rate limits.
+	rateLimiter   *rateLimiter
+	rateLimited   uint64
+	rateDelayed   uint64
+	rateTarpitted uint64
+
+	// connectionBandwidth holds the rates of each
+	// connection while shaper tracks the throttles
+	// shared by the connections of each client.
+	connectionBandwidth bandwidthRates
+	shaper              *clientShaper
+
+	pc             net.PacketConn
+	maxFlows       int
+	flowsMu        sync.Mutex
+	flows          map[string]*udpFlow
+	droppedPackets uint64
+	done           chan struct{}
+}
+
+func newFrontend(cfg Frontend, backends map[string]*backend, global connectionLimit, logger zerolog.Logger) (f *frontend, err error) {
+	if cfg.Network == "" {
+		cfg.Network = "tcp"
+	}
+
+	if cfg.LimitAction == "" {
+		cfg.LimitAction = LimitActionClose
+	}
+
+	err = validateLimitAction(cfg.LimitAction)
+	if err != nil {
+		err = errors.Wrapf(err,
+			"invalid configuration for frontend %s", cfg.Name)
+		return
+	}
+
+	if cfg.MaxConnections < 0 || cfg.MaxConnectionsPerClient < 0 {
+		err = errors.Errorf("frontend %s must not have negative connection limits",
+			cfg.Name)
+		return
+	}
+
+	err = validateNetwork(cfg.Network)
+	if err != nil {
+		err = errors.Wrapf(err,
+			"invalid configuration for frontend %s", cfg.Name)
+		return
+	}
+
+	if cfg.Protocol == "" {
+		cfg.Protocol = ProtocolTcp
+	}
+
+	switch cfg.Protocol {
+	case ProtocolTcp:
+	case ProtocolUdp:
+		if isUnixAddress(cfg.Address) || cfg.AcceptProxyProtocol {
+			err = errors.Errorf("udp frontend %s can't use unix sockets "+
+				"nor accept the proxy protocol", cfg.Name)
+			return
+		}
+
+		if cfg.IdleTimeout == 0 {
+			cfg.IdleTimeout = defaultUdpIdleTimeout
+		}
+
+		if cfg.MaxFlows == 0 {
+			cfg.MaxFlows = defaultMaxFlows
+		}
+	default:
+		err = errors.Errorf("unknown protocol '%s' for frontend %s",
+			cfg.Protocol, cfg.Name)
+		return
+	}
+
+	f = &frontend{
+		name:                 cfg.Name,
+		address:              cfg.Address,
+		protocol:             cfg.Protocol,
+		maxFlows:             cfg.MaxFlows,
+		flows:                map[string]*udpFlow{},
+		done:                 make(chan struct{}),
+		network:              cfg.Network,
+		iface:                cfg.Interface,
+		backend:              backends[cfg.Backend],
+		global:               global,
+		limit:                newConnectionLimit(cfg.MaxConnections),
+		clients:              newClientLimit(cfg.MaxConnectionsPerClient),
+		limitAction:          cfg.LimitAction,
+		idleTimeout:          cfg.IdleTimeout,
+		acceptProxyProtocol:  cfg.AcceptProxyProtocol,
+		proxyProtocolTimeout: cfg.ProxyProtocolTimeout,
+		logger: logger.With().
+			Str("frontend", cfg.Name).
+			Logger(),
+	}
+
+	if isUnixAddress(cfg.Address) && cfg.Interface != "" {
+		err = errors.Errorf("frontend %s can't bind a unix socket to an interface",
+			cfg.Name)
+		return
+	}
+
+	f.socket, err = parseUnixSocketOptions(
+		cfg.SocketMode, cfg.SocketOwner, cfg.SocketGroup)
+	if err != nil {
+		err = errors.Wrapf(err,
+			"invalid configuration for frontend %s", cfg.Name)
+		return
+	}
+
+	f.connectionBandwidth, err = newBandwidthRates(cfg.Bandwidth.PerConnection)
+	if err != nil {
+		err = errors.Wrapf(err,
+			"invalid bandwidth for frontend %s", cfg.Name)
+		return
+	}
+
+	clientBandwidth, err := newBandwidthRates(cfg.Bandwidth.PerClient)
+	if err != nil {
+		err = errors.Wrapf(err,
+			"invalid bandwidth for frontend %s", cfg.Name)
+		return
+	}
+
+	f.shaper = newClientShaper(clientBandwidth)
+
+	f.acl, err = newACL(cfg.ACL, f.logger)
+	if err != nil {
+		err = errors.Wrapf(err,
+			"invalid acl for frontend %s", cfg.Name)
+		return
+	}
+
+	f.geoIP, err = newGeoIP(cfg.GeoIP, backends, f.logger)
+	if err != nil {
+		err = errors.Wrapf(err,
+			"invalid geoip configuration for frontend %s", cfg.Name)
+		return
+	}
+
+	f.sniffer, err = newSniffer(cfg.Sniff, backends)
+	if err != nil {
+		err = errors.Wrapf(err,
+			"invalid sniff configuration for frontend %s", cfg.Name)
+		return
+	}
+
+	f.hostRouter, err = newHostRouter(cfg.HostRouting, backends)
+	if err != nil {
+		err = errors.Wrapf(err,
+			"invalid host routing for frontend %s", cfg.Name)
+		return
+	}
+
+	f.mirror, err = newMirror(cfg.Mirror, backends, f.logger)
+	if err != nil {
+		err = errors.Wrapf(err,
+			"invalid mirror for frontend %s", cfg.Name)
+		return
+	}
+
+	f.rateLimiter, err = newRateLimiter(cfg.RateLimit)
+	if err != nil {
+		err = errors.Wrapf(err,
+			"invalid rate limit for frontend %s", cfg.Name)
+		return
+	}
+
+	if cfg.Protocol == ProtocolUdp {
+		err = validateUdpFrontend(f, cfg)
+		if err != nil {
+			return
+		}
+	}
+
+	f.proxyProtocolTrusted, err = ParseCIDRs(cfg.ProxyProtocolTrusted)
+	if err != nil {
+		err = errors.Wrapf(err,
+			"invalid proxy protocol trusted networks for frontend %s",
+			cfg.Name)
+		return
+	}
+
+	return
+}
+
+// validateUdpFrontend rejects the options that only
+// apply to TCP, so that they don't get silently ignored
+// (or break flows) in a UDP frontend.
+func validateUdpFrontend(f *frontend, cfg Frontend) (err error) {
+	var unsupported []string
+
+	if cfg.MaxConnections != 0 || cfg.MaxConnectionsPerClient != 0 {
+		unsupported = append(unsupported, "connection limits")
+	}
+
+	if f.rateLimiter != nil {
+		unsupported = append(unsupported, "rate_limit")
+	}
+
+	if f.geoIP != nil {
+		unsupported = append(unsupported, "geoip")
+	}
+
+	if f.sniffer != nil {
+		unsupported = append(unsupported, "sniff")
+	}
+
+	if f.hostRouter != nil {
+		unsupported = append(unsupported, "host_routing")
+	}
+
+	if f.mirror != nil {
+		unsupported = append(unsupported, "mirror")
+	}
+
+	if cfg.Bandwidth != (FrontendBandwidth{}) {
+		unsupported = append(unsupported, "bandwidth")
+	}
+
+	// health checks (and so failover tiers) dial TCP,
+	// which would mark UDP-only servers as down.
+	if f.backend.healthCheck.Interval > 0 {
+		unsupported = append(unsupported,
+			"the health_check of backend "+f.backend.name)
+	}
+
+	if len(unsupported) > 0 {
+		err = errors.Errorf("udp frontend %s doesn't support %s",
+			cfg.Name, strings.Join(unsupported, ", "))
+	}
+
+	return
+}
+
+func (f *frontend) listen() (err error) {
+	var (
+		ln           net.Listener
+		listenConfig net.ListenConfig
+	)
+
+	if f.protocol == ProtocolUdp {
+		err = f.listenUdp()
+		return
+	}
+
+	network, address := resolveNetwork(f.network, f.address)
+	if network == "unix" {
+		ln, err = listenUnix(address, f.socket)
+		if err != nil {
+			err = errors.Wrapf(err,
+				"couldn't listen on address %s", f.address)
+			return
+		}
+
+		f.setListener(ln)
+		return
+	}
+
+	if f.iface != "" {
+		_, err = net.InterfaceByName(f.iface)
+		if err != nil {
+			err = errors.Wrapf(err,
+				"couldn't find interface %s", f.iface)
+			return
+		}
+
+		listenConfig.Control = bindToDevice(f.iface)
+	}
+
+	ln, err = listenConfig.Listen(context.Background(), network, address)
+	if err != nil {
+		err = errors.Wrapf(err,
+			"couldn't listen on address %s", f.address)
+		return
+	}
+
+	f.setListener(ln)
+	return
+}
+
+// setListener wraps the listener with the graceful and
+// PROXY protocol layers so that it's ready to serve.
+func (f *frontend) setListener(ln net.Listener) {
+	f.logger.Info().
+		Str("address", ln.Addr().String()).
+		Str("network", ln.Addr().Network()).
+		Str("interface", f.iface).
+		Str("backend", f.backend.name).
+		Msg("listening")
+
+	ln = NewGracefulListener(GracefulListenerConfig{
+		Listener: ln,
+	})
+
+	if f.acceptProxyProtocol {
+		ln = NewProxyProtocolListener(ProxyProtocolListenerConfig{
+			Listener:        ln,
+			ReadTimeout:     f.proxyProtocolTimeout,
+			TrustedNetworks: f.proxyProtocolTrusted,
+		})
+	}
+
+	f.mu.Lock()
+	f.ln = ln
+	closed := atomic.LoadUint32(&f.closed) != 0
+	f.mu.Unlock()
+
+	// the frontend got closed while listening, so that
+	// it's up to us to close the listener, making serve
+	// return right away.
+	if closed {
+		ln.Close()
+	}
+}
+
+// serve accepts connections until the frontend gets
+// closed.
+func (f *frontend) serve() {
+	if f.protocol == ProtocolUdp {
+		f.serveUdp()
+		return
+	}
+
+	for {
+		if !f.acceptSlot() {
+			return
+		}
+
+		conn, err := f.ln.Accept()
+		if err != nil {
+			if f.limitAction == LimitActionWait {
+				f.releaseSlot()
+			}
+
+			if atomic.LoadUint32(&f.closed) != 0 {
+				return
+			}
+
+			f.logger.Error().
+				Err(err).
+				Msg("errored accepting connection")
+			continue
+		}
+
+		go f.handle(conn)
+	}
+}
+
+func (f *frontend) close() (err error) {
+	f.mu.Lock()
+	if atomic.LoadUint32(&f.closed) != 0 {
+		f.mu.Unlock()
+		return
+	}
+
+	atomic.StoreUint32(&f.closed, 1)
+	var ln, pc = f.ln, f.pc
+	f.mu.Unlock()
+
+	close(f.done)
+
+	if pc != nil {
+		err = f.closeUdp(pc)
+		return
+	}
+
+	if ln != nil {
+		err = ln.Close()
+	}
+
+	return
+}
+
+func (f *frontend) handle(conn net.Conn) {
+	atomic.AddUint64(&f.totalConnections, 1)
+	atomic.AddInt64(&f.activeConnections, 1)
+	defer atomic.AddInt64(&f.activeConnections, -1)
+
+	// connections accepted with the 'wait' action come
+	// with their slots, while the others only take them
+	// once they got through the rate limits.
+	var slotted = f.limitAction == LimitActionWait
+	defer func() {
+		if slotted {
+			f.releaseSlot()
+		}
+	}()
+
+	if ppConn, ok := conn.(*ProxyProtocolConn); ok {
+		_, err := ppConn.Header()
+		if err != nil {
+			f.logger.Error().
+				Err(err).
+				Msg("couldn't accept connection")
+			conn.Close()
+			return
+		}
+	}
+
+	if f.acl != nil && !f.acl.allows(conn.RemoteAddr()) {
+		atomic.AddUint64(&f.denied, 1)
+		f.logger.Debug().
+			Str("remote", conn.RemoteAddr().String()).
+			Msg("connection denied")
+		conn.Close()
+		return
+	}
+
+	// clients denied by geoip get closed before taking
+	// any tokens or slots.
+	client := conn.RemoteAddr()
+	geo, geoMatched, ok := f.geoRoute(client)
+	if !ok {
+		conn.Close()
+		return
+	}
+
+	if !f.rateLimit(client, func() {
+		if slotted {
+			f.releaseSlot()
+			slotted = false
+		}
+	}) {
+		conn.Close()
+		return
+	}
+
+	if !slotted {
+		if !f.takeSlot() {
+			conn.Close()
+			return
+		}
+		slotted = true
+	}
+
+	if !f.clients.tryAcquire(client) {
+		atomic.AddUint64(&f.rejectedClient, 1)
+		f.logger.Warn().
+			Str("remote", client.String()).
+			Msg("too many connections from client")
+		conn.Close()
+		return
+	}
+	defer f.clients.release(client)
+
+	conn, b := f.route(conn, geo, geoMatched)
+
+	s, err := b.acquire(client)
+	if err != nil {
+		f.logger.Error().
+			Err(err).
+			Str("remote", conn.RemoteAddr().String()).
+			Str("backend", b.name).
+			Msg("couldn't pick a server")
+		conn.Close()
+		return
+	}
+	defer b.release(s)
+
+	var (
+		id         = xid.New().String()
+		serverName string
+		logger     = f.logger.With().
+				Str("remote", conn.RemoteAddr().String()).
+				Str("local", conn.LocalAddr().String()).
+				Str("backend", b.name).
+				Str("upstream", s.address).
+				Str("id", id).
+				Logger()
+	)
+
+	if s.proxyProtocolSNI {
+		conn, serverName = peekServerName(conn, sniPeekTimeout)
+	}
+
+	logger.Info().Msg("dialing")
+	agent, err := b.dial(s)
+	b.observeDial(s, err)
+	if err != nil {
+		logger.Error().
+			Err(err).
+			Msg("couldn't dial server")
+		conn.Close()
+		return
+	}
+
+	if s.proxyProtocol != "" {
+		err = writeProxyProtocolHeader(agent, conn, s.proxyProtocol, id, serverName)
+		if err != nil {
+			logger.Error().
+				Err(err).
+				Msg("couldn't write proxy protocol header")
+			agent.Close()
+			conn.Close()
+			return
+		}
+	}
+
+	clientThrottles := f.shaper.acquire(client)
+	defer f.shaper.release(client)
+
+	var mirror io.Writer
+	if stream := f.mirror.start(conn); stream != nil {
+		defer stream.Close()
+		mirror = stream
+	}
+
+	var capture Tap
+	if stream := f.capturer.start(id, conn, s.address); stream != nil {
+		defer stream.Close()
+		capture = stream
+	}
+
+	proxy, err := NewProxy(ProxyConfig{
+		To:                agent,
+		From:              conn,
+		ConnectionTimeout: 10 * time.Second,
+		IdleTimeout:       f.idleTimeout,
+		ToThrottles: []*Throttle{
+			NewThrottle(f.connectionBandwidth.upload),
+			clientThrottles.upload,
+			s.upload,
+		},
+		FromThrottles: []*Throttle{
+			NewThrottle(f.connectionBandwidth.download),
+			clientThrottles.download,
+			s.download,
+		},
+		Mirror:  mirror,
+		Capture: capture,
+	})
+	if err != nil {
+		logger.Error().
+			Err(err).
+			Msg("couldn't create proxy")
+		agent.Close()
+		conn.Close()
+		return
+	}
+
+	s.track(&proxy)
+	defer s.untrack(&proxy)
+
+	logger.Info().Msg("proxying")
+	err = proxy.Transfer()
+	if err == ErrIdleTimeout {
+		logger.Info().Msg("closed idle connection")
+		return
+	}
+
+	if err != nil {
+		logger.Error().
+			Err(err).
+			Msg("errored transferring between connections")
+		return
+	}
+
+	logger.Info().Msg("finished")
+}
+
+// route picks the backend of a connection given the
+// one geoip picked ('b'): geoip matches come first, then
+// the sniffing routes and the host rules, falling back
+// to 'b'. It retrieves the connection to proxy, which
+// replays any bytes peeked.
+func (f *frontend) route(conn net.Conn, b *backend, geoMatched bool) (net.Conn, *backend) {
+	if geoMatched {
+		return conn, b
+	}
+
+	if f.sniffer != nil {
+		var sniffed *backend
+
+		conn, sniffed = f.sniff(conn)
+		if sniffed != nil {
+			return conn, sniffed
+		}
+	}
+
+	if f.hostRouter != nil {
+		var routed *backend
+
+		conn, routed = f.hostRoute(conn)
+		if routed != nil {
+			return conn, routed
+		}
+	}
+
+	return conn, b
+}
+
+func (f *frontend) stats() (stats FrontendStats) {
+	stats = FrontendStats{
+		Name:              f.name,
+		Address:           f.address,
+		Protocol:          f.protocol,
+		Backend:           f.backend.name,
+		ActiveConnections: atomic.LoadInt64(&f.activeConnections),
+		TotalConnections:  atomic.LoadUint64(&f.totalConnections),
+		RejectedGlobal:    atomic.LoadUint64(&f.rejectedGlobal),
+		RejectedFrontend:  atomic.LoadUint64(&f.rejectedFrontend),
+		RejectedClient:    atomic.LoadUint64(&f.rejectedClient),
+		AcceptWaits:       atomic.LoadUint64(&f.acceptWaits),
+		Denied:            atomic.LoadUint64(&f.denied),
+		GeoRouted:         atomic.LoadUint64(&f.geoRouted),
+		GeoDenied:         atomic.LoadUint64(&f.geoDenied),
+		SniffMatched:      atomic.LoadUint64(&f.sniffMatched),
+		SniffUnmatched:    atomic.LoadUint64(&f.sniffUnmatched),
+		HostMatched:       atomic.LoadUint64(&f.hostMatched),
+		HostUnmatched:     atomic.LoadUint64(&f.hostUnmatched),
+		RateLimited:       atomic.LoadUint64(&f.rateLimited),
+		RateDelayed:       atomic.LoadUint64(&f.rateDelayed),
+		RateTarpitted:     atomic.LoadUint64(&f.rateTarpitted),
+	}
+
+	stats.MirroredConnections, stats.MirroredBytes, stats.MirrorDroppedBytes =
+		f.mirror.stats()
+
+	if f.rateLimiter != nil {
+		stats.RateLimitClients = f.rateLimiter.clientCount()
+	}
+
+	if f.protocol == ProtocolUdp {
+		stats.DroppedPackets = atomic.LoadUint64(&f.droppedPackets)
+		stats.Flows = f.flowStats()
+	}
+
+	return
+}
+
+// writeProxyProtocolHeader sends to the upstream the
+// addresses of the client connection. With v2, the
+// server name requested by the client (if known) and
+// the connection id are also sent as TLVs.
+func writeProxyProtocolHeader(agent, conn net.Conn, version, id, serverName string) (err error) {
+	var header = ProxyProtocolHeader{
+		Version:     version,
+		Source:      conn.RemoteAddr(),
+		Destination: conn.LocalAddr(),
+	}
+
+	if version == ProxyProtocolV2 {
+		if serverName != "" {
+			header.TLVs = append(header.TLVs, ProxyProtocolTLV{
+				Type:  PP2TypeAuthority,
+				Value: []byte(serverName),
+			})
+		}
+
+		header.TLVs = append(header.TLVs, ProxyProtocolTLV{
+			Type:  PP2TypeUniqueId,
+			Value: []byte(id),
+		})
+	}
+
+	_, err = header.WriteTo(agent)
+	return
+}
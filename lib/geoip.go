@@ -0,0 +1,415 @@
+package lib
+
+import (
+	"bytes"
+	"container/list"
+	"io/ioutil"
+	"net"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/rs/zerolog"
+)
+
+// Fields that GeoIP rules match on and the action that
+// denies clients instead of routing them to a backend.
+const (
+	GeoFieldCountry = "country"
+	GeoFieldAsn     = "asn"
+	GeoActionDeny   = "deny"
+)
+
+const (
+	defaultGeoCacheSize = 10000
+)
+
+// geoRulePattern matches rules such as
+// 'country in [DE, FR] -> eu'.
+var geoRulePattern = regexp.MustCompile(`^\s*(\w+)\s+in\s+\[([^\]]*)\]\s*->\s*(\S+)\s*$`)
+
+// geoInfo is what the databases know about an IP.
+type geoInfo struct {
+	country string
+	asn     uint64
+}
+
+func (g geoInfo) field(name string) string {
+	switch name {
+	case GeoFieldCountry:
+		return g.country
+	case GeoFieldAsn:
+		if g.asn == 0 {
+			return ""
+		}
+
+		return strconv.FormatUint(g.asn, 10)
+	}
+
+	return ""
+}
+
+// geoRule sends the clients whose field is among
+// 'values' to a backend, or denies them if it's nil.
+type geoRule struct {
+	field   string
+	values  map[string]bool
+	backend *backend
+}
+
+func parseGeoRule(rule string, backends map[string]*backend) (r geoRule, err error) {
+	matches := geoRulePattern.FindStringSubmatch(rule)
+	if matches == nil {
+		err = errors.Errorf("malformed rule '%s'", rule)
+		return
+	}
+
+	r = geoRule{
+		field:  matches[1],
+		values: map[string]bool{},
+	}
+
+	switch r.field {
+	case GeoFieldCountry, GeoFieldAsn:
+	default:
+		err = errors.Errorf("unknown field '%s' in rule '%s'", r.field, rule)
+		return
+	}
+
+	for _, value := range strings.Split(matches[2], ",") {
+		value = strings.ToUpper(strings.TrimSpace(value))
+		if r.field == GeoFieldAsn {
+			value = strings.TrimPrefix(value, "AS")
+		}
+
+		if value != "" {
+			r.values[value] = true
+		}
+	}
+
+	if len(r.values) == 0 {
+		err = errors.Errorf("rule '%s' must list values", rule)
+		return
+	}
+
+	if matches[3] != GeoActionDeny {
+		r.backend = backends[matches[3]]
+		if r.backend == nil {
+			err = errors.Errorf("unknown backend %s in rule '%s'", matches[3], rule)
+			return
+		}
+	}
+
+	return
+}
+
+// geoIP routes clients by the country and autonomous
+// system that the databases assign to their IPs. Lookups
+// are cached in a bounded table that evicts the least
+// recently used entries and gets cleared whenever a
+// database is reloaded. Entries are tagged with the
+// generation of the databases they were looked up in,
+// so that lookups racing with a reload don't leave
+// stale results behind.
+type geoIP struct {
+	databases []*geoDatabase
+	rules     []geoRule
+	cacheSize int
+
+	mu         sync.Mutex
+	cache      map[string]*list.Element
+	lru        *list.List
+	generation uint64
+}
+
+type geoCacheEntry struct {
+	key        string
+	info       geoInfo
+	generation uint64
+}
+
+func newGeoIP(cfg GeoIP, backends map[string]*backend, logger zerolog.Logger) (g *geoIP, err error) {
+	if len(cfg.Databases) == 0 && len(cfg.Rules) == 0 {
+		return
+	}
+
+	if len(cfg.Databases) == 0 {
+		err = errors.Errorf("geoip rules require databases")
+		return
+	}
+
+	if cfg.CacheSize < 0 {
+		err = errors.Errorf("cache size must not be negative")
+		return
+	}
+
+	if cfg.CacheSize == 0 {
+		cfg.CacheSize = defaultGeoCacheSize
+	}
+
+	g = &geoIP{
+		cacheSize: cfg.CacheSize,
+		cache:     map[string]*list.Element{},
+		lru:       list.New(),
+	}
+
+	for _, rule := range cfg.Rules {
+		var r geoRule
+
+		r, err = parseGeoRule(rule, backends)
+		if err != nil {
+			return
+		}
+
+		g.rules = append(g.rules, r)
+	}
+
+	for _, path := range cfg.Databases {
+		db := newGeoDatabase(path, g.purge, logger)
+
+		// databases must be valid at startup, while
+		// failing to reload them keeps the previous
+		// version.
+		_, err = db.load()
+		if err != nil {
+			return
+		}
+
+		g.databases = append(g.databases, db)
+	}
+
+	return
+}
+
+// route retrieves the backend that a client should be
+// sent to given the first rule that matches it, or
+// 'fallback' if none does. A nil backend means that
+// the client is denied.
+func (g *geoIP) route(client net.Addr, fallback *backend) (b *backend, matched bool) {
+	ip := addrIP(client)
+	if ip == nil {
+		return fallback, false
+	}
+
+	info := g.lookup(ip)
+	for _, rule := range g.rules {
+		if rule.values[info.field(rule.field)] {
+			return rule.backend, true
+		}
+	}
+
+	return fallback, false
+}
+
+func (g *geoIP) lookup(ip net.IP) (info geoInfo) {
+	var key = ip.String()
+
+	g.mu.Lock()
+	var generation = g.generation
+	if elem, ok := g.cache[key]; ok {
+		entry := elem.Value.(*geoCacheEntry)
+		if entry.generation == generation {
+			g.lru.MoveToFront(elem)
+			info = entry.info
+			g.mu.Unlock()
+			return
+		}
+
+		g.lru.Remove(elem)
+		delete(g.cache, key)
+	}
+	g.mu.Unlock()
+
+	for _, db := range g.databases {
+		db.fill(ip, &info)
+	}
+
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	// a database got reloaded while looking the IP up,
+	// so the result might come from the previous one.
+	if g.generation != generation {
+		return
+	}
+
+	if _, ok := g.cache[key]; ok {
+		return
+	}
+
+	if g.lru.Len() >= g.cacheSize {
+		oldest := g.lru.Back()
+		g.lru.Remove(oldest)
+		delete(g.cache, oldest.Value.(*geoCacheEntry).key)
+	}
+
+	g.cache[key] = g.lru.PushFront(&geoCacheEntry{
+		key:        key,
+		info:       info,
+		generation: generation,
+	})
+	return
+}
+
+func (g *geoIP) purge() {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	g.generation++
+	g.cache = map[string]*list.Element{}
+	g.lru.Init()
+}
+
+func (g *geoIP) cached() int {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	return g.lru.Len()
+}
+
+// geoDatabase holds an MMDB file in memory, reloading it
+// as it gets rewritten.
+type geoDatabase struct {
+	path         string
+	pollInterval time.Duration
+	debounce     time.Duration
+	onReload     func()
+	logger       zerolog.Logger
+
+	mu      sync.Mutex
+	content []byte
+	reader  atomic.Value
+}
+
+func newGeoDatabase(path string, onReload func(), logger zerolog.Logger) *geoDatabase {
+	return &geoDatabase{
+		path:         path,
+		pollInterval: defaultFilePollInterval,
+		debounce:     defaultFileDebounce,
+		onReload:     onReload,
+		logger: logger.With().
+			Str("geoip", path).
+			Logger(),
+	}
+}
+
+// load reads and parses the database, retrieving
+// whether it changed.
+func (d *geoDatabase) load() (changed bool, err error) {
+	content, err := ioutil.ReadFile(d.path)
+	if err != nil {
+		err = errors.Wrapf(err, "couldn't read geoip database %s", d.path)
+		return
+	}
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if d.content != nil && bytes.Equal(content, d.content) {
+		return
+	}
+
+	reader, err := parseMMDB(content)
+	if err != nil {
+		err = errors.Wrapf(err, "malformed geoip database %s", d.path)
+		return
+	}
+
+	d.content = content
+	d.reader.Store(reader)
+	changed = true
+	return
+}
+
+// fill sets the fields of 'info' that are still empty
+// with what the database holds about 'ip'.
+func (d *geoDatabase) fill(ip net.IP, info *geoInfo) {
+	reader := d.reader.Load().(*mmdbReader)
+
+	record, err := reader.lookup(ip)
+	if err != nil {
+		d.logger.Debug().
+			Err(err).
+			Str("ip", ip.String()).
+			Msg("lookup failed")
+		return
+	}
+
+	fields, _ := record.(map[string]interface{})
+	if fields == nil {
+		return
+	}
+
+	if info.country == "" {
+		info.country = mmdbIsoCode(fields["country"])
+	}
+
+	if info.country == "" {
+		info.country = mmdbIsoCode(fields["registered_country"])
+	}
+
+	if info.asn == 0 {
+		info.asn, _ = fields["autonomous_system_number"].(uint64)
+	}
+}
+
+func mmdbIsoCode(value interface{}) string {
+	country, _ := value.(map[string]interface{})
+	code, _ := country["iso_code"].(string)
+	return strings.ToUpper(code)
+}
+
+// refresh reloads the database, keeping the previous
+// version if it can't be read or parsed.
+func (d *geoDatabase) refresh() {
+	changed, err := d.load()
+	if err != nil {
+		d.logger.Error().
+			Err(err).
+			Msg("keeping previous geoip database")
+		return
+	}
+
+	if changed {
+		d.onReload()
+		d.logger.Info().Msg("geoip database reloaded")
+	}
+}
+
+func (d *geoDatabase) run(done <-chan struct{}) {
+	followFile(d.path, d.pollInterval, d.debounce, done, d.logger, func() time.Duration {
+		d.refresh()
+		return 0
+	})
+}
+
+// geoRoute retrieves the backend a connection from
+// 'client' should go to by geoip, accounting matches.
+// It retrieves false if the client got denied.
+func (f *frontend) geoRoute(client net.Addr) (b *backend, matched, ok bool) {
+	if f.geoIP == nil {
+		return f.backend, false, true
+	}
+
+	b, matched = f.geoIP.route(client, f.backend)
+	if !matched {
+		ok = true
+		return
+	}
+
+	if b == nil {
+		atomic.AddUint64(&f.geoDenied, 1)
+		f.logger.Debug().
+			Str("remote", client.String()).
+			Msg("connection denied by geoip")
+		return
+	}
+
+	atomic.AddUint64(&f.geoRouted, 1)
+	ok = true
+	return
+}
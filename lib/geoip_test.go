@@ -0,0 +1,287 @@
+package lib
+
+import (
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/rs/zerolog"
+	"github.com/stretchr/testify/assert"
+)
+
+func asn(number uint32) map[string]interface{} {
+	return map[string]interface{}{
+		"autonomous_system_number":       number,
+		"autonomous_system_organization": "Example",
+	}
+}
+
+func TestParseGeoRule(t *testing.T) {
+	var backends = map[string]*backend{"eu": {name: "eu"}}
+
+	var testCases = []struct {
+		description string
+		rule        string
+		field       string
+		values      []string
+		deny        bool
+		shouldFail  bool
+	}{
+		{"countries", "country in [DE, fr] -> eu", "country", []string{"DE", "FR"}, false, false},
+		{"asns", "asn in [AS64512, 64513] -> deny", "asn", []string{"64512", "64513"}, true, false},
+		{"unknown field", "city in [Berlin] -> eu", "", nil, false, true},
+		{"unknown backend", "country in [DE] -> us", "", nil, false, true},
+		{"without values", "country in [] -> eu", "", nil, false, true},
+		{"malformed", "country DE -> eu", "", nil, false, true},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.description, func(t *testing.T) {
+			rule, err := parseGeoRule(tc.rule, backends)
+			if tc.shouldFail {
+				assert.Error(t, err)
+				return
+			}
+
+			assert.NoError(t, err)
+			assert.Equal(t, tc.field, rule.field)
+			assert.Len(t, rule.values, len(tc.values))
+			for _, value := range tc.values {
+				assert.True(t, rule.values[value])
+			}
+
+			assert.Equal(t, tc.deny, rule.backend == nil)
+		})
+	}
+}
+
+// newGeoIPTest writes a country and an ASN database,
+// retrieving their paths.
+func newGeoIPTest(t *testing.T) (countries, asns string) {
+	dir, err := ioutil.TempDir("", "geoip")
+	assert.NoError(t, err)
+	t.Cleanup(func() { os.RemoveAll(dir) })
+
+	countries = filepath.Join(dir, "countries.mmdb")
+	asns = filepath.Join(dir, "asns.mmdb")
+
+	writeMMDB(t, countries, map[string]interface{}{
+		"10.0.0.0/8":    country("DE"),
+		"172.16.0.0/12": country("US"),
+		"2001:db8::/32": country("FR"),
+	})
+	writeMMDB(t, asns, map[string]interface{}{
+		"172.16.0.0/16": asn(64512),
+	})
+
+	return
+}
+
+func TestGeoIPRoute(t *testing.T) {
+	var (
+		countries, asns = newGeoIPTest(t)
+		fallback        = &backend{name: "default"}
+		eu              = &backend{name: "eu"}
+	)
+
+	g, err := newGeoIP(GeoIP{
+		Databases: []string{countries, asns},
+		Rules: []string{
+			"asn in [64512] -> deny",
+			"country in [DE, FR] -> eu",
+		},
+	}, map[string]*backend{"eu": eu}, zerolog.Nop())
+	assert.NoError(t, err)
+
+	var testCases = []struct {
+		description string
+		ip          string
+		backend     *backend
+		matched     bool
+	}{
+		{"country", "10.1.1.1", eu, true},
+		{"ipv6 country", "2001:db8::1", eu, true},
+		{"asn from the second database", "172.16.1.1", nil, true},
+		{"country without a rule", "172.17.1.1", fallback, false},
+		{"unknown", "192.168.1.1", fallback, false},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.description, func(t *testing.T) {
+			b, matched := g.route(&net.TCPAddr{IP: net.ParseIP(tc.ip)}, fallback)
+			assert.Equal(t, tc.matched, matched)
+			assert.True(t, tc.backend == b)
+		})
+	}
+
+	assert.Equal(t, len(testCases), g.cached())
+}
+
+func TestGeoIPCacheIsBounded(t *testing.T) {
+	countries, _ := newGeoIPTest(t)
+
+	g, err := newGeoIP(GeoIP{
+		Databases: []string{countries},
+		CacheSize: 2,
+	}, nil, zerolog.Nop())
+	assert.NoError(t, err)
+
+	for _, ip := range []string{"10.0.0.1", "10.0.0.2", "10.0.0.1", "10.0.0.3"} {
+		g.lookup(net.ParseIP(ip))
+	}
+
+	assert.Equal(t, 2, g.cached())
+	assert.Contains(t, g.cache, "10.0.0.1")
+	assert.Contains(t, g.cache, "10.0.0.3")
+}
+
+func TestGeoIPIgnoresStaleEntries(t *testing.T) {
+	countries, _ := newGeoIPTest(t)
+
+	g, err := newGeoIP(GeoIP{Databases: []string{countries}}, nil, zerolog.Nop())
+	assert.NoError(t, err)
+
+	var ip = net.ParseIP("10.0.0.1")
+	assert.Equal(t, "DE", g.lookup(ip).country)
+
+	// an entry written by a lookup that raced with a
+	// reload belongs to the previous generation.
+	g.purge()
+	g.cache[ip.String()] = g.lru.PushFront(&geoCacheEntry{
+		key:  ip.String(),
+		info: geoInfo{country: "NL"},
+	})
+
+	assert.Equal(t, "DE", g.lookup(ip).country)
+	assert.Equal(t, 1, g.cached())
+}
+
+func TestGeoIPReloadsDatabases(t *testing.T) {
+	countries, _ := newGeoIPTest(t)
+
+	g, err := newGeoIP(GeoIP{Databases: []string{countries}}, nil, zerolog.Nop())
+	assert.NoError(t, err)
+
+	var (
+		ip   = net.ParseIP("10.0.0.1")
+		db   = g.databases[0]
+		done = make(chan struct{})
+	)
+	defer close(done)
+
+	assert.Equal(t, "DE", g.lookup(ip).country)
+
+	db.debounce = 10 * time.Millisecond
+	db.pollInterval = 10 * time.Millisecond
+	go db.run(done)
+	time.Sleep(50 * time.Millisecond)
+
+	tmp := countries + ".tmp"
+	writeMMDB(t, tmp, map[string]interface{}{"10.0.0.0/8": country("NL")})
+	assert.NoError(t, os.Rename(tmp, countries))
+
+	assert.True(t, waitFor(2*time.Second, func() bool {
+		return g.lookup(ip).country == "NL"
+	}))
+
+	// broken databases keep the previous version.
+	writeAtomically(t, countries, "garbage")
+	time.Sleep(200 * time.Millisecond)
+	assert.Equal(t, "NL", g.lookup(ip).country)
+}
+
+func TestLoadBalancerRoutesByGeoIP(t *testing.T) {
+	countries, _ := newGeoIPTest(t)
+	writeMMDB(t, countries, map[string]interface{}{
+		"127.0.0.0/8": country("DE"),
+	})
+
+	other, otherAddress := listenEcho(t, "tcp4", "127.0.0.1:0")
+	defer other.Close()
+
+	var testCases = []struct {
+		description string
+		rule        string
+		served      bool
+		expected    func(stats Stats) uint64
+	}{
+		{
+			description: "routes",
+			rule:        "country in [DE] -> eu",
+			served:      true,
+			expected: func(stats Stats) uint64 {
+				return stats.Backends[1].Servers[0].TotalConnections
+			},
+		},
+		{
+			description: "denies",
+			rule:        "country in [DE] -> deny",
+			served:      false,
+			expected:    func(stats Stats) uint64 { return stats.Frontends[0].GeoDenied },
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.description, func(t *testing.T) {
+			upstream, upstreamAddress := listenEcho(t, "tcp4", "127.0.0.1:0")
+			defer upstream.Close()
+
+			lb := startLoadBalancer(t, LoadBalancerConfig{
+				Frontends: []Frontend{{
+					Name:    "a",
+					Address: freeAddress(t),
+					Backend: "echo",
+					GeoIP: GeoIP{
+						Databases: []string{countries},
+						Rules:     []string{tc.rule},
+					},
+				}},
+				Backends: []Backend{
+					{Name: "echo", Servers: []Server{{Address: upstreamAddress}}},
+					{Name: "eu", Servers: []Server{{Address: otherAddress}}},
+				},
+			})
+
+			conn, served := dialEcho(t, lb.frontends[0].address)
+			conn.Close()
+			assert.Equal(t, tc.served, served)
+
+			time.Sleep(50 * time.Millisecond)
+			stats := lb.Stats()
+			assert.Equal(t, uint64(1), tc.expected(stats))
+			assert.Equal(t, uint64(0), stats.Backends[0].Servers[0].TotalConnections)
+		})
+	}
+}
+
+func TestLoadBalancerDeniesByGeoIPBeforeLimits(t *testing.T) {
+	countries, _ := newGeoIPTest(t)
+	writeMMDB(t, countries, map[string]interface{}{
+		"127.0.0.0/8": country("DE"),
+	})
+
+	lb, addresses := startLimitedLoadBalancer(t, LoadBalancerConfig{}, Frontend{
+		Name:                    "a",
+		MaxConnectionsPerClient: 1,
+		RateLimit:               RateLimit{Rate: 1, Burst: 1},
+		GeoIP: GeoIP{
+			Databases: []string{countries},
+			Rules:     []string{"country in [DE] -> deny"},
+		},
+	})
+
+	for i := 0; i < 3; i++ {
+		conn, served := dialEcho(t, addresses[0])
+		conn.Close()
+		assert.False(t, served)
+	}
+
+	// denied clients take neither tokens nor slots.
+	stats := lb.Stats().Frontends[0]
+	assert.Equal(t, uint64(3), stats.GeoDenied)
+	assert.Equal(t, uint64(0), stats.RateLimited)
+	assert.Equal(t, 0, stats.RateLimitClients)
+}
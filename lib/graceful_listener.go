@@ -2,6 +2,7 @@ package lib
 
 import (
 	"net"
+	"sync"
 	"sync/atomic"
 	"time"
 
@@ -21,6 +22,7 @@ type GracefulListener struct {
 	ln               net.Listener
 	maxCloseWaitTime time.Duration
 	done             chan struct{}
+	doneOnce         sync.Once
 	connsCount       uint64
 	shutdown         uint64
 }
@@ -71,7 +73,7 @@ func (ln *GracefulListener) Close() error {
 func (ln *GracefulListener) waitForZeroConns() error {
 	atomic.AddUint64(&ln.shutdown, 1)
 	if atomic.LoadUint64(&ln.connsCount) == 0 {
-		close(ln.done)
+		ln.finish()
 		return nil
 	}
 
@@ -82,13 +84,20 @@ func (ln *GracefulListener) waitForZeroConns() error {
 		return errors.Errorf("cannot complete graceful shutdown in %s",
 			ln.maxCloseWaitTime)
 	}
-
-	return nil
 }
 
 func (ln *GracefulListener) closeConn() {
 	connsCount := atomic.AddUint64(&ln.connsCount, ^uint64(0))
 	if atomic.LoadUint64(&ln.shutdown) != 0 && connsCount == 0 {
-		close(ln.done)
+		ln.finish()
 	}
 }
+
+// finish signals that the last connection went away.
+// Both the listener and its last connection may find
+// out at once.
+func (ln *GracefulListener) finish() {
+	ln.doneOnce.Do(func() {
+		close(ln.done)
+	})
+}
@@ -0,0 +1,162 @@
+package lib
+
+import (
+	"fmt"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	defaultHealthCheckTimeout = 2 * time.Second
+	defaultHealthCheckRise    = 2
+	defaultHealthCheckFall    = 3
+)
+
+func validateHealthCheck(cfg *HealthCheck) (err error) {
+	if cfg.Interval < 0 || cfg.Timeout < 0 || cfg.Rise < 0 || cfg.Fall < 0 {
+		err = errors.Errorf("health check settings must not be negative")
+		return
+	}
+
+	if cfg.Timeout == 0 {
+		cfg.Timeout = defaultHealthCheckTimeout
+	}
+
+	if cfg.Rise == 0 {
+		cfg.Rise = defaultHealthCheckRise
+	}
+
+	if cfg.Fall == 0 {
+		cfg.Fall = defaultHealthCheckFall
+	}
+
+	return
+}
+
+func (s *server) healthy() bool {
+	return atomic.LoadUint32(&s.unhealthy) == 0
+}
+
+// precedes tells whether 's' belongs to a tier that
+// comes before the one of 'other'.
+func (s *server) precedes(other *server) bool {
+	if s.backup != other.backup {
+		return !s.backup
+	}
+
+	return s.priority < other.priority
+}
+
+func (s *server) tierName() string {
+	if s.backup {
+		return fmt.Sprintf("backup/%d", s.priority)
+	}
+
+	return fmt.Sprintf("primary/%d", s.priority)
+}
+
+// observe accounts the result of a connection attempt,
+// retrieving whether the server changed its health.
+func (s *server) observe(success bool, rise, fall int) (changed bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if success {
+		s.failures = 0
+		s.successes++
+
+		if !s.healthy() && s.successes >= rise {
+			atomic.StoreUint32(&s.unhealthy, 0)
+			changed = true
+		}
+
+		return
+	}
+
+	s.successes = 0
+	s.failures++
+
+	if s.healthy() && s.failures >= fall {
+		atomic.StoreUint32(&s.unhealthy, 1)
+		changed = true
+	}
+
+	return
+}
+
+// observe accounts the result of a connection attempt
+// to a server when health checks are enabled, logging
+// the changes in its health.
+func (b *backend) observe(s *server, err error) {
+	if b.healthCheck.Interval == 0 {
+		return
+	}
+
+	if !s.observe(err == nil, b.healthCheck.Rise, b.healthCheck.Fall) {
+		return
+	}
+
+	if s.healthy() {
+		s.startRamp(b.slowStart)
+
+		b.mu.Lock()
+		b.dispatch()
+		b.mu.Unlock()
+
+		b.logger.Info().
+			Str("upstream", s.address).
+			Msg("server is up")
+		return
+	}
+
+	b.logger.Warn().
+		Err(err).
+		Str("upstream", s.address).
+		Msg("server is down")
+}
+
+// checkHealth periodically tries to connect to every
+// server until the backend gets stopped.
+func (b *backend) checkHealth() {
+	ticker := time.NewTicker(b.healthCheck.Interval)
+	defer ticker.Stop()
+
+	for {
+		var wg sync.WaitGroup
+
+		b.mu.Lock()
+		var servers = append([]*server{}, b.servers...)
+		b.mu.Unlock()
+
+		for _, s := range servers {
+			wg.Add(1)
+			go func(s *server) {
+				defer wg.Done()
+				b.check(s)
+			}(s)
+		}
+
+		wg.Wait()
+
+		select {
+		case <-b.done:
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+func (b *backend) check(s *server) {
+	network, address := resolveNetwork(b.network, s.address)
+
+	conn, err := net.DialTimeout(network, address, b.healthCheck.Timeout)
+	if err == nil {
+		conn.Close()
+	}
+
+	b.observe(s, err)
+}
@@ -0,0 +1,130 @@
+package lib
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/rs/zerolog"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestServerObserve(t *testing.T) {
+	var testCases = []struct {
+		description string
+		results     []bool
+		healthy     bool
+	}{
+		{"no results", nil, true},
+		{"failures below fall", []bool{false, false}, true},
+		{"failures reaching fall", []bool{false, false, false}, false},
+		{"failures interleaved", []bool{false, false, true, false, false}, true},
+		{"successes below rise", []bool{false, false, false, true}, false},
+		{"successes reaching rise", []bool{false, false, false, true, true}, true},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.description, func(t *testing.T) {
+			s := mustServers(t, Server{Address: "10.0.0.1:80"})[0]
+
+			for _, success := range tc.results {
+				s.observe(success, 2, 3)
+			}
+
+			assert.Equal(t, tc.healthy, s.healthy())
+		})
+	}
+}
+
+// listenAndDiscard accepts connections on 'address',
+// closing them right away.
+func listenAndDiscard(t *testing.T, address string) net.Listener {
+	ln, err := net.Listen("tcp4", address)
+	assert.NoError(t, err)
+
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+
+			conn.Close()
+		}
+	}()
+
+	return ln
+}
+
+func TestBackendFailsOverToBackups(t *testing.T) {
+	primary := listenAndDiscard(t, "127.0.0.1:0")
+	defer primary.Close()
+
+	backup := listenAndDiscard(t, "127.0.0.1:0")
+	defer backup.Close()
+
+	b, err := newBackend(Backend{
+		Name: "app",
+		HealthCheck: HealthCheck{
+			Interval: 20 * time.Millisecond,
+			Rise:     1,
+			Fall:     1,
+		},
+		Servers: []Server{
+			{Address: primary.Addr().String()},
+			{Address: backup.Addr().String(), Backup: true},
+		},
+	}, nil, zerolog.Nop())
+	assert.NoError(t, err)
+
+	b.start()
+	defer b.stop()
+
+	assert.Equal(t, primary.Addr().String(), pickAddress(b, nil))
+
+	primaryAddress := primary.Addr().String()
+	primary.Close()
+
+	assert.True(t, waitFor(2*time.Second, func() bool {
+		return pickAddress(b, nil) == backup.Addr().String()
+	}))
+
+	primary = listenAndDiscard(t, primaryAddress)
+
+	assert.True(t, waitFor(2*time.Second, func() bool {
+		return pickAddress(b, nil) == primaryAddress
+	}))
+}
+
+func TestBackendRequiresHealthChecksForFailover(t *testing.T) {
+	var testCases = []struct {
+		description string
+		server      Server
+	}{
+		{
+			description: "backup",
+			server:      Server{Address: "127.0.0.1:8081", Backup: true},
+		},
+		{
+			description: "priority",
+			server:      Server{Address: "127.0.0.1:8081", Priority: 1},
+		},
+		{
+			description: "discovered backup",
+			server:      Server{Address: "srv:_app._tcp.example.internal", Backup: true},
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.description, func(t *testing.T) {
+			_, err := newBackend(Backend{
+				Name: "app",
+				Servers: []Server{
+					{Address: "127.0.0.1:8080"},
+					tc.server,
+				},
+			}, nil, zerolog.Nop())
+			assert.Error(t, err)
+		})
+	}
+}
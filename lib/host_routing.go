@@ -0,0 +1,241 @@
+package lib
+
+import (
+	"bytes"
+	"net"
+	"net/url"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	defaultHostRoutingTimeout  = 1 * time.Second
+	defaultHostRoutingMaxBytes = 8192
+)
+
+// hostRule sends connections requesting a host to a
+// backend. Wildcard rules keep the suffix (with the
+// leading dot) that hosts must end with.
+type hostRule struct {
+	host     string
+	wildcard bool
+	backend  *backend
+}
+
+func newHostRule(cfg HostRule, backends map[string]*backend) (r hostRule, err error) {
+	var host = strings.TrimSuffix(strings.ToLower(cfg.Host), ".")
+
+	if strings.HasPrefix(host, "*.") {
+		r.wildcard = true
+		host = host[1:]
+	}
+
+	if len(strings.Trim(host, ".")) == 0 || strings.Contains(host, "*") {
+		err = errors.Errorf("malformed host '%s'", cfg.Host)
+		return
+	}
+
+	r.host = host
+	r.backend = backends[cfg.Backend]
+	if r.backend == nil {
+		err = errors.Errorf("unknown backend '%s' for host %s", cfg.Backend, cfg.Host)
+		return
+	}
+
+	return
+}
+
+func (r *hostRule) match(host string) bool {
+	if r.wildcard {
+		return len(host) > len(r.host) && strings.HasSuffix(host, r.host)
+	}
+
+	return host == r.host
+}
+
+// hostRouter routes plaintext HTTP/1.x connections by
+// the host of their first request, evaluating rules in
+// order.
+type hostRouter struct {
+	rules    []hostRule
+	timeout  time.Duration
+	maxBytes int
+}
+
+func newHostRouter(cfg HostRouting, backends map[string]*backend) (r *hostRouter, err error) {
+	if len(cfg.Rules) == 0 {
+		return
+	}
+
+	if cfg.Timeout < 0 || cfg.MaxBytes < 0 {
+		err = errors.Errorf("timeout and max bytes must not be negative")
+		return
+	}
+
+	if cfg.Timeout == 0 {
+		cfg.Timeout = defaultHostRoutingTimeout
+	}
+
+	if cfg.MaxBytes == 0 {
+		cfg.MaxBytes = defaultHostRoutingMaxBytes
+	}
+
+	r = &hostRouter{
+		timeout:  cfg.Timeout,
+		maxBytes: cfg.MaxBytes,
+	}
+
+	for _, ruleCfg := range cfg.Rules {
+		var rule hostRule
+
+		rule, err = newHostRule(ruleCfg, backends)
+		if err != nil {
+			return
+		}
+
+		r.rules = append(r.rules, rule)
+	}
+
+	return
+}
+
+// route peeks the request line and headers of a
+// connection until the host shows up, the headers end,
+// the deadline expires or 'maxBytes' got peeked. The
+// returned connection replays what was peeked and a nil
+// rule means that none matched.
+func (r *hostRouter) route(conn net.Conn) (peeked *PeekedConn, rule *hostRule, host string) {
+	var (
+		deadline = time.Now().Add(r.timeout)
+		want     = 1
+	)
+
+	peeked = NewPeekedConn(conn, r.maxBytes)
+
+	for {
+		remaining := time.Until(deadline)
+		if remaining <= 0 {
+			remaining = time.Nanosecond
+		}
+
+		_, err := peeked.PeekWithTimeout(want, remaining)
+		b, _ := peeked.r.Peek(peeked.r.Buffered())
+
+		var done bool
+
+		host, done = parseHttpHost(b)
+		if done || err != nil || len(b) >= r.maxBytes {
+			break
+		}
+
+		want = len(b) + 1
+	}
+
+	if host == "" {
+		return
+	}
+
+	for ndx := range r.rules {
+		if r.rules[ndx].match(host) {
+			rule = &r.rules[ndx]
+			return
+		}
+	}
+
+	return
+}
+
+// parseHttpHost looks for the host requested by the
+// HTTP/1.x request at the start of 'b': the one of an
+// absolute request target or else the Host header. It
+// tells whether it reached a conclusion ('done') or
+// needs more bytes, with an empty host meaning that
+// there's none to route by (not HTTP or no Host).
+func parseHttpHost(b []byte) (host string, done bool) {
+	end := bytes.IndexByte(b, '\n')
+	if end < 0 {
+		// bails out as soon as the bytes can't be the
+		// method of a request.
+		for _, c := range b {
+			if c == ' ' {
+				break
+			}
+
+			if c < 'A' || c > 'Z' {
+				done = true
+				return
+			}
+		}
+
+		return
+	}
+
+	fields := strings.Fields(string(b[:end]))
+	if len(fields) != 3 || !strings.HasPrefix(fields[2], "HTTP/1.") {
+		done = true
+		return
+	}
+
+	if strings.Contains(fields[1], "://") {
+		u, err := url.Parse(fields[1])
+		if err == nil && u.Host != "" {
+			host, done = normalizeHost(u.Host), true
+			return
+		}
+	}
+
+	for b = b[end+1:]; ; b = b[end+1:] {
+		end = bytes.IndexByte(b, '\n')
+		if end < 0 {
+			return
+		}
+
+		line := strings.TrimRight(string(b[:end]), "\r")
+		if line == "" {
+			done = true
+			return
+		}
+
+		colon := strings.IndexByte(line, ':')
+		if colon > 0 && strings.EqualFold(line[:colon], "host") {
+			host, done = normalizeHost(line[colon+1:]), true
+			return
+		}
+	}
+}
+
+// normalizeHost lowercases a host and strips its port,
+// the brackets of IPv6 addresses and the trailing dot.
+func normalizeHost(host string) string {
+	host = strings.ToLower(strings.TrimSpace(host))
+
+	if name, _, err := net.SplitHostPort(host); err == nil {
+		host = name
+	}
+
+	host = strings.TrimSuffix(strings.TrimPrefix(host, "["), "]")
+	return strings.TrimSuffix(host, ".")
+}
+
+// hostRoute routes a connection by the host of its
+// first HTTP request, retrieving the connection to proxy
+// (replaying the peeked bytes) and the backend of the
+// rule that matched, if any.
+func (f *frontend) hostRoute(conn net.Conn) (net.Conn, *backend) {
+	peeked, rule, host := f.hostRouter.route(conn)
+	if rule == nil {
+		atomic.AddUint64(&f.hostUnmatched, 1)
+		return peeked, nil
+	}
+
+	atomic.AddUint64(&f.hostMatched, 1)
+	f.logger.Debug().
+		Str("remote", conn.RemoteAddr().String()).
+		Str("host", host).
+		Str("backend", rule.backend.name).
+		Msg("routed by host")
+	return peeked, rule.backend
+}
@@ -0,0 +1,213 @@
+package lib
+
+import (
+	"io"
+	"io/ioutil"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseHttpHost(t *testing.T) {
+	var testCases = []struct {
+		description string
+		input       string
+		host        string
+		done        bool
+	}{
+		{"host header", "GET / HTTP/1.1\r\nHost: example.com\r\n\r\n", "example.com", true},
+		{"before the end of the headers", "GET / HTTP/1.1\r\nAccept: */*\r\nHost: example.com\r\n", "example.com", true},
+		{"case insensitive", "GET / HTTP/1.1\r\nhOsT: Example.COM.\r\n", "example.com", true},
+		{"with port", "GET / HTTP/1.1\r\nHost: example.com:8080\r\n", "example.com", true},
+		{"ipv6", "GET / HTTP/1.1\r\nHost: [2001:db8::1]:8080\r\n", "2001:db8::1", true},
+		{"bare line feeds", "GET / HTTP/1.0\nHost: example.com\n", "example.com", true},
+		{"absolute target", "GET http://other.com/a HTTP/1.1\r\nHost: example.com\r\n", "other.com", true},
+		{"without host", "GET / HTTP/1.0\r\nAccept: */*\r\n\r\n", "", true},
+		{"partial request line", "GET / HT", "", false},
+		{"partial header", "GET / HTTP/1.1\r\nHost: exam", "", false},
+		{"not http", "\x16\x03\x01", "", true},
+		{"http/2", "PRI * HTTP/2.0\r\n\r\n", "", true},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.description, func(t *testing.T) {
+			host, done := parseHttpHost([]byte(tc.input))
+			assert.Equal(t, tc.host, host)
+			assert.Equal(t, tc.done, done)
+		})
+	}
+}
+
+func TestHostRuleMatch(t *testing.T) {
+	var backends = map[string]*backend{"b": {name: "b"}}
+
+	var testCases = []struct {
+		description string
+		rule        string
+		host        string
+		matched     bool
+	}{
+		{"exact", "Example.com", "example.com", true},
+		{"exact mismatch", "example.com", "a.example.com", false},
+		{"wildcard", "*.example.com", "a.example.com", true},
+		{"nested wildcard", "*.example.com", "a.b.example.com", true},
+		{"wildcard without subdomain", "*.example.com", "example.com", false},
+		{"wildcard suffix only", "*.example.com", "badexample.com", false},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.description, func(t *testing.T) {
+			rule, err := newHostRule(HostRule{Host: tc.rule, Backend: "b"}, backends)
+			assert.NoError(t, err)
+			assert.Equal(t, tc.matched, rule.match(tc.host))
+		})
+	}
+
+	for _, rule := range []HostRule{
+		{Host: "", Backend: "b"},
+		{Host: "*.", Backend: "b"},
+		{Host: "a.*.com", Backend: "b"},
+		{Host: "example.com", Backend: "c"},
+	} {
+		_, err := newHostRule(rule, backends)
+		assert.Error(t, err, "%+v", rule)
+	}
+}
+
+func TestHostRouterRoute(t *testing.T) {
+	var backends = map[string]*backend{
+		"api": {name: "api"},
+		"web": {name: "web"},
+	}
+
+	var testCases = []struct {
+		description string
+		chunks      []string
+		expected    string
+	}{
+		{"single chunk", []string{"GET / HTTP/1.1\r\nHost: api.example.com\r\n\r\n"}, "api"},
+		{"split chunks", []string{"GET / HTTP/1.1\r\n", "Host: www.exa", "mple.com\r\n\r\nbody"}, "web"},
+		{"earlier rule takes precedence", []string{"GET / HTTP/1.1\r\nHost: api.example.com\r\n"}, "api"},
+		{"no rule", []string{"GET / HTTP/1.1\r\nHost: other.com\r\n\r\n"}, ""},
+		{"not http", []string{"SSH-2.0-client\r\n"}, ""},
+		{"headers never end", []string{"GET / HTTP/1.1\r\nAccept: */*\r\n"}, ""},
+		{"silent client", nil, ""},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.description, func(t *testing.T) {
+			r, err := newHostRouter(HostRouting{
+				Timeout: 200 * time.Millisecond,
+				Rules: []HostRule{
+					{Host: "api.example.com", Backend: "api"},
+					{Host: "*.example.com", Backend: "web"},
+				},
+			}, backends)
+			assert.NoError(t, err)
+
+			client, server := net.Pipe()
+			defer client.Close()
+			defer server.Close()
+
+			go func() {
+				for _, chunk := range tc.chunks {
+					client.Write([]byte(chunk))
+					time.Sleep(20 * time.Millisecond)
+				}
+			}()
+
+			conn, rule, _ := r.route(server)
+			if tc.expected == "" {
+				assert.Nil(t, rule)
+			} else if assert.NotNil(t, rule) {
+				assert.Equal(t, tc.expected, rule.backend.name)
+			}
+
+			// the peeked bytes get replayed.
+			time.Sleep(100 * time.Millisecond)
+			client.Close()
+
+			replayed, _ := ioutil.ReadAll(conn)
+			assert.Equal(t, strings.Join(tc.chunks, ""), string(replayed))
+		})
+	}
+}
+
+func TestHostRouterBoundsPeekedBytes(t *testing.T) {
+	r, err := newHostRouter(HostRouting{
+		Timeout:  time.Second,
+		MaxBytes: 64,
+		Rules:    []HostRule{{Host: "example.com", Backend: "b"}},
+	}, map[string]*backend{"b": {name: "b"}})
+	assert.NoError(t, err)
+
+	client, server := net.Pipe()
+	defer client.Close()
+	defer server.Close()
+
+	request := "GET / HTTP/1.1\r\nCookie: " + strings.Repeat("a", 100) +
+		"\r\nHost: example.com\r\n\r\n"
+	go client.Write([]byte(request))
+
+	start := time.Now()
+	conn, rule, _ := r.route(server)
+	assert.Nil(t, rule)
+	assert.True(t, time.Since(start) < 500*time.Millisecond)
+
+	replayed := make([]byte, len(request))
+	_, err = io.ReadFull(conn, replayed)
+	assert.NoError(t, err)
+	assert.Equal(t, request, string(replayed))
+}
+
+func TestLoadBalancerRoutesByHost(t *testing.T) {
+	upstream, upstreamAddress := listenEcho(t, "tcp4", "127.0.0.1:0")
+	defer upstream.Close()
+
+	api, apiAddress := listenEcho(t, "tcp4", "127.0.0.1:0")
+	defer api.Close()
+
+	lb := startLoadBalancer(t, LoadBalancerConfig{
+		Frontends: []Frontend{{
+			Name:    "a",
+			Address: freeAddress(t),
+			Backend: "echo",
+			HostRouting: HostRouting{
+				Timeout: 200 * time.Millisecond,
+				Rules:   []HostRule{{Host: "*.example.com", Backend: "api"}},
+			},
+		}},
+		Backends: []Backend{
+			{Name: "echo", Servers: []Server{{Address: upstreamAddress}}},
+			{Name: "api", Servers: []Server{{Address: apiAddress}}},
+		},
+	})
+
+	for _, request := range []string{
+		"GET / HTTP/1.1\r\nHost: api.example.com\r\n\r\n",
+		"GET / HTTP/1.1\r\nHost: other.com\r\n\r\n",
+	} {
+		conn, err := net.Dial("tcp", lb.frontends[0].address)
+		assert.NoError(t, err)
+
+		_, err = conn.Write([]byte(request))
+		assert.NoError(t, err)
+
+		conn.SetReadDeadline(time.Now().Add(time.Second))
+		reply := make([]byte, len(request))
+		_, err = io.ReadFull(conn, reply)
+		assert.NoError(t, err)
+		assert.Equal(t, request, string(reply))
+		conn.Close()
+	}
+
+	time.Sleep(50 * time.Millisecond)
+	stats := lb.Stats()
+	assert.Equal(t, uint64(1), stats.Frontends[0].HostMatched)
+	assert.Equal(t, uint64(1), stats.Frontends[0].HostUnmatched)
+	assert.Equal(t, uint64(1), stats.Backends[0].Servers[0].TotalConnections)
+	assert.Equal(t, uint64(1), stats.Backends[1].Servers[0].TotalConnections)
+}
@@ -0,0 +1,200 @@
+package lib
+
+import (
+	"net"
+	"sync"
+	"sync/atomic"
+
+	"github.com/pkg/errors"
+)
+
+// Actions taken when a frontend is at its connection
+// limits.
+const (
+	LimitActionClose = "close"
+	LimitActionWait  = "wait"
+)
+
+// connectionLimit bounds the number of concurrent
+// connections. A nil limit is unlimited.
+type connectionLimit chan struct{}
+
+func newConnectionLimit(max int) connectionLimit {
+	if max == 0 {
+		return nil
+	}
+
+	return make(connectionLimit, max)
+}
+
+// tryAcquire takes a slot without waiting, retrieving
+// whether it could.
+func (l connectionLimit) tryAcquire() bool {
+	if l == nil {
+		return true
+	}
+
+	select {
+	case l <- struct{}{}:
+		return true
+	default:
+		return false
+	}
+}
+
+// acquire waits for a slot until 'done' gets closed,
+// retrieving whether it got one.
+func (l connectionLimit) acquire(done <-chan struct{}) bool {
+	if l == nil {
+		return true
+	}
+
+	select {
+	case l <- struct{}{}:
+		return true
+	case <-done:
+		return false
+	}
+}
+
+func (l connectionLimit) release() {
+	if l == nil {
+		return
+	}
+
+	<-l
+}
+
+// clientLimit bounds the concurrent connections of
+// each client IP. Entries only exist while a client
+// has connections, so the table is bounded by the
+// connections being served.
+type clientLimit struct {
+	max     int
+	mu      sync.Mutex
+	clients map[string]int
+}
+
+func newClientLimit(max int) *clientLimit {
+	return &clientLimit{
+		max:     max,
+		clients: map[string]int{},
+	}
+}
+
+func (l *clientLimit) tryAcquire(client net.Addr) bool {
+	if l.max == 0 {
+		return true
+	}
+
+	var key = clientKey(client)
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.clients[key] >= l.max {
+		return false
+	}
+
+	l.clients[key]++
+	return true
+}
+
+func (l *clientLimit) release(client net.Addr) {
+	if l.max == 0 {
+		return
+	}
+
+	var key = clientKey(client)
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.clients[key]--
+	if l.clients[key] <= 0 {
+		delete(l.clients, key)
+	}
+}
+
+func validateLimitAction(action string) (err error) {
+	switch action {
+	case LimitActionClose, LimitActionWait:
+	default:
+		err = errors.Errorf("unknown limit action '%s'", action)
+	}
+
+	return
+}
+
+// acceptSlot takes the frontend and global slots of a
+// connection about to be accepted when the limit
+// action is 'wait', blocking until there are free
+// slots (which leaves new connections in the listen
+// backlog). It retrieves false if the frontend got
+// closed while waiting.
+func (f *frontend) acceptSlot() bool {
+	var waited bool
+
+	if f.limitAction != LimitActionWait {
+		return true
+	}
+
+	if !f.limit.tryAcquire() {
+		waited = true
+		if !f.limit.acquire(f.done) {
+			return false
+		}
+	}
+
+	if !f.global.tryAcquire() {
+		waited = true
+		if !f.global.acquire(f.done) {
+			f.limit.release()
+			return false
+		}
+	}
+
+	if waited {
+		atomic.AddUint64(&f.acceptWaits, 1)
+	}
+
+	return true
+}
+
+// admit takes the global and frontend slots of an
+// accepted connection when the limit action is
+// 'close', retrieving false (and accounting it) when
+// one of the limits is reached.
+func (f *frontend) admit() bool {
+	if f.limitAction == LimitActionWait {
+		return true
+	}
+
+	if !f.global.tryAcquire() {
+		atomic.AddUint64(&f.rejectedGlobal, 1)
+		return false
+	}
+
+	if !f.limit.tryAcquire() {
+		f.global.release()
+		atomic.AddUint64(&f.rejectedFrontend, 1)
+		return false
+	}
+
+	return true
+}
+
+// takeSlot takes the slots of a connection that holds
+// none, as per the limit action.
+func (f *frontend) takeSlot() bool {
+	if f.limitAction == LimitActionWait {
+		return f.acceptSlot()
+	}
+
+	return f.admit()
+}
+
+func (f *frontend) releaseSlot() {
+	f.limit.release()
+	f.global.release()
+}
@@ -0,0 +1,178 @@
+package lib
+
+import (
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestConnectionLimit(t *testing.T) {
+	var testCases = []struct {
+		description string
+		max         int
+		acquired    int
+	}{
+		{"unlimited", 0, 10},
+		{"limited", 3, 3},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.description, func(t *testing.T) {
+			var (
+				limit    = newConnectionLimit(tc.max)
+				acquired int
+			)
+
+			for i := 0; i < 10; i++ {
+				if limit.tryAcquire() {
+					acquired++
+				}
+			}
+
+			assert.Equal(t, tc.acquired, acquired)
+
+			limit.release()
+			assert.True(t, limit.tryAcquire())
+		})
+	}
+}
+
+func TestClientLimit(t *testing.T) {
+	var (
+		limit = newClientLimit(2)
+		a1    = &net.TCPAddr{IP: net.ParseIP("10.0.0.1"), Port: 1}
+		a2    = &net.TCPAddr{IP: net.ParseIP("10.0.0.1"), Port: 2}
+		a3    = &net.TCPAddr{IP: net.ParseIP("10.0.0.1"), Port: 3}
+		b     = &net.TCPAddr{IP: net.ParseIP("10.0.0.2"), Port: 1}
+	)
+
+	assert.True(t, limit.tryAcquire(a1))
+	assert.True(t, limit.tryAcquire(a2))
+	assert.False(t, limit.tryAcquire(a3))
+	assert.True(t, limit.tryAcquire(b))
+
+	limit.release(a1)
+	assert.True(t, limit.tryAcquire(a3))
+
+	limit.release(a2)
+	limit.release(a3)
+	limit.release(b)
+	assert.Empty(t, limit.clients)
+}
+
+// dialEcho connects to an echo server through the
+// load-balancer, retrieving whether the connection
+// got served.
+func dialEcho(t *testing.T, address string) (net.Conn, bool) {
+	conn, err := net.Dial("tcp", address)
+	assert.NoError(t, err)
+
+	_, err = conn.Write([]byte("ping"))
+	if err != nil {
+		return conn, false
+	}
+
+	conn.SetReadDeadline(time.Now().Add(500 * time.Millisecond))
+	_, err = io.ReadFull(conn, make([]byte, 4))
+	conn.SetReadDeadline(time.Time{})
+
+	return conn, err == nil
+}
+
+func startLimitedLoadBalancer(t *testing.T, cfg LoadBalancerConfig, frontends ...Frontend) (*LoadBalancer, []string) {
+	upstream, upstreamAddress := listenEcho(t, "tcp4", "127.0.0.1:0")
+	t.Cleanup(func() { upstream.Close() })
+
+	var addresses []string
+	for ndx := range frontends {
+		frontends[ndx].Address = freeAddress(t)
+		frontends[ndx].Backend = "echo"
+		addresses = append(addresses, frontends[ndx].Address)
+	}
+
+	cfg.Frontends = frontends
+	cfg.Backends = []Backend{{
+		Name:    "echo",
+		Servers: []Server{{Address: upstreamAddress}},
+	}}
+
+	return startLoadBalancer(t, cfg), addresses
+}
+
+func TestLoadBalancerClosesConnectionsOverLimits(t *testing.T) {
+	var testCases = []struct {
+		description string
+		config      LoadBalancerConfig
+		frontends   []Frontend
+		expected    func(stats FrontendStats) uint64
+	}{
+		{
+			description: "global",
+			config:      LoadBalancerConfig{MaxConnections: 1},
+			frontends:   []Frontend{{Name: "a"}, {Name: "b"}},
+			expected:    func(stats FrontendStats) uint64 { return stats.RejectedGlobal },
+		},
+		{
+			description: "frontend",
+			frontends:   []Frontend{{Name: "a", MaxConnections: 1}, {Name: "b", MaxConnections: 1}},
+			expected:    func(stats FrontendStats) uint64 { return stats.RejectedFrontend },
+		},
+		{
+			description: "client",
+			frontends:   []Frontend{{Name: "a", MaxConnectionsPerClient: 1}, {Name: "b"}},
+			expected:    func(stats FrontendStats) uint64 { return stats.RejectedClient },
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.description, func(t *testing.T) {
+			lb, addresses := startLimitedLoadBalancer(t, tc.config, tc.frontends...)
+
+			first, served := dialEcho(t, addresses[0])
+			defer first.Close()
+			assert.True(t, served)
+
+			second, served := dialEcho(t, addresses[0])
+			defer second.Close()
+			assert.False(t, served)
+
+			assert.Equal(t, uint64(1), tc.expected(lb.Stats().Frontends[0]))
+
+			first.Close()
+			time.Sleep(100 * time.Millisecond)
+
+			third, served := dialEcho(t, addresses[0])
+			defer third.Close()
+			assert.True(t, served)
+		})
+	}
+}
+
+func TestLoadBalancerWaitsAtLimits(t *testing.T) {
+	lb, addresses := startLimitedLoadBalancer(t, LoadBalancerConfig{}, Frontend{
+		Name:           "a",
+		MaxConnections: 1,
+		LimitAction:    LimitActionWait,
+	})
+
+	first, served := dialEcho(t, addresses[0])
+	defer first.Close()
+	assert.True(t, served)
+
+	second, served := dialEcho(t, addresses[0])
+	defer second.Close()
+	assert.False(t, served)
+
+	first.Close()
+
+	second.SetReadDeadline(time.Now().Add(2 * time.Second))
+	_, err := io.ReadFull(second, make([]byte, 4))
+	assert.NoError(t, err)
+
+	stats := lb.Stats().Frontends[0]
+	assert.Equal(t, uint64(1), stats.AcceptWaits)
+	assert.Equal(t, uint64(0), stats.RejectedFrontend)
+}
@@ -1,144 +1,277 @@
 package lib
 
 import (
-	"fmt"
-	"net"
+	"net/http"
 	"os"
-	"time"
+	"sync"
 
 	"github.com/pkg/errors"
-	"github.com/rs/xid"
 	"github.com/rs/zerolog"
 )
 
-type server struct {
-	address          string
-	activeProxies    []Proxy
-	totalConnections uint64
-	totalRx          uint64
-	totalTx          uint64
-}
-
+// LoadBalancer holds a set of frontends, each sending
+// connections to a named backend pool. Logging, stats
+// and the admin interface are shared among them.
 type LoadBalancer struct {
-	servers []*server
-	nextIdx int
-	port    int
-	logger  zerolog.Logger
+	frontends []*frontend
+	backends  []*backend
+	logger    zerolog.Logger
+
+	// discoverers feed many backends at once, as opposed
+	// to the ones of each backend. The acl files and
+	// geoip databases of the frontends get reloaded
+	// through them as well.
+	discoverers []discoverer
+	done        chan struct{}
+
+	adminAddress string
+	adminServer  *http.Server
+	stateFile    string
+	capturer     *capturer
 }
 
 type LoadBalancerConfig struct {
-	Port  int
 	Debug bool
+
+	// Admin is the address where the admin HTTP
+	// interface listens on. Empty disables it.
+	Admin string
+
+	// MaxConnections bounds the concurrent connections
+	// of all frontends. Zero means no limit.
+	MaxConnections int
+
+	Frontends []Frontend
+	Backends  []Backend
+
+	// Discovery feeds the backends with servers at
+	// runtime. Backends may only lack servers in the
+	// configuration when it's set.
+	Discovery Discovery
+
+	// Resolver is used to periodically resolve the
+	// servers of backends that set a resolve interval.
+	// Defaults to net.DefaultResolver.
+	Resolver Resolver
+
+	// StateFile is read when creating the load-balancer
+	// and written when stopping it so that state (e.g.,
+	// the affinity tables) survives graceful restarts.
+	// Empty disables it.
+	StateFile string
+
+	// Capture records the traffic of selected TCP
+	// connections to files.
+	Capture Capture
 }
 
-func NewLoadBalancer(cfg LoadBalancerConfig) (lb LoadBalancer, err error) {
-	if cfg.Port == 0 {
-		err = errors.Errorf("a port != 0 must be specified")
+func NewLoadBalancer(cfg LoadBalancerConfig) (lb *LoadBalancer, err error) {
+	var backends = map[string]*backend{}
+
+	err = validateTopology(cfg.Frontends, cfg.Backends)
+	if err != nil {
+		return
+	}
+
+	if cfg.MaxConnections < 0 {
+		err = errors.Errorf("max connections must not be negative")
 		return
 	}
 
+	global := newConnectionLimit(cfg.MaxConnections)
+
+	lb = &LoadBalancer{
+		adminAddress: cfg.Admin,
+		stateFile:    cfg.StateFile,
+		done:         make(chan struct{}),
+	}
+
 	if cfg.Debug {
 		lb.logger = zerolog.New(zerolog.ConsoleWriter{Out: os.Stderr})
 	} else {
 		lb.logger = zerolog.New(os.Stderr)
 	}
 
-	lb.port = cfg.Port
-	return
-}
+	lb.capturer, err = newCapturer(cfg.Capture, lb.logger)
+	if err != nil {
+		return
+	}
 
-func (lb *LoadBalancer) Load(addresses []string) (err error) {
-	lb.logger.Info().
-		Int("n-addresses", len(addresses)).
-		Msg("loading configuration")
+	for _, backendCfg := range cfg.Backends {
+		var b *backend
 
-	var servers []*server
+		if len(backendCfg.Servers) == 0 && !cfg.Discovery.enabled() {
+			err = errors.Errorf("backend %s must specify at least one server",
+				backendCfg.Name)
+			return
+		}
 
-	if len(addresses) == 0 {
-		err = errors.Errorf("must specify at least one server")
-		return
+		b, err = newBackend(backendCfg, cfg.Resolver, lb.logger)
+		if err != nil {
+			return
+		}
+
+		backends[b.name] = b
+		lb.backends = append(lb.backends, b)
 	}
 
-	servers = make([]*server, len(addresses))
-	for ndx, address := range addresses {
-		servers[ndx] = &server{
-			address: address,
+	for _, frontendCfg := range cfg.Frontends {
+		var f *frontend
+
+		f, err = newFrontend(frontendCfg, backends, global, lb.logger)
+		if err != nil {
+			return
 		}
+
+		f.capturer = lb.capturer
+		lb.frontends = append(lb.frontends, f)
+
+		if f.acl != nil {
+			for _, file := range f.acl.files {
+				lb.discoverers = append(lb.discoverers, file)
+			}
+		}
+
+		if f.geoIP != nil {
+			for _, db := range f.geoIP.databases {
+				lb.discoverers = append(lb.discoverers, db)
+			}
+		}
+	}
+
+	if lb.stateFile != "" {
+		// a broken state file only loses the state,
+		// which is no reason not to start.
+		stateErr := lb.loadState()
+		if stateErr != nil {
+			lb.logger.Error().
+				Err(stateErr).
+				Msg("couldn't load state")
+		}
+	}
+
+	if cfg.Discovery.File.Path != "" {
+		lb.discoverers = append(lb.discoverers, newFileDiscovery(
+			cfg.Discovery.File, backends, lb.logger))
+	}
+
+	if cfg.Discovery.Docker.Socket != "" {
+		lb.discoverers = append(lb.discoverers, newDockerDiscovery(
+			cfg.Discovery.Docker, backends, lb.logger))
 	}
 
-	lb.servers = servers
 	return
 }
 
+// Listen starts listening on every frontend (and the
+// admin interface if configured), blocking until the
+// load-balancer gets stopped.
 func (lb *LoadBalancer) Listen() (err error) {
-	lb.logger.Info().
-		Int("port", lb.port).
-		Msg("listening")
+	var wg sync.WaitGroup
 
-	ln, err := net.Listen("tcp4", fmt.Sprintf(":%d", lb.port))
-	if err != nil {
-		err = errors.Wrapf(err,
-			"couldn't listen on port %d", lb.port)
-		return
+	for _, b := range lb.backends {
+		b.start()
 	}
 
-	ln = NewGracefulListener(GracefulListenerConfig{
-		Listener: ln,
-	})
+	for _, d := range lb.discoverers {
+		d.refresh()
+		go d.run(lb.done)
+	}
 
-	for {
-		conn, err := ln.Accept()
+	for _, f := range lb.frontends {
+		err = f.listen()
 		if err != nil {
-			lb.logger.Error().
-				Err(err).
-				Msg("errored accepting connection")
-			continue
+			lb.Stop()
+			return
 		}
+	}
+
+	if lb.adminAddress != "" {
+		err = lb.listenAdmin()
+		if err != nil {
+			lb.Stop()
+			return
+		}
+	}
 
-		go lb.handle(conn, lb.servers[lb.nextIdx%len(lb.servers)])
+	for _, f := range lb.frontends {
+		wg.Add(1)
+		go func(f *frontend) {
+			defer wg.Done()
+			f.serve()
+		}(f)
 	}
+
+	wg.Wait()
+	return
 }
 
-func (lb *LoadBalancer) handle(conn net.Conn, s *server) {
-	var logger = lb.logger.With().
-		Str("local", conn.LocalAddr().String()).
-		Str("upstream", s.address).
-		Str("id", xid.New().String()).
-		Logger()
+// Stop closes the frontends, waiting for established
+// connections to finish, and saves the state file.
+func (lb *LoadBalancer) Stop() (err error) {
+	if lb.adminServer != nil {
+		lb.adminServer.Close()
+	}
 
-	logger.Info().Msg("dialing")
-	agent, err := net.Dial("tcp4", s.address)
-	if err != nil {
-		logger.Error().
-			Err(err).
-			Msg("couldn't dial server")
-		return
+	for _, b := range lb.backends {
+		b.stop()
 	}
 
-	proxy, err := NewProxy(ProxyConfig{
-		To:                agent,
-		From:              conn,
-		ConnectionTimeout: 10 * time.Second,
-	})
-	if err != nil {
-		logger.Error().
-			Err(err).
-			Msg("couldn't create proxy")
-		return
+	select {
+	case <-lb.done:
+	default:
+		close(lb.done)
 	}
 
-	logger.Info().Msg("proxying")
-	err = proxy.Transfer()
-	if err != nil {
-		logger.Error().
-			Err(err).
-			Msg("errored transferring between connections")
-		return
+	for _, f := range lb.frontends {
+		closeErr := f.close()
+		if closeErr != nil && err == nil {
+			err = errors.Wrapf(closeErr,
+				"couldn't gracefully close frontend %s", f.name)
+		}
 	}
 
-	logger.Info().Msg("finished")
+	if lb.stateFile != "" {
+		stateErr := lb.saveState()
+		if stateErr != nil && err == nil {
+			err = stateErr
+		}
+	}
+
+	return
 }
 
-func (lb *LoadBalancer) Stop() (err error) {
+func (lb *LoadBalancer) Stats() (stats Stats) {
+	stats.Frontends = make([]FrontendStats, len(lb.frontends))
+	for ndx, f := range lb.frontends {
+		stats.Frontends[ndx] = f.stats()
+	}
+
+	stats.Backends = make([]BackendStats, len(lb.backends))
+	for ndx, b := range lb.backends {
+		stats.Backends[ndx] = b.stats()
+	}
+
+	stats.Capture = lb.capturer.stats()
 	return
 }
+
+func (lb *LoadBalancer) frontend(name string) *frontend {
+	for _, f := range lb.frontends {
+		if f.name == name {
+			return f
+		}
+	}
+
+	return nil
+}
+
+func (lb *LoadBalancer) backend(name string) *backend {
+	for _, b := range lb.backends {
+		if b.name == name {
+			return b
+		}
+	}
+
+	return nil
+}
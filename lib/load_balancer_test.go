@@ -0,0 +1,311 @@
+package lib
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// freeAddress retrieves a local address that is very
+// likely not being used.
+func freeAddress(t *testing.T) string {
+	ln, err := net.Listen("tcp4", "127.0.0.1:0")
+	assert.NoError(t, err)
+	defer ln.Close()
+
+	return ln.Addr().String()
+}
+
+func startDumbTcpServer(t *testing.T, w io.Writer) *DumbTcpServer {
+	server := NewDumbTcpServer(w)
+
+	go func() {
+		server.Listen()
+	}()
+
+	time.Sleep(100 * time.Millisecond)
+	return &server
+}
+
+// startLoadBalancer creates a load-balancer and makes
+// it listen, waiting until all of its frontends are
+// ready. Once the test finishes, it gets stopped and
+// waited for.
+func startLoadBalancer(t *testing.T, cfg LoadBalancerConfig) *LoadBalancer {
+	lb, err := NewLoadBalancer(cfg)
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+
+	var listened = make(chan error, 1)
+	go func() {
+		listened <- lb.Listen()
+	}()
+
+	t.Cleanup(func() {
+		lb.Stop()
+		assert.NoError(t, <-listened)
+	})
+
+	deadline := time.After(2 * time.Second)
+	for !frontendsReady(lb) {
+		select {
+		case err := <-listened:
+			listened <- err
+			t.Fatalf("load-balancer stopped listening: %v", err)
+		case <-deadline:
+			t.Fatal("load-balancer didn't get ready")
+		case <-time.After(5 * time.Millisecond):
+		}
+	}
+
+	return lb
+}
+
+// frontendsReady tells whether every frontend of the
+// load-balancer got its listener.
+func frontendsReady(lb *LoadBalancer) bool {
+	for _, f := range lb.frontends {
+		f.mu.Lock()
+		ready := f.ln != nil || f.pc != nil
+		f.mu.Unlock()
+
+		if !ready {
+			return false
+		}
+	}
+
+	return true
+}
+
+func echo(t *testing.T, address string, msg []byte) {
+	conn, err := net.Dial("tcp", address)
+	assert.NoError(t, err)
+	defer conn.Close()
+
+	_, err = conn.Write(msg)
+	assert.NoError(t, err)
+
+	var received = make([]byte, len(msg))
+	_, err = io.ReadFull(conn, received)
+	assert.NoError(t, err)
+	assert.Equal(t, msg, received)
+}
+
+func TestNewLoadBalancerValidatesTopology(t *testing.T) {
+	var testCases = []struct {
+		description string
+		config      LoadBalancerConfig
+		shouldError bool
+	}{
+		{
+			description: "fails without frontends",
+			config:      LoadBalancerConfig{},
+			shouldError: true,
+		},
+		{
+			description: "fails with unknown backend",
+			config: LoadBalancerConfig{
+				Frontends: []Frontend{{Name: "f", Address: ":0", Backend: "b"}},
+			},
+			shouldError: true,
+		},
+		{
+			description: "fails with duplicate frontends",
+			config: LoadBalancerConfig{
+				Frontends: []Frontend{
+					{Name: "f", Address: ":0", Backend: "b"},
+					{Name: "f", Address: ":1", Backend: "b"},
+				},
+				Backends: []Backend{{Name: "b", Servers: []Server{{Address: "a:1"}}}},
+			},
+			shouldError: true,
+		},
+		{
+			description: "fails with unknown strategy",
+			config: LoadBalancerConfig{
+				Frontends: []Frontend{{Name: "f", Address: ":0", Backend: "b"}},
+				Backends: []Backend{{
+					Name: "b", Strategy: "random", Servers: []Server{{Address: "a:1"}},
+				}},
+			},
+			shouldError: true,
+		},
+		{
+			description: "fails with backends without servers",
+			config: LoadBalancerConfig{
+				Frontends: []Frontend{{Name: "f", Address: ":0", Backend: "b"}},
+				Backends:  []Backend{{Name: "b"}},
+			},
+			shouldError: true,
+		},
+		{
+			description: "succeeds with backends fed by discovery",
+			config: LoadBalancerConfig{
+				Frontends: []Frontend{{Name: "f", Address: ":0", Backend: "b"}},
+				Backends:  []Backend{{Name: "b"}},
+				Discovery: Discovery{
+					File: FileDiscovery{Path: "/tmp/endpoints.json"},
+				},
+			},
+		},
+		{
+			description: "succeeds with frontends sharing a backend",
+			config: LoadBalancerConfig{
+				Frontends: []Frontend{
+					{Name: "f1", Address: ":0", Backend: "b"},
+					{Name: "f2", Address: ":1", Backend: "b"},
+				},
+				Backends: []Backend{{Name: "b", Servers: []Server{{Address: "a:1"}}}},
+			},
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.description, func(t *testing.T) {
+			_, err := NewLoadBalancer(tc.config)
+			if tc.shouldError {
+				assert.Error(t, err)
+				return
+			}
+
+			assert.NoError(t, err)
+		})
+	}
+}
+
+func TestLoadBalancerWithMultipleFrontends(t *testing.T) {
+	var (
+		bufA, bufB bytes.Buffer
+		msg        = []byte("PING\r\n")
+	)
+
+	serverA := startDumbTcpServer(t, &bufA)
+	defer serverA.Close()
+	serverB := startDumbTcpServer(t, &bufB)
+	defer serverB.Close()
+
+	var (
+		addressA = freeAddress(t)
+		addressB = freeAddress(t)
+	)
+
+	lb := startLoadBalancer(t, LoadBalancerConfig{
+		Frontends: []Frontend{
+			{Name: "a", Address: addressA, Backend: "a"},
+			{Name: "b", Address: addressB, Backend: "b"},
+		},
+		Backends: []Backend{
+			{Name: "a", Servers: []Server{
+				{Address: fmt.Sprintf("127.0.0.1:%d", serverA.GetPort())},
+			}},
+			{Name: "b", Strategy: StrategyLeastConnections, Servers: []Server{
+				{Address: fmt.Sprintf("127.0.0.1:%d", serverB.GetPort())},
+			}},
+		},
+	})
+
+	echo(t, addressA, msg)
+	echo(t, addressA, msg)
+	echo(t, addressB, msg)
+
+	time.Sleep(100 * time.Millisecond)
+
+	assert.Equal(t, bytes.Repeat(msg, 2), bufA.Bytes())
+	assert.Equal(t, msg, bufB.Bytes())
+
+	stats := lb.Stats()
+	assert.Equal(t, uint64(2), stats.Frontends[0].TotalConnections)
+	assert.Equal(t, uint64(1), stats.Frontends[1].TotalConnections)
+	assert.Equal(t, uint64(2), stats.Backends[0].Servers[0].TotalConnections)
+	assert.Equal(t, uint64(2*len(msg)), stats.Backends[0].Servers[0].Tx)
+	assert.Equal(t, uint64(2*len(msg)), stats.Backends[0].Servers[0].Rx)
+}
+
+// listenEcho starts an echo server on 'address' and
+// retrieves the address it ended up bound to.
+func listenEcho(t *testing.T, network, address string) (net.Listener, string) {
+	ln, err := net.Listen(network, address)
+	if err != nil {
+		t.Skipf("can't listen on %s %s: %v", network, address, err)
+	}
+
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+
+			go func() {
+				defer conn.Close()
+				io.Copy(conn, conn)
+			}()
+		}
+	}()
+
+	return ln, ln.Addr().String()
+}
+
+func TestLoadBalancerWithIpv6(t *testing.T) {
+	var msg = []byte("PING\r\n")
+
+	upstream, upstreamAddress := listenEcho(t, "tcp6", "[::1]:0")
+	defer upstream.Close()
+
+	probe, _ := listenEcho(t, "tcp", ":0")
+	port := probe.Addr().(*net.TCPAddr).Port
+	probe.Close()
+
+	startLoadBalancer(t, LoadBalancerConfig{
+		Frontends: []Frontend{
+			{Name: "dual-stack", Address: fmt.Sprintf(":%d", port), Backend: "v6"},
+		},
+		Backends: []Backend{
+			{Name: "v6", Servers: []Server{{Address: upstreamAddress}}},
+		},
+	})
+
+	echo(t, fmt.Sprintf("127.0.0.1:%d", port), msg)
+	echo(t, fmt.Sprintf("[::1]:%d", port), msg)
+}
+
+func TestLoadBalancerStoppedBeforeListening(t *testing.T) {
+	for _, protocol := range []string{ProtocolTcp, ProtocolUdp} {
+		t.Run(protocol, func(t *testing.T) {
+			lb, err := NewLoadBalancer(LoadBalancerConfig{
+				Frontends: []Frontend{
+					{Name: "a", Address: freeAddress(t), Backend: "b", Protocol: protocol},
+				},
+				Backends: []Backend{
+					{Name: "b", Servers: []Server{{Address: "127.0.0.1:1"}}},
+				},
+			})
+			assert.NoError(t, err)
+
+			assert.NoError(t, lb.Stop())
+
+			var listened = make(chan error, 1)
+			go func() {
+				listened <- lb.Listen()
+			}()
+
+			select {
+			case err := <-listened:
+				assert.NoError(t, err)
+			case <-time.After(2 * time.Second):
+				t.Fatal("stopped load-balancer kept serving")
+			}
+
+			if protocol == ProtocolTcp {
+				_, err = net.Dial("tcp", lb.frontends[0].address)
+				assert.Error(t, err)
+			}
+		})
+	}
+}
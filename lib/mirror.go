@@ -0,0 +1,270 @@
+package lib
+
+import (
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/rs/xid"
+	"github.com/rs/zerolog"
+)
+
+const (
+	defaultMirrorBufferSize = 1024 * 1024
+	mirrorWriteTimeout      = 5 * time.Second
+)
+
+// mirror tees the bytes that clients send to a sample of
+// connections to a shadow backend. The shadow gets
+// written to on its own goroutine, so that it never
+// slows down the connection being proxied.
+type mirror struct {
+	backend    *backend
+	sample     float64
+	bufferSize int
+	logger     zerolog.Logger
+
+	connections uint64
+	mirrored    uint64
+	dropped     uint64
+}
+
+// newMirror creates the mirror of a frontend, retrieving
+// nil if no shadow backend is configured.
+func newMirror(cfg Mirror, backends map[string]*backend, logger zerolog.Logger) (m *mirror, err error) {
+	if cfg.Backend == "" {
+		return
+	}
+
+	if cfg.Sample < 0 || cfg.Sample > 1 {
+		err = errors.Errorf("mirror sample must be between 0 and 1")
+		return
+	}
+
+	if cfg.Sample == 0 {
+		cfg.Sample = 1
+	}
+
+	if cfg.BufferSize < 0 {
+		err = errors.Errorf("mirror buffer size must not be negative")
+		return
+	}
+
+	if cfg.BufferSize == 0 {
+		cfg.BufferSize = defaultMirrorBufferSize
+	}
+
+	b := backends[cfg.Backend]
+	if b == nil {
+		err = errors.Errorf("unknown mirror backend '%s'", cfg.Backend)
+		return
+	}
+
+	m = &mirror{
+		backend:    b,
+		sample:     cfg.Sample,
+		bufferSize: cfg.BufferSize,
+		logger: logger.With().
+			Str("mirror", b.name).
+			Logger(),
+	}
+	return
+}
+
+// start begins mirroring a client connection if it's
+// part of the sample, retrieving nil otherwise.
+func (m *mirror) start(conn net.Conn) *mirrorStream {
+	if m == nil || (m.sample < 1 && rand.Float64() >= m.sample) {
+		return nil
+	}
+
+	atomic.AddUint64(&m.connections, 1)
+
+	s := newMirrorStream(m, conn)
+	go s.run()
+	return s
+}
+
+func (m *mirror) stats() (connections, mirrored, dropped uint64) {
+	if m == nil {
+		return
+	}
+
+	return atomic.LoadUint64(&m.connections),
+		atomic.LoadUint64(&m.mirrored),
+		atomic.LoadUint64(&m.dropped)
+}
+
+// mirrorStream buffers the bytes of a client connection
+// until they're written to the shadow server. Once the
+// buffer overflows or the shadow fails, the rest of the
+// bytes are dropped: a stream with gaps would be of no
+// use to the shadow.
+type mirrorStream struct {
+	mirror *mirror
+	client net.Conn
+
+	mu      sync.Mutex
+	cond    *sync.Cond
+	buf     []byte
+	pending int
+	shadow  net.Conn
+	closed  bool
+	broken  bool
+}
+
+func newMirrorStream(m *mirror, conn net.Conn) *mirrorStream {
+	s := &mirrorStream{
+		mirror: m,
+		client: conn,
+	}
+	s.cond = sync.NewCond(&s.mu)
+	return s
+}
+
+// Write buffers 'p' to be sent to the shadow without
+// ever blocking. It never fails, so that the connection
+// being proxied goes on regardless of the shadow.
+func (s *mirrorStream) Write(p []byte) (n int, err error) {
+	n = len(p)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.broken || s.closed {
+		atomic.AddUint64(&s.mirror.dropped, uint64(n))
+		return
+	}
+
+	if s.pending+n > s.mirror.bufferSize {
+		atomic.AddUint64(&s.mirror.dropped, uint64(n))
+		s.fail(errors.Errorf("buffer of %d bytes overflowed", s.mirror.bufferSize))
+		return
+	}
+
+	s.buf = append(s.buf, p...)
+	s.pending += n
+	s.cond.Signal()
+	return
+}
+
+// Close stops buffering bytes, letting the ones already
+// buffered be sent to the shadow before closing it.
+func (s *mirrorStream) Close() error {
+	s.mu.Lock()
+	s.closed = true
+	s.cond.Signal()
+	s.mu.Unlock()
+	return nil
+}
+
+// fail drops the bytes buffered and closes the shadow
+// connection, if any. It must be called with the stream
+// locked.
+func (s *mirrorStream) fail(err error) {
+	if s.broken {
+		return
+	}
+
+	s.broken = true
+	atomic.AddUint64(&s.mirror.dropped, uint64(len(s.buf)))
+	s.pending -= len(s.buf)
+	s.buf = nil
+	s.cond.Signal()
+
+	if s.shadow != nil {
+		s.shadow.Close()
+	}
+
+	s.mirror.logger.Debug().
+		Err(err).
+		Str("remote", s.client.RemoteAddr().String()).
+		Msg("stopped mirroring connection")
+}
+
+func (s *mirrorStream) run() {
+	shadow, release, err := s.connect()
+	if err != nil {
+		s.mu.Lock()
+		s.fail(err)
+		s.mu.Unlock()
+		return
+	}
+	defer release()
+	defer shadow.Close()
+
+	// the responses of the shadow are of no use.
+	go io.Copy(ioutil.Discard, shadow)
+
+	s.mu.Lock()
+	if s.broken {
+		s.mu.Unlock()
+		return
+	}
+	s.shadow = shadow
+
+	for {
+		for len(s.buf) == 0 && !s.closed && !s.broken {
+			s.cond.Wait()
+		}
+
+		if s.broken || len(s.buf) == 0 {
+			s.mu.Unlock()
+			return
+		}
+
+		chunk := s.buf
+		s.buf = nil
+		s.mu.Unlock()
+
+		shadow.SetWriteDeadline(time.Now().Add(mirrorWriteTimeout))
+		n, err := shadow.Write(chunk)
+		atomic.AddUint64(&s.mirror.mirrored, uint64(n))
+
+		s.mu.Lock()
+		s.pending -= len(chunk)
+		if err != nil {
+			atomic.AddUint64(&s.mirror.dropped, uint64(len(chunk)-n))
+			s.fail(err)
+		}
+	}
+}
+
+// connect dials a server of the shadow backend, taking
+// one of its slots without waiting.
+func (s *mirrorStream) connect() (shadow net.Conn, release func(), err error) {
+	var b = s.mirror.backend
+
+	server := b.tryAcquire(s.client.RemoteAddr())
+	if server == nil {
+		err = errors.Errorf("no server available in backend %s", b.name)
+		return
+	}
+
+	shadow, err = b.dial(server)
+	b.observeDial(server, err)
+	if err != nil {
+		b.release(server)
+		err = errors.Wrapf(err, "couldn't dial shadow server %s", server.address)
+		return
+	}
+
+	if server.proxyProtocol != "" {
+		err = writeProxyProtocolHeader(shadow, s.client,
+			server.proxyProtocol, xid.New().String(), "")
+		if err != nil {
+			shadow.Close()
+			b.release(server)
+			err = errors.Wrapf(err, "couldn't write proxy protocol header")
+			return
+		}
+	}
+
+	release = func() { b.release(server) }
+	return
+}
@@ -0,0 +1,226 @@
+package lib
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/rs/zerolog"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestNewMirrorValidates(t *testing.T) {
+	var backends = map[string]*backend{"shadow": {name: "shadow"}}
+
+	var testCases = []struct {
+		description string
+		config      Mirror
+		shouldFail  bool
+	}{
+		{
+			description: "no backend",
+			config:      Mirror{Sample: 0.5},
+		},
+		{
+			description: "defaults",
+			config:      Mirror{Backend: "shadow"},
+		},
+		{
+			description: "unknown backend",
+			config:      Mirror{Backend: "unknown"},
+			shouldFail:  true,
+		},
+		{
+			description: "sample over 1",
+			config:      Mirror{Backend: "shadow", Sample: 1.5},
+			shouldFail:  true,
+		},
+		{
+			description: "negative buffer size",
+			config:      Mirror{Backend: "shadow", BufferSize: -1},
+			shouldFail:  true,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.description, func(t *testing.T) {
+			_, err := newMirror(tc.config, backends, zerolog.Nop())
+			if tc.shouldFail {
+				assert.Error(t, err)
+				return
+			}
+
+			assert.NoError(t, err)
+		})
+	}
+}
+
+func TestMirrorStreamDropsOnOverflow(t *testing.T) {
+	client, _ := net.Pipe()
+	defer client.Close()
+
+	var (
+		m = &mirror{bufferSize: 8, logger: zerolog.Nop()}
+		s = newMirrorStream(m, client)
+	)
+
+	for _, chunk := range []string{"abcd", "efgh", "i", "jk"} {
+		n, err := s.Write([]byte(chunk))
+		assert.NoError(t, err)
+		assert.Equal(t, len(chunk), n)
+	}
+
+	// once the buffer overflowed, what was buffered gets
+	// dropped along with the rest.
+	_, mirrored, dropped := m.stats()
+	assert.Equal(t, uint64(0), mirrored)
+	assert.Equal(t, uint64(11), dropped)
+	assert.Empty(t, s.buf)
+}
+
+// listenShadow accepts connections, retrieving the bytes
+// they send through the channel once they're closed.
+// Unless 'read' is set, nothing gets read from them.
+func listenShadow(t *testing.T, read bool) (string, chan []byte) {
+	ln, err := net.Listen("tcp4", "127.0.0.1:0")
+	assert.NoError(t, err)
+
+	var (
+		received = make(chan []byte, 1)
+		done     = make(chan struct{})
+	)
+
+	t.Cleanup(func() {
+		ln.Close()
+		close(done)
+	})
+
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+
+			go func() {
+				defer conn.Close()
+
+				if !read {
+					<-done
+					return
+				}
+
+				// responses must not reach the client.
+				conn.Write([]byte("shadow"))
+
+				content, _ := ioutil.ReadAll(conn)
+				received <- content
+			}()
+		}
+	}()
+
+	return ln.Addr().String(), received
+}
+
+func startMirroredLoadBalancer(t *testing.T, shadow string, mirror Mirror) (*LoadBalancer, string) {
+	upstream, upstreamAddress := listenEcho(t, "tcp4", "127.0.0.1:0")
+	t.Cleanup(func() { upstream.Close() })
+
+	mirror.Backend = "shadow"
+
+	lb := startLoadBalancer(t, LoadBalancerConfig{
+		Frontends: []Frontend{{
+			Name:    "a",
+			Address: freeAddress(t),
+			Backend: "echo",
+			Mirror:  mirror,
+		}},
+		Backends: []Backend{
+			{Name: "echo", Servers: []Server{{Address: upstreamAddress}}},
+			{Name: "shadow", Servers: []Server{{Address: shadow}}},
+		},
+	})
+
+	return lb, lb.frontends[0].address
+}
+
+func TestLoadBalancerMirrorsConnections(t *testing.T) {
+	shadow, received := listenShadow(t, true)
+	lb, address := startMirroredLoadBalancer(t, shadow, Mirror{})
+
+	echo(t, address, []byte("hello"))
+
+	select {
+	case content := <-received:
+		assert.Equal(t, "hello", string(content))
+	case <-time.After(2 * time.Second):
+		t.Fatal("shadow got nothing")
+	}
+
+	stats := lb.Stats().Frontends[0]
+	assert.Equal(t, uint64(1), stats.MirroredConnections)
+	assert.Equal(t, uint64(5), stats.MirroredBytes)
+	assert.Equal(t, uint64(0), stats.MirrorDroppedBytes)
+}
+
+func TestLoadBalancerMirrorsWithoutBlocking(t *testing.T) {
+	var testCases = []struct {
+		description string
+		shadow      func(t *testing.T) string
+	}{
+		{
+			description: "shadow down",
+			shadow: func(t *testing.T) string {
+				return freeAddress(t)
+			},
+		},
+		{
+			description: "shadow not reading",
+			shadow: func(t *testing.T) string {
+				address, _ := listenShadow(t, false)
+				return address
+			},
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.description, func(t *testing.T) {
+			lb, address := startMirroredLoadBalancer(t, tc.shadow(t), Mirror{
+				BufferSize: 64 * 1024,
+			})
+
+			conn, err := net.Dial("tcp", address)
+			assert.NoError(t, err)
+			defer conn.Close()
+
+			var (
+				msg      = bytes.Repeat([]byte("l4"), 16*1024*1024)
+				received = make([]byte, len(msg))
+				wg       sync.WaitGroup
+			)
+
+			conn.SetDeadline(time.Now().Add(10 * time.Second))
+
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				_, err := conn.Write(msg)
+				assert.NoError(t, err)
+			}()
+
+			_, err = io.ReadFull(conn, received)
+			assert.NoError(t, err)
+			assert.True(t, bytes.Equal(msg, received))
+			wg.Wait()
+
+			stats := lb.Stats().Frontends[0]
+			assert.Equal(t, uint64(1), stats.MirroredConnections)
+			assert.True(t, stats.MirrorDroppedBytes > 0)
+			assert.True(t, stats.MirroredBytes+stats.MirrorDroppedBytes <= uint64(len(msg)))
+		})
+	}
+}
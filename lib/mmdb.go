@@ -0,0 +1,422 @@
+package lib
+
+import (
+	"bytes"
+	"encoding/binary"
+	"math"
+	"math/big"
+	"net"
+
+	"github.com/pkg/errors"
+)
+
+// mmdbMetadataMarker precedes the metadata section at
+// the end of MaxMind DB files.
+var mmdbMetadataMarker = []byte("\xab\xcd\xefMaxMind.com")
+
+// Types of the fields of the data section.
+const (
+	mmdbExtended  = 0
+	mmdbPointer   = 1
+	mmdbString    = 2
+	mmdbDouble    = 3
+	mmdbBytes     = 4
+	mmdbUint16    = 5
+	mmdbUint32    = 6
+	mmdbMap       = 7
+	mmdbInt32     = 8
+	mmdbUint64    = 9
+	mmdbUint128   = 10
+	mmdbArray     = 11
+	mmdbContainer = 12
+	mmdbEndMarker = 13
+	mmdbBool      = 14
+	mmdbFloat     = 15
+)
+
+const (
+	// mmdbDataSeparator is the size of the zeroed
+	// section between the search tree and the data.
+	mmdbDataSeparator = 16
+
+	// mmdbMaxDepth bounds the nesting of decoded values
+	// so that malformed files can't recurse forever.
+	mmdbMaxDepth = 32
+)
+
+// mmdbReader looks up IP addresses in a MaxMind DB
+// (MMDB) file held in memory. See
+// https://maxmind.github.io/MaxMind-DB/ for the format.
+type mmdbReader struct {
+	tree       []byte
+	data       mmdbDecoder
+	nodeCount  uint
+	recordSize uint
+	ipVersion  uint
+
+	// ipv4Start is the node that IPv4 addresses start
+	// from in IPv6 databases, which hold them under
+	// '::/96'.
+	ipv4Start uint
+
+	databaseType string
+}
+
+func parseMMDB(content []byte) (r *mmdbReader, err error) {
+	metadataStart := bytes.LastIndex(content, mmdbMetadataMarker)
+	if metadataStart < 0 {
+		err = errors.Errorf("missing metadata marker")
+		return
+	}
+
+	metadataDecoder := mmdbDecoder(content[metadataStart+len(mmdbMetadataMarker):])
+
+	value, _, err := metadataDecoder.decode(0, 0)
+	if err != nil {
+		err = errors.Wrapf(err, "malformed metadata")
+		return
+	}
+
+	metadata, ok := value.(map[string]interface{})
+	if !ok {
+		err = errors.Errorf("metadata must be a map")
+		return
+	}
+
+	nodeCount, ok1 := metadata["node_count"].(uint64)
+	recordSize, ok2 := metadata["record_size"].(uint64)
+	ipVersion, ok3 := metadata["ip_version"].(uint64)
+	if !ok1 || !ok2 || !ok3 {
+		err = errors.Errorf("metadata lacks the node count, record size or ip version")
+		return
+	}
+
+	switch recordSize {
+	case 24, 28, 32:
+	default:
+		err = errors.Errorf("unsupported record size %d", recordSize)
+		return
+	}
+
+	if ipVersion != 4 && ipVersion != 6 {
+		err = errors.Errorf("unsupported ip version %d", ipVersion)
+		return
+	}
+
+	// the node count comes from the file, so it's bounded
+	// before being multiplied to not overflow.
+	if nodeCount > uint64(metadataStart)*4/recordSize {
+		err = errors.Errorf("search tree of %d nodes exceeds the file", nodeCount)
+		return
+	}
+
+	treeSize := nodeCount * recordSize / 4
+	if treeSize+mmdbDataSeparator > uint64(metadataStart) {
+		err = errors.Errorf("search tree of %d nodes exceeds the file", nodeCount)
+		return
+	}
+
+	r = &mmdbReader{
+		tree:       content[:treeSize],
+		data:       mmdbDecoder(content[treeSize+mmdbDataSeparator : metadataStart]),
+		nodeCount:  uint(nodeCount),
+		recordSize: uint(recordSize),
+		ipVersion:  uint(ipVersion),
+	}
+
+	r.databaseType, _ = metadata["database_type"].(string)
+
+	if r.ipVersion == 6 {
+		for i := 0; i < 96 && r.ipv4Start < r.nodeCount; i++ {
+			r.ipv4Start = r.record(r.ipv4Start, 0)
+		}
+	}
+
+	return
+}
+
+// record retrieves the left (bit 0) or right (bit 1)
+// record of a node of the search tree.
+func (r *mmdbReader) record(node uint, bit byte) uint {
+	switch r.recordSize {
+	case 24:
+		off := node*6 + uint(bit)*3
+		return uint(r.tree[off])<<16 | uint(r.tree[off+1])<<8 | uint(r.tree[off+2])
+	case 28:
+		off := node * 7
+		if bit == 0 {
+			return uint(r.tree[off+3]&0xf0)<<20 |
+				uint(r.tree[off])<<16 | uint(r.tree[off+1])<<8 | uint(r.tree[off+2])
+		}
+
+		return uint(r.tree[off+3]&0x0f)<<24 |
+			uint(r.tree[off+4])<<16 | uint(r.tree[off+5])<<8 | uint(r.tree[off+6])
+	default:
+		off := node*8 + uint(bit)*4
+		return uint(binary.BigEndian.Uint32(r.tree[off:]))
+	}
+}
+
+// lookup retrieves the record of the network holding
+// 'ip', or nil if there's none.
+func (r *mmdbReader) lookup(ip net.IP) (record interface{}, err error) {
+	var (
+		node    uint
+		address = ip.To4()
+	)
+
+	switch {
+	case address != nil && r.ipVersion == 6:
+		node = r.ipv4Start
+	case address == nil && r.ipVersion == 6:
+		address = ip.To16()
+	case address == nil:
+		// IPv6 addresses can't be in IPv4 databases.
+		return
+	}
+
+	if address == nil {
+		err = errors.Errorf("malformed ip")
+		return
+	}
+
+	for i := 0; i < len(address)*8 && node < r.nodeCount; i++ {
+		node = r.record(node, (address[i/8]>>uint(7-i%8))&1)
+	}
+
+	if node == r.nodeCount {
+		return
+	}
+
+	if node < r.nodeCount {
+		err = errors.Errorf("search tree deeper than the address")
+		return
+	}
+
+	offset := node - r.nodeCount - mmdbDataSeparator
+	record, _, err = r.data.decode(offset, 0)
+	return
+}
+
+// mmdbDecoder decodes the values of a data section,
+// whose pointers are relative to its start.
+type mmdbDecoder []byte
+
+func (d mmdbDecoder) bytes(offset, size uint) (b []byte, err error) {
+	if offset+size > uint(len(d)) || offset+size < offset {
+		err = errors.Errorf("field at %d exceeds the data section", offset)
+		return
+	}
+
+	b = d[offset : offset+size]
+	return
+}
+
+func (d mmdbDecoder) uint(offset, size uint) (value uint64, err error) {
+	b, err := d.bytes(offset, size)
+	if err != nil {
+		return
+	}
+
+	for _, c := range b {
+		value = value<<8 | uint64(c)
+	}
+
+	return
+}
+
+// decode decodes the value at 'offset', retrieving it
+// along with the offset of the next one.
+func (d mmdbDecoder) decode(offset uint, depth int) (value interface{}, next uint, err error) {
+	if depth > mmdbMaxDepth {
+		err = errors.Errorf("values nested too deep")
+		return
+	}
+
+	control, err := d.uint(offset, 1)
+	if err != nil {
+		return
+	}
+	offset++
+
+	typ := uint(control >> 5)
+	if typ == mmdbPointer {
+		var pointer uint
+
+		pointer, next, err = d.pointer(offset, uint(control))
+		if err != nil {
+			return
+		}
+
+		value, _, err = d.decode(pointer, depth+1)
+		return
+	}
+
+	if typ == mmdbExtended {
+		var extended uint64
+
+		extended, err = d.uint(offset, 1)
+		if err != nil {
+			return
+		}
+
+		typ = 7 + uint(extended)
+		offset++
+	}
+
+	size := uint(control & 0x1f)
+	switch size {
+	case 29, 30, 31:
+		var (
+			extra  = size - 28
+			extend uint64
+		)
+
+		extend, err = d.uint(offset, extra)
+		if err != nil {
+			return
+		}
+
+		size = [...]uint{29, 285, 65821}[extra-1] + uint(extend)
+		offset += extra
+	}
+
+	return d.decodeValue(typ, offset, size, depth)
+}
+
+// pointer decodes a pointer whose control byte was
+// already read, retrieving its target and the offset
+// after it.
+func (d mmdbDecoder) pointer(offset, control uint) (pointer, next uint, err error) {
+	var (
+		size  = (control>>3)&0x3 + 1
+		bits  = control & 0x7
+		value uint64
+	)
+
+	value, err = d.uint(offset, size)
+	if err != nil {
+		return
+	}
+
+	switch size {
+	case 1:
+		pointer = bits<<8 | uint(value)
+	case 2:
+		pointer = (bits<<16 | uint(value)) + 2048
+	case 3:
+		pointer = (bits<<24 | uint(value)) + 526336
+	default:
+		pointer = uint(value)
+	}
+
+	next = offset + size
+	return
+}
+
+func (d mmdbDecoder) decodeValue(typ, offset, size uint, depth int) (value interface{}, next uint, err error) {
+	next = offset + size
+
+	switch typ {
+	case mmdbString:
+		var b []byte
+
+		b, err = d.bytes(offset, size)
+		value = string(b)
+	case mmdbBytes:
+		var b []byte
+
+		b, err = d.bytes(offset, size)
+		value = append([]byte(nil), b...)
+	case mmdbDouble, mmdbFloat:
+		var bits uint64
+
+		if (typ == mmdbDouble && size != 8) || (typ == mmdbFloat && size != 4) {
+			err = errors.Errorf("invalid size %d for a floating point", size)
+			return
+		}
+
+		bits, err = d.uint(offset, size)
+		if typ == mmdbDouble {
+			value = math.Float64frombits(bits)
+		} else {
+			value = float64(math.Float32frombits(uint32(bits)))
+		}
+	case mmdbUint16, mmdbUint32, mmdbUint64, mmdbInt32:
+		var v uint64
+
+		if size > 8 {
+			err = errors.Errorf("invalid size %d for an integer", size)
+			return
+		}
+
+		v, err = d.uint(offset, size)
+		if typ == mmdbInt32 {
+			value = int64(int32(uint32(v)))
+		} else {
+			value = v
+		}
+	case mmdbUint128:
+		var b []byte
+
+		b, err = d.bytes(offset, size)
+		value = new(big.Int).SetBytes(b)
+	case mmdbBool:
+		value = size != 0
+		next = offset
+	case mmdbMap:
+		value, next, err = d.decodeMap(offset, size, depth)
+	case mmdbArray:
+		value, next, err = d.decodeArray(offset, size, depth)
+	default:
+		err = errors.Errorf("unexpected field type %d", typ)
+	}
+
+	return
+}
+
+func (d mmdbDecoder) decodeMap(offset, size uint, depth int) (value map[string]interface{}, next uint, err error) {
+	value = make(map[string]interface{})
+	next = offset
+
+	for i := uint(0); i < size; i++ {
+		var key, v interface{}
+
+		key, next, err = d.decode(next, depth+1)
+		if err != nil {
+			return
+		}
+
+		name, ok := key.(string)
+		if !ok {
+			err = errors.Errorf("map keys must be strings")
+			return
+		}
+
+		v, next, err = d.decode(next, depth+1)
+		if err != nil {
+			return
+		}
+
+		value[name] = v
+	}
+
+	return
+}
+
+func (d mmdbDecoder) decodeArray(offset, size uint, depth int) (value []interface{}, next uint, err error) {
+	next = offset
+
+	for i := uint(0); i < size; i++ {
+		var v interface{}
+
+		v, next, err = d.decode(next, depth+1)
+		if err != nil {
+			return
+		}
+
+		value = append(value, v)
+	}
+
+	return
+}
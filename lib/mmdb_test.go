@@ -0,0 +1,430 @@
+package lib
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io/ioutil"
+	"math"
+	"math/big"
+	"net"
+	"sort"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// mmdbEncoder writes the values of a data section,
+// deduplicating strings through pointers like the
+// MaxMind writers do.
+type mmdbEncoder struct {
+	buf     bytes.Buffer
+	strings map[string]int
+}
+
+func (e *mmdbEncoder) control(typ, size int) {
+	var first byte
+
+	if typ <= 7 {
+		first = byte(typ << 5)
+	}
+
+	switch {
+	case size < 29:
+		e.buf.WriteByte(first | byte(size))
+	case size < 285:
+		e.buf.WriteByte(first | 29)
+	case size < 65821:
+		e.buf.WriteByte(first | 30)
+	default:
+		e.buf.WriteByte(first | 31)
+	}
+
+	if typ > 7 {
+		e.buf.WriteByte(byte(typ - 7))
+	}
+
+	switch {
+	case size < 29:
+	case size < 285:
+		e.buf.WriteByte(byte(size - 29))
+	case size < 65821:
+		e.buf.Write([]byte{byte((size - 285) >> 8), byte(size - 285)})
+	default:
+		size -= 65821
+		e.buf.Write([]byte{byte(size >> 16), byte(size >> 8), byte(size)})
+	}
+}
+
+func (e *mmdbEncoder) pointer(offset int) {
+	if offset < 2048 {
+		e.buf.Write([]byte{1<<5 | byte(offset>>8), byte(offset)})
+		return
+	}
+
+	offset -= 2048
+	e.buf.Write([]byte{1<<5 | 1<<3 | byte(offset>>16)&7, byte(offset >> 8), byte(offset)})
+}
+
+func (e *mmdbEncoder) uint(typ int, value uint64, maxSize int) {
+	var b = make([]byte, 8)
+	binary.BigEndian.PutUint64(b, value)
+
+	b = bytes.TrimLeft(b[8-maxSize:], "\x00")
+	e.control(typ, len(b))
+	e.buf.Write(b)
+}
+
+// encode writes 'value', retrieving its offset.
+func (e *mmdbEncoder) encode(value interface{}) (offset int) {
+	offset = e.buf.Len()
+
+	switch v := value.(type) {
+	case string:
+		if e.strings != nil {
+			if previous, ok := e.strings[v]; ok {
+				e.pointer(previous)
+				return
+			}
+
+			e.strings[v] = offset
+		}
+
+		e.control(mmdbString, len(v))
+		e.buf.WriteString(v)
+	case []byte:
+		e.control(mmdbBytes, len(v))
+		e.buf.Write(v)
+	case float64:
+		e.control(mmdbDouble, 8)
+		binary.Write(&e.buf, binary.BigEndian, math.Float64bits(v))
+	case float32:
+		e.control(mmdbFloat, 4)
+		binary.Write(&e.buf, binary.BigEndian, math.Float32bits(v))
+	case uint16:
+		e.uint(mmdbUint16, uint64(v), 2)
+	case uint32:
+		e.uint(mmdbUint32, uint64(v), 4)
+	case uint64:
+		e.uint(mmdbUint64, v, 8)
+	case int32:
+		e.control(mmdbInt32, 4)
+		binary.Write(&e.buf, binary.BigEndian, v)
+	case *big.Int:
+		b := v.Bytes()
+		e.control(mmdbUint128, len(b))
+		e.buf.Write(b)
+	case bool:
+		size := 0
+		if v {
+			size = 1
+		}
+
+		e.control(mmdbBool, size)
+	case []interface{}:
+		e.control(mmdbArray, len(v))
+		for _, item := range v {
+			e.encode(item)
+		}
+	case map[string]interface{}:
+		var keys []string
+		for key := range v {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+
+		e.control(mmdbMap, len(v))
+		for _, key := range keys {
+			e.encode(key)
+			e.encode(v[key])
+		}
+	default:
+		panic("unsupported value")
+	}
+
+	return
+}
+
+// mmdbNode is a node of the search tree being built,
+// whose children are either nodes or data offsets.
+type mmdbNode struct {
+	children [2]interface{}
+	id       int
+}
+
+// buildMMDB generates a MaxMind DB holding 'networks'
+// (CIDRs mapped to their records). IPv4 networks of
+// IPv6 databases are stored under '::/96'.
+func buildMMDB(t *testing.T, ipVersion, recordSize int, networks map[string]interface{}) []byte {
+	var (
+		root = &mmdbNode{}
+		data = &mmdbEncoder{strings: map[string]int{}}
+		keys []string
+	)
+
+	for cidr := range networks {
+		keys = append(keys, cidr)
+	}
+
+	// shorter prefixes first so that longer ones can
+	// split them.
+	sort.Slice(keys, func(i, j int) bool {
+		_, a, _ := net.ParseCIDR(keys[i])
+		_, b, _ := net.ParseCIDR(keys[j])
+		onesA, _ := a.Mask.Size()
+		onesB, _ := b.Mask.Size()
+		return onesA < onesB
+	})
+
+	for _, cidr := range keys {
+		_, network, err := net.ParseCIDR(cidr)
+		assert.NoError(t, err)
+
+		var (
+			ones, bits = network.Mask.Size()
+			address    = []byte(network.IP)
+			offset     = data.encode(networks[cidr])
+		)
+
+		if ipVersion == 6 && bits == 32 {
+			address = append(make([]byte, 12), address...)
+			ones += 96
+		}
+
+		node := root
+		for i := 0; i < ones; i++ {
+			bit := (address[i/8] >> uint(7-i%8)) & 1
+			if i == ones-1 {
+				node.children[bit] = offset
+				break
+			}
+
+			child, ok := node.children[bit].(*mmdbNode)
+			if !ok {
+				child = &mmdbNode{}
+				if leaf, isLeaf := node.children[bit].(int); isLeaf {
+					child.children = [2]interface{}{leaf, leaf}
+				}
+
+				node.children[bit] = child
+			}
+
+			node = child
+		}
+	}
+
+	var nodes = []*mmdbNode{root}
+	for ndx := 0; ndx < len(nodes); ndx++ {
+		nodes[ndx].id = ndx
+		for _, child := range nodes[ndx].children {
+			if node, ok := child.(*mmdbNode); ok {
+				nodes = append(nodes, node)
+			}
+		}
+	}
+
+	var (
+		content   bytes.Buffer
+		nodeCount = len(nodes)
+	)
+
+	for _, node := range nodes {
+		var records [2]uint32
+
+		for bit, child := range node.children {
+			switch c := child.(type) {
+			case *mmdbNode:
+				records[bit] = uint32(c.id)
+			case int:
+				records[bit] = uint32(nodeCount + mmdbDataSeparator + c)
+			default:
+				records[bit] = uint32(nodeCount)
+			}
+		}
+
+		left, right := records[0], records[1]
+		switch recordSize {
+		case 24:
+			content.Write([]byte{byte(left >> 16), byte(left >> 8), byte(left),
+				byte(right >> 16), byte(right >> 8), byte(right)})
+		case 28:
+			content.Write([]byte{byte(left >> 16), byte(left >> 8), byte(left),
+				byte(left>>20)&0xf0 | byte(right>>24)&0x0f,
+				byte(right >> 16), byte(right >> 8), byte(right)})
+		case 32:
+			binary.Write(&content, binary.BigEndian, records)
+		}
+	}
+
+	content.Write(make([]byte, mmdbDataSeparator))
+	content.Write(data.buf.Bytes())
+	content.Write(mmdbMetadataMarker)
+
+	metadata := &mmdbEncoder{}
+	metadata.encode(map[string]interface{}{
+		"node_count":                  uint32(nodeCount),
+		"record_size":                 uint16(recordSize),
+		"ip_version":                  uint16(ipVersion),
+		"database_type":               "L4-Test",
+		"binary_format_major_version": uint16(2),
+		"languages":                   []interface{}{"en"},
+	})
+	content.Write(metadata.buf.Bytes())
+
+	return content.Bytes()
+}
+
+func writeMMDB(t *testing.T, path string, networks map[string]interface{}) {
+	assert.NoError(t, ioutil.WriteFile(path, buildMMDB(t, 6, 28, networks), 0644))
+}
+
+func country(code string) map[string]interface{} {
+	return map[string]interface{}{
+		"country": map[string]interface{}{
+			"iso_code": code,
+			"names":    map[string]interface{}{"en": code},
+		},
+	}
+}
+
+func TestMMDBLookup(t *testing.T) {
+	var networks = map[string]interface{}{
+		"81.2.69.0/24":   country("GB"),
+		"81.2.69.128/25": country("IE"),
+		"2001:db8::/32":  country("DE"),
+	}
+
+	var testCases = []struct {
+		description string
+		ip          string
+		expected    string
+		onlyV6      bool
+	}{
+		{"ipv4", "81.2.69.1", "GB", false},
+		{"more specific ipv4", "81.2.69.200", "IE", false},
+		{"ipv4 outside", "81.2.70.1", "", false},
+		{"ipv6", "2001:db8::1", "DE", true},
+		{"ipv6 outside", "2001:db9::1", "", true},
+	}
+
+	for _, ipVersion := range []int{4, 6} {
+		for _, recordSize := range []int{24, 28, 32} {
+			var db = networks
+			if ipVersion == 4 {
+				db = map[string]interface{}{
+					"81.2.69.0/24":   networks["81.2.69.0/24"],
+					"81.2.69.128/25": networks["81.2.69.128/25"],
+				}
+			}
+
+			r, err := parseMMDB(buildMMDB(t, ipVersion, recordSize, db))
+			assert.NoError(t, err)
+			assert.Equal(t, "L4-Test", r.databaseType)
+
+			for _, tc := range testCases {
+				if tc.onlyV6 && ipVersion == 4 {
+					continue
+				}
+
+				record, err := r.lookup(net.ParseIP(tc.ip))
+				assert.NoError(t, err)
+				assert.Equal(t, tc.expected, mmdbIsoCode(mapField(record, "country")),
+					"%s with ipv%d and %d bit records", tc.description, ipVersion, recordSize)
+			}
+		}
+	}
+}
+
+func mapField(record interface{}, field string) interface{} {
+	fields, _ := record.(map[string]interface{})
+	return fields[field]
+}
+
+func TestMMDBDecodesTypes(t *testing.T) {
+	var (
+		long  = string(bytes.Repeat([]byte("a"), 300))
+		large = new(big.Int).Lsh(big.NewInt(1), 100)
+	)
+
+	r, err := parseMMDB(buildMMDB(t, 4, 24, map[string]interface{}{
+		"10.0.0.0/8": map[string]interface{}{
+			"string":  "value",
+			"long":    long,
+			"bytes":   []byte{1, 2},
+			"double":  1.5,
+			"float":   float32(2.5),
+			"uint16":  uint16(65535),
+			"uint32":  uint32(1 << 31),
+			"uint64":  uint64(1 << 40),
+			"uint128": large,
+			"int32":   int32(-5),
+			"true":    true,
+			"false":   false,
+			"array":   []interface{}{"value", uint32(1)},
+			"map":     map[string]interface{}{"string": "value"},
+		},
+	}))
+	assert.NoError(t, err)
+
+	record, err := r.lookup(net.ParseIP("10.1.2.3"))
+	assert.NoError(t, err)
+	assert.Equal(t, map[string]interface{}{
+		"string":  "value",
+		"long":    long,
+		"bytes":   []byte{1, 2},
+		"double":  1.5,
+		"float":   2.5,
+		"uint16":  uint64(65535),
+		"uint32":  uint64(1 << 31),
+		"uint64":  uint64(1 << 40),
+		"uint128": large,
+		"int32":   int64(-5),
+		"true":    true,
+		"false":   false,
+		"array":   []interface{}{"value", uint64(1)},
+		"map":     map[string]interface{}{"string": "value"},
+	}, record)
+}
+
+// corruptMMDB builds a database out of zeroes and the
+// given metadata.
+func corruptMMDB(t *testing.T, metadata map[string]interface{}) []byte {
+	var (
+		content bytes.Buffer
+		encoder = &mmdbEncoder{}
+	)
+
+	content.Write(make([]byte, 32))
+	content.Write(mmdbMetadataMarker)
+	encoder.encode(metadata)
+	content.Write(encoder.buf.Bytes())
+
+	return content.Bytes()
+}
+
+func TestParseMMDBFailures(t *testing.T) {
+	var valid = buildMMDB(t, 6, 24, map[string]interface{}{"10.0.0.0/8": country("DE")})
+
+	var testCases = []struct {
+		description string
+		content     []byte
+	}{
+		{"empty", nil},
+		{"without metadata", valid[:bytes.Index(valid, mmdbMetadataMarker)]},
+		{"truncated metadata", valid[:len(valid)-10]},
+		{"truncated tree", valid[bytes.Index(valid, mmdbMetadataMarker)-20:]},
+		{"overflowing node count", corruptMMDB(t, map[string]interface{}{
+			// 24 bits per node make the tree size wrap
+			// around to 2 bytes.
+			"node_count":  uint64(1<<64/6 + 1),
+			"record_size": uint16(24),
+			"ip_version":  uint16(6),
+		})},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.description, func(t *testing.T) {
+			_, err := parseMMDB(tc.content)
+			assert.Error(t, err)
+		})
+	}
+}
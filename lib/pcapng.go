@@ -0,0 +1,278 @@
+package lib
+
+import (
+	"encoding/binary"
+	"io"
+	"net"
+	"time"
+)
+
+const (
+	pcapngSectionHeaderBlock        = 0x0a0d0d0a
+	pcapngInterfaceDescriptionBlock = 0x00000001
+	pcapngEnhancedPacketBlock       = 0x00000006
+	pcapngByteOrderMagic            = 0x1a2b3c4d
+
+	// linkTypeRaw makes packets start with their IP
+	// header, be it IPv4 or IPv6.
+	linkTypeRaw = 101
+
+	tcpFin = 0x01
+	tcpSyn = 0x02
+	tcpPsh = 0x08
+	tcpAck = 0x10
+
+	// pcapngMaxSegment bounds the payload of the segments
+	// synthesized, keeping them under the size limit of
+	// IPv4 packets.
+	pcapngMaxSegment = 32 * 1024
+)
+
+// pcapngWriter writes the traffic of a connection to a
+// pcapng file as the TCP segments of a single stream,
+// synthesizing the TCP/IP headers (handshake and
+// teardown included) so that tools like wireshark can
+// follow it.
+type pcapngWriter struct {
+	w          io.Writer
+	client     *net.TCPAddr
+	server     *net.TCPAddr
+	v6         bool
+	clientSeq  uint32
+	serverSeq  uint32
+	identifier uint16
+}
+
+// newPcapngWriter creates a writer for the connection
+// between 'client' and 'server'. Addresses that aren't
+// TCP ones (e.g., of unix sockets) are replaced by
+// loopback ones.
+func newPcapngWriter(w io.Writer, client, server net.Addr) *pcapngWriter {
+	src, dst, v6, ok := tcpAddrs(client, server)
+	if !ok {
+		src = &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 1}
+		dst = &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 2}
+	}
+
+	return &pcapngWriter{
+		w:      w,
+		client: src,
+		server: dst,
+		v6:     v6,
+	}
+}
+
+// start writes the headers of the file followed by the
+// three-way handshake.
+func (p *pcapngWriter) start(ts time.Time) (err error) {
+	var shb = make([]byte, 16)
+	binary.LittleEndian.PutUint32(shb[0:], pcapngByteOrderMagic)
+	binary.LittleEndian.PutUint16(shb[4:], 1)
+	binary.LittleEndian.PutUint16(shb[6:], 0)
+	// the length of the section is unknown.
+	binary.LittleEndian.PutUint64(shb[8:], ^uint64(0))
+
+	err = p.block(pcapngSectionHeaderBlock, shb)
+	if err != nil {
+		return
+	}
+
+	// a snapshot length of zero means no limit.
+	var idb = make([]byte, 8)
+	binary.LittleEndian.PutUint16(idb[0:], linkTypeRaw)
+
+	err = p.block(pcapngInterfaceDescriptionBlock, idb)
+	if err != nil {
+		return
+	}
+
+	err = p.segment(ts, true, tcpSyn, nil)
+	if err != nil {
+		return
+	}
+
+	err = p.segment(ts, false, tcpSyn|tcpAck, nil)
+	if err != nil {
+		return
+	}
+
+	err = p.segment(ts, true, tcpAck, nil)
+	return
+}
+
+func (p *pcapngWriter) write(ts time.Time, payload []byte, toUpstream bool) (err error) {
+	for len(payload) > 0 {
+		var n = len(payload)
+		if n > pcapngMaxSegment {
+			n = pcapngMaxSegment
+		}
+
+		err = p.segment(ts, toUpstream, tcpPsh|tcpAck, payload[:n])
+		if err != nil {
+			return
+		}
+
+		payload = payload[n:]
+	}
+
+	return
+}
+
+// finish writes the teardown of the connection.
+func (p *pcapngWriter) finish(ts time.Time) (err error) {
+	err = p.segment(ts, true, tcpFin|tcpAck, nil)
+	if err != nil {
+		return
+	}
+
+	err = p.segment(ts, false, tcpFin|tcpAck, nil)
+	if err != nil {
+		return
+	}
+
+	err = p.segment(ts, true, tcpAck, nil)
+	return
+}
+
+// segment writes a TCP segment sent by the client (or
+// by the server), advancing its sequence number.
+func (p *pcapngWriter) segment(ts time.Time, fromClient bool, flags byte, payload []byte) (err error) {
+	var (
+		src, dst = p.client, p.server
+		seq, ack = &p.clientSeq, p.serverSeq
+		tcp      = make([]byte, 20+len(payload))
+	)
+
+	if !fromClient {
+		src, dst = dst, src
+		seq, ack = &p.serverSeq, p.clientSeq
+	}
+
+	if flags&tcpAck == 0 {
+		ack = 0
+	}
+
+	binary.BigEndian.PutUint16(tcp[0:], uint16(src.Port))
+	binary.BigEndian.PutUint16(tcp[2:], uint16(dst.Port))
+	binary.BigEndian.PutUint32(tcp[4:], *seq)
+	binary.BigEndian.PutUint32(tcp[8:], ack)
+	tcp[12] = 5 << 4
+	tcp[13] = flags
+	binary.BigEndian.PutUint16(tcp[14:], 65535)
+	copy(tcp[20:], payload)
+
+	*seq += uint32(len(payload))
+	if flags&(tcpSyn|tcpFin) != 0 {
+		*seq++
+	}
+
+	var ip, pseudo []byte
+	if p.v6 {
+		ip, pseudo = ipv6Header(src.IP, dst.IP, len(tcp))
+	} else {
+		p.identifier++
+		ip, pseudo = ipv4Header(src.IP, dst.IP, len(tcp), p.identifier)
+	}
+
+	binary.BigEndian.PutUint16(tcp[16:], checksum(append(pseudo, tcp...)))
+
+	err = p.packet(ts, append(ip, tcp...))
+	return
+}
+
+func (p *pcapngWriter) packet(ts time.Time, packet []byte) (err error) {
+	var (
+		micros = uint64(ts.UnixNano() / int64(time.Microsecond))
+		epb    = make([]byte, 20+len(packet))
+	)
+
+	binary.LittleEndian.PutUint32(epb[0:], 0)
+	binary.LittleEndian.PutUint32(epb[4:], uint32(micros>>32))
+	binary.LittleEndian.PutUint32(epb[8:], uint32(micros))
+	binary.LittleEndian.PutUint32(epb[12:], uint32(len(packet)))
+	binary.LittleEndian.PutUint32(epb[16:], uint32(len(packet)))
+	copy(epb[20:], packet)
+
+	err = p.block(pcapngEnhancedPacketBlock, epb)
+	return
+}
+
+// block writes a pcapng block, padding its body to 32
+// bits.
+func (p *pcapngWriter) block(kind uint32, body []byte) (err error) {
+	var (
+		total = 12 + (len(body)+3)&^3
+		buf   = make([]byte, total)
+	)
+
+	binary.LittleEndian.PutUint32(buf[0:], kind)
+	binary.LittleEndian.PutUint32(buf[4:], uint32(total))
+	copy(buf[8:], body)
+	binary.LittleEndian.PutUint32(buf[total-4:], uint32(total))
+
+	_, err = p.w.Write(buf)
+	return
+}
+
+// ipv4Header builds the header of an IPv4 packet
+// carrying 'length' bytes of TCP, along with the
+// pseudo-header that TCP checksums cover.
+func ipv4Header(src, dst net.IP, length int, identifier uint16) (header, pseudo []byte) {
+	header = make([]byte, 20)
+	header[0] = 0x45
+	binary.BigEndian.PutUint16(header[2:], uint16(20+length))
+	binary.BigEndian.PutUint16(header[4:], identifier)
+	// don't fragment.
+	header[6] = 0x40
+	header[8] = 64
+	header[9] = 6
+	copy(header[12:], src.To4())
+	copy(header[16:], dst.To4())
+	binary.BigEndian.PutUint16(header[10:], checksum(header))
+
+	pseudo = make([]byte, 12)
+	copy(pseudo[0:], src.To4())
+	copy(pseudo[4:], dst.To4())
+	pseudo[9] = 6
+	binary.BigEndian.PutUint16(pseudo[10:], uint16(length))
+	return
+}
+
+// ipv6Header is the IPv6 counterpart of ipv4Header.
+// IPv4 addresses show up as IPv4-mapped ones.
+func ipv6Header(src, dst net.IP, length int) (header, pseudo []byte) {
+	header = make([]byte, 40)
+	header[0] = 0x60
+	binary.BigEndian.PutUint16(header[4:], uint16(length))
+	header[6] = 6
+	header[7] = 64
+	copy(header[8:], src.To16())
+	copy(header[24:], dst.To16())
+
+	pseudo = make([]byte, 40)
+	copy(pseudo[0:], src.To16())
+	copy(pseudo[16:], dst.To16())
+	binary.BigEndian.PutUint32(pseudo[32:], uint32(length))
+	pseudo[39] = 6
+	return
+}
+
+// checksum computes the internet checksum (RFC 1071)
+// of 'data'.
+func checksum(data []byte) uint16 {
+	var sum uint32
+
+	for i := 0; i+1 < len(data); i += 2 {
+		sum += uint32(binary.BigEndian.Uint16(data[i:]))
+	}
+
+	if len(data)%2 == 1 {
+		sum += uint32(data[len(data)-1]) << 8
+	}
+
+	for sum > 0xffff {
+		sum = sum&0xffff + sum>>16
+	}
+
+	return ^uint16(sum)
+}
@@ -0,0 +1,144 @@
+package lib
+
+import (
+	"bytes"
+	"encoding/binary"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+type pcapngSegment struct {
+	fromClient bool
+	flags      byte
+	seq        uint32
+	ack        uint32
+	payload    string
+}
+
+// readPcapng parses the blocks of a pcapng file written
+// by pcapngWriter, checking the checksums of the
+// packets and retrieving their TCP segments.
+func readPcapng(t *testing.T, content []byte, client *net.TCPAddr) (segments []pcapngSegment) {
+	var kinds []uint32
+
+	for len(content) > 0 {
+		var (
+			kind  = binary.LittleEndian.Uint32(content[0:])
+			total = int(binary.LittleEndian.Uint32(content[4:]))
+		)
+
+		assert.Equal(t, 0, total%4)
+		assert.Equal(t, uint32(total), binary.LittleEndian.Uint32(content[total-4:]))
+
+		kinds = append(kinds, kind)
+
+		if kind == pcapngEnhancedPacketBlock {
+			var (
+				length = int(binary.LittleEndian.Uint32(content[20:]))
+				packet = content[28 : 28+length]
+				ip     []byte
+				tcp    []byte
+				pseudo []byte
+				src    net.IP
+			)
+
+			if packet[0]>>4 == 4 {
+				ip, tcp = packet[:20], packet[20:]
+				assert.Equal(t, uint16(0), checksum(ip))
+				src = net.IP(ip[12:16])
+				_, pseudo = ipv4Header(ip[12:16], ip[16:20], len(tcp), 0)
+			} else {
+				ip, tcp = packet[:40], packet[40:]
+				src = net.IP(ip[8:24])
+				_, pseudo = ipv6Header(ip[8:24], ip[24:40], len(tcp))
+			}
+
+			assert.Equal(t, uint16(0), checksum(append(pseudo, tcp...)))
+
+			segments = append(segments, pcapngSegment{
+				fromClient: src.Equal(client.IP) &&
+					int(binary.BigEndian.Uint16(tcp[0:])) == client.Port,
+				flags:   tcp[13],
+				seq:     binary.BigEndian.Uint32(tcp[4:]),
+				ack:     binary.BigEndian.Uint32(tcp[8:]),
+				payload: string(tcp[20:]),
+			})
+		}
+
+		content = content[total:]
+	}
+
+	if assert.True(t, len(kinds) >= 2) {
+		assert.Equal(t, uint32(pcapngSectionHeaderBlock), kinds[0])
+		assert.Equal(t, uint32(pcapngInterfaceDescriptionBlock), kinds[1])
+	}
+
+	return
+}
+
+func TestPcapngWriter(t *testing.T) {
+	var testCases = []struct {
+		description string
+		client      *net.TCPAddr
+		server      *net.TCPAddr
+	}{
+		{
+			description: "ipv4",
+			client:      &net.TCPAddr{IP: net.ParseIP("10.0.0.1").To4(), Port: 40000},
+			server:      &net.TCPAddr{IP: net.ParseIP("10.0.0.2").To4(), Port: 80},
+		},
+		{
+			description: "ipv6",
+			client:      &net.TCPAddr{IP: net.ParseIP("2001:db8::1"), Port: 40000},
+			server:      &net.TCPAddr{IP: net.ParseIP("2001:db8::2"), Port: 80},
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.description, func(t *testing.T) {
+			var (
+				buf bytes.Buffer
+				w   = newPcapngWriter(&buf, tc.client, tc.server)
+				now = time.Now()
+			)
+
+			assert.NoError(t, w.start(now))
+			assert.NoError(t, w.write(now, []byte("ping"), true))
+			assert.NoError(t, w.write(now, []byte("pong!"), false))
+			assert.NoError(t, w.finish(now))
+
+			assert.Equal(t, []pcapngSegment{
+				{fromClient: true, flags: tcpSyn},
+				{fromClient: false, flags: tcpSyn | tcpAck, ack: 1},
+				{fromClient: true, flags: tcpAck, seq: 1, ack: 1},
+				{fromClient: true, flags: tcpPsh | tcpAck, seq: 1, ack: 1, payload: "ping"},
+				{fromClient: false, flags: tcpPsh | tcpAck, seq: 1, ack: 5, payload: "pong!"},
+				{fromClient: true, flags: tcpFin | tcpAck, seq: 5, ack: 6},
+				{fromClient: false, flags: tcpFin | tcpAck, seq: 6, ack: 6},
+				{fromClient: true, flags: tcpAck, seq: 6, ack: 7},
+			}, readPcapng(t, buf.Bytes(), tc.client))
+		})
+	}
+}
+
+func TestPcapngWriterSplitsLargePayloads(t *testing.T) {
+	var (
+		buf     bytes.Buffer
+		client  = &net.TCPAddr{IP: net.ParseIP("10.0.0.1").To4(), Port: 40000}
+		w       = newPcapngWriter(&buf, client, &net.TCPAddr{IP: net.ParseIP("10.0.0.2").To4(), Port: 80})
+		payload = bytes.Repeat([]byte("a"), pcapngMaxSegment+10)
+	)
+
+	assert.NoError(t, w.start(time.Now()))
+	assert.NoError(t, w.write(time.Now(), payload, true))
+
+	segments := readPcapng(t, buf.Bytes(), client)
+	if assert.Len(t, segments, 5) {
+		assert.Len(t, segments[3].payload, pcapngMaxSegment)
+		assert.Len(t, segments[4].payload, 10)
+		assert.Equal(t, uint32(1+pcapngMaxSegment), segments[4].seq)
+	}
+}
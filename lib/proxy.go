@@ -3,6 +3,7 @@ package lib
 import (
 	"io"
 	"net"
+	"sync/atomic"
 	"time"
 
 	"github.com/pkg/errors"
@@ -13,19 +14,64 @@ const (
 	errClosedNetworkConn = "use of closed network connection"
 )
 
+// ErrIdleTimeout is returned by Transfer when no bytes
+// flowed in either direction for longer than the idle
+// timeout configured.
+var ErrIdleTimeout = errors.New("connection idle for too long")
+
+// Tap gets a copy of the bytes a Proxy transfers, with
+// 'toUpstream' set for the ones written to 'To'. It must
+// not hold on to 'p', which gets reused.
+type Tap interface {
+	Tap(p []byte, toUpstream bool)
+}
+
 type ProxyConfig struct {
 	To                net.Conn
 	From              net.Conn
 	ConnectionTimeout time.Duration
+
+	// IdleTimeout closes both connections once no bytes
+	// flow in either direction for that long. Zero
+	// disables it.
+	IdleTimeout time.Duration
+
+	// ToThrottles and FromThrottles shape the bytes
+	// written to 'To' and to 'From', respectively.
+	ToThrottles   []*Throttle
+	FromThrottles []*Throttle
+
+	// Mirror gets a copy of the bytes written to 'To'.
+	// It must not block, as it's written to inline.
+	Mirror io.Writer
+
+	// Capture gets a copy of the bytes transferred in
+	// both directions.
+	Capture Tap
 }
 
 type Proxy struct {
+	// lastActivity is the unix time in nanoseconds of the
+	// last read from either side. It comes first so that
+	// it's 64-bit aligned for atomic operations.
+	lastActivity int64
+
 	to                net.Conn
 	from              net.Conn
 	connectionTimeout time.Duration
+	idleTimeout       time.Duration
 	toStats           *IoStats
 	fromStats         *IoStats
+	toThrottles       throttles
+	fromThrottles     throttles
+	mirror            io.Writer
+	capture           Tap
 	statsInterrupt    chan struct{}
+
+	// done gets closed along with the connections so that
+	// the copies waiting on the throttles return early.
+	closed uint32
+	done   chan struct{}
 }
 
 func NewProxy(cfg ProxyConfig) (proxy Proxy, err error) {
@@ -43,6 +89,12 @@ func NewProxy(cfg ProxyConfig) (proxy Proxy, err error) {
 	proxy.fromStats = &IoStats{}
 	proxy.from = cfg.From
 	proxy.to = cfg.To
+	proxy.idleTimeout = cfg.IdleTimeout
+	proxy.toThrottles = cfg.ToThrottles
+	proxy.fromThrottles = cfg.FromThrottles
+	proxy.mirror = cfg.Mirror
+	proxy.capture = cfg.Capture
+	proxy.done = make(chan struct{})
 
 	if cfg.ConnectionTimeout == 0 {
 		proxy.connectionTimeout = 10 * time.Second
@@ -51,19 +103,27 @@ func NewProxy(cfg ProxyConfig) (proxy Proxy, err error) {
 	return
 }
 
+// Stats retrieves the bytes transferred so far in each
+// direction: 'to' accounts what was read from 'From'
+// and written to 'To', while 'from' accounts the
+// opposite direction.
+func (p *Proxy) Stats() (to, from IoStats) {
+	return p.toStats.snapshot(), p.fromStats.snapshot()
+}
+
 func (p *Proxy) Transfer() (err error) {
 	var errChan = make(chan error, 1)
 
+	p.touch()
+
 	go func() {
-		err2 := copy(p.to, p.from, p.toStats)
-		p.to.Close()
-		p.from.Close()
+		err2 := p.copy(p.to, p.from, p.toStats, p.toThrottles, p.mirror)
+		p.Close()
 		errChan <- err2
 	}()
 
-	err1 := copy(p.from, p.to, p.fromStats)
-	p.to.Close()
-	p.from.Close()
+	err1 := p.copy(p.from, p.to, p.fromStats, p.fromThrottles, nil)
+	p.Close()
 	err2 := <-errChan
 
 	if err1 != nil {
@@ -75,7 +135,40 @@ func (p *Proxy) Transfer() (err error) {
 	return
 }
 
-func copy(to io.Writer, from io.Reader, stats *IoStats) (err error) {
+// Close closes both connections, making Transfer
+// return.
+func (p *Proxy) Close() error {
+	if atomic.CompareAndSwapUint32(&p.closed, 0, 1) {
+		close(p.done)
+	}
+
+	p.from.Close()
+	return p.to.Close()
+}
+
+// wait waits for 'd' unless the proxy gets closed in the
+// meantime, retrieving whether it waited it all.
+func (p *Proxy) wait(d time.Duration) bool {
+	var timer = time.NewTimer(d)
+	defer timer.Stop()
+
+	select {
+	case <-timer.C:
+		return true
+	case <-p.done:
+		return false
+	}
+}
+
+func (p *Proxy) touch() {
+	atomic.StoreInt64(&p.lastActivity, time.Now().UnixNano())
+}
+
+func (p *Proxy) idleFor() time.Duration {
+	return time.Since(time.Unix(0, atomic.LoadInt64(&p.lastActivity)))
+}
+
+func (p *Proxy) copy(to io.Writer, from net.Conn, stats *IoStats, throttles throttles, mirror io.Writer) (err error) {
 	var (
 		buf    = make([]byte, bufferSize)
 		readN  int
@@ -83,18 +176,46 @@ func copy(to io.Writer, from io.Reader, stats *IoStats) (err error) {
 	)
 
 	for {
-		readN, err = from.Read(buf)
+		if p.idleTimeout != 0 {
+			from.SetReadDeadline(time.Now().Add(p.idleTimeout))
+		}
+
+		readN, err = from.Read(buf[:throttles.chunkSize(len(buf))])
 		if err == io.EOF {
 			err = nil
 			break
 		}
 
 		if err != nil {
+			if p.idleTimeout != 0 && isTimeout(err) {
+				// the other direction might still be
+				// active, in which case we keep waiting.
+				if p.idleFor() < p.idleTimeout {
+					continue
+				}
+
+				err = ErrIdleTimeout
+			}
+
 			break
 		}
 
 		if readN > 0 {
-			stats.Rx += uint64(readN)
+			p.touch()
+			atomic.AddUint64(&stats.Rx, uint64(readN))
+
+			if wait := throttles.reserve(readN, time.Now()); wait > 0 {
+				if !p.wait(wait) {
+					break
+				}
+
+				atomic.AddInt64((*int64)(&stats.Throttled), int64(wait))
+
+				// waiting on the throttles doesn't make
+				// the connection idle.
+				p.touch()
+			}
+
 			writeN, err = to.Write(buf[0:readN])
 			if err != nil {
 				break
@@ -106,14 +227,22 @@ func copy(to io.Writer, from io.Reader, stats *IoStats) (err error) {
 			}
 
 			if writeN > 0 {
-				stats.Tx += uint64(writeN)
+				atomic.AddUint64(&stats.Tx, uint64(writeN))
+			}
+
+			if mirror != nil {
+				mirror.Write(buf[0:writeN])
+			}
+
+			if p.capture != nil {
+				p.capture.Tap(buf[0:writeN], from == p.from)
 			}
 		}
 	}
 
 	if err != nil {
-		e, _ := err.(*net.OpError)
-		if e.Err.Error() == errClosedNetworkConn {
+		e, ok := err.(*net.OpError)
+		if ok && e.Err.Error() == errClosedNetworkConn {
 			err = nil
 			return
 		}
@@ -121,3 +250,8 @@ func copy(to io.Writer, from io.Reader, stats *IoStats) (err error) {
 
 	return
 }
+
+func isTimeout(err error) bool {
+	netErr, ok := err.(net.Error)
+	return ok && netErr.Timeout()
+}
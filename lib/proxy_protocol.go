@@ -0,0 +1,396 @@
+package lib
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// PROXY protocol versions that can be set on a
+// server so that l4 prepends a header carrying
+// the original client and destination addresses.
+//
+// See https://www.haproxy.org/download/1.8/doc/proxy-protocol.txt
+const (
+	ProxyProtocolV1 = "v1"
+	ProxyProtocolV2 = "v2"
+)
+
+// Types of the v2 TLVs that l4 knows how to
+// produce.
+const (
+	PP2TypeAuthority = 0x02
+	PP2TypeUniqueId  = 0x05
+)
+
+const (
+	pp2VersionCommandProxy = 0x21
+	pp2FamilyUnspec        = 0x00
+	pp2FamilyTcp4          = 0x11
+	pp2FamilyTcp6          = 0x21
+	pp2MaxUniqueIdLength   = 128
+)
+
+var proxyProtocolV2Signature = []byte("\r\n\r\n\x00\r\nQUIT\n")
+
+type ProxyProtocolTLV struct {
+	Type  byte
+	Value []byte
+}
+
+// ProxyProtocolHeader holds the information that
+// gets serialized in front of an upstream connection.
+// TLVs are only taken into account by v2 headers.
+type ProxyProtocolHeader struct {
+	Version     string
+	Source      net.Addr
+	Destination net.Addr
+	TLVs        []ProxyProtocolTLV
+}
+
+// ValidateProxyProtocolVersion verifies whether the
+// version string is one of the supported ones. An
+// empty version means that the protocol is disabled.
+func ValidateProxyProtocolVersion(version string) (err error) {
+	switch version {
+	case "", ProxyProtocolV1, ProxyProtocolV2:
+	default:
+		err = errors.Errorf("unknown proxy protocol version '%s'", version)
+	}
+
+	return
+}
+
+func (h ProxyProtocolHeader) WriteTo(w io.Writer) (n int64, err error) {
+	var (
+		header  []byte
+		written int
+	)
+
+	header, err = h.Bytes()
+	if err != nil {
+		return
+	}
+
+	written, err = w.Write(header)
+	n = int64(written)
+	return
+}
+
+func (h ProxyProtocolHeader) Bytes() (header []byte, err error) {
+	switch h.Version {
+	case ProxyProtocolV1:
+		header = h.v1()
+	case ProxyProtocolV2:
+		header, err = h.v2()
+	default:
+		err = errors.Errorf("unknown proxy protocol version '%s'", h.Version)
+	}
+
+	return
+}
+
+func (h ProxyProtocolHeader) v1() []byte {
+	src, dst, v6, ok := tcpAddrs(h.Source, h.Destination)
+	if !ok {
+		return []byte("PROXY UNKNOWN\r\n")
+	}
+
+	if v6 {
+		return []byte(fmt.Sprintf("PROXY TCP6 %s %s %d %d\r\n",
+			ipv6String(src.IP), ipv6String(dst.IP), src.Port, dst.Port))
+	}
+
+	return []byte(fmt.Sprintf("PROXY TCP4 %s %s %d %d\r\n",
+		src.IP.String(), dst.IP.String(), src.Port, dst.Port))
+}
+
+func (h ProxyProtocolHeader) v2() (header []byte, err error) {
+	var (
+		buf       bytes.Buffer
+		addresses bytes.Buffer
+		tlvs      bytes.Buffer
+		family    byte = pp2FamilyUnspec
+	)
+
+	src, dst, v6, ok := tcpAddrs(h.Source, h.Destination)
+	if ok {
+		if v6 {
+			family = pp2FamilyTcp6
+			addresses.Write(src.IP.To16())
+			addresses.Write(dst.IP.To16())
+		} else {
+			family = pp2FamilyTcp4
+			addresses.Write(src.IP.To4())
+			addresses.Write(dst.IP.To4())
+		}
+
+		binary.Write(&addresses, binary.BigEndian, uint16(src.Port))
+		binary.Write(&addresses, binary.BigEndian, uint16(dst.Port))
+	}
+
+	for _, tlv := range h.TLVs {
+		if tlv.Type == PP2TypeUniqueId && len(tlv.Value) > pp2MaxUniqueIdLength {
+			err = errors.Errorf("unique id tlv must not exceed %d bytes",
+				pp2MaxUniqueIdLength)
+			return
+		}
+
+		tlvs.WriteByte(tlv.Type)
+		binary.Write(&tlvs, binary.BigEndian, uint16(len(tlv.Value)))
+		tlvs.Write(tlv.Value)
+	}
+
+	length := addresses.Len() + tlvs.Len()
+	if length > 0xffff {
+		err = errors.Errorf("proxy protocol header too large (%d bytes)", length)
+		return
+	}
+
+	buf.Write(proxyProtocolV2Signature)
+	buf.WriteByte(pp2VersionCommandProxy)
+	buf.WriteByte(family)
+	binary.Write(&buf, binary.BigEndian, uint16(length))
+	buf.Write(addresses.Bytes())
+	buf.Write(tlvs.Bytes())
+
+	header = buf.Bytes()
+	return
+}
+
+// tcpAddrs retrieves a pair of TCP addresses and the
+// family they should be encoded with. When only one
+// of them is IPv6, the other is represented as an
+// IPv4-mapped address.
+func tcpAddrs(source, destination net.Addr) (src, dst *net.TCPAddr, v6 bool, ok bool) {
+	src, ok = source.(*net.TCPAddr)
+	if !ok || src == nil {
+		return nil, nil, false, false
+	}
+
+	dst, ok = destination.(*net.TCPAddr)
+	if !ok || dst == nil {
+		return nil, nil, false, false
+	}
+
+	v6 = src.IP.To4() == nil || dst.IP.To4() == nil
+	return
+}
+
+// ipv6String formats an IP in its IPv6 form, making
+// IPv4 addresses show up as IPv4-mapped ones.
+func ipv6String(ip net.IP) string {
+	if v4 := ip.To4(); v4 != nil {
+		return "::ffff:" + v4.String()
+	}
+
+	return ip.String()
+}
+
+const (
+	pp2HeaderSize         = 16
+	pp2CommandLocal       = 0x0
+	pp2CommandProxy       = 0x1
+	pp1MaxHeaderSize      = 107
+	proxyProtocolV1Prefix = "PROXY "
+	pp2AddressesSizeTcp4  = 12
+	pp2AddressesSizeTcp6  = 36
+	pp2TlvHeaderSize      = 3
+)
+
+var errMissingProxyProtocolHeader = errors.New("missing proxy protocol header")
+
+// ReadProxyProtocolHeader consumes a v1 or v2 PROXY
+// protocol header from the reader. Headers that don't
+// carry addresses (LOCAL command, UNKNOWN or UNSPEC
+// families) are returned without Source and Destination.
+func ReadProxyProtocolHeader(r *bufio.Reader) (header *ProxyProtocolHeader, err error) {
+	signature, err := r.Peek(len(proxyProtocolV1Prefix))
+	if err != nil {
+		return
+	}
+
+	if bytes.Equal(signature, []byte(proxyProtocolV1Prefix)) {
+		header, err = readProxyProtocolV1(r)
+		return
+	}
+
+	signature, err = r.Peek(len(proxyProtocolV2Signature))
+	if err != nil {
+		err = errMissingProxyProtocolHeader
+		return
+	}
+
+	if bytes.Equal(signature, proxyProtocolV2Signature) {
+		header, err = readProxyProtocolV2(r)
+		return
+	}
+
+	err = errMissingProxyProtocolHeader
+	return
+}
+
+func readProxyProtocolV1(r *bufio.Reader) (header *ProxyProtocolHeader, err error) {
+	var line []byte
+
+	for len(line) < pp1MaxHeaderSize {
+		var b byte
+
+		b, err = r.ReadByte()
+		if err != nil {
+			return
+		}
+
+		line = append(line, b)
+		if b == '\n' {
+			break
+		}
+	}
+
+	if !bytes.HasSuffix(line, []byte("\r\n")) {
+		err = errors.Errorf("malformed proxy protocol v1 header")
+		return
+	}
+
+	fields := strings.Split(string(line[:len(line)-2]), " ")
+	header = &ProxyProtocolHeader{
+		Version: ProxyProtocolV1,
+	}
+
+	if len(fields) >= 2 && fields[1] == "UNKNOWN" {
+		return
+	}
+
+	if len(fields) != 6 || (fields[1] != "TCP4" && fields[1] != "TCP6") {
+		err = errors.Errorf("malformed proxy protocol v1 header '%s'",
+			strings.TrimSpace(string(line)))
+		return
+	}
+
+	header.Source, err = parseProxyProtocolV1Address(fields[2], fields[4])
+	if err != nil {
+		return
+	}
+
+	header.Destination, err = parseProxyProtocolV1Address(fields[3], fields[5])
+	return
+}
+
+func parseProxyProtocolV1Address(ip, port string) (addr *net.TCPAddr, err error) {
+	parsedIp := net.ParseIP(ip)
+	if parsedIp == nil {
+		err = errors.Errorf("malformed ip '%s' in proxy protocol header", ip)
+		return
+	}
+
+	parsedPort, err := strconv.ParseUint(port, 10, 16)
+	if err != nil {
+		err = errors.Errorf("malformed port '%s' in proxy protocol header", port)
+		return
+	}
+
+	if v4 := parsedIp.To4(); v4 != nil {
+		parsedIp = v4
+	}
+
+	addr = &net.TCPAddr{IP: parsedIp, Port: int(parsedPort)}
+	return
+}
+
+func readProxyProtocolV2(r *bufio.Reader) (header *ProxyProtocolHeader, err error) {
+	var fixed = make([]byte, pp2HeaderSize)
+
+	_, err = io.ReadFull(r, fixed)
+	if err != nil {
+		return
+	}
+
+	if fixed[12]>>4 != 0x2 {
+		err = errors.Errorf("unsupported proxy protocol v2 version %d", fixed[12]>>4)
+		return
+	}
+
+	var (
+		command = fixed[12] & 0x0f
+		family  = fixed[13]
+		payload = make([]byte, binary.BigEndian.Uint16(fixed[14:16]))
+	)
+
+	_, err = io.ReadFull(r, payload)
+	if err != nil {
+		return
+	}
+
+	header = &ProxyProtocolHeader{
+		Version: ProxyProtocolV2,
+	}
+
+	switch command {
+	case pp2CommandLocal:
+		return
+	case pp2CommandProxy:
+	default:
+		err = errors.Errorf("unknown proxy protocol v2 command %d", command)
+		return
+	}
+
+	switch family {
+	case pp2FamilyTcp4:
+		if len(payload) < pp2AddressesSizeTcp4 {
+			err = errors.Errorf("truncated proxy protocol v2 addresses")
+			return
+		}
+
+		header.Source = &net.TCPAddr{
+			IP:   net.IP(append([]byte{}, payload[0:4]...)),
+			Port: int(binary.BigEndian.Uint16(payload[8:10])),
+		}
+		header.Destination = &net.TCPAddr{
+			IP:   net.IP(append([]byte{}, payload[4:8]...)),
+			Port: int(binary.BigEndian.Uint16(payload[10:12])),
+		}
+		payload = payload[pp2AddressesSizeTcp4:]
+	case pp2FamilyTcp6:
+		if len(payload) < pp2AddressesSizeTcp6 {
+			err = errors.Errorf("truncated proxy protocol v2 addresses")
+			return
+		}
+
+		header.Source = &net.TCPAddr{
+			IP:   net.IP(append([]byte{}, payload[0:16]...)),
+			Port: int(binary.BigEndian.Uint16(payload[32:34])),
+		}
+		header.Destination = &net.TCPAddr{
+			IP:   net.IP(append([]byte{}, payload[16:32]...)),
+			Port: int(binary.BigEndian.Uint16(payload[34:36])),
+		}
+		payload = payload[pp2AddressesSizeTcp6:]
+	default:
+		// addresses of families we don't proxy for (UDP,
+		// unix sockets) are ignored altogether.
+		return
+	}
+
+	for len(payload) >= pp2TlvHeaderSize {
+		length := int(binary.BigEndian.Uint16(payload[1:3]))
+		if len(payload) < pp2TlvHeaderSize+length {
+			err = errors.Errorf("truncated proxy protocol v2 tlv")
+			return
+		}
+
+		header.TLVs = append(header.TLVs, ProxyProtocolTLV{
+			Type:  payload[0],
+			Value: append([]byte{}, payload[pp2TlvHeaderSize:pp2TlvHeaderSize+length]...),
+		})
+		payload = payload[pp2TlvHeaderSize+length:]
+	}
+
+	return
+}
@@ -0,0 +1,155 @@
+package lib
+
+import (
+	"net"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	defaultProxyProtocolReadTimeout = 5 * time.Second
+	proxyProtocolBufferSize         = 512
+)
+
+type ProxyProtocolListenerConfig struct {
+	Listener    net.Listener
+	ReadTimeout time.Duration
+
+	// TrustedNetworks lists the networks from which
+	// PROXY protocol headers are accepted. Connections
+	// coming from anywhere else are passed through
+	// untouched. An empty list trusts everyone.
+	TrustedNetworks []*net.IPNet
+}
+
+// ProxyProtocolListener wraps a listener whose peers
+// (e.g., another load-balancer) prepend a PROXY protocol
+// header to the connections so that the address of the
+// real client can be retrieved via RemoteAddr().
+type ProxyProtocolListener struct {
+	ln              net.Listener
+	readTimeout     time.Duration
+	trustedNetworks []*net.IPNet
+}
+
+func NewProxyProtocolListener(cfg ProxyProtocolListenerConfig) net.Listener {
+	if cfg.Listener == nil {
+		panic(errors.New(
+			"Can't create proxy protocol listener without a listener"))
+	}
+
+	if cfg.ReadTimeout == 0 {
+		cfg.ReadTimeout = defaultProxyProtocolReadTimeout
+	}
+
+	return &ProxyProtocolListener{
+		ln:              cfg.Listener,
+		readTimeout:     cfg.ReadTimeout,
+		trustedNetworks: cfg.TrustedNetworks,
+	}
+}
+
+// Accept doesn't read the header itself so that a slow
+// peer can't hold the accept loop; the header is parsed
+// on the first use of the connection instead.
+func (ln *ProxyProtocolListener) Accept() (net.Conn, error) {
+	c, err := ln.ln.Accept()
+	if err != nil {
+		return nil, err
+	}
+
+	return &ProxyProtocolConn{
+		PeekedConn:  NewPeekedConn(c, proxyProtocolBufferSize),
+		readTimeout: ln.readTimeout,
+		trusted:     ln.isTrusted(c.RemoteAddr()),
+	}, nil
+}
+
+func (ln *ProxyProtocolListener) Addr() net.Addr {
+	return ln.ln.Addr()
+}
+
+func (ln *ProxyProtocolListener) Close() error {
+	return ln.ln.Close()
+}
+
+func (ln *ProxyProtocolListener) isTrusted(addr net.Addr) bool {
+	if len(ln.trustedNetworks) == 0 {
+		return true
+	}
+
+	return cidrsContain(ln.trustedNetworks, addrIP(addr))
+}
+
+// ProxyProtocolConn is a connection whose addresses are
+// taken from the PROXY protocol header sent by a trusted
+// peer. Trusted peers that don't send a header get their
+// connections failed.
+type ProxyProtocolConn struct {
+	*PeekedConn
+	readTimeout time.Duration
+	trusted     bool
+
+	once   sync.Once
+	header *ProxyProtocolHeader
+	err    error
+}
+
+func (c *ProxyProtocolConn) init() {
+	c.once.Do(func() {
+		if !c.trusted {
+			return
+		}
+
+		c.err = c.Conn.SetReadDeadline(time.Now().Add(c.readTimeout))
+		if c.err != nil {
+			return
+		}
+
+		c.header, c.err = ReadProxyProtocolHeader(c.r)
+		if c.err != nil {
+			c.err = errors.Wrapf(c.err,
+				"couldn't read proxy protocol header from %s",
+				c.Conn.RemoteAddr())
+			return
+		}
+
+		c.err = c.Conn.SetReadDeadline(time.Time{})
+	})
+}
+
+// Header retrieves the PROXY protocol header received,
+// if any.
+func (c *ProxyProtocolConn) Header() (*ProxyProtocolHeader, error) {
+	c.init()
+	return c.header, c.err
+}
+
+func (c *ProxyProtocolConn) Read(b []byte) (int, error) {
+	c.init()
+	if c.err != nil {
+		return 0, c.err
+	}
+
+	return c.PeekedConn.Read(b)
+}
+
+func (c *ProxyProtocolConn) RemoteAddr() net.Addr {
+	c.init()
+	if c.header != nil && c.header.Source != nil {
+		return c.header.Source
+	}
+
+	return c.Conn.RemoteAddr()
+}
+
+func (c *ProxyProtocolConn) LocalAddr() net.Addr {
+	c.init()
+	if c.header != nil && c.header.Destination != nil {
+		return c.header.Destination
+	}
+
+	return c.Conn.LocalAddr()
+}
@@ -0,0 +1,341 @@
+package lib
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/tls"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestProxyProtocolHeaderBytes(t *testing.T) {
+	var testCases = []struct {
+		description string
+		header      ProxyProtocolHeader
+		expected    []byte
+		shouldError bool
+	}{
+		{
+			description: "fails with unknown version",
+			header: ProxyProtocolHeader{
+				Version: "v3",
+			},
+			shouldError: true,
+		},
+		{
+			description: "v1 with ipv4 addresses",
+			header: ProxyProtocolHeader{
+				Version:     ProxyProtocolV1,
+				Source:      &net.TCPAddr{IP: net.ParseIP("10.0.0.1"), Port: 5000},
+				Destination: &net.TCPAddr{IP: net.ParseIP("10.0.0.2"), Port: 80},
+			},
+			expected: []byte("PROXY TCP4 10.0.0.1 10.0.0.2 5000 80\r\n"),
+		},
+		{
+			description: "v1 with ipv6 addresses",
+			header: ProxyProtocolHeader{
+				Version:     ProxyProtocolV1,
+				Source:      &net.TCPAddr{IP: net.ParseIP("::1"), Port: 5000},
+				Destination: &net.TCPAddr{IP: net.ParseIP("fe80::1"), Port: 80},
+			},
+			expected: []byte("PROXY TCP6 ::1 fe80::1 5000 80\r\n"),
+		},
+		{
+			description: "v1 with mixed families",
+			header: ProxyProtocolHeader{
+				Version:     ProxyProtocolV1,
+				Source:      &net.TCPAddr{IP: net.ParseIP("10.0.0.1"), Port: 5000},
+				Destination: &net.TCPAddr{IP: net.ParseIP("::1"), Port: 80},
+			},
+			expected: []byte("PROXY TCP6 ::ffff:10.0.0.1 ::1 5000 80\r\n"),
+		},
+		{
+			description: "v1 with unknown addresses",
+			header: ProxyProtocolHeader{
+				Version: ProxyProtocolV1,
+			},
+			expected: []byte("PROXY UNKNOWN\r\n"),
+		},
+		{
+			description: "v2 with ipv4 addresses and tlvs",
+			header: ProxyProtocolHeader{
+				Version:     ProxyProtocolV2,
+				Source:      &net.TCPAddr{IP: net.ParseIP("10.0.0.1"), Port: 5000},
+				Destination: &net.TCPAddr{IP: net.ParseIP("10.0.0.2"), Port: 80},
+				TLVs: []ProxyProtocolTLV{
+					{Type: PP2TypeAuthority, Value: []byte("a.io")},
+				},
+			},
+			expected: append(append([]byte{}, proxyProtocolV2Signature...),
+				0x21, 0x11, 0x00, 0x13,
+				10, 0, 0, 1,
+				10, 0, 0, 2,
+				0x13, 0x88,
+				0x00, 0x50,
+				0x02, 0x00, 0x04, 'a', '.', 'i', 'o'),
+		},
+		{
+			description: "v2 with unknown addresses",
+			header: ProxyProtocolHeader{
+				Version: ProxyProtocolV2,
+			},
+			expected: append(append([]byte{}, proxyProtocolV2Signature...),
+				0x21, 0x00, 0x00, 0x00),
+		},
+		{
+			description: "v2 fails with too large unique id",
+			header: ProxyProtocolHeader{
+				Version: ProxyProtocolV2,
+				TLVs: []ProxyProtocolTLV{
+					{Type: PP2TypeUniqueId, Value: make([]byte, 129)},
+				},
+			},
+			shouldError: true,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.description, func(t *testing.T) {
+			actual, err := tc.header.Bytes()
+			if tc.shouldError {
+				assert.Error(t, err)
+				return
+			}
+
+			assert.NoError(t, err)
+			assert.Equal(t, tc.expected, actual)
+		})
+	}
+}
+
+func TestPeekServerName(t *testing.T) {
+	client, server := net.Pipe()
+	defer server.Close()
+
+	go func() {
+		tls.Client(client, &tls.Config{
+			ServerName: "example.com",
+		}).Handshake()
+		client.Close()
+	}()
+
+	peeked, name := peekServerName(server, 1*time.Second)
+	assert.Equal(t, "example.com", name)
+
+	// the peeked bytes must still be readable
+	var record = make([]byte, tlsRecordHeaderSize)
+	_, err := peeked.Read(record)
+	assert.NoError(t, err)
+	assert.Equal(t, byte(tlsRecordTypeHandshake), record[0])
+}
+
+func TestPeekServerNameWithoutTls(t *testing.T) {
+	var msg = []byte("PING\r\n")
+
+	client, server := net.Pipe()
+	defer server.Close()
+
+	go func() {
+		client.Write(msg)
+	}()
+
+	peeked, name := peekServerName(server, 1*time.Second)
+	assert.Equal(t, "", name)
+
+	var received = make([]byte, len(msg))
+	n, err := peeked.Read(received)
+	assert.NoError(t, err)
+	assert.True(t, bytes.HasPrefix(msg, received[:n]))
+}
+
+func TestReadProxyProtocolHeader(t *testing.T) {
+	var (
+		source       = &net.TCPAddr{IP: net.ParseIP("10.0.0.1").To4(), Port: 5000}
+		destination  = &net.TCPAddr{IP: net.ParseIP("10.0.0.2").To4(), Port: 80}
+		source6      = &net.TCPAddr{IP: net.ParseIP("2001:db8::1"), Port: 5000}
+		destination6 = &net.TCPAddr{IP: net.ParseIP("2001:db8::2"), Port: 80}
+	)
+
+	var testCases = []struct {
+		description string
+		input       []byte
+		expected    *ProxyProtocolHeader
+		shouldError bool
+	}{
+		{
+			description: "fails without header",
+			input:       []byte("GET / HTTP/1.1\r\n\r\n"),
+			shouldError: true,
+		},
+		{
+			description: "fails with malformed v1 header",
+			input:       []byte("PROXY TCP4 10.0.0.1\r\n"),
+			shouldError: true,
+		},
+		{
+			description: "fails with v1 header without crlf",
+			input:       []byte("PROXY TCP4 10.0.0.1 10.0.0.2 5000 80\n"),
+			shouldError: true,
+		},
+		{
+			description: "v1 unknown",
+			input:       []byte("PROXY UNKNOWN\r\n"),
+			expected:    &ProxyProtocolHeader{Version: ProxyProtocolV1},
+		},
+		{
+			description: "v1 ipv4",
+			input: mustProxyProtocolHeader(t, ProxyProtocolHeader{
+				Version: ProxyProtocolV1, Source: source, Destination: destination,
+			}),
+			expected: &ProxyProtocolHeader{
+				Version: ProxyProtocolV1, Source: source, Destination: destination,
+			},
+		},
+		{
+			description: "v2 ipv6 with tlvs",
+			input: mustProxyProtocolHeader(t, ProxyProtocolHeader{
+				Version: ProxyProtocolV2, Source: source6, Destination: destination6,
+				TLVs: []ProxyProtocolTLV{{Type: PP2TypeUniqueId, Value: []byte("id")}},
+			}),
+			expected: &ProxyProtocolHeader{
+				Version: ProxyProtocolV2, Source: source6, Destination: destination6,
+				TLVs: []ProxyProtocolTLV{{Type: PP2TypeUniqueId, Value: []byte("id")}},
+			},
+		},
+		{
+			description: "v2 local",
+			input: append(append([]byte{}, proxyProtocolV2Signature...),
+				0x20, 0x00, 0x00, 0x00),
+			expected: &ProxyProtocolHeader{Version: ProxyProtocolV2},
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.description, func(t *testing.T) {
+			actual, err := ReadProxyProtocolHeader(
+				bufio.NewReader(bytes.NewReader(tc.input)))
+			if tc.shouldError {
+				assert.Error(t, err)
+				return
+			}
+
+			assert.NoError(t, err)
+			assert.Equal(t, tc.expected, actual)
+		})
+	}
+}
+
+func TestProxyProtocolListener(t *testing.T) {
+	var msg = []byte("PING\r\n")
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.NoError(t, err)
+
+	ln = NewProxyProtocolListener(ProxyProtocolListenerConfig{
+		Listener: ln,
+	})
+	defer ln.Close()
+
+	go func() {
+		conn, err := net.Dial("tcp", ln.Addr().String())
+		assert.NoError(t, err)
+		defer conn.Close()
+
+		conn.Write([]byte("PROXY TCP4 192.168.0.1 192.168.0.2 1234 443\r\n"))
+		conn.Write(msg)
+	}()
+
+	conn, err := ln.Accept()
+	assert.NoError(t, err)
+	defer conn.Close()
+
+	assert.Equal(t, "192.168.0.1:1234", conn.RemoteAddr().String())
+	assert.Equal(t, "192.168.0.2:443", conn.LocalAddr().String())
+
+	var received = make([]byte, len(msg))
+	_, err = io.ReadFull(conn, received)
+	assert.NoError(t, err)
+	assert.Equal(t, msg, received)
+}
+
+func mustProxyProtocolHeader(t *testing.T, header ProxyProtocolHeader) []byte {
+	b, err := header.Bytes()
+	assert.NoError(t, err)
+	return b
+}
+
+func TestLoadBalancerSendsServerNameWhenAsked(t *testing.T) {
+	var testCases = []struct {
+		description string
+		sni         bool
+		expected    string
+	}{
+		{
+			description: "without sni",
+			expected:    "",
+		},
+		{
+			description: "with sni",
+			sni:         true,
+			expected:    "example.com",
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.description, func(t *testing.T) {
+			upstream, err := net.Listen("tcp4", "127.0.0.1:0")
+			assert.NoError(t, err)
+			defer upstream.Close()
+
+			lb := startLoadBalancer(t, LoadBalancerConfig{
+				Frontends: []Frontend{{Name: "a", Address: freeAddress(t), Backend: "tls"}},
+				Backends: []Backend{{
+					Name: "tls",
+					Servers: []Server{{
+						Address:          upstream.Addr().String(),
+						ProxyProtocol:    ProxyProtocolV2,
+						ProxyProtocolSNI: tc.sni,
+					}},
+				}},
+			})
+
+			client, err := net.Dial("tcp", lb.frontends[0].address)
+			assert.NoError(t, err)
+			defer client.Close()
+
+			go tls.Client(client, &tls.Config{ServerName: "example.com"}).Handshake()
+
+			conn, err := upstream.Accept()
+			assert.NoError(t, err)
+			defer conn.Close()
+
+			conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+			header, err := ReadProxyProtocolHeader(bufio.NewReader(conn))
+			if !assert.NoError(t, err) {
+				return
+			}
+
+			var serverName string
+			for _, tlv := range header.TLVs {
+				if tlv.Type == PP2TypeAuthority {
+					serverName = string(tlv.Value)
+				}
+			}
+
+			assert.Equal(t, tc.expected, serverName)
+		})
+	}
+}
+
+func TestNewServerValidatesSNI(t *testing.T) {
+	_, err := newServer(Server{
+		Address:          "127.0.0.1:8080",
+		ProxyProtocol:    ProxyProtocolV1,
+		ProxyProtocolSNI: true,
+	})
+	assert.Error(t, err)
+}
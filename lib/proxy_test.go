@@ -4,6 +4,7 @@ import (
 	"bytes"
 	"fmt"
 	"net"
+	"sync"
 	"testing"
 	"time"
 
@@ -56,14 +57,11 @@ func TestNew(t *testing.T) {
 		},
 	}
 
-	var (
-		proxy Proxy
-		err   error
-	)
+	var err error
 
 	for _, tc := range testCases {
 		t.Run(tc.description, func(t *testing.T) {
-			proxy, err = NewProxy(*tc.config)
+			_, err = NewProxy(*tc.config)
 			if tc.shouldError {
 				assert.Error(t, err)
 				return
@@ -126,9 +124,11 @@ func TestNew(t *testing.T) {
 //	sides (the one that initiated).
 //
 func TestProxyingInLoop(t *testing.T) {
-	var msg = []byte("PING\r\n")
-	var receiveBuffer = make([]byte, len(msg))
-	var buf bytes.Buffer
+	var (
+		msg = []byte("PING\r\n")
+		buf lockedBuffer
+	)
+
 	server := NewDumbTcpServer(&buf)
 	defer server.Close()
 
@@ -147,24 +147,71 @@ func TestProxyingInLoop(t *testing.T) {
 	assert.NoError(t, err)
 	defer upstream.Close()
 
+	// a broken proxy fails the test instead of hanging
+	// it.
+	downstream.SetDeadline(time.Now().Add(5 * time.Second))
+	upstream.SetDeadline(time.Now().Add(5 * time.Second))
+
 	proxy, err := NewProxy(ProxyConfig{
 		From: downstream,
 		To:   upstream,
 	})
 	assert.NoError(t, err)
 
+	var transferred = make(chan error, 1)
 	go func() {
-		assert.NoError(t, proxy.Transfer())
+		transferred <- proxy.Transfer()
 	}()
 
-	time.Sleep(500 * time.Millisecond)
-
 	n, err := downstream.Write(msg)
 	assert.NoError(t, err)
 	assert.Equal(t, len(msg), n)
 
-	n, err = upstream.Read(receiveBuffer)
-	assert.NoError(t, err)
-	assert.Equal(t, len(msg), n)
+	// the message goes around the loop until the proxy
+	// gets closed.
+	var deadline = time.Now().Add(3 * time.Second)
+	for {
+		to, from := proxy.Stats()
+		if to.Tx >= uint64(4*len(msg)) && from.Tx >= uint64(4*len(msg)) {
+			break
+		}
+
+		if time.Now().After(deadline) {
+			t.Fatalf("message didn't loop: to=%+v from=%+v", to, from)
+		}
+
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	proxy.Close()
+
+	select {
+	case err := <-transferred:
+		assert.NoError(t, err)
+	case <-time.After(3 * time.Second):
+		t.Fatal("transfer didn't finish after closing the proxy")
+	}
+
 	assert.True(t, bytes.Count(buf.Bytes(), msg) > 4)
 }
+
+// lockedBuffer is a bytes.Buffer safe for concurrent
+// use.
+type lockedBuffer struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (b *lockedBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	return b.buf.Write(p)
+}
+
+func (b *lockedBuffer) Bytes() []byte {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	return append([]byte{}, b.buf.Bytes()...)
+}
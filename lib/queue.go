@@ -0,0 +1,143 @@
+package lib
+
+import (
+	"net"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	defaultMaxQueue     = 100
+	defaultQueueTimeout = 10 * time.Second
+)
+
+var (
+	errNoServerAvailable = errors.New("no server available")
+	errQueueFull         = errors.New("all servers are saturated and the queue is full")
+	errQueueTimeout      = errors.New("timed out waiting for a server")
+)
+
+// queuedConnection is a connection waiting for a
+// server to have a free slot.
+type queuedConnection struct {
+	client net.Addr
+	server chan *server
+}
+
+func (s *server) saturated() bool {
+	return s.maxConnections != 0 && s.slots >= s.maxConnections
+}
+
+// acquire takes a slot of a server for a connection
+// from 'client'. When every server is saturated, the
+// connection waits in a FIFO queue until a slot frees
+// up or the queue timeout expires. The slot must be
+// given back with release.
+func (b *backend) acquire(client net.Addr) (s *server, err error) {
+	b.mu.Lock()
+
+	s, saturated := b.pick(client)
+	if s != nil {
+		s.slots++
+		b.mu.Unlock()
+		return
+	}
+
+	if !saturated {
+		b.mu.Unlock()
+		err = errNoServerAvailable
+		return
+	}
+
+	if len(b.queue) >= b.maxQueue {
+		b.rejected++
+		b.mu.Unlock()
+		err = errQueueFull
+		return
+	}
+
+	var (
+		queued = &queuedConnection{
+			client: client,
+			server: make(chan *server, 1),
+		}
+		started = time.Now()
+		timer   = time.NewTimer(b.queueTimeout)
+	)
+	defer timer.Stop()
+
+	b.queue = append(b.queue, queued)
+	b.totalQueued++
+	b.mu.Unlock()
+
+	select {
+	case s = <-queued.server:
+	case <-timer.C:
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.totalQueueWait += time.Since(started)
+
+	if s != nil {
+		return
+	}
+
+	for ndx, other := range b.queue {
+		if other == queued {
+			b.queue = append(b.queue[:ndx], b.queue[ndx+1:]...)
+			b.rejected++
+			err = errQueueTimeout
+			return
+		}
+	}
+
+	// a slot got assigned right as the timer fired.
+	s = <-queued.server
+	return
+}
+
+// tryAcquire takes a slot of a server without waiting,
+// retrieving nil if none is available.
+func (b *backend) tryAcquire(client net.Addr) (s *server) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	s, _ = b.pick(client)
+	if s != nil {
+		s.slots++
+	}
+
+	return
+}
+
+// release gives back the slot of a server, handing it
+// to the connection waiting the longest, if any.
+func (b *backend) release(s *server) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	s.slots--
+	b.checkDrained(s)
+	b.dispatch()
+}
+
+// dispatch assigns free slots to the queued
+// connections in arrival order. It must be called
+// with the backend locked.
+func (b *backend) dispatch() {
+	for len(b.queue) != 0 {
+		queued := b.queue[0]
+
+		s, _ := b.pick(queued.client)
+		if s == nil {
+			return
+		}
+
+		s.slots++
+		queued.server <- s
+		b.queue = b.queue[1:]
+	}
+}
@@ -0,0 +1,130 @@
+package lib
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/rs/zerolog"
+	"github.com/stretchr/testify/assert"
+)
+
+// pickAddress retrieves the address of the server
+// that a connection from 'client' would be sent to.
+func pickAddress(b *backend, client net.Addr) string {
+	s := b.tryAcquire(client)
+	if s == nil {
+		return ""
+	}
+
+	b.release(s)
+	return s.address
+}
+
+func newQueueTestBackend(t *testing.T, cfg Backend) *backend {
+	cfg.Name = "app"
+	b, err := newBackend(cfg, nil, zerolog.Nop())
+	assert.NoError(t, err)
+
+	return b
+}
+
+// waitQueueDepth waits for 'depth' connections to be
+// queued in the backend.
+func waitQueueDepth(t *testing.T, b *backend, depth int) {
+	assert.True(t, waitFor(2*time.Second, func() bool {
+		return b.stats().QueueDepth == depth
+	}))
+}
+
+func TestAcquireSkipsSaturatedServers(t *testing.T) {
+	b := newQueueTestBackend(t, Backend{
+		Servers: []Server{
+			{Address: "10.0.0.1:80", MaxConnections: 1},
+			{Address: "10.0.0.2:80", MaxConnections: 1},
+		},
+	})
+
+	first := b.tryAcquire(nil)
+	second := b.tryAcquire(nil)
+	assert.NotNil(t, first)
+	assert.NotNil(t, second)
+	assert.NotEqual(t, first.address, second.address)
+	assert.Nil(t, b.tryAcquire(nil))
+
+	b.release(first)
+	assert.Equal(t, first, b.tryAcquire(nil))
+}
+
+func TestAcquireQueuesInOrder(t *testing.T) {
+	b := newQueueTestBackend(t, Backend{
+		Servers: []Server{{Address: "10.0.0.1:80", MaxConnections: 1}},
+	})
+
+	held, err := b.acquire(nil)
+	assert.NoError(t, err)
+
+	var served = make(chan int, 2)
+	for ndx := 0; ndx < 2; ndx++ {
+		go func(ndx int) {
+			s, err := b.acquire(nil)
+			assert.NoError(t, err)
+
+			served <- ndx
+			time.Sleep(10 * time.Millisecond)
+			b.release(s)
+		}(ndx)
+
+		waitQueueDepth(t, b, ndx+1)
+	}
+
+	b.release(held)
+	assert.Equal(t, 0, <-served)
+	assert.Equal(t, 1, <-served)
+
+	stats := b.stats()
+	assert.Equal(t, 0, stats.QueueDepth)
+	assert.Equal(t, uint64(2), stats.TotalQueued)
+	assert.True(t, stats.TotalQueueWait > 0)
+	assert.Equal(t, uint64(0), stats.Rejected)
+}
+
+func TestAcquireRejects(t *testing.T) {
+	var testCases = []struct {
+		description string
+		queued      int
+		expected    error
+	}{
+		{"when timing out", 0, errQueueTimeout},
+		{"when the queue is full", 1, errQueueFull},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.description, func(t *testing.T) {
+			b := newQueueTestBackend(t, Backend{
+				MaxQueue:     1,
+				QueueTimeout: 100 * time.Millisecond,
+				Servers:      []Server{{Address: "10.0.0.1:80", MaxConnections: 1}},
+			})
+
+			_, err := b.acquire(nil)
+			assert.NoError(t, err)
+
+			for ndx := 0; ndx < tc.queued; ndx++ {
+				go b.acquire(nil)
+				waitQueueDepth(t, b, ndx+1)
+			}
+
+			_, err = b.acquire(nil)
+			assert.Equal(t, tc.expected, err)
+			assert.True(t, b.stats().Rejected >= 1)
+		})
+	}
+}
+
+func TestAcquireWithoutServers(t *testing.T) {
+	b := newQueueTestBackend(t, Backend{})
+
+	_, err := b.acquire(nil)
+	assert.Equal(t, errNoServerAvailable, err)
+}
@@ -0,0 +1,359 @@
+package lib
+
+import (
+	"container/list"
+	"math"
+	"net"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/rs/zerolog"
+)
+
+// Actions taken on connections over the rate limits.
+const (
+	RateLimitActionReject = "reject"
+	RateLimitActionDelay  = "delay"
+	RateLimitActionTarpit = "tarpit"
+)
+
+const (
+	defaultRateLimitMaxDelay   = 1 * time.Second
+	defaultRateLimitTarpit     = 10 * time.Second
+	defaultRateLimitMaxClients = 10000
+	defaultRateLimitMaxTarpit  = 1000
+	rateLimitLogInterval       = 1 * time.Second
+)
+
+// tokenBucket allows 'rate' events per second with
+// bursts of up to 'burst' events.
+type tokenBucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// reserve takes a token from the bucket, retrieving how
+// long to wait for it to be available. When the wait
+// would exceed 'maxWait', no token is taken and 'ok' is
+// false.
+func (b *tokenBucket) reserve(now time.Time, rate float64, burst int, maxWait time.Duration) (wait time.Duration, ok bool) {
+	if b.last.IsZero() {
+		b.tokens = float64(burst)
+	} else if elapsed := now.Sub(b.last).Seconds(); elapsed > 0 {
+		b.tokens = math.Min(float64(burst), b.tokens+elapsed*rate)
+	}
+	b.last = now
+
+	if b.tokens >= 1 {
+		b.tokens--
+		ok = true
+		return
+	}
+
+	wait = time.Duration((1 - b.tokens) / rate * float64(time.Second))
+	if wait > maxWait {
+		wait = 0
+		return
+	}
+
+	b.tokens--
+	ok = true
+	return
+}
+
+// refund gives back the token taken by the last
+// reservation.
+func (b *tokenBucket) refund() {
+	b.tokens++
+}
+
+// clientBucket is an entry of the LRU table of
+// per-client buckets.
+type clientBucket struct {
+	key    string
+	bucket tokenBucket
+}
+
+// rateLimiter limits the rate of new connections per
+// client (IPs grouped by prefix) and for the whole
+// listener. The table of client buckets is bounded,
+// evicting the least recently used ones.
+type rateLimiter struct {
+	cfg RateLimit
+
+	mu      sync.Mutex
+	global  tokenBucket
+	clients map[string]*list.Element
+	lru     *list.List
+
+	// tarpitted is the number of connections being
+	// held by the tarpit.
+	tarpitted int64
+
+	// violations since the last one logged, so that
+	// attacks don't flood the log.
+	lastLogged time.Time
+	suppressed uint64
+}
+
+func newRateLimiter(cfg RateLimit) (l *rateLimiter, err error) {
+	if cfg.Rate < 0 || cfg.GlobalRate < 0 || cfg.Burst < 0 || cfg.GlobalBurst < 0 {
+		err = errors.Errorf("rates must not be negative")
+		return
+	}
+
+	if cfg.Rate == 0 && cfg.GlobalRate == 0 {
+		return
+	}
+
+	if cfg.Action == "" {
+		cfg.Action = RateLimitActionReject
+	}
+
+	switch cfg.Action {
+	case RateLimitActionReject, RateLimitActionDelay, RateLimitActionTarpit:
+	default:
+		err = errors.Errorf("unknown rate limit action '%s'", cfg.Action)
+		return
+	}
+
+	if cfg.ClientPrefixV4 == 0 {
+		cfg.ClientPrefixV4 = 32
+	}
+
+	if cfg.ClientPrefixV6 == 0 {
+		cfg.ClientPrefixV6 = 128
+	}
+
+	if cfg.ClientPrefixV4 < 0 || cfg.ClientPrefixV4 > 32 ||
+		cfg.ClientPrefixV6 < 0 || cfg.ClientPrefixV6 > 128 {
+		err = errors.Errorf("invalid client prefix lengths /%d and /%d",
+			cfg.ClientPrefixV4, cfg.ClientPrefixV6)
+		return
+	}
+
+	if cfg.Burst == 0 {
+		cfg.Burst = int(math.Max(1, math.Ceil(cfg.Rate)))
+	}
+
+	if cfg.GlobalBurst == 0 {
+		cfg.GlobalBurst = int(math.Max(1, math.Ceil(cfg.GlobalRate)))
+	}
+
+	if cfg.MaxDelay == 0 {
+		cfg.MaxDelay = defaultRateLimitMaxDelay
+	}
+
+	if cfg.Tarpit == 0 {
+		cfg.Tarpit = defaultRateLimitTarpit
+	}
+
+	if cfg.MaxClients == 0 {
+		cfg.MaxClients = defaultRateLimitMaxClients
+	}
+
+	if cfg.MaxTarpit < 0 {
+		err = errors.Errorf("max tarpit must not be negative")
+		return
+	}
+
+	if cfg.MaxTarpit == 0 {
+		cfg.MaxTarpit = defaultRateLimitMaxTarpit
+	}
+
+	l = &rateLimiter{
+		cfg:     cfg,
+		clients: map[string]*list.Element{},
+		lru:     list.New(),
+	}
+	return
+}
+
+// allow decides whether a new connection from 'client'
+// can proceed, retrieving how long it should be
+// delayed first.
+func (l *rateLimiter) allow(client net.Addr, now time.Time) (wait time.Duration, ok bool) {
+	var maxWait time.Duration
+
+	if l.cfg.Action == RateLimitActionDelay {
+		maxWait = l.cfg.MaxDelay
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	var bucket *tokenBucket
+
+	ok = true
+	if l.cfg.Rate > 0 {
+		bucket = l.bucket(client)
+
+		wait, ok = bucket.reserve(now, l.cfg.Rate, l.cfg.Burst, maxWait)
+		if !ok {
+			return
+		}
+	}
+
+	if l.cfg.GlobalRate > 0 {
+		var globalWait time.Duration
+
+		globalWait, ok = l.global.reserve(now, l.cfg.GlobalRate, l.cfg.GlobalBurst, maxWait)
+		if !ok {
+			// the connection won't go on, so the client
+			// keeps its token.
+			if bucket != nil {
+				bucket.refund()
+			}
+
+			wait = 0
+			return
+		}
+
+		if globalWait > wait {
+			wait = globalWait
+		}
+	}
+
+	return
+}
+
+// bucket retrieves the bucket of a client, creating it
+// (and evicting the least recently used one if the
+// table is full) if needed. It must be called with the
+// limiter locked.
+func (l *rateLimiter) bucket(client net.Addr) *tokenBucket {
+	var key = l.clientKey(client)
+
+	if elem, ok := l.clients[key]; ok {
+		l.lru.MoveToFront(elem)
+		return &elem.Value.(*clientBucket).bucket
+	}
+
+	if l.lru.Len() >= l.cfg.MaxClients {
+		oldest := l.lru.Back()
+		l.lru.Remove(oldest)
+		delete(l.clients, oldest.Value.(*clientBucket).key)
+	}
+
+	entry := &clientBucket{key: key}
+	l.clients[key] = l.lru.PushFront(entry)
+	return &entry.bucket
+}
+
+// clientKey identifies the network of a client given
+// the configured prefix lengths.
+func (l *rateLimiter) clientKey(client net.Addr) string {
+	ip := addrIP(client)
+	if ip == nil {
+		return clientKey(client)
+	}
+
+	if ip4 := ip.To4(); ip4 != nil {
+		return ip4.Mask(net.CIDRMask(l.cfg.ClientPrefixV4, 32)).String() +
+			"/" + strconv.Itoa(l.cfg.ClientPrefixV4)
+	}
+
+	return ip.Mask(net.CIDRMask(l.cfg.ClientPrefixV6, 128)).String() +
+		"/" + strconv.Itoa(l.cfg.ClientPrefixV6)
+}
+
+func (l *rateLimiter) clientCount() int {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	return l.lru.Len()
+}
+
+// logViolation logs a connection over the limits,
+// logging at most one violation per interval along
+// with the number of the ones that were omitted.
+func (l *rateLimiter) logViolation(logger zerolog.Logger, client net.Addr, now time.Time) {
+	l.mu.Lock()
+	if now.Sub(l.lastLogged) < rateLimitLogInterval {
+		l.suppressed++
+		l.mu.Unlock()
+		return
+	}
+
+	suppressed := l.suppressed
+	l.lastLogged = now
+	l.suppressed = 0
+	l.mu.Unlock()
+
+	logger.Warn().
+		Str("remote", client.String()).
+		Str("action", l.cfg.Action).
+		Uint64("suppressed", suppressed).
+		Msg("connection rate limited")
+}
+
+// rateLimit applies the rate limits to a connection
+// before it takes any slots, retrieving whether it
+// should be served. Delayed and tarpitted connections
+// block here, calling 'yield' first so that they give
+// back the slots they might be holding.
+func (f *frontend) rateLimit(client net.Addr, yield func()) bool {
+	if f.rateLimiter == nil {
+		return true
+	}
+
+	var now = time.Now()
+
+	wait, ok := f.rateLimiter.allow(client, now)
+	if ok && wait == 0 {
+		return true
+	}
+
+	atomic.AddUint64(&f.rateLimited, 1)
+	f.rateLimiter.logViolation(f.logger, client, now)
+
+	if ok {
+		atomic.AddUint64(&f.rateDelayed, 1)
+		yield()
+		return f.sleep(wait)
+	}
+
+	if f.rateLimiter.cfg.Action == RateLimitActionTarpit && f.rateLimiter.enterTarpit() {
+		defer f.rateLimiter.leaveTarpit()
+
+		atomic.AddUint64(&f.rateTarpitted, 1)
+		yield()
+		f.sleep(f.rateLimiter.cfg.Tarpit)
+	}
+
+	return false
+}
+
+// enterTarpit takes a place in the tarpit, retrieving
+// false when it's full so that the connection gets
+// closed right away instead.
+func (l *rateLimiter) enterTarpit() bool {
+	if atomic.AddInt64(&l.tarpitted, 1) > int64(l.cfg.MaxTarpit) {
+		atomic.AddInt64(&l.tarpitted, -1)
+		return false
+	}
+
+	return true
+}
+
+func (l *rateLimiter) leaveTarpit() {
+	atomic.AddInt64(&l.tarpitted, -1)
+}
+
+// sleep waits for 'd' unless the frontend gets closed
+// in the meantime, retrieving whether it waited it
+// all.
+func (f *frontend) sleep(d time.Duration) bool {
+	var timer = time.NewTimer(d)
+	defer timer.Stop()
+
+	select {
+	case <-timer.C:
+		return true
+	case <-f.done:
+		return false
+	}
+}
@@ -0,0 +1,287 @@
+package lib
+
+import (
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestTokenBucketReserve(t *testing.T) {
+	var now = time.Now()
+
+	var testCases = []struct {
+		description string
+		taken       int
+		elapsed     time.Duration
+		maxWait     time.Duration
+		wait        time.Duration
+		ok          bool
+	}{
+		{"within burst", 1, 0, 0, 0, true},
+		{"burst exhausted", 2, 0, 0, 0, false},
+		{"refilled", 2, 100 * time.Millisecond, 0, 0, true},
+		{"delayed", 2, 0, time.Second, 100 * time.Millisecond, true},
+		{"delay too long", 2, 0, 50 * time.Millisecond, 0, false},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.description, func(t *testing.T) {
+			var bucket tokenBucket
+
+			for ndx := 0; ndx < tc.taken; ndx++ {
+				bucket.reserve(now, 10, 2, 0)
+			}
+
+			wait, ok := bucket.reserve(now.Add(tc.elapsed), 10, 2, tc.maxWait)
+			assert.Equal(t, tc.ok, ok)
+			assert.InDelta(t, float64(tc.wait), float64(wait), float64(time.Millisecond))
+		})
+	}
+}
+
+func TestRateLimiterGroupsClients(t *testing.T) {
+	var testCases = []struct {
+		description string
+		cfg         RateLimit
+		other       string
+		limited     bool
+	}{
+		{"single addresses", RateLimit{}, "10.0.0.2", false},
+		{"same network", RateLimit{ClientPrefixV4: 24}, "10.0.0.2", true},
+		{"other network", RateLimit{ClientPrefixV4: 24}, "10.0.1.1", false},
+		{"ipv6 network", RateLimit{ClientPrefixV6: 64}, "2001:db8::2", true},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.description, func(t *testing.T) {
+			tc.cfg.Rate = 1
+			l, err := newRateLimiter(tc.cfg)
+			assert.NoError(t, err)
+
+			var (
+				now   = time.Now()
+				first = "10.0.0.1"
+			)
+
+			if net.ParseIP(tc.other).To4() == nil {
+				first = "2001:db8::1"
+			}
+
+			_, ok := l.allow(&net.TCPAddr{IP: net.ParseIP(first)}, now)
+			assert.True(t, ok)
+
+			_, ok = l.allow(&net.TCPAddr{IP: net.ParseIP(tc.other)}, now)
+			assert.Equal(t, tc.limited, !ok)
+		})
+	}
+}
+
+func TestRateLimiterEvictsLeastRecentlyUsed(t *testing.T) {
+	l, err := newRateLimiter(RateLimit{Rate: 1, MaxClients: 2})
+	assert.NoError(t, err)
+
+	var (
+		now = time.Now()
+		a   = &net.TCPAddr{IP: net.ParseIP("10.0.0.1")}
+		b   = &net.TCPAddr{IP: net.ParseIP("10.0.0.2")}
+		c   = &net.TCPAddr{IP: net.ParseIP("10.0.0.3")}
+	)
+
+	l.allow(a, now)
+	l.allow(b, now)
+	l.allow(a, now)
+	l.allow(c, now)
+	assert.Equal(t, 2, l.clientCount())
+
+	// 'b' got evicted, so it starts over with a full
+	// bucket while 'c' is still limited.
+	_, ok := l.allow(b, now)
+	assert.True(t, ok)
+
+	_, ok = l.allow(c, now)
+	assert.False(t, ok)
+}
+
+func TestRateLimiterGlobalRate(t *testing.T) {
+	l, err := newRateLimiter(RateLimit{GlobalRate: 2})
+	assert.NoError(t, err)
+
+	var now = time.Now()
+	for ndx := 0; ndx < 2; ndx++ {
+		_, ok := l.allow(&net.TCPAddr{IP: net.IPv4(10, 0, 0, byte(ndx))}, now)
+		assert.True(t, ok)
+	}
+
+	_, ok := l.allow(&net.TCPAddr{IP: net.IPv4(10, 0, 0, 9)}, now)
+	assert.False(t, ok)
+	assert.Equal(t, 0, l.clientCount())
+}
+
+func TestRateLimiterRefundsClientsOnGlobalRejection(t *testing.T) {
+	l, err := newRateLimiter(RateLimit{Rate: 0.5, GlobalRate: 1})
+	assert.NoError(t, err)
+
+	var (
+		now    = time.Now()
+		client = &net.TCPAddr{IP: net.IPv4(10, 0, 0, 1)}
+	)
+
+	_, ok := l.allow(&net.TCPAddr{IP: net.IPv4(10, 0, 0, 2)}, now)
+	assert.True(t, ok)
+
+	_, ok = l.allow(client, now)
+	assert.False(t, ok)
+
+	// the global bucket refilled while the client's
+	// still holds the token it didn't get to use.
+	_, ok = l.allow(client, now.Add(time.Second))
+	assert.True(t, ok)
+}
+
+func TestNewRateLimiterValidates(t *testing.T) {
+	var testCases = []struct {
+		description string
+		cfg         RateLimit
+		shouldFail  bool
+	}{
+		{"disabled", RateLimit{}, false},
+		{"negative rate", RateLimit{Rate: -1}, true},
+		{"unknown action", RateLimit{Rate: 1, Action: "drop"}, true},
+		{"invalid prefix", RateLimit{Rate: 1, ClientPrefixV4: 33}, true},
+		{"tarpit", RateLimit{Rate: 1, Action: RateLimitActionTarpit}, false},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.description, func(t *testing.T) {
+			_, err := newRateLimiter(tc.cfg)
+			if tc.shouldFail {
+				assert.Error(t, err)
+				return
+			}
+
+			assert.NoError(t, err)
+		})
+	}
+}
+
+func TestLoadBalancerRateLimits(t *testing.T) {
+	var testCases = []struct {
+		description string
+		rateLimit   RateLimit
+		served      bool
+		minDuration time.Duration
+		expected    func(stats FrontendStats) uint64
+	}{
+		{
+			description: "reject",
+			rateLimit:   RateLimit{Rate: 2, Burst: 1},
+			served:      false,
+			expected:    func(stats FrontendStats) uint64 { return stats.RateLimited },
+		},
+		{
+			description: "delay",
+			rateLimit:   RateLimit{Rate: 2, Burst: 1, Action: RateLimitActionDelay},
+			served:      true,
+			minDuration: 300 * time.Millisecond,
+			expected:    func(stats FrontendStats) uint64 { return stats.RateDelayed },
+		},
+		{
+			description: "tarpit",
+			rateLimit: RateLimit{
+				Rate:   2,
+				Burst:  1,
+				Action: RateLimitActionTarpit,
+				Tarpit: 300 * time.Millisecond,
+			},
+			served:      false,
+			minDuration: 300 * time.Millisecond,
+			expected:    func(stats FrontendStats) uint64 { return stats.RateTarpitted },
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.description, func(t *testing.T) {
+			lb, addresses := startLimitedLoadBalancer(t, LoadBalancerConfig{}, Frontend{
+				Name:      "a",
+				RateLimit: tc.rateLimit,
+			})
+
+			first, served := dialEcho(t, addresses[0])
+			defer first.Close()
+			assert.True(t, served)
+
+			start := time.Now()
+			second, err := net.Dial("tcp", addresses[0])
+			assert.NoError(t, err)
+			defer second.Close()
+
+			second.Write([]byte("ping"))
+			second.SetReadDeadline(time.Now().Add(2 * time.Second))
+			_, err = second.Read(make([]byte, 4))
+			assert.Equal(t, tc.served, err == nil)
+			assert.True(t, time.Since(start) >= tc.minDuration)
+
+			stats := lb.Stats().Frontends[0]
+			assert.Equal(t, uint64(1), stats.RateLimited)
+			assert.Equal(t, uint64(1), tc.expected(stats))
+			assert.Equal(t, 1, stats.RateLimitClients)
+		})
+	}
+}
+
+func TestLoadBalancerTarpitsWithoutSlots(t *testing.T) {
+	for _, action := range []string{LimitActionClose, LimitActionWait} {
+		t.Run(action, func(t *testing.T) {
+			lb, addresses := startLimitedLoadBalancer(t, LoadBalancerConfig{}, Frontend{
+				Name:           "a",
+				MaxConnections: 1,
+				LimitAction:    action,
+				RateLimit: RateLimit{
+					Rate:      2,
+					Burst:     1,
+					Action:    RateLimitActionTarpit,
+					Tarpit:    2 * time.Second,
+					MaxTarpit: 1,
+				},
+			})
+
+			first, served := dialEcho(t, addresses[0])
+			assert.True(t, served)
+			first.Close()
+
+			assert.True(t, waitFor(time.Second, func() bool {
+				return lb.Stats().Frontends[0].ActiveConnections == 0
+			}))
+
+			tarpitted, err := net.Dial("tcp", addresses[0])
+			assert.NoError(t, err)
+			defer tarpitted.Close()
+
+			assert.True(t, waitFor(time.Second, func() bool {
+				return lb.Stats().Frontends[0].RateTarpitted == 1
+			}))
+
+			// the tarpit is full, so this one gets closed
+			// right away.
+			start := time.Now()
+			closed, err := net.Dial("tcp", addresses[0])
+			assert.NoError(t, err)
+			defer closed.Close()
+
+			closed.SetReadDeadline(time.Now().Add(time.Second))
+			_, err = closed.Read(make([]byte, 1))
+			assert.Equal(t, io.EOF, err)
+			assert.True(t, time.Since(start) < time.Second)
+
+			// the tarpitted connection doesn't hold the only
+			// slot of the frontend.
+			time.Sleep(500 * time.Millisecond)
+			last, served := dialEcho(t, addresses[0])
+			defer last.Close()
+			assert.True(t, served)
+		})
+	}
+}
@@ -0,0 +1,228 @@
+package lib
+
+import (
+	"context"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// SrvAddressPrefix marks servers that stand for the
+// targets of a DNS SRV record, e.g.
+// 'srv:_http._tcp.example.internal'.
+const SrvAddressPrefix = "srv:"
+
+const (
+	dnsLookupTimeout          = 5 * time.Second
+	defaultSrvResolveInterval = 30 * time.Second
+)
+
+// Resolver looks up the addresses of a hostname and
+// the SRV records of a service. net.DefaultResolver
+// satisfies it.
+type Resolver interface {
+	LookupIPAddr(ctx context.Context, host string) ([]net.IPAddr, error)
+	LookupSRV(ctx context.Context, service, proto, name string) (string, []*net.SRV, error)
+}
+
+// dnsDiscoverer expands a server specified by hostname
+// into one server per address the name resolves to.
+type dnsDiscoverer struct {
+	backend  *backend
+	server   Server
+	host     string
+	port     string
+	source   string
+	resolver Resolver
+	interval time.Duration
+}
+
+func newDnsDiscoverer(b *backend, cfg Server, resolver Resolver, interval time.Duration) *dnsDiscoverer {
+	host, port, _ := net.SplitHostPort(cfg.Address)
+
+	if resolver == nil {
+		resolver = net.DefaultResolver
+	}
+
+	return &dnsDiscoverer{
+		backend:  b,
+		server:   cfg,
+		host:     host,
+		port:     port,
+		source:   "dns:" + cfg.Address,
+		resolver: resolver,
+		interval: interval,
+	}
+}
+
+// refresh resolves the hostname, replacing the servers
+// of the source with the addresses found. On lookup
+// failures the previous servers are kept.
+func (d *dnsDiscoverer) refresh() {
+	ctx, cancel := context.WithTimeout(context.Background(), dnsLookupTimeout)
+	defer cancel()
+
+	addrs, err := d.resolver.LookupIPAddr(ctx, d.host)
+	if err != nil {
+		d.backend.logger.Error().
+			Err(err).
+			Str("source", d.source).
+			Msg("couldn't resolve server")
+		return
+	}
+
+	var (
+		seen    = map[string]bool{}
+		configs []Server
+	)
+
+	for _, addr := range addrs {
+		if !matchesNetwork(d.backend.network, addr.IP) {
+			continue
+		}
+
+		address := net.JoinHostPort(addr.IP.String(), d.port)
+		if seen[address] {
+			continue
+		}
+
+		seen[address] = true
+
+		cfg := d.server
+		cfg.Address = address
+		configs = append(configs, cfg)
+	}
+
+	sort.Slice(configs, func(i, j int) bool {
+		return configs[i].Address < configs[j].Address
+	})
+
+	d.backend.updateAndLog(d.source, configs)
+}
+
+func (d *dnsDiscoverer) run(done <-chan struct{}) {
+	refreshEvery(d, d.interval, done)
+}
+
+// srvDiscoverer turns the targets of a SRV record into
+// servers: the record's priority sets their failover
+// tier and its weight their balancing weight.
+type srvDiscoverer struct {
+	backend  *backend
+	server   Server
+	name     string
+	source   string
+	resolver Resolver
+	interval time.Duration
+}
+
+func newSrvDiscoverer(b *backend, cfg Server, resolver Resolver, interval time.Duration) *srvDiscoverer {
+	if resolver == nil {
+		resolver = net.DefaultResolver
+	}
+
+	if interval == 0 {
+		interval = defaultSrvResolveInterval
+	}
+
+	return &srvDiscoverer{
+		backend:  b,
+		server:   cfg,
+		name:     strings.TrimPrefix(cfg.Address, SrvAddressPrefix),
+		source:   cfg.Address,
+		resolver: resolver,
+		interval: interval,
+	}
+}
+
+// refresh looks the SRV record up, replacing the
+// servers of the source with its targets. On lookup
+// failures the previous servers are kept.
+func (d *srvDiscoverer) refresh() {
+	ctx, cancel := context.WithTimeout(context.Background(), dnsLookupTimeout)
+	defer cancel()
+
+	_, records, err := d.resolver.LookupSRV(ctx, "", "", d.name)
+	if err != nil {
+		d.backend.logger.Error().
+			Err(err).
+			Str("source", d.source).
+			Msg("couldn't look up srv record")
+		return
+	}
+
+	var configs = make([]Server, 0, len(records))
+
+	for _, record := range records {
+		// a target of "." means that the service is
+		// decidedly not available at the name (RFC 2782).
+		if record.Target == "." {
+			continue
+		}
+
+		cfg := d.server
+		cfg.Address = net.JoinHostPort(
+			strings.TrimSuffix(record.Target, "."),
+			strconv.Itoa(int(record.Port)))
+		cfg.Priority = int(record.Priority)
+
+		// a zero weight means that the target should
+		// only rarely be picked when others have weights
+		// set, which the lowest weight approximates.
+		cfg.Weight = int(record.Weight)
+		if cfg.Weight == 0 {
+			cfg.Weight = 1
+		}
+
+		configs = append(configs, cfg)
+	}
+
+	sort.Slice(configs, func(i, j int) bool {
+		if configs[i].Priority != configs[j].Priority {
+			return configs[i].Priority < configs[j].Priority
+		}
+
+		return configs[i].Address < configs[j].Address
+	})
+
+	d.backend.updateAndLog(d.source, configs)
+}
+
+func (d *srvDiscoverer) run(done <-chan struct{}) {
+	refreshEvery(d, d.interval, done)
+}
+
+func isSrvAddress(address string) bool {
+	return strings.HasPrefix(address, SrvAddressPrefix)
+}
+
+// isHostname tells whether a server address refers to
+// a name that needs to be resolved (as opposed to an
+// IP address or a unix socket).
+func isHostname(address string) bool {
+	if isUnixAddress(address) {
+		return false
+	}
+
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return false
+	}
+
+	return net.ParseIP(host) == nil
+}
+
+// matchesNetwork tells whether 'ip' can be reached
+// through the TCP network 'network'.
+func matchesNetwork(network string, ip net.IP) bool {
+	switch network {
+	case "tcp4":
+		return ip.To4() != nil
+	case "tcp6":
+		return ip.To4() == nil
+	}
+
+	return true
+}
@@ -0,0 +1,242 @@
+package lib
+
+import (
+	"context"
+	"errors"
+	"net"
+	"sync"
+	"testing"
+
+	"github.com/rs/zerolog"
+	"github.com/stretchr/testify/assert"
+)
+
+// fakeResolver answers lookups from a table that tests
+// can change at any time.
+type fakeResolver struct {
+	mu      sync.Mutex
+	records map[string][]string
+	srv     map[string][]*net.SRV
+	err     error
+}
+
+func (r *fakeResolver) setSrv(name string, records ...*net.SRV) {
+	r.mu.Lock()
+	r.srv[name] = records
+	r.mu.Unlock()
+}
+
+func (r *fakeResolver) LookupSRV(ctx context.Context, service, proto, name string) (cname string, records []*net.SRV, err error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.err != nil {
+		err = r.err
+		return
+	}
+
+	cname, records = name, r.srv[name]
+	return
+}
+
+func (r *fakeResolver) set(host string, ips ...string) {
+	r.mu.Lock()
+	r.records[host] = ips
+	r.mu.Unlock()
+}
+
+func (r *fakeResolver) fail(err error) {
+	r.mu.Lock()
+	r.err = err
+	r.mu.Unlock()
+}
+
+func (r *fakeResolver) LookupIPAddr(ctx context.Context, host string) (addrs []net.IPAddr, err error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.err != nil {
+		err = r.err
+		return
+	}
+
+	for _, ip := range r.records[host] {
+		addrs = append(addrs, net.IPAddr{IP: net.ParseIP(ip)})
+	}
+
+	return
+}
+
+func serverAddresses(b *backend) (addresses []string) {
+	for _, s := range b.stats().Servers {
+		addresses = append(addresses, s.Address)
+	}
+
+	return
+}
+
+func TestIsHostname(t *testing.T) {
+	var testCases = []struct {
+		description string
+		address     string
+		expected    bool
+	}{
+		{"hostname", "nginx:80", true},
+		{"ipv4", "10.0.0.1:80", false},
+		{"ipv6", "[::1]:80", false},
+		{"unix socket", "unix:/var/run/app.sock", false},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.description, func(t *testing.T) {
+			assert.Equal(t, tc.expected, isHostname(tc.address))
+		})
+	}
+}
+
+func TestDnsDiscoveryExpandsAddresses(t *testing.T) {
+	var testCases = []struct {
+		description string
+		network     string
+		expected    []string
+	}{
+		{
+			description: "every family",
+			network:     "tcp",
+			expected:    []string{"10.0.0.1:80", "10.0.0.2:80", "[2001:db8::1]:80"},
+		},
+		{
+			description: "ipv4 only",
+			network:     "tcp4",
+			expected:    []string{"10.0.0.1:80", "10.0.0.2:80"},
+		},
+		{
+			description: "ipv6 only",
+			network:     "tcp6",
+			expected:    []string{"[2001:db8::1]:80"},
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.description, func(t *testing.T) {
+			resolver := &fakeResolver{records: map[string][]string{}}
+			resolver.set("app", "10.0.0.2", "2001:db8::1", "10.0.0.1")
+
+			b, err := newBackend(Backend{
+				Name:            "app",
+				Network:         tc.network,
+				ResolveInterval: 1,
+				Servers: []Server{
+					{Address: "app:80"},
+					{Address: "10.1.1.1:80"},
+				},
+			}, resolver, zerolog.Nop())
+			assert.NoError(t, err)
+
+			b.start()
+			defer b.stop()
+
+			assert.Equal(t,
+				append([]string{"10.1.1.1:80"}, tc.expected...),
+				serverAddresses(b))
+		})
+	}
+}
+
+func TestDnsDiscoveryFollowsChanges(t *testing.T) {
+	resolver := &fakeResolver{records: map[string][]string{}}
+	resolver.set("app", "10.0.0.1", "10.0.0.2")
+
+	b, err := newBackend(Backend{
+		Name:            "app",
+		ResolveInterval: 1,
+		Servers: []Server{
+			{Address: "app:80", Weight: 3},
+		},
+	}, resolver, zerolog.Nop())
+	assert.NoError(t, err)
+
+	d := b.discoverers[0]
+	d.refresh()
+	assert.Equal(t, []string{"10.0.0.1:80", "10.0.0.2:80"}, serverAddresses(b))
+
+	kept := b.servers[1]
+	assert.Equal(t, 3, kept.weight)
+
+	resolver.set("app", "10.0.0.2", "10.0.0.3")
+	d.refresh()
+	assert.Equal(t, []string{"10.0.0.2:80", "10.0.0.3:80"}, serverAddresses(b))
+	assert.True(t, kept == b.servers[0])
+
+	resolver.fail(errors.New("no such host"))
+	d.refresh()
+	assert.Equal(t, []string{"10.0.0.2:80", "10.0.0.3:80"}, serverAddresses(b))
+}
+
+func TestSrvDiscovery(t *testing.T) {
+	resolver := &fakeResolver{srv: map[string][]*net.SRV{}}
+	resolver.setSrv("_app._tcp.example.internal",
+		&net.SRV{Target: "b.example.internal.", Port: 8080, Priority: 10, Weight: 5},
+		&net.SRV{Target: "a.example.internal.", Port: 8081, Priority: 10, Weight: 0},
+		&net.SRV{Target: "backup.example.internal.", Port: 8080, Priority: 20, Weight: 1},
+	)
+
+	b, err := newBackend(Backend{
+		Name: "app",
+		Servers: []Server{
+			{Address: "srv:_app._tcp.example.internal", ProxyProtocol: ProxyProtocolV1},
+		},
+	}, resolver, zerolog.Nop())
+	assert.NoError(t, err)
+
+	b.start()
+	defer b.stop()
+
+	var servers []Server
+	for _, s := range b.servers {
+		servers = append(servers, s.config)
+	}
+
+	assert.Equal(t, []Server{
+		{Address: "a.example.internal:8081", ProxyProtocol: ProxyProtocolV1, Weight: 1, Priority: 10},
+		{Address: "b.example.internal:8080", ProxyProtocol: ProxyProtocolV1, Weight: 5, Priority: 10},
+		{Address: "backup.example.internal:8080", ProxyProtocol: ProxyProtocolV1, Weight: 1, Priority: 20},
+	}, servers)
+
+	for i := 0; i < 10; i++ {
+		assert.NotEqual(t, "backup.example.internal:8080", pickAddress(b, nil))
+	}
+
+	resolver.setSrv("_app._tcp.example.internal",
+		&net.SRV{Target: "backup.example.internal.", Port: 8080, Priority: 20, Weight: 1},
+	)
+	b.discoverers[0].refresh()
+	assert.Equal(t, "backup.example.internal:8080", pickAddress(b, nil))
+}
+
+func TestSrvDiscoverySkipsUnavailableTargets(t *testing.T) {
+	resolver := &fakeResolver{srv: map[string][]*net.SRV{}}
+	resolver.setSrv("_app._tcp.example.internal",
+		&net.SRV{Target: ".", Port: 0},
+		&net.SRV{Target: "a.example.internal.", Port: 8080, Weight: 1},
+	)
+
+	b, err := newBackend(Backend{
+		Name: "app",
+		Servers: []Server{
+			{Address: "srv:_app._tcp.example.internal"},
+		},
+	}, resolver, zerolog.Nop())
+	assert.NoError(t, err)
+
+	b.start()
+	defer b.stop()
+
+	assert.Equal(t, []string{"a.example.internal:8080"}, serverAddresses(b))
+
+	resolver.setSrv("_app._tcp.example.internal",
+		&net.SRV{Target: ".", Port: 0},
+	)
+	b.discoverers[0].refresh()
+	assert.Empty(t, serverAddresses(b))
+}
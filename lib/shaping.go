@@ -0,0 +1,312 @@
+package lib
+
+import (
+	"math"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// Rate is a bandwidth limit in bytes per second that
+// can be changed while connections are being throttled
+// by it. Zero means unlimited.
+type Rate struct {
+	bytesPerSecond int64
+}
+
+func NewRate(bytesPerSecond int64) *Rate {
+	return &Rate{bytesPerSecond: bytesPerSecond}
+}
+
+func (r *Rate) Set(bytesPerSecond int64) {
+	atomic.StoreInt64(&r.bytesPerSecond, bytesPerSecond)
+}
+
+func (r *Rate) Get() int64 {
+	if r == nil {
+		return 0
+	}
+
+	return atomic.LoadInt64(&r.bytesPerSecond)
+}
+
+// Throttle keeps the bytes transferred through it under
+// a rate using a token bucket that allows bursts of up
+// to a second worth of bytes. A throttle can be shared
+// by several transfers.
+type Throttle struct {
+	rate *Rate
+
+	mu     sync.Mutex
+	tokens float64
+	last   time.Time
+}
+
+func NewThrottle(rate *Rate) *Throttle {
+	return &Throttle{rate: rate}
+}
+
+// reserve takes 'n' bytes from the bucket, retrieving
+// how long the transfer must wait for them to be
+// within the rate.
+func (t *Throttle) reserve(n int, now time.Time) (wait time.Duration) {
+	var rate = float64(t.rate.Get())
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if rate == 0 {
+		t.last = time.Time{}
+		return
+	}
+
+	if t.last.IsZero() {
+		t.tokens = rate
+	} else if elapsed := now.Sub(t.last).Seconds(); elapsed > 0 {
+		t.tokens = math.Min(rate, t.tokens+elapsed*rate)
+	}
+	t.last = now
+
+	t.tokens -= float64(n)
+	if t.tokens < 0 {
+		wait = time.Duration(-t.tokens / rate * float64(time.Second))
+	}
+
+	return
+}
+
+// throttles is the set of throttles a direction of a
+// transfer goes through. Nil throttles are skipped.
+type throttles []*Throttle
+
+// chunkSize bounds the size of reads so that slow rates
+// don't get exceeded by whole buffers.
+func (ts throttles) chunkSize(size int) int {
+	for _, t := range ts {
+		if t == nil {
+			continue
+		}
+
+		rate := t.rate.Get()
+		if rate > 0 && rate < int64(size) {
+			size = int(rate)
+		}
+	}
+
+	return size
+}
+
+// reserve takes 'n' bytes from all of the throttles,
+// retrieving how long to wait for the slowest one.
+func (ts throttles) reserve(n int, now time.Time) (wait time.Duration) {
+	for _, t := range ts {
+		if t == nil {
+			continue
+		}
+
+		if w := t.reserve(n, now); w > wait {
+			wait = w
+		}
+	}
+
+	return
+}
+
+// bandwidthRates holds the rates of both directions of
+// a limit: upload goes from clients to servers and
+// download from servers to clients.
+type bandwidthRates struct {
+	upload   *Rate
+	download *Rate
+}
+
+func newBandwidthRates(cfg Bandwidth) (rates bandwidthRates, err error) {
+	err = validateBandwidth(cfg)
+	if err != nil {
+		return
+	}
+
+	rates = bandwidthRates{
+		upload:   NewRate(cfg.Upload),
+		download: NewRate(cfg.Download),
+	}
+	return
+}
+
+func (r bandwidthRates) set(cfg Bandwidth) (err error) {
+	err = validateBandwidth(cfg)
+	if err != nil {
+		return
+	}
+
+	r.upload.Set(cfg.Upload)
+	r.download.Set(cfg.Download)
+	return
+}
+
+func (r bandwidthRates) config() Bandwidth {
+	return Bandwidth{
+		Upload:   r.upload.Get(),
+		Download: r.download.Get(),
+	}
+}
+
+func validateBandwidth(cfg Bandwidth) (err error) {
+	if cfg.Upload < 0 || cfg.Download < 0 {
+		err = errors.Errorf("bandwidth limits must not be negative")
+	}
+
+	return
+}
+
+// clientThrottles are the throttles shared by the
+// connections of a client IP.
+type clientThrottles struct {
+	upload      *Throttle
+	download    *Throttle
+	connections int
+}
+
+// clientShaper tracks the throttles of each client IP.
+// Entries only exist while a client has connections so
+// that the table is bounded by the connections being
+// served.
+type clientShaper struct {
+	rates bandwidthRates
+
+	mu      sync.Mutex
+	clients map[string]*clientThrottles
+}
+
+func newClientShaper(rates bandwidthRates) *clientShaper {
+	return &clientShaper{
+		rates:   rates,
+		clients: map[string]*clientThrottles{},
+	}
+}
+
+func (c *clientShaper) acquire(client net.Addr) *clientThrottles {
+	var key = clientKey(client)
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	entry, ok := c.clients[key]
+	if !ok {
+		entry = &clientThrottles{
+			upload:   NewThrottle(c.rates.upload),
+			download: NewThrottle(c.rates.download),
+		}
+		c.clients[key] = entry
+	}
+
+	entry.connections++
+	return entry
+}
+
+func (c *clientShaper) release(client net.Addr) {
+	var key = clientKey(client)
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	entry, ok := c.clients[key]
+	if !ok {
+		return
+	}
+
+	entry.connections--
+	if entry.connections <= 0 {
+		delete(c.clients, key)
+	}
+}
+
+// FrontendBandwidth retrieves the current bandwidth
+// limits of a frontend.
+func (lb *LoadBalancer) FrontendBandwidth(name string) (cfg FrontendBandwidth, err error) {
+	f := lb.frontend(name)
+	if f == nil {
+		err = errors.Errorf("unknown frontend %s", name)
+		return
+	}
+
+	cfg = FrontendBandwidth{
+		PerConnection: f.connectionBandwidth.config(),
+		PerClient:     f.shaper.rates.config(),
+	}
+	return
+}
+
+// SetFrontendBandwidth changes the bandwidth limits of a
+// frontend, applying them to the connections already
+// established as well.
+func (lb *LoadBalancer) SetFrontendBandwidth(name string, cfg FrontendBandwidth) (err error) {
+	f := lb.frontend(name)
+	if f == nil {
+		err = errors.Errorf("unknown frontend %s", name)
+		return
+	}
+
+	if f.protocol == ProtocolUdp {
+		err = errors.Errorf("udp frontend %s can't be shaped", name)
+		return
+	}
+
+	err = validateBandwidth(cfg.PerConnection)
+	if err != nil {
+		return
+	}
+
+	err = validateBandwidth(cfg.PerClient)
+	if err != nil {
+		return
+	}
+
+	f.connectionBandwidth.set(cfg.PerConnection)
+	f.shaper.rates.set(cfg.PerClient)
+
+	f.logger.Info().
+		Int64("connection_upload", cfg.PerConnection.Upload).
+		Int64("connection_download", cfg.PerConnection.Download).
+		Int64("client_upload", cfg.PerClient.Upload).
+		Int64("client_download", cfg.PerClient.Download).
+		Msg("bandwidth changed")
+	return
+}
+
+// ServerBandwidth retrieves the current bandwidth limits
+// of each server of a backend.
+func (lb *LoadBalancer) ServerBandwidth(name string) (cfg Bandwidth, err error) {
+	b := lb.backend(name)
+	if b == nil {
+		err = errors.Errorf("unknown backend %s", name)
+		return
+	}
+
+	cfg = b.serverBandwidth.config()
+	return
+}
+
+// SetServerBandwidth changes the bandwidth limits of
+// each server of a backend.
+func (lb *LoadBalancer) SetServerBandwidth(name string, cfg Bandwidth) (err error) {
+	b := lb.backend(name)
+	if b == nil {
+		err = errors.Errorf("unknown backend %s", name)
+		return
+	}
+
+	err = b.serverBandwidth.set(cfg)
+	if err != nil {
+		return
+	}
+
+	b.logger.Info().
+		Int64("upload", cfg.Upload).
+		Int64("download", cfg.Download).
+		Msg("server bandwidth changed")
+	return
+}
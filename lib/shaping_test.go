@@ -0,0 +1,188 @@
+package lib
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestThrottleReserve(t *testing.T) {
+	var now = time.Now()
+
+	var testCases = []struct {
+		description string
+		rate        int64
+		taken       int
+		elapsed     time.Duration
+		n           int
+		wait        time.Duration
+	}{
+		{"unlimited", 0, 0, 0, 1 << 20, 0},
+		{"within burst", 1000, 0, 0, 1000, 0},
+		{"over burst", 1000, 1000, 0, 500, 500 * time.Millisecond},
+		{"refilled", 1000, 1000, time.Second, 1000, 0},
+		{"in debt", 1000, 2000, 0, 1000, 2 * time.Second},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.description, func(t *testing.T) {
+			var throttle = NewThrottle(NewRate(tc.rate))
+
+			if tc.taken > 0 {
+				throttle.reserve(tc.taken, now)
+			}
+
+			wait := throttle.reserve(tc.n, now.Add(tc.elapsed))
+			assert.InDelta(t, float64(tc.wait), float64(wait), float64(time.Millisecond))
+		})
+	}
+}
+
+func TestThrottlesFollowRateChanges(t *testing.T) {
+	var (
+		now      = time.Now()
+		rate     = NewRate(100)
+		throttle = NewThrottle(rate)
+		ts       = throttles{nil, throttle}
+	)
+
+	assert.Equal(t, 100, ts.chunkSize(bufferSize))
+	assert.Equal(t, time.Duration(0), ts.reserve(100, now))
+	assert.Equal(t, time.Second, ts.reserve(100, now))
+
+	rate.Set(0)
+	assert.Equal(t, bufferSize, ts.chunkSize(bufferSize))
+	assert.Equal(t, time.Duration(0), ts.reserve(1<<20, now))
+}
+
+func TestProxyStopsWaitingOnThrottlesWhenClosed(t *testing.T) {
+	client, from := net.Pipe()
+	to, upstream := net.Pipe()
+	defer client.Close()
+	defer upstream.Close()
+
+	proxy, err := NewProxy(ProxyConfig{
+		To:          to,
+		From:        from,
+		ToThrottles: []*Throttle{NewThrottle(NewRate(100))},
+	})
+	assert.NoError(t, err)
+
+	go io.Copy(ioutil.Discard, upstream)
+	go client.Write(make([]byte, 1000))
+
+	var done = make(chan error, 1)
+	go func() { done <- proxy.Transfer() }()
+
+	// the second chunk waits for a second on the
+	// throttle, which closing the proxy interrupts.
+	time.Sleep(100 * time.Millisecond)
+	start := time.Now()
+	proxy.Close()
+
+	select {
+	case <-done:
+		assert.True(t, time.Since(start) < 500*time.Millisecond)
+	case <-time.After(2 * time.Second):
+		t.Fatal("transfer didn't return")
+	}
+}
+
+func TestClientShaperSharesThrottles(t *testing.T) {
+	rates, err := newBandwidthRates(Bandwidth{Upload: 10})
+	assert.NoError(t, err)
+
+	var (
+		shaper = newClientShaper(rates)
+		a1     = &net.TCPAddr{IP: net.ParseIP("10.0.0.1"), Port: 1}
+		a2     = &net.TCPAddr{IP: net.ParseIP("10.0.0.1"), Port: 2}
+		b      = &net.TCPAddr{IP: net.ParseIP("10.0.0.2"), Port: 1}
+	)
+
+	assert.True(t, shaper.acquire(a1) == shaper.acquire(a2))
+	assert.True(t, shaper.acquire(a1) != shaper.acquire(b))
+
+	shaper.release(a1)
+	shaper.release(a2)
+	shaper.release(a1)
+	shaper.release(b)
+	assert.Empty(t, shaper.clients)
+}
+
+func TestLoadBalancerShapesBandwidth(t *testing.T) {
+	lb, addresses := startLimitedLoadBalancer(t, LoadBalancerConfig{}, Frontend{
+		Name: "a",
+		Bandwidth: FrontendBandwidth{
+			PerConnection: Bandwidth{Download: 4096},
+		},
+	})
+
+	conn, err := net.Dial("tcp", addresses[0])
+	assert.NoError(t, err)
+	defer conn.Close()
+
+	var payload = bytes.Repeat([]byte("a"), 8192)
+
+	start := time.Now()
+	_, err = conn.Write(payload)
+	assert.NoError(t, err)
+
+	_, err = io.ReadFull(conn, make([]byte, len(payload)))
+	assert.NoError(t, err)
+	assert.True(t, time.Since(start) >= 800*time.Millisecond,
+		"took %s", time.Since(start))
+
+	stats := lb.Stats().Backends[0].Servers[0]
+	assert.True(t, stats.RxThrottled >= 800*time.Millisecond,
+		"throttled for %s", stats.RxThrottled)
+	assert.Equal(t, time.Duration(0), stats.TxThrottled)
+}
+
+func TestAdminChangesBandwidth(t *testing.T) {
+	lb, _ := startLimitedLoadBalancer(t, LoadBalancerConfig{}, Frontend{Name: "a"})
+
+	var testCases = []struct {
+		description string
+		path        string
+		body        string
+		status      int
+	}{
+		{"frontend", "/bandwidth/frontends/a", `{"per_client": {"upload": 100}}`, http.StatusOK},
+		{"backend", "/bandwidth/backends/echo", `{"download": 200}`, http.StatusOK},
+		{"negative", "/bandwidth/backends/echo", `{"download": -1}`, http.StatusBadRequest},
+		{"unknown frontend", "/bandwidth/frontends/b", `{}`, http.StatusNotFound},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.description, func(t *testing.T) {
+			var (
+				recorder = httptest.NewRecorder()
+				request  = httptest.NewRequest(http.MethodPut, tc.path, strings.NewReader(tc.body))
+			)
+
+			lb.adminHandler().ServeHTTP(recorder, request)
+			assert.Equal(t, tc.status, recorder.Code)
+		})
+	}
+
+	frontend, err := lb.FrontendBandwidth("a")
+	assert.NoError(t, err)
+	assert.Equal(t, FrontendBandwidth{PerClient: Bandwidth{Upload: 100}}, frontend)
+
+	recorder := httptest.NewRecorder()
+	lb.adminHandler().ServeHTTP(recorder,
+		httptest.NewRequest(http.MethodGet, "/bandwidth/backends/echo", nil))
+
+	var server Bandwidth
+	assert.NoError(t, json.NewDecoder(recorder.Body).Decode(&server))
+	assert.Equal(t, Bandwidth{Download: 200}, server)
+}
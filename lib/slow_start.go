@@ -0,0 +1,59 @@
+package lib
+
+import (
+	"sync/atomic"
+	"time"
+)
+
+const (
+	// weightScale multiplies the weights of the servers
+	// so that fractions of them can be represented while
+	// ramping up.
+	weightScale = 100
+
+	slowStartInitialFraction = 0.1
+)
+
+// startRamp makes the server go through a slow start
+// of 'window' from now on.
+func (s *server) startRamp(window time.Duration) {
+	if window == 0 {
+		return
+	}
+
+	atomic.StoreInt64(&s.rampStart, time.Now().UnixNano())
+}
+
+// rampedWeight retrieves the scaled weight of the
+// server at 'now': while within the slow start window
+// it grows linearly from a fraction of the weight up to
+// the full weight.
+func (s *server) rampedWeight(now time.Time, window time.Duration) int {
+	var (
+		full  = s.weight * weightScale
+		start = atomic.LoadInt64(&s.rampStart)
+	)
+
+	if window == 0 || start == 0 {
+		return full
+	}
+
+	elapsed := now.Sub(time.Unix(0, start))
+	if elapsed >= window {
+		return full
+	}
+
+	if elapsed < 0 {
+		elapsed = 0
+	}
+
+	fraction := slowStartInitialFraction +
+		(1-slowStartInitialFraction)*float64(elapsed)/float64(window)
+
+	weight := int(float64(full) * fraction)
+	if weight < 1 {
+		weight = 1
+	}
+
+	return weight
+}
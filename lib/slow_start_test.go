@@ -0,0 +1,91 @@
+package lib
+
+import (
+	"testing"
+	"time"
+
+	"github.com/rs/zerolog"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRampedWeight(t *testing.T) {
+	var (
+		now    = time.Now()
+		window = 10 * time.Second
+	)
+
+	var testCases = []struct {
+		description string
+		window      time.Duration
+		rampStart   time.Time
+		expected    int
+	}{
+		{"without slow start", 0, now, 400},
+		{"never ramped", window, time.Time{}, 400},
+		{"just started", window, now, 40},
+		{"half way", window, now.Add(-window / 2), 220},
+		{"finished", window, now.Add(-window), 400},
+		{"clock went back", window, now.Add(window), 40},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.description, func(t *testing.T) {
+			s := mustServers(t, Server{Address: "a", Weight: 4})[0]
+			if !tc.rampStart.IsZero() {
+				s.rampStart = tc.rampStart.UnixNano()
+			}
+
+			assert.Equal(t, tc.expected, s.rampedWeight(now, tc.window))
+		})
+	}
+}
+
+func TestSlowStartAppliesToStrategies(t *testing.T) {
+	for _, strategy := range []string{
+		StrategyRoundRobin,
+		StrategyLeastConnections,
+		StrategySourceHash,
+	} {
+		t.Run(strategy, func(t *testing.T) {
+			b, err := newBackend(Backend{
+				Name:      "app",
+				Strategy:  strategy,
+				SlowStart: time.Hour,
+				Servers:   []Server{{Address: "10.0.0.1:80"}},
+			}, nil, zerolog.Nop())
+			assert.NoError(t, err)
+
+			b.start()
+			defer b.stop()
+
+			_, _, err = b.update("test", []Server{{Address: "10.0.0.2:80"}})
+			assert.NoError(t, err)
+
+			stats := b.stats()
+			assert.Equal(t, 1.0, stats.Servers[0].EffectiveWeight)
+			assert.InDelta(t, 0.1, stats.Servers[1].EffectiveWeight, 0.01)
+
+			var picks = map[string]int{}
+			for i := 0; i < 1000; i++ {
+				client := &fakeAddr{address: string(rune('a'+i%26)) + string(rune('a'+i/26))}
+				s := b.tryAcquire(client)
+				picks[s.address]++
+
+				// keeps the connections open so that
+				// least-connections sees the load.
+				s.track(&Proxy{})
+			}
+
+			assert.True(t, picks["10.0.0.2:80"] < 200,
+				"ramping server got %d of the connections", picks["10.0.0.2:80"])
+			assert.True(t, picks["10.0.0.2:80"] > 0)
+		})
+	}
+}
+
+type fakeAddr struct {
+	address string
+}
+
+func (a *fakeAddr) Network() string { return "fake" }
+func (a *fakeAddr) String() string  { return a.address }
@@ -0,0 +1,230 @@
+package lib
+
+import (
+	"bufio"
+	"encoding/binary"
+	"net"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	tlsRecordHeaderSize      = 5
+	tlsMaxRecordSize         = tlsRecordHeaderSize + 16384
+	tlsRecordTypeHandshake   = 0x16
+	tlsHandshakeClientHello  = 0x01
+	tlsExtensionServerName   = 0x0000
+	tlsServerNameTypeDnsName = 0x00
+)
+
+var errNotClientHello = errors.New("not a tls client hello")
+
+// PeekedConn is a connection whose initial bytes were
+// inspected (without being consumed) before proxying.
+// Reads go through the buffered reader first so that
+// whatever was peeked gets replayed.
+type PeekedConn struct {
+	net.Conn
+	r *bufio.Reader
+}
+
+func NewPeekedConn(conn net.Conn, size int) *PeekedConn {
+	if peeked, ok := conn.(*PeekedConn); ok && peeked.r.Size() >= size {
+		return peeked
+	}
+
+	return &PeekedConn{
+		Conn: conn,
+		r:    bufio.NewReaderSize(conn, size),
+	}
+}
+
+func (c *PeekedConn) Read(b []byte) (int, error) {
+	return c.r.Read(b)
+}
+
+// PeekWithTimeout peeks at most 'n' bytes, waiting no
+// longer than 'timeout' for them to arrive.
+func (c *PeekedConn) PeekWithTimeout(n int, timeout time.Duration) (b []byte, err error) {
+	err = c.Conn.SetReadDeadline(time.Now().Add(timeout))
+	if err != nil {
+		return
+	}
+
+	b, err = c.r.Peek(n)
+	c.Conn.SetReadDeadline(time.Time{})
+	return
+}
+
+// peekServerName tries to retrieve the server name
+// indication (SNI) sent by a TLS client without
+// consuming the bytes from the connection. An empty
+// name is returned if the client doesn't start with a
+// TLS ClientHello in time.
+func peekServerName(conn net.Conn, timeout time.Duration) (*PeekedConn, string) {
+	var peeked = NewPeekedConn(conn, tlsMaxRecordSize)
+
+	header, err := peeked.PeekWithTimeout(tlsRecordHeaderSize, timeout)
+	if err != nil || header[0] != tlsRecordTypeHandshake {
+		return peeked, ""
+	}
+
+	length := int(binary.BigEndian.Uint16(header[3:5]))
+	if tlsRecordHeaderSize+length > tlsMaxRecordSize {
+		return peeked, ""
+	}
+
+	record, err := peeked.PeekWithTimeout(tlsRecordHeaderSize+length, timeout)
+	if err != nil {
+		return peeked, ""
+	}
+
+	name, err := parseClientHelloServerName(record)
+	if err != nil {
+		return peeked, ""
+	}
+
+	return peeked, name
+}
+
+// parseClientHelloServerName extracts the host_name
+// entry of the server_name extension from a TLS record
+// carrying a ClientHello message.
+func parseClientHelloServerName(record []byte) (name string, err error) {
+	var r = tlsReader(record)
+
+	if !r.skipByte(tlsRecordTypeHandshake) || !r.skip(4) {
+		err = errNotClientHello
+		return
+	}
+
+	if !r.skipByte(tlsHandshakeClientHello) || !r.skip(3) {
+		err = errNotClientHello
+		return
+	}
+
+	// client_version + random
+	if !r.skip(2 + 32) {
+		err = errNotClientHello
+		return
+	}
+
+	// session_id, cipher_suites and compression_methods
+	if !r.skipVector(1) || !r.skipVector(2) || !r.skipVector(1) {
+		err = errNotClientHello
+		return
+	}
+
+	extensions, ok := r.vector(2)
+	if !ok {
+		return
+	}
+
+	for len(extensions) > 0 {
+		var (
+			extensionType uint16
+			extension     tlsReader
+		)
+
+		extensionType, ok = extensions.uint16()
+		if !ok {
+			err = errNotClientHello
+			return
+		}
+
+		extension, ok = extensions.vector(2)
+		if !ok {
+			err = errNotClientHello
+			return
+		}
+
+		if extensionType != tlsExtensionServerName {
+			continue
+		}
+
+		names, ok := extension.vector(2)
+		if !ok {
+			err = errNotClientHello
+			return
+		}
+
+		for len(names) > 0 {
+			var nameType = names[0]
+
+			names = names[1:]
+			value, ok := names.vector(2)
+			if !ok {
+				err = errNotClientHello
+				return
+			}
+
+			if nameType == tlsServerNameTypeDnsName {
+				name = string(value)
+				return
+			}
+		}
+	}
+
+	return
+}
+
+// tlsReader consumes TLS wire-format fields from the
+// front of a byte slice.
+type tlsReader []byte
+
+func (r *tlsReader) skip(n int) bool {
+	if len(*r) < n {
+		return false
+	}
+
+	*r = (*r)[n:]
+	return true
+}
+
+func (r *tlsReader) skipByte(expected byte) bool {
+	if len(*r) < 1 || (*r)[0] != expected {
+		return false
+	}
+
+	*r = (*r)[1:]
+	return true
+}
+
+func (r *tlsReader) uint16() (v uint16, ok bool) {
+	if len(*r) < 2 {
+		return
+	}
+
+	v = binary.BigEndian.Uint16(*r)
+	*r = (*r)[2:]
+	ok = true
+	return
+}
+
+// vector reads a variable-length vector whose length
+// is prefixed by 'lengthSize' bytes.
+func (r *tlsReader) vector(lengthSize int) (v tlsReader, ok bool) {
+	if len(*r) < lengthSize {
+		return
+	}
+
+	var length int
+	for _, b := range (*r)[:lengthSize] {
+		length = length<<8 | int(b)
+	}
+
+	if len(*r) < lengthSize+length {
+		return
+	}
+
+	v = (*r)[lengthSize : lengthSize+length]
+	*r = (*r)[lengthSize+length:]
+	ok = true
+	return
+}
+
+func (r *tlsReader) skipVector(lengthSize int) bool {
+	_, ok := r.vector(lengthSize)
+	return ok
+}
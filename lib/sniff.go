@@ -0,0 +1,246 @@
+package lib
+
+import (
+	"bytes"
+	"net"
+	"regexp"
+	"sync/atomic"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// Protocols recognized by the built-in detectors.
+const (
+	SniffTls         = "tls"
+	SniffHttp        = "http"
+	SniffSsh         = "ssh"
+	SniffProxy       = "proxy"
+	SniffPostgresSsl = "postgres-ssl"
+)
+
+const (
+	defaultSniffTimeout  = 1 * time.Second
+	defaultSniffMaxBytes = 1024
+)
+
+// sniffDetectors hold the prefixes that the first bytes
+// of each built-in protocol start with.
+var sniffDetectors = map[string][][]byte{
+	// TLS handshake records, versions SSL 3.0 to 1.3.
+	SniffTls: {
+		{0x16, 0x03, 0x00}, {0x16, 0x03, 0x01}, {0x16, 0x03, 0x02},
+		{0x16, 0x03, 0x03}, {0x16, 0x03, 0x04},
+	},
+	SniffHttp: {
+		[]byte("GET "), []byte("HEAD "), []byte("POST "), []byte("PUT "),
+		[]byte("DELETE "), []byte("OPTIONS "), []byte("PATCH "),
+		[]byte("CONNECT "), []byte("TRACE "), []byte("PRI * HTTP/2.0"),
+	},
+	SniffSsh: {
+		[]byte("SSH-"),
+	},
+	SniffProxy: {
+		[]byte("PROXY "), proxyProtocolV2Signature,
+	},
+	// SSLRequest: length 8 followed by code 80877103.
+	SniffPostgresSsl: {
+		{0x00, 0x00, 0x00, 0x08, 0x04, 0xd2, 0x16, 0x2f},
+	},
+}
+
+// sniffRoute sends connections whose first bytes match
+// to a backend.
+type sniffRoute struct {
+	name     string
+	prefixes [][]byte
+	regex    *regexp.Regexp
+	backend  *backend
+}
+
+func newSniffRoute(cfg SniffRoute, backends map[string]*backend) (r sniffRoute, err error) {
+	var matchers int
+
+	if cfg.Protocol != "" {
+		matchers++
+		r.name = cfg.Protocol
+		r.prefixes = sniffDetectors[cfg.Protocol]
+		if r.prefixes == nil {
+			err = errors.Errorf("unknown protocol '%s'", cfg.Protocol)
+			return
+		}
+	}
+
+	if cfg.Prefix != "" {
+		matchers++
+		r.name = "prefix"
+		r.prefixes = [][]byte{[]byte(cfg.Prefix)}
+	}
+
+	if cfg.Regex != "" {
+		matchers++
+		r.name = "regex"
+		r.regex, err = regexp.Compile(cfg.Regex)
+		if err != nil {
+			err = errors.Wrapf(err, "malformed regex '%s'", cfg.Regex)
+			return
+		}
+	}
+
+	if matchers != 1 {
+		err = errors.Errorf("routes must have exactly one of protocol, prefix or regex")
+		return
+	}
+
+	r.backend = backends[cfg.Backend]
+	if r.backend == nil {
+		err = errors.Errorf("unknown backend '%s' for %s route", cfg.Backend, r.name)
+		return
+	}
+
+	return
+}
+
+// match tells whether 'b' matches the route, or whether
+// more bytes are needed to tell. Regexes are evaluated
+// against whatever was received so far, always asking
+// for more bytes until they match.
+func (r *sniffRoute) match(b []byte) (matched, more bool) {
+	if r.regex != nil {
+		matched = r.regex.Match(b)
+		more = !matched
+		return
+	}
+
+	for _, prefix := range r.prefixes {
+		if bytes.HasPrefix(b, prefix) {
+			return true, false
+		}
+
+		if len(b) < len(prefix) && bytes.HasPrefix(prefix, b) {
+			more = true
+		}
+	}
+
+	return
+}
+
+// sniffer routes connections by their first bytes,
+// evaluating routes in order.
+type sniffer struct {
+	routes   []sniffRoute
+	timeout  time.Duration
+	maxBytes int
+}
+
+func newSniffer(cfg Sniff, backends map[string]*backend) (s *sniffer, err error) {
+	if len(cfg.Routes) == 0 {
+		return
+	}
+
+	if cfg.Timeout < 0 || cfg.MaxBytes < 0 {
+		err = errors.Errorf("timeout and max bytes must not be negative")
+		return
+	}
+
+	if cfg.Timeout == 0 {
+		cfg.Timeout = defaultSniffTimeout
+	}
+
+	if cfg.MaxBytes == 0 {
+		cfg.MaxBytes = defaultSniffMaxBytes
+	}
+
+	s = &sniffer{
+		timeout:  cfg.Timeout,
+		maxBytes: cfg.MaxBytes,
+	}
+
+	for _, routeCfg := range cfg.Routes {
+		var route sniffRoute
+
+		route, err = newSniffRoute(routeCfg, backends)
+		if err != nil {
+			return
+		}
+
+		s.routes = append(s.routes, route)
+	}
+
+	return
+}
+
+// sniff peeks the first bytes of a connection until a
+// route matches (or can't match anymore), the deadline
+// expires or 'maxBytes' got peeked. The returned
+// connection replays what was peeked and a nil route
+// means that none matched.
+func (s *sniffer) sniff(conn net.Conn) (*PeekedConn, *sniffRoute) {
+	var (
+		peeked   = NewPeekedConn(conn, s.maxBytes)
+		deadline = time.Now().Add(s.timeout)
+		want     = 1
+	)
+
+	for {
+		remaining := time.Until(deadline)
+		if remaining <= 0 {
+			remaining = time.Nanosecond
+		}
+
+		// peeks whatever arrived, waiting for at
+		// least 'want' bytes.
+		_, err := peeked.PeekWithTimeout(want, remaining)
+		b, _ := peeked.r.Peek(peeked.r.Buffered())
+
+		final := err != nil || len(b) >= s.maxBytes
+
+		route, more := s.match(b, final)
+		if route != nil || !more {
+			return peeked, route
+		}
+
+		want = len(b) + 1
+	}
+}
+
+// match retrieves the first route matching 'b'. Unless
+// no more bytes can be peeked ('final'), routes that
+// need more bytes to tell stop the evaluation given
+// that they take precedence over the ones after them.
+func (s *sniffer) match(b []byte, final bool) (route *sniffRoute, more bool) {
+	for ndx := range s.routes {
+		matched, needsMore := s.routes[ndx].match(b)
+		if matched {
+			route = &s.routes[ndx]
+			return
+		}
+
+		if needsMore && !final {
+			more = true
+			return
+		}
+	}
+
+	return
+}
+
+// sniff routes a connection by its first bytes,
+// retrieving the connection to proxy (replaying the
+// peeked bytes) and the backend of the route that
+// matched, if any.
+func (f *frontend) sniff(conn net.Conn) (net.Conn, *backend) {
+	peeked, route := f.sniffer.sniff(conn)
+	if route == nil {
+		atomic.AddUint64(&f.sniffUnmatched, 1)
+		return peeked, nil
+	}
+
+	atomic.AddUint64(&f.sniffMatched, 1)
+	f.logger.Debug().
+		Str("remote", conn.RemoteAddr().String()).
+		Str("route", route.name).
+		Str("backend", route.backend.name).
+		Msg("sniffed protocol")
+	return peeked, route.backend
+}
@@ -0,0 +1,197 @@
+package lib
+
+import (
+	"io"
+	"io/ioutil"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSniffRouteMatch(t *testing.T) {
+	var backends = map[string]*backend{"b": {name: "b"}}
+
+	var testCases = []struct {
+		description string
+		route       SniffRoute
+		input       string
+		matched     bool
+		more        bool
+	}{
+		{"tls", SniffRoute{Protocol: SniffTls}, "\x16\x03\x01\x02\x00\x01", true, false},
+		{"partial tls", SniffRoute{Protocol: SniffTls}, "\x16", false, true},
+		{"not tls", SniffRoute{Protocol: SniffTls}, "\x16\x02", false, false},
+		{"http", SniffRoute{Protocol: SniffHttp}, "GET / HTTP/1.1\r\n", true, false},
+		{"partial http", SniffRoute{Protocol: SniffHttp}, "PO", false, true},
+		{"http2 preface", SniffRoute{Protocol: SniffHttp}, "PRI * HTTP/2.0\r\n", true, false},
+		{"ssh", SniffRoute{Protocol: SniffSsh}, "SSH-2.0-OpenSSH_8.9\r\n", true, false},
+		{"proxy v1", SniffRoute{Protocol: SniffProxy}, "PROXY TCP4 ", true, false},
+		{"proxy v2", SniffRoute{Protocol: SniffProxy}, string(proxyProtocolV2Signature) + "\x21", true, false},
+		{"postgres", SniffRoute{Protocol: SniffPostgresSsl}, "\x00\x00\x00\x08\x04\xd2\x16\x2f", true, false},
+		{"postgres startup", SniffRoute{Protocol: SniffPostgresSsl}, "\x00\x00\x00\x29\x00\x03", false, false},
+		{"prefix", SniffRoute{Prefix: "\x01\x02"}, "\x01\x02\x03", true, false},
+		{"regex", SniffRoute{Regex: "^[A-Z]+ /"}, "FETCH /", true, false},
+		{"regex mismatch", SniffRoute{Regex: "^[A-Z]+ /"}, "F", false, true},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.description, func(t *testing.T) {
+			tc.route.Backend = "b"
+			route, err := newSniffRoute(tc.route, backends)
+			assert.NoError(t, err)
+
+			matched, more := route.match([]byte(tc.input))
+			assert.Equal(t, tc.matched, matched)
+			assert.Equal(t, tc.more, more)
+		})
+	}
+}
+
+func TestNewSniffRouteValidates(t *testing.T) {
+	var backends = map[string]*backend{"b": {name: "b"}}
+
+	for _, route := range []SniffRoute{
+		{Backend: "b"},
+		{Protocol: "smtp", Backend: "b"},
+		{Protocol: SniffTls, Prefix: "a", Backend: "b"},
+		{Regex: "(", Backend: "b"},
+		{Protocol: SniffTls, Backend: "c"},
+	} {
+		_, err := newSniffRoute(route, backends)
+		assert.Error(t, err, "%+v", route)
+	}
+}
+
+func TestSnifferSniff(t *testing.T) {
+	var backends = map[string]*backend{
+		"tls": {name: "tls"},
+		"ssh": {name: "ssh"},
+		"txt": {name: "txt"},
+	}
+
+	var testCases = []struct {
+		description string
+		chunks      []string
+		expected    string
+	}{
+		{"single chunk", []string{"SSH-2.0-client\r\n"}, "ssh"},
+		{"split chunks", []string{"S", "SH", "-2.0-client\r\n"}, "ssh"},
+		{"earlier route takes precedence", []string{"\x16\x03\x03"}, "tls"},
+		{"later route", []string{"hello"}, "txt"},
+		{"no match", []string{"\x00\x01"}, ""},
+		{"silent client", nil, ""},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.description, func(t *testing.T) {
+			s, err := newSniffer(Sniff{
+				Timeout: 200 * time.Millisecond,
+				Routes: []SniffRoute{
+					{Protocol: SniffTls, Backend: "tls"},
+					{Protocol: SniffSsh, Backend: "ssh"},
+					{Regex: "^[a-z]+$", Backend: "txt"},
+				},
+			}, backends)
+			assert.NoError(t, err)
+
+			client, server := net.Pipe()
+			defer client.Close()
+			defer server.Close()
+
+			go func() {
+				for _, chunk := range tc.chunks {
+					client.Write([]byte(chunk))
+					time.Sleep(20 * time.Millisecond)
+				}
+			}()
+
+			conn, route := s.sniff(server)
+			if tc.expected == "" {
+				assert.Nil(t, route)
+			} else if assert.NotNil(t, route) {
+				assert.Equal(t, tc.expected, route.backend.name)
+			}
+
+			// the peeked bytes get replayed.
+			time.Sleep(100 * time.Millisecond)
+			client.Close()
+
+			replayed, _ := ioutil.ReadAll(conn)
+			assert.Equal(t, strings.Join(tc.chunks, ""), string(replayed))
+		})
+	}
+}
+
+func TestSnifferWaitsForRegexes(t *testing.T) {
+	var backends = map[string]*backend{"fetch": {name: "fetch"}}
+
+	s, err := newSniffer(Sniff{
+		Timeout: time.Second,
+		Routes:  []SniffRoute{{Regex: "^FETCH /", Backend: "fetch"}},
+	}, backends)
+	assert.NoError(t, err)
+
+	client, server := net.Pipe()
+	defer client.Close()
+	defer server.Close()
+
+	go func() {
+		client.Write([]byte("FET"))
+		time.Sleep(20 * time.Millisecond)
+		client.Write([]byte("CH /index"))
+	}()
+
+	_, route := s.sniff(server)
+	if assert.NotNil(t, route) {
+		assert.Equal(t, "fetch", route.backend.name)
+	}
+}
+
+func TestLoadBalancerRoutesBySniffing(t *testing.T) {
+	upstream, upstreamAddress := listenEcho(t, "tcp4", "127.0.0.1:0")
+	defer upstream.Close()
+
+	ssh, sshAddress := listenEcho(t, "tcp4", "127.0.0.1:0")
+	defer ssh.Close()
+
+	lb := startLoadBalancer(t, LoadBalancerConfig{
+		Frontends: []Frontend{{
+			Name:    "a",
+			Address: freeAddress(t),
+			Backend: "echo",
+			Sniff: Sniff{
+				Timeout: 200 * time.Millisecond,
+				Routes:  []SniffRoute{{Protocol: SniffSsh, Backend: "ssh"}},
+			},
+		}},
+		Backends: []Backend{
+			{Name: "echo", Servers: []Server{{Address: upstreamAddress}}},
+			{Name: "ssh", Servers: []Server{{Address: sshAddress}}},
+		},
+	})
+
+	for _, greeting := range []string{"SSH-2.0-client\r\n", "ping"} {
+		conn, err := net.Dial("tcp", lb.frontends[0].address)
+		assert.NoError(t, err)
+
+		_, err = conn.Write([]byte(greeting))
+		assert.NoError(t, err)
+
+		conn.SetReadDeadline(time.Now().Add(time.Second))
+		reply := make([]byte, len(greeting))
+		_, err = io.ReadFull(conn, reply)
+		assert.NoError(t, err)
+		assert.Equal(t, greeting, string(reply))
+		conn.Close()
+	}
+
+	time.Sleep(50 * time.Millisecond)
+	stats := lb.Stats()
+	assert.Equal(t, uint64(1), stats.Frontends[0].SniffMatched)
+	assert.Equal(t, uint64(1), stats.Frontends[0].SniffUnmatched)
+	assert.Equal(t, uint64(1), stats.Backends[0].Servers[0].TotalConnections)
+	assert.Equal(t, uint64(1), stats.Backends[1].Servers[0].TotalConnections)
+}
@@ -0,0 +1,109 @@
+package lib
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// State is what a load-balancer hands over to the one
+// replacing it on a graceful restart.
+type State struct {
+	// Affinity holds the affinity entries of each
+	// backend by name.
+	Affinity map[string][]AffinityEntry `json:"affinity"`
+}
+
+// ExportState retrieves the state worth keeping across
+// restarts.
+func (lb *LoadBalancer) ExportState() (state State) {
+	var now = time.Now()
+
+	state.Affinity = map[string][]AffinityEntry{}
+	for _, b := range lb.backends {
+		if b.affinity != nil {
+			state.Affinity[b.name] = b.affinity.export(now)
+		}
+	}
+
+	return
+}
+
+// ImportState restores the state exported by a previous
+// load-balancer. Backends that don't exist anymore (or
+// don't have affinity enabled) are skipped.
+func (lb *LoadBalancer) ImportState(state State) {
+	var now = time.Now()
+
+	for name, entries := range state.Affinity {
+		b := lb.backend(name)
+		if b == nil || b.affinity == nil {
+			continue
+		}
+
+		b.affinity.restore(entries, now)
+	}
+}
+
+// loadState imports the state file, if any.
+func (lb *LoadBalancer) loadState() (err error) {
+	var state State
+
+	content, err := ioutil.ReadFile(lb.stateFile)
+	if os.IsNotExist(err) {
+		err = nil
+		return
+	}
+
+	if err != nil {
+		err = errors.Wrapf(err, "couldn't read state file %s", lb.stateFile)
+		return
+	}
+
+	err = json.Unmarshal(content, &state)
+	if err != nil {
+		err = errors.Wrapf(err, "malformed state file %s", lb.stateFile)
+		return
+	}
+
+	lb.ImportState(state)
+	return
+}
+
+// saveState writes the state file, replacing it
+// atomically.
+func (lb *LoadBalancer) saveState() (err error) {
+	content, err := json.Marshal(lb.ExportState())
+	if err != nil {
+		return
+	}
+
+	tmp, err := ioutil.TempFile(filepath.Dir(lb.stateFile), ".l4-state")
+	if err != nil {
+		err = errors.Wrapf(err, "couldn't create state file")
+		return
+	}
+	defer os.Remove(tmp.Name())
+
+	_, err = tmp.Write(content)
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+
+	if err != nil {
+		err = errors.Wrapf(err, "couldn't write state file")
+		return
+	}
+
+	err = os.Rename(tmp.Name(), lb.stateFile)
+	if err != nil {
+		err = errors.Wrapf(err, "couldn't replace state file %s", lb.stateFile)
+		return
+	}
+
+	return
+}
@@ -1,6 +1,171 @@
 package lib
 
+import (
+	"sync/atomic"
+	"time"
+)
+
 type IoStats struct {
 	Tx uint64
 	Rx uint64
+
+	// Throttled is the time spent waiting for the
+	// bandwidth limits.
+	Throttled time.Duration
+}
+
+// snapshot atomically loads the counters so that they
+// can be read while a transfer is still going on.
+func (s *IoStats) snapshot() IoStats {
+	return IoStats{
+		Tx: atomic.LoadUint64(&s.Tx),
+		Rx: atomic.LoadUint64(&s.Rx),
+
+		Throttled: time.Duration(atomic.LoadInt64((*int64)(&s.Throttled))),
+	}
+}
+
+type Stats struct {
+	Frontends []FrontendStats `json:"frontends"`
+	Backends  []BackendStats  `json:"backends"`
+	Capture   CaptureStats    `json:"capture"`
+}
+
+// CaptureStats accounts the connections captured and
+// the bytes written of them. Truncated counts the
+// captures cut short by the limits, while
+// RemainingBytes is what's left of the overall one.
+type CaptureStats struct {
+	ActiveConnections int64  `json:"active_connections"`
+	Connections       uint64 `json:"connections"`
+	Bytes             uint64 `json:"bytes"`
+	Truncated         uint64 `json:"truncated"`
+	RemainingBytes    int64  `json:"remaining_bytes"`
+}
+
+// FrontendStats accounts the connections accepted by
+// a frontend. For UDP frontends, connections are flows.
+type FrontendStats struct {
+	Name              string      `json:"name"`
+	Address           string      `json:"address"`
+	Protocol          string      `json:"protocol"`
+	Backend           string      `json:"backend"`
+	ActiveConnections int64       `json:"active_connections"`
+	TotalConnections  uint64      `json:"total_connections"`
+	DroppedPackets    uint64      `json:"dropped_packets,omitempty"`
+	Flows             []FlowStats `json:"flows,omitempty"`
+
+	// RejectedGlobal, RejectedFrontend and RejectedClient
+	// count the connections closed for being over the
+	// global, frontend and per-client limits while
+	// AcceptWaits counts the times accepting waited for
+	// connections to finish.
+	RejectedGlobal   uint64 `json:"rejected_global"`
+	RejectedFrontend uint64 `json:"rejected_frontend"`
+	RejectedClient   uint64 `json:"rejected_client"`
+	AcceptWaits      uint64 `json:"accept_waits"`
+
+	// Denied counts the connections closed by the acl.
+	Denied uint64 `json:"denied"`
+
+	// GeoRouted and GeoDenied count the connections
+	// that matched a geoip rule sending them to another
+	// backend or denying them.
+	GeoRouted uint64 `json:"geo_routed"`
+	GeoDenied uint64 `json:"geo_denied"`
+
+	// SniffMatched and SniffUnmatched count the
+	// connections whose first bytes matched a sniffing
+	// route and the ones sent to the default backend.
+	SniffMatched   uint64 `json:"sniff_matched"`
+	SniffUnmatched uint64 `json:"sniff_unmatched"`
+
+	// HostMatched and HostUnmatched count the
+	// connections whose HTTP host matched a host rule
+	// and the ones sent to the default backend.
+	HostMatched   uint64 `json:"host_matched"`
+	HostUnmatched uint64 `json:"host_unmatched"`
+
+	// MirroredConnections counts the connections teed
+	// to the shadow backend, while MirroredBytes and
+	// MirrorDroppedBytes count the bytes the shadow got
+	// and the ones it missed.
+	MirroredConnections uint64 `json:"mirrored_connections"`
+	MirroredBytes       uint64 `json:"mirrored_bytes"`
+	MirrorDroppedBytes  uint64 `json:"mirror_dropped_bytes"`
+
+	// RateLimited counts the connections over the rate
+	// limits, out of which RateDelayed got delayed and
+	// RateTarpitted got held before being closed.
+	// RateLimitClients is the size of the table of
+	// client buckets.
+	RateLimited      uint64 `json:"rate_limited"`
+	RateDelayed      uint64 `json:"rate_delayed"`
+	RateTarpitted    uint64 `json:"rate_tarpitted"`
+	RateLimitClients int    `json:"rate_limit_clients"`
+}
+
+// FlowStats accounts the traffic of a UDP flow. Rx
+// holds the bytes received from the client while Tx
+// holds the ones sent back to it.
+type FlowStats struct {
+	Client   string        `json:"client"`
+	Upstream string        `json:"upstream"`
+	Idle     time.Duration `json:"idle"`
+	Rx       uint64        `json:"rx"`
+	Tx       uint64        `json:"tx"`
+}
+
+type BackendStats struct {
+	Name     string        `json:"name"`
+	Strategy string        `json:"strategy"`
+	Servers  []ServerStats `json:"servers"`
+
+	// QueueDepth is the number of connections waiting
+	// for a server below its max connections right now
+	// while TotalQueued and TotalQueueWait account all
+	// of those that waited. Rejected counts the ones that
+	// found the queue full or timed out.
+	QueueDepth     int           `json:"queue_depth"`
+	TotalQueued    uint64        `json:"total_queued"`
+	TotalQueueWait time.Duration `json:"total_queue_wait"`
+	Rejected       uint64        `json:"rejected"`
+
+	// AffinityEntries is the size of the affinity table
+	// and AffinityHits counts the connections sent to the
+	// server their client was pinned to.
+	AffinityEntries int    `json:"affinity_entries"`
+	AffinityHits    uint64 `json:"affinity_hits"`
+}
+
+// ServerStats accounts the traffic of a server. Rx
+// holds the bytes received from the server while Tx
+// holds the ones sent to it.
+type ServerStats struct {
+	Address           string  `json:"address"`
+	Source            string  `json:"source"`
+	Weight            int     `json:"weight"`
+	EffectiveWeight   float64 `json:"effective_weight"`
+	Priority          int     `json:"priority"`
+	Backup            bool    `json:"backup"`
+	Healthy           bool    `json:"healthy"`
+	Draining          bool    `json:"draining"`
+	Drained           bool    `json:"drained"`
+	MaxConnections    int     `json:"max_connections"`
+	ActiveConnections int     `json:"active_connections"`
+	TotalConnections  uint64  `json:"total_connections"`
+	Rx                uint64  `json:"rx"`
+	Tx                uint64  `json:"tx"`
+
+	// TxThrottled and RxThrottled are the time spent by
+	// connections waiting for the bandwidth limits when
+	// sending to and receiving from the server.
+	TxThrottled time.Duration `json:"tx_throttled"`
+	RxThrottled time.Duration `json:"rx_throttled"`
+
+	// Circuit is the state of the circuit breaker (empty
+	// when disabled) and CircuitTrips counts the times it
+	// opened.
+	Circuit      string `json:"circuit"`
+	CircuitTrips uint64 `json:"circuit_trips"`
 }
@@ -0,0 +1,142 @@
+package lib
+
+import (
+	"hash/fnv"
+	"math"
+	"net"
+
+	"github.com/pkg/errors"
+)
+
+// Strategies that can be set on a backend to decide
+// how connections are spread across its servers.
+const (
+	StrategyRoundRobin       = "round-robin"
+	StrategyLeastConnections = "least-connections"
+	StrategySourceHash       = "source-hash"
+)
+
+// strategy picks one of the servers of a pool to
+// handle a connection from 'client'. It's always
+// called with the pool locked and a non-empty list.
+// Weights are taken from the servers' effective
+// weight, which accounts for slow start.
+type strategy interface {
+	pick(servers []*server, client net.Addr) *server
+}
+
+func newStrategy(name string) (s strategy, err error) {
+	switch name {
+	case StrategyRoundRobin:
+		s = &roundRobin{}
+	case StrategyLeastConnections:
+		s = &leastConnections{}
+	case StrategySourceHash:
+		s = &sourceHash{}
+	default:
+		err = errors.Errorf("unknown strategy '%s'", name)
+	}
+
+	return
+}
+
+// roundRobin implements smooth weighted round-robin:
+// servers are picked proportionally to their weights
+// while avoiding bursts towards the heaviest ones.
+type roundRobin struct{}
+
+func (r *roundRobin) pick(servers []*server, client net.Addr) *server {
+	var (
+		best  *server
+		total int
+	)
+
+	for _, s := range servers {
+		s.currentWeight += s.effectiveWeight
+		total += s.effectiveWeight
+
+		if best == nil || s.currentWeight > best.currentWeight {
+			best = s
+		}
+	}
+
+	best.currentWeight -= total
+	return best
+}
+
+// leastConnections picks the server with the fewest
+// connections relative to its weight. Connections are
+// counted by the slots the servers hold, which are taken
+// right when they get picked, so that a burst of
+// connections doesn't all go to the same server before
+// any of them is established. Ties are broken by
+// rotating the starting point.
+type leastConnections struct {
+	next int
+}
+
+func (l *leastConnections) pick(servers []*server, client net.Addr) *server {
+	var (
+		best       *server
+		bestActive int
+	)
+
+	l.next++
+	for i := range servers {
+		s := servers[(l.next+i)%len(servers)]
+		active := s.slots
+
+		if best == nil || active*best.effectiveWeight < bestActive*s.effectiveWeight {
+			best = s
+			bestActive = active
+		}
+	}
+
+	return best
+}
+
+// sourceHash consistently maps a client IP to a server
+// using weighted rendezvous hashing, so that changes to
+// the pool only move the clients of the servers that
+// were affected.
+type sourceHash struct{}
+
+func (h *sourceHash) pick(servers []*server, client net.Addr) *server {
+	var (
+		best      *server
+		bestScore float64
+		key       = clientKey(client)
+	)
+
+	for _, s := range servers {
+		hash := fnv.New64a()
+		hash.Write([]byte(key))
+		hash.Write([]byte(s.address))
+
+		// maps the hash to (0, 1) and then to a score
+		// whose distribution is weighted.
+		u := (float64(hash.Sum64()>>11) + 0.5) / (1 << 53)
+		score := float64(s.effectiveWeight) / -math.Log(u)
+
+		if best == nil || score > bestScore {
+			best = s
+			bestScore = score
+		}
+	}
+
+	return best
+}
+
+// clientKey retrieves a string identifying the client
+// regardless of the source port used.
+func clientKey(client net.Addr) string {
+	if client == nil {
+		return ""
+	}
+
+	if ip := addrIP(client); ip != nil {
+		return ip.String()
+	}
+
+	return client.String()
+}
@@ -0,0 +1,219 @@
+package lib
+
+import (
+	"fmt"
+	"net"
+	"testing"
+
+	"github.com/rs/zerolog"
+	"github.com/stretchr/testify/assert"
+)
+
+func mustServers(t *testing.T, configs ...Server) []*server {
+	var servers = make([]*server, len(configs))
+
+	for ndx, cfg := range configs {
+		s, err := newServer(cfg)
+		assert.NoError(t, err)
+		servers[ndx] = s
+	}
+
+	return servers
+}
+
+func TestNewStrategy(t *testing.T) {
+	for _, name := range []string{
+		StrategyRoundRobin,
+		StrategyLeastConnections,
+		StrategySourceHash,
+	} {
+		_, err := newStrategy(name)
+		assert.NoError(t, err)
+	}
+
+	_, err := newStrategy("random")
+	assert.Error(t, err)
+}
+
+func TestRoundRobinHonorsWeights(t *testing.T) {
+	var (
+		strategy = &roundRobin{}
+		picks    = map[string]int{}
+		servers  = mustServers(t,
+			Server{Address: "a", Weight: 5},
+			Server{Address: "b", Weight: 1},
+			Server{Address: "c", Weight: 1},
+		)
+	)
+
+	for i := 0; i < 70; i++ {
+		picks[strategy.pick(servers, nil).address]++
+	}
+
+	assert.Equal(t, map[string]int{"a": 50, "b": 10, "c": 10}, picks)
+
+	// smooth round-robin interleaves the heaviest server
+	// with the others instead of picking it in a burst.
+	var sequence []string
+	for i := 0; i < 7; i++ {
+		sequence = append(sequence, strategy.pick(servers, nil).address)
+	}
+
+	assert.Equal(t, []string{"a", "a", "b", "a", "c", "a", "a"}, sequence)
+}
+
+func TestLeastConnectionsPicksLeastLoaded(t *testing.T) {
+	var (
+		strategy = &leastConnections{}
+		servers  = mustServers(t,
+			Server{Address: "a"},
+			Server{Address: "b"},
+			Server{Address: "c", Weight: 4},
+		)
+	)
+
+	servers[0].slots = 1
+	servers[1].slots = 2
+	servers[2].slots = 3
+
+	// 'c' has more connections but also a much bigger
+	// weight: 3/4 < 1/1 < 2/1
+	assert.Equal(t, "c", strategy.pick(servers, nil).address)
+	servers[2].slots += 2
+	assert.Equal(t, "a", strategy.pick(servers, nil).address)
+}
+
+func TestLeastConnectionsSpreadsBursts(t *testing.T) {
+	b, err := newBackend(Backend{
+		Name:     "app",
+		Strategy: StrategyLeastConnections,
+		Servers: []Server{
+			{Address: "127.0.0.1:8080"},
+			{Address: "127.0.0.1:8081"},
+		},
+	}, nil, zerolog.Nop())
+	assert.NoError(t, err)
+
+	// connections that are yet to be established count
+	// as much as the ones already proxied.
+	first, second := b.tryAcquire(nil), b.tryAcquire(nil)
+	if assert.NotNil(t, first) && assert.NotNil(t, second) {
+		assert.NotEqual(t, first.address, second.address)
+	}
+}
+
+func TestSourceHashIsConsistent(t *testing.T) {
+	var (
+		strategy = &sourceHash{}
+		servers  = mustServers(t,
+			Server{Address: "a"},
+			Server{Address: "b"},
+			Server{Address: "c"},
+		)
+		client = &net.TCPAddr{IP: net.ParseIP("10.0.0.1"), Port: 1234}
+		other  = &net.TCPAddr{IP: net.ParseIP("10.0.0.1"), Port: 4321}
+	)
+
+	picked := strategy.pick(servers, client)
+	assert.Equal(t, picked, strategy.pick(servers, other))
+
+	// removing a server that wasn't picked keeps the
+	// mapping untouched.
+	var remaining []*server
+	for _, s := range servers {
+		if s == picked || len(remaining) == 0 {
+			remaining = append(remaining, s)
+		}
+	}
+
+	assert.Equal(t, picked, strategy.pick(remaining, client))
+}
+
+func TestTierSelectsFirstHealthyTier(t *testing.T) {
+	var testCases = []struct {
+		description string
+		priorities  []int
+		backups     []int
+		unhealthy   []int
+		expected    []int
+	}{
+		{description: "empty"},
+		{
+			description: "single tier",
+			priorities:  []int{0, 0},
+			expected:    []int{0, 1},
+		},
+		{
+			description: "primary first",
+			priorities:  []int{0, 1, 0},
+			expected:    []int{0, 2},
+		},
+		{
+			description: "lower priority later",
+			priorities:  []int{2, 1, 2, 1},
+			expected:    []int{1, 3},
+		},
+		{
+			description: "backups after primaries",
+			priorities:  []int{5, 0, 0},
+			backups:     []int{1},
+			expected:    []int{2},
+		},
+		{
+			description: "falls through unhealthy tier",
+			priorities:  []int{0, 0, 1},
+			unhealthy:   []int{0, 1},
+			expected:    []int{2},
+		},
+		{
+			description: "partially unhealthy tier",
+			priorities:  []int{0, 0, 1},
+			unhealthy:   []int{0},
+			expected:    []int{1},
+		},
+		{
+			description: "backups when primaries are down",
+			priorities:  []int{0, 1, 0},
+			backups:     []int{2},
+			unhealthy:   []int{0, 1},
+			expected:    []int{2},
+		},
+		{
+			description: "nothing healthy",
+			priorities:  []int{0, 0},
+			unhealthy:   []int{0, 1},
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.description, func(t *testing.T) {
+			var configs []Server
+			for ndx, priority := range tc.priorities {
+				configs = append(configs, Server{
+					Address:  fmt.Sprintf("10.0.0.%d:80", ndx),
+					Priority: priority,
+				})
+			}
+
+			for _, ndx := range tc.backups {
+				configs[ndx].Backup = true
+			}
+
+			servers := mustServers(t, configs...)
+			for _, ndx := range tc.unhealthy {
+				servers[ndx].unhealthy = 1
+			}
+
+			var selected []int
+			for _, s := range tier(servers) {
+				for ndx := range servers {
+					if servers[ndx] == s {
+						selected = append(selected, ndx)
+					}
+				}
+			}
+
+			assert.Equal(t, tc.expected, selected)
+		})
+	}
+}
@@ -0,0 +1,430 @@
+package lib
+
+import (
+	"context"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/rs/xid"
+)
+
+const (
+	defaultUdpIdleTimeout = 30 * time.Second
+	defaultMaxFlows       = 10000
+	udpBufferSize         = 64 * 1024
+	minFlowExpiryInterval = 100 * time.Millisecond
+
+	// maxPendingDatagrams bounds the datagrams that a
+	// flow buffers while its upstream socket is dialed.
+	maxPendingDatagrams = 16
+)
+
+var (
+	errFlowTableFull = errors.New("flow table is full")
+	errClientDenied  = errors.New("client denied")
+)
+
+// udpFlow pins the datagrams of a client to a server,
+// using a dedicated upstream socket so that replies
+// can be relayed back to the right client. The socket
+// gets dialed in the background, so the datagrams that
+// arrive in the meantime are kept pending.
+type udpFlow struct {
+	// lastActivity is the unix time in nanoseconds of the
+	// last datagram seen in either direction.
+	lastActivity int64
+
+	id        string
+	client    net.Addr
+	server    *server
+	toStats   *IoStats
+	fromStats *IoStats
+
+	mu       sync.Mutex
+	upstream net.Conn
+	pending  [][]byte
+	closed   bool
+}
+
+// Stats retrieves the bytes transferred so far: 'to'
+// accounts datagrams from the client to the server and
+// 'from' the replies.
+func (flow *udpFlow) Stats() (to, from IoStats) {
+	return flow.toStats.snapshot(), flow.fromStats.snapshot()
+}
+
+// Close closes the upstream socket, which makes the
+// flow get removed. A flow still being dialed gets its
+// socket closed as soon as it's connected.
+func (flow *udpFlow) Close() (err error) {
+	flow.mu.Lock()
+	defer flow.mu.Unlock()
+
+	flow.closed = true
+	if flow.upstream != nil {
+		err = flow.upstream.Close()
+	}
+
+	return
+}
+
+// send writes a datagram to the server, keeping it
+// pending if the upstream socket isn't connected yet.
+// It retrieves false if the datagram got dropped.
+func (flow *udpFlow) send(p []byte) bool {
+	flow.mu.Lock()
+	if flow.upstream == nil {
+		defer flow.mu.Unlock()
+
+		if flow.closed || len(flow.pending) >= maxPendingDatagrams {
+			return false
+		}
+
+		flow.pending = append(flow.pending, append([]byte(nil), p...))
+		return true
+	}
+
+	upstream := flow.upstream
+	flow.mu.Unlock()
+
+	written, err := upstream.Write(p)
+	if err != nil {
+		return false
+	}
+
+	atomic.AddUint64(&flow.toStats.Tx, uint64(written))
+	return true
+}
+
+func (flow *udpFlow) touch() {
+	atomic.StoreInt64(&flow.lastActivity, time.Now().UnixNano())
+}
+
+func (flow *udpFlow) idleFor() time.Duration {
+	return time.Since(time.Unix(0, atomic.LoadInt64(&flow.lastActivity)))
+}
+
+func (f *frontend) listenUdp() (err error) {
+	var listenConfig net.ListenConfig
+
+	if f.iface != "" {
+		_, err = net.InterfaceByName(f.iface)
+		if err != nil {
+			err = errors.Wrapf(err,
+				"couldn't find interface %s", f.iface)
+			return
+		}
+
+		listenConfig.Control = bindToDevice(f.iface)
+	}
+
+	pc, err := listenConfig.ListenPacket(context.Background(),
+		packetNetwork(f.network), f.address)
+	if err != nil {
+		err = errors.Wrapf(err,
+			"couldn't listen on address %s", f.address)
+		return
+	}
+
+	f.logger.Info().
+		Str("address", pc.LocalAddr().String()).
+		Str("network", pc.LocalAddr().Network()).
+		Str("interface", f.iface).
+		Str("backend", f.backend.name).
+		Msg("listening")
+
+	f.mu.Lock()
+	f.pc = pc
+	closed := atomic.LoadUint32(&f.closed) != 0
+	f.mu.Unlock()
+
+	// see setListener.
+	if closed {
+		pc.Close()
+		return
+	}
+
+	go f.expireFlows()
+	return
+}
+
+// serveUdp reads datagrams from clients, forwarding
+// each to the upstream socket of the client's flow.
+func (f *frontend) serveUdp() {
+	var buf = make([]byte, udpBufferSize)
+
+	for {
+		n, client, err := f.pc.ReadFrom(buf)
+		if err != nil {
+			if atomic.LoadUint32(&f.closed) != 0 {
+				return
+			}
+
+			f.logger.Error().
+				Err(err).
+				Msg("errored reading datagram")
+			continue
+		}
+
+		flow, err := f.flow(client)
+		if err == errClientDenied {
+			atomic.AddUint64(&f.denied, 1)
+			f.logger.Debug().
+				Str("remote", client.String()).
+				Msg("datagram denied")
+			continue
+		}
+
+		if err != nil {
+			atomic.AddUint64(&f.droppedPackets, 1)
+			f.logger.Error().
+				Err(err).
+				Str("remote", client.String()).
+				Msg("dropped datagram")
+			continue
+		}
+
+		flow.touch()
+		atomic.AddUint64(&flow.toStats.Rx, uint64(n))
+
+		if !flow.send(buf[:n]) {
+			atomic.AddUint64(&f.droppedPackets, 1)
+		}
+	}
+}
+
+// flow retrieves the flow of a client, creating one
+// pinned to a freshly picked server if needed. The
+// upstream socket of new flows is dialed in the
+// background so that reading datagrams never waits on
+// it (e.g., resolving the server).
+func (f *frontend) flow(client net.Addr) (flow *udpFlow, err error) {
+	var key = client.String()
+
+	f.flowsMu.Lock()
+	defer f.flowsMu.Unlock()
+
+	flow, ok := f.flows[key]
+	if ok {
+		return
+	}
+
+	if f.acl != nil && !f.acl.allows(client) {
+		err = errClientDenied
+		return
+	}
+
+	if len(f.flows) >= f.maxFlows {
+		err = errFlowTableFull
+		return
+	}
+
+	s := f.backend.tryAcquire(client)
+	if s == nil {
+		err = errors.Errorf("no server available in backend %s",
+			f.backend.name)
+		return
+	}
+
+	flow = &udpFlow{
+		id:        xid.New().String(),
+		client:    client,
+		server:    s,
+		toStats:   &IoStats{},
+		fromStats: &IoStats{},
+	}
+	flow.touch()
+
+	f.flows[key] = flow
+	s.track(flow)
+	atomic.AddUint64(&f.totalConnections, 1)
+	atomic.AddInt64(&f.activeConnections, 1)
+
+	f.logger.Info().
+		Str("remote", key).
+		Str("upstream", s.address).
+		Str("id", flow.id).
+		Msg("flow created")
+
+	go f.connect(flow)
+	return
+}
+
+// connect dials the upstream socket of a flow, sending
+// the datagrams that were kept pending before relaying
+// the replies.
+func (f *frontend) connect(flow *udpFlow) {
+	upstream, err := f.backend.dialPacket(flow.server)
+	f.backend.observeDial(flow.server, err)
+	if err != nil {
+		flow.mu.Lock()
+		flow.closed = true
+		dropped := len(flow.pending)
+		flow.pending = nil
+		flow.mu.Unlock()
+
+		atomic.AddUint64(&f.droppedPackets, uint64(dropped))
+		f.removeFlow(flow, errors.Wrapf(err,
+			"couldn't dial server %s", flow.server.address))
+		return
+	}
+
+	// the pending datagrams are sent with the flow locked
+	// so that they go before the ones that come next.
+	flow.mu.Lock()
+	if flow.closed {
+		flow.mu.Unlock()
+		upstream.Close()
+		f.removeFlow(flow, nil)
+		return
+	}
+
+	for _, p := range flow.pending {
+		written, err := upstream.Write(p)
+		if err != nil {
+			atomic.AddUint64(&f.droppedPackets, 1)
+			continue
+		}
+
+		atomic.AddUint64(&flow.toStats.Tx, uint64(written))
+	}
+
+	flow.pending = nil
+	flow.upstream = upstream
+	flow.mu.Unlock()
+
+	f.relay(flow)
+}
+
+// relay sends the replies of the server back to the
+// client until the flow gets removed.
+func (f *frontend) relay(flow *udpFlow) {
+	var buf = make([]byte, udpBufferSize)
+
+	for {
+		n, err := flow.upstream.Read(buf)
+		if err != nil {
+			f.removeFlow(flow, err)
+			return
+		}
+
+		flow.touch()
+		atomic.AddUint64(&flow.fromStats.Rx, uint64(n))
+
+		written, err := f.pc.WriteTo(buf[:n], flow.client)
+		if err != nil {
+			continue
+		}
+
+		atomic.AddUint64(&flow.fromStats.Tx, uint64(written))
+	}
+}
+
+// expireFlows periodically removes the flows that have
+// been idle for longer than the idle timeout.
+func (f *frontend) expireFlows() {
+	var interval = f.idleTimeout / 2
+	if interval < minFlowExpiryInterval {
+		interval = minFlowExpiryInterval
+	}
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-f.done:
+			return
+		case <-ticker.C:
+		}
+
+		var expired []*udpFlow
+
+		f.flowsMu.Lock()
+		for _, flow := range f.flows {
+			if flow.idleFor() >= f.idleTimeout {
+				expired = append(expired, flow)
+			}
+		}
+		f.flowsMu.Unlock()
+
+		for _, flow := range expired {
+			f.removeFlow(flow, nil)
+		}
+	}
+}
+
+// removeFlow drops a flow from the table and releases
+// its upstream socket. 'reason' is nil when the flow
+// expired.
+func (f *frontend) removeFlow(flow *udpFlow, reason error) {
+	var key = flow.client.String()
+
+	f.flowsMu.Lock()
+	current, ok := f.flows[key]
+	if !ok || current != flow {
+		f.flowsMu.Unlock()
+		return
+	}
+
+	delete(f.flows, key)
+	f.flowsMu.Unlock()
+
+	flow.Close()
+	flow.server.untrack(flow)
+	f.backend.release(flow.server)
+	atomic.AddInt64(&f.activeConnections, -1)
+
+	toStats, fromStats := flow.Stats()
+	event := f.logger.Info()
+	if reason != nil && atomic.LoadUint32(&f.closed) == 0 {
+		event = f.logger.Error().Err(reason)
+	}
+
+	event.
+		Str("remote", key).
+		Str("upstream", flow.server.address).
+		Str("id", flow.id).
+		Uint64("rx", toStats.Rx).
+		Uint64("tx", fromStats.Tx).
+		Msg("flow finished")
+}
+
+func (f *frontend) closeUdp(pc net.PacketConn) (err error) {
+	err = pc.Close()
+
+	f.flowsMu.Lock()
+	var flows = make([]*udpFlow, 0, len(f.flows))
+	for _, flow := range f.flows {
+		flows = append(flows, flow)
+	}
+	f.flowsMu.Unlock()
+
+	for _, flow := range flows {
+		f.removeFlow(flow, nil)
+	}
+
+	return
+}
+
+func (f *frontend) flowStats() (stats []FlowStats) {
+	f.flowsMu.Lock()
+	defer f.flowsMu.Unlock()
+
+	stats = make([]FlowStats, 0, len(f.flows))
+	for key, flow := range f.flows {
+		toStats, fromStats := flow.Stats()
+		stats = append(stats, FlowStats{
+			Client:   key,
+			Upstream: flow.server.address,
+			Idle:     flow.idleFor(),
+			Rx:       toStats.Rx,
+			Tx:       fromStats.Tx,
+		})
+	}
+
+	return
+}
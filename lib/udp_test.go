@@ -0,0 +1,325 @@
+package lib
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// udpEchoServer replies to every datagram with its
+// own address followed by the payload received.
+func udpEchoServer(t *testing.T) net.PacketConn {
+	pc, err := net.ListenPacket("udp4", "127.0.0.1:0")
+	assert.NoError(t, err)
+
+	go func() {
+		var buf = make([]byte, udpBufferSize)
+
+		for {
+			n, addr, err := pc.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+
+			reply := append([]byte(pc.LocalAddr().String()+" "), buf[:n]...)
+			pc.WriteTo(reply, addr)
+		}
+	}()
+
+	return pc
+}
+
+func udpExchange(t *testing.T, conn net.Conn, msg string) string {
+	var buf = make([]byte, 512)
+
+	_, err := conn.Write([]byte(msg))
+	assert.NoError(t, err)
+
+	conn.SetReadDeadline(time.Now().Add(1 * time.Second))
+	n, err := conn.Read(buf)
+	if err != nil {
+		return ""
+	}
+
+	return string(buf[:n])
+}
+
+func startUdpLoadBalancer(t *testing.T, frontend Frontend, servers []Server) (*LoadBalancer, string) {
+	probe, err := net.ListenPacket("udp4", "127.0.0.1:0")
+	assert.NoError(t, err)
+	frontend.Address = probe.LocalAddr().String()
+	probe.Close()
+
+	frontend.Name = "udp"
+	frontend.Backend = "udp"
+	frontend.Protocol = ProtocolUdp
+
+	lb := startLoadBalancer(t, LoadBalancerConfig{
+		Frontends: []Frontend{frontend},
+		Backends:  []Backend{{Name: "udp", Servers: servers}},
+	})
+
+	return lb, frontend.Address
+}
+
+func TestUdpFlowsArePinned(t *testing.T) {
+	upstreamA := udpEchoServer(t)
+	defer upstreamA.Close()
+	upstreamB := udpEchoServer(t)
+	defer upstreamB.Close()
+
+	lb, address := startUdpLoadBalancer(t, Frontend{}, []Server{
+		{Address: upstreamA.LocalAddr().String()},
+		{Address: upstreamB.LocalAddr().String()},
+	})
+
+	client1, err := net.Dial("udp4", address)
+	assert.NoError(t, err)
+	defer client1.Close()
+
+	client2, err := net.Dial("udp4", address)
+	assert.NoError(t, err)
+	defer client2.Close()
+
+	reply1 := udpExchange(t, client1, "one")
+	reply2 := udpExchange(t, client2, "two")
+	assert.NotEqual(t, reply1, reply2)
+
+	// subsequent datagrams of a client keep going to the
+	// same server.
+	assert.Equal(t, reply1, udpExchange(t, client1, "one"))
+	assert.Equal(t, reply2, udpExchange(t, client2, "two"))
+
+	stats := lb.Stats().Frontends[0]
+	assert.Equal(t, int64(2), stats.ActiveConnections)
+	assert.Len(t, stats.Flows, 2)
+
+	for _, flow := range stats.Flows {
+		assert.Equal(t, uint64(6), flow.Rx)
+		assert.True(t, flow.Tx > flow.Rx)
+	}
+}
+
+func TestUdpFlowsExpire(t *testing.T) {
+	upstream := udpEchoServer(t)
+	defer upstream.Close()
+
+	lb, address := startUdpLoadBalancer(t, Frontend{
+		IdleTimeout: 200 * time.Millisecond,
+	}, []Server{
+		{Address: upstream.LocalAddr().String()},
+	})
+
+	client, err := net.Dial("udp4", address)
+	assert.NoError(t, err)
+	defer client.Close()
+
+	assert.NotEmpty(t, udpExchange(t, client, "ping"))
+	assert.Len(t, lb.Stats().Frontends[0].Flows, 1)
+
+	// the flow expires once idle for longer than the
+	// timeout, releasing its server.
+	var (
+		stats    Stats
+		deadline = time.Now().Add(2 * time.Second)
+	)
+
+	for {
+		stats = lb.Stats()
+		if len(stats.Frontends[0].Flows) == 0 &&
+			stats.Backends[0].Servers[0].ActiveConnections == 0 {
+			break
+		}
+
+		if time.Now().After(deadline) {
+			t.Fatal("flow didn't expire")
+		}
+
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	assert.Equal(t, uint64(1), stats.Backends[0].Servers[0].TotalConnections)
+	assert.Equal(t, 0, stats.Backends[0].Servers[0].ActiveConnections)
+	assert.Equal(t, uint64(4), stats.Backends[0].Servers[0].Tx)
+}
+
+func TestUdpFlowTableIsBounded(t *testing.T) {
+	upstream := udpEchoServer(t)
+	defer upstream.Close()
+
+	lb, address := startUdpLoadBalancer(t, Frontend{
+		MaxFlows: 1,
+	}, []Server{
+		{Address: upstream.LocalAddr().String()},
+	})
+
+	client1, err := net.Dial("udp4", address)
+	assert.NoError(t, err)
+	defer client1.Close()
+
+	client2, err := net.Dial("udp4", address)
+	assert.NoError(t, err)
+	defer client2.Close()
+
+	assert.NotEmpty(t, udpExchange(t, client1, "one"))
+	assert.Empty(t, udpExchange(t, client2, "two"))
+	assert.Equal(t, uint64(1), lb.Stats().Frontends[0].DroppedPackets)
+}
+
+func TestUdpFlowsHonorACL(t *testing.T) {
+	upstream := udpEchoServer(t)
+	defer upstream.Close()
+
+	lb, address := startUdpLoadBalancer(t, Frontend{
+		ACL: ACL{Rules: []string{"deny 127.0.0.0/8"}},
+	}, []Server{
+		{Address: upstream.LocalAddr().String()},
+	})
+
+	client, err := net.Dial("udp4", address)
+	assert.NoError(t, err)
+	defer client.Close()
+
+	assert.Empty(t, udpExchange(t, client, "ping"))
+
+	stats := lb.Stats().Frontends[0]
+	assert.Equal(t, uint64(1), stats.Denied)
+	assert.Empty(t, stats.Flows)
+}
+
+func TestUdpFrontendRejectsTcpOptions(t *testing.T) {
+	var testCases = []struct {
+		description string
+		frontend    Frontend
+		healthCheck HealthCheck
+		shouldFail  bool
+	}{
+		{
+			description: "defaults",
+		},
+		{
+			description: "acl",
+			frontend:    Frontend{ACL: ACL{Rules: []string{"deny 10.0.0.0/8"}}},
+		},
+		{
+			description: "per-client limit",
+			frontend:    Frontend{MaxConnectionsPerClient: 10},
+			shouldFail:  true,
+		},
+		{
+			description: "rate limit",
+			frontend:    Frontend{RateLimit: RateLimit{Rate: 10}},
+			shouldFail:  true,
+		},
+		{
+			description: "host routing",
+			frontend: Frontend{HostRouting: HostRouting{
+				Rules: []HostRule{{Host: "example.com", Backend: "udp"}},
+			}},
+			shouldFail: true,
+		},
+		{
+			description: "mirror",
+			frontend:    Frontend{Mirror: Mirror{Backend: "udp"}},
+			shouldFail:  true,
+		},
+		{
+			description: "bandwidth",
+			frontend: Frontend{Bandwidth: FrontendBandwidth{
+				PerClient: Bandwidth{Upload: 1024},
+			}},
+			shouldFail: true,
+		},
+		{
+			description: "health checks",
+			healthCheck: HealthCheck{Interval: time.Second},
+			shouldFail:  true,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.description, func(t *testing.T) {
+			tc.frontend.Name = "udp"
+			tc.frontend.Address = "127.0.0.1:0"
+			tc.frontend.Backend = "udp"
+			tc.frontend.Protocol = ProtocolUdp
+
+			_, err := NewLoadBalancer(LoadBalancerConfig{
+				Frontends: []Frontend{tc.frontend},
+				Backends: []Backend{{
+					Name:        "udp",
+					HealthCheck: tc.healthCheck,
+					Servers:     []Server{{Address: "127.0.0.1:53"}},
+				}},
+			})
+			if tc.shouldFail {
+				assert.Error(t, err)
+				return
+			}
+
+			assert.NoError(t, err)
+		})
+	}
+}
+
+func TestUdpFlowsCloseCircuits(t *testing.T) {
+	upstream := udpEchoServer(t)
+	defer upstream.Close()
+
+	probe, err := net.ListenPacket("udp4", "127.0.0.1:0")
+	assert.NoError(t, err)
+	address := probe.LocalAddr().String()
+	probe.Close()
+
+	lb := startLoadBalancer(t, LoadBalancerConfig{
+		Frontends: []Frontend{{
+			Name:     "udp",
+			Address:  address,
+			Backend:  "udp",
+			Protocol: ProtocolUdp,
+		}},
+		Backends: []Backend{{
+			Name: "udp",
+			CircuitBreaker: CircuitBreaker{
+				ConsecutiveFailures: 1,
+				OpenTimeout:         100 * time.Millisecond,
+			},
+			Servers: []Server{{Address: upstream.LocalAddr().String()}},
+		}},
+	})
+
+	s := lb.backends[0].servers[0]
+	assert.Equal(t, CircuitOpen, s.breaker.observe(false, time.Now()))
+	time.Sleep(150 * time.Millisecond)
+
+	// the trial flow closes the circuit, letting the
+	// other clients through.
+	for i := 0; i < 3; i++ {
+		client, err := net.Dial("udp4", address)
+		assert.NoError(t, err)
+		defer client.Close()
+
+		assert.NotEmpty(t, udpExchange(t, client, "ping"))
+	}
+
+	assert.Equal(t, CircuitClosed, lb.Stats().Backends[0].Servers[0].Circuit)
+}
+
+func TestUdpFlowKeepsDatagramsPending(t *testing.T) {
+	var flow = &udpFlow{toStats: &IoStats{}, fromStats: &IoStats{}}
+
+	// until the upstream socket gets dialed, datagrams
+	// are kept up to a bound.
+	for i := 0; i < maxPendingDatagrams; i++ {
+		assert.True(t, flow.send([]byte("ping")))
+	}
+
+	assert.False(t, flow.send([]byte("ping")))
+	assert.Len(t, flow.pending, maxPendingDatagrams)
+
+	flow.Close()
+	flow.pending = nil
+	assert.False(t, flow.send([]byte("ping")))
+}
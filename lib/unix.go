@@ -0,0 +1,181 @@
+package lib
+
+import (
+	"net"
+	"os"
+	"os/user"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// UnixAddressPrefix marks addresses (of frontends and
+// servers) that refer to unix domain sockets, e.g.
+// 'unix:/var/run/docker.sock'.
+const UnixAddressPrefix = "unix:"
+
+const staleSocketDialTimeout = 1 * time.Second
+
+// unixSocketOptions holds the permissions applied to
+// the socket files l4 listens on. Negative ids leave
+// the owner or group untouched.
+type unixSocketOptions struct {
+	mode os.FileMode
+	uid  int
+	gid  int
+}
+
+// resolveNetwork retrieves the network and address to
+// be used with the net package, taking unix socket
+// addresses into account.
+func resolveNetwork(network, address string) (string, string) {
+	if strings.HasPrefix(address, UnixAddressPrefix) {
+		return "unix", strings.TrimPrefix(address, UnixAddressPrefix)
+	}
+
+	return network, address
+}
+
+func isUnixAddress(address string) bool {
+	return strings.HasPrefix(address, UnixAddressPrefix)
+}
+
+func parseUnixSocketOptions(mode, owner, group string) (opts unixSocketOptions, err error) {
+	opts.uid, opts.gid = -1, -1
+
+	if mode != "" {
+		var parsed uint64
+
+		parsed, err = strconv.ParseUint(mode, 8, 32)
+		if err != nil || parsed > 0777 {
+			err = errors.Errorf("malformed socket mode '%s'", mode)
+			return
+		}
+
+		opts.mode = os.FileMode(parsed)
+	}
+
+	if owner != "" {
+		opts.uid, err = strconv.Atoi(owner)
+		if err != nil {
+			var u *user.User
+
+			u, err = user.Lookup(owner)
+			if err != nil {
+				err = errors.Wrapf(err, "unknown socket owner '%s'", owner)
+				return
+			}
+
+			opts.uid, _ = strconv.Atoi(u.Uid)
+		}
+	}
+
+	if group != "" {
+		opts.gid, err = strconv.Atoi(group)
+		if err != nil {
+			var g *user.Group
+
+			g, err = user.LookupGroup(group)
+			if err != nil {
+				err = errors.Wrapf(err, "unknown socket group '%s'", group)
+				return
+			}
+
+			opts.gid, _ = strconv.Atoi(g.Gid)
+		}
+	}
+
+	return
+}
+
+// listenUnix listens on the socket file at 'path',
+// removing it first if it's a leftover from a process
+// that didn't shut down cleanly.
+func listenUnix(path string, opts unixSocketOptions) (ln net.Listener, err error) {
+	err = removeStaleSocket(path)
+	if err != nil {
+		return
+	}
+
+	ln, err = net.Listen("unix", path)
+	if err != nil {
+		return
+	}
+
+	if opts.mode != 0 {
+		err = os.Chmod(path, opts.mode)
+		if err != nil {
+			ln.Close()
+			err = errors.Wrapf(err, "couldn't change mode of socket %s", path)
+			return
+		}
+	}
+
+	if opts.uid >= 0 || opts.gid >= 0 {
+		err = os.Chown(path, opts.uid, opts.gid)
+		if err != nil {
+			ln.Close()
+			err = errors.Wrapf(err, "couldn't change owner of socket %s", path)
+			return
+		}
+	}
+
+	return
+}
+
+// removeStaleSocket removes a socket file that nobody
+// is accepting connections on. Sockets in use and
+// files that are not sockets are never removed.
+func removeStaleSocket(path string) (err error) {
+	info, err := os.Lstat(path)
+	if os.IsNotExist(err) {
+		err = nil
+		return
+	}
+
+	if err != nil {
+		return
+	}
+
+	if info.Mode()&os.ModeSocket == 0 {
+		err = errors.Errorf("%s exists and is not a socket", path)
+		return
+	}
+
+	conn, err := net.DialTimeout("unix", path, staleSocketDialTimeout)
+	if err == nil {
+		conn.Close()
+		err = errors.Errorf("socket %s is already in use", path)
+		return
+	}
+
+	if !isConnectionRefused(err) {
+		err = errors.Wrapf(err, "couldn't verify whether socket %s is stale", path)
+		return
+	}
+
+	err = os.Remove(path)
+	if err != nil {
+		err = errors.Wrapf(err, "couldn't remove stale socket %s", path)
+		return
+	}
+
+	return
+}
+
+func isConnectionRefused(err error) bool {
+	opErr, ok := err.(*net.OpError)
+	if !ok {
+		return false
+	}
+
+	syscallErr, ok := opErr.Err.(*os.SyscallError)
+	if !ok {
+		return false
+	}
+
+	return syscallErr.Err == syscall.ECONNREFUSED
+}
@@ -0,0 +1,144 @@
+package lib
+
+import (
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseUnixSocketOptions(t *testing.T) {
+	var testCases = []struct {
+		description string
+		mode        string
+		owner       string
+		group       string
+		expected    unixSocketOptions
+		shouldError bool
+	}{
+		{
+			description: "leaves everything untouched by default",
+			expected:    unixSocketOptions{uid: -1, gid: -1},
+		},
+		{
+			description: "parses octal modes and numeric ids",
+			mode:        "0660",
+			owner:       "1000",
+			group:       "50",
+			expected:    unixSocketOptions{mode: 0660, uid: 1000, gid: 50},
+		},
+		{
+			description: "resolves names",
+			owner:       "root",
+			group:       "root",
+			expected:    unixSocketOptions{uid: 0, gid: 0},
+		},
+		{
+			description: "fails with malformed mode",
+			mode:        "rw-rw----",
+			shouldError: true,
+		},
+		{
+			description: "fails with unknown owner",
+			owner:       "l4-nonexistent-user",
+			shouldError: true,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.description, func(t *testing.T) {
+			actual, err := parseUnixSocketOptions(tc.mode, tc.owner, tc.group)
+			if tc.shouldError {
+				assert.Error(t, err)
+				return
+			}
+
+			assert.NoError(t, err)
+			assert.Equal(t, tc.expected, actual)
+		})
+	}
+}
+
+func TestListenUnixRemovesStaleSocket(t *testing.T) {
+	dir, err := ioutil.TempDir("", "l4")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	var path = filepath.Join(dir, "l4.sock")
+
+	stale, err := net.Listen("unix", path)
+	assert.NoError(t, err)
+	stale.(*net.UnixListener).SetUnlinkOnClose(false)
+	stale.Close()
+
+	ln, err := listenUnix(path, unixSocketOptions{mode: 0600, uid: -1, gid: -1})
+	assert.NoError(t, err)
+	defer ln.Close()
+
+	info, err := os.Stat(path)
+	assert.NoError(t, err)
+	assert.Equal(t, os.FileMode(0600), info.Mode().Perm())
+
+	// a socket that is in use must not be taken over
+	_, err = listenUnix(path, unixSocketOptions{uid: -1, gid: -1})
+	assert.Error(t, err)
+}
+
+func TestListenUnixDoesntRemoveRegularFiles(t *testing.T) {
+	dir, err := ioutil.TempDir("", "l4")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	var path = filepath.Join(dir, "l4.sock")
+	assert.NoError(t, ioutil.WriteFile(path, []byte("data"), 0644))
+
+	_, err = listenUnix(path, unixSocketOptions{uid: -1, gid: -1})
+	assert.Error(t, err)
+
+	_, err = os.Stat(path)
+	assert.NoError(t, err)
+}
+
+func TestLoadBalancerWithUnixSockets(t *testing.T) {
+	var msg = []byte("PING\r\n")
+
+	dir, err := ioutil.TempDir("", "l4")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	var (
+		frontendPath = filepath.Join(dir, "frontend.sock")
+		upstreamPath = filepath.Join(dir, "upstream.sock")
+	)
+
+	upstream, _ := listenEcho(t, "unix", upstreamPath)
+	defer upstream.Close()
+
+	startLoadBalancer(t, LoadBalancerConfig{
+		Frontends: []Frontend{{
+			Name:       "sidecar",
+			Address:    UnixAddressPrefix + frontendPath,
+			Backend:    "local",
+			SocketMode: "0666",
+		}},
+		Backends: []Backend{{
+			Name:    "local",
+			Servers: []Server{{Address: UnixAddressPrefix + upstreamPath}},
+		}},
+	})
+
+	conn, err := net.Dial("unix", frontendPath)
+	assert.NoError(t, err)
+	defer conn.Close()
+
+	_, err = conn.Write(msg)
+	assert.NoError(t, err)
+
+	var received = make([]byte, len(msg))
+	_, err = conn.Read(received)
+	assert.NoError(t, err)
+	assert.Equal(t, msg, received)
+}
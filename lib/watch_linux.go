@@ -0,0 +1,80 @@
+//go:build linux
+// +build linux
+
+package lib
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"unsafe"
+
+	"github.com/pkg/errors"
+)
+
+const inotifyMask = syscall.IN_CLOSE_WRITE | syscall.IN_MODIFY |
+	syscall.IN_CREATE | syscall.IN_DELETE |
+	syscall.IN_MOVED_TO | syscall.IN_MOVED_FROM
+
+// watchFile notifies about changes to the file at
+// 'path' using inotify. The directory is watched
+// instead of the file so that files replaced by
+// renames (atomic writes) keep being followed.
+func watchFile(path string, done <-chan struct{}) (events <-chan struct{}, err error) {
+	var (
+		dir, name = filepath.Split(path)
+		ch        = make(chan struct{}, 1)
+	)
+
+	if dir == "" {
+		dir = "."
+	}
+
+	fd, err := syscall.InotifyInit1(syscall.IN_CLOEXEC | syscall.IN_NONBLOCK)
+	if err != nil {
+		err = errors.Wrapf(err, "couldn't initialize inotify")
+		return
+	}
+
+	_, err = syscall.InotifyAddWatch(fd, dir, inotifyMask)
+	if err != nil {
+		syscall.Close(fd)
+		err = errors.Wrapf(err, "couldn't watch directory %s", dir)
+		return
+	}
+
+	// being non-blocking, the descriptor is handled by
+	// the runtime poller, which lets Close interrupt a
+	// pending Read.
+	file := os.NewFile(uintptr(fd), "inotify")
+
+	go func() {
+		<-done
+		file.Close()
+	}()
+
+	go func() {
+		var buf = make([]byte, 64*1024)
+
+		for {
+			n, err := file.Read(buf)
+			if err != nil {
+				return
+			}
+
+			for offset := 0; offset+syscall.SizeofInotifyEvent <= n; {
+				event := (*syscall.InotifyEvent)(unsafe.Pointer(&buf[offset]))
+				start := offset + syscall.SizeofInotifyEvent
+				offset = start + int(event.Len)
+
+				if strings.TrimRight(string(buf[start:offset]), "\x00") == name {
+					notify(ch)
+				}
+			}
+		}
+	}()
+
+	events = ch
+	return
+}
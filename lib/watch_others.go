@@ -0,0 +1,13 @@
+//go:build !linux
+// +build !linux
+
+package lib
+
+import (
+	"github.com/pkg/errors"
+)
+
+func watchFile(path string, done <-chan struct{}) (events <-chan struct{}, err error) {
+	err = errors.Errorf("watching files is only supported on linux")
+	return
+}
@@ -3,6 +3,8 @@ package main
 import (
 	"fmt"
 	"os"
+	"os/signal"
+	"syscall"
 
 	"github.com/alexflint/go-arg"
 
@@ -10,45 +12,108 @@ import (
 )
 
 type config struct {
-	Port    int      `arg:"-p,env,help:port to listen to"`
+	Port    int      `arg:"-p,env,help:port to listen to (default: 3000)"`
 	Config  string   `arg:"-c,env,help:configuration file to use"`
+	Admin   string   `arg:"-a,env,help:address of the admin interface"`
 	Debug   bool     `arg:"-d,env,help:enables debug mode"`
 	Servers []string `arg:"positional"`
 }
 
+const defaultPort = 3000
+
 var (
-	args      = &config{Port: 3000}
+	args      = &config{}
 	argParser *arg.Parser
 	err       error
 )
 
 func main() {
+	var cfg Config
+
 	argParser = arg.MustParse(args)
-	if len(args.Servers) == 0 {
-		argParser.Fail("At least one server must be specified (positional argument).")
+	if args.Config != "" {
+		cfg, err = LoadConfig(args.Config)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "ERROR: Couldn't load configuration.\n"+
+				"%+v\n", err)
+			os.Exit(1)
+		}
 	}
 
-	lb, err := NewLoadBalancer(LoadBalancerConfig{
-		Port:  args.Port,
-		Debug: args.Debug,
-	})
+	// the flag (or its environment variable) takes
+	// precedence over the configuration file, like the
+	// admin address does.
+	if args.Port != 0 {
+		cfg.Port = args.Port
+	}
+
+	if cfg.Port == 0 {
+		cfg.Port = defaultPort
+	}
+
+	if args.Admin != "" {
+		cfg.Admin = args.Admin
+	}
+
+	for _, address := range args.Servers {
+		cfg.Servers = append(cfg.Servers, Server{
+			Address: address,
+		})
+	}
+
+	err = cfg.Normalize()
 	if err != nil {
-		fmt.Fprintf(os.Stderr, "ERROR: Couldn't instantiate load-balancer.\n"+
+		fmt.Fprintf(os.Stderr, "ERROR: Invalid configuration.\n"+
 			"%+v\n", err)
 		os.Exit(1)
 	}
 
-	err = lb.Load(args.Servers)
+	if len(cfg.Frontends) == 0 {
+		argParser.Fail("At least one server must be specified " +
+			"(positional argument or configuration file).")
+	}
+
+	lb, err := NewLoadBalancer(LoadBalancerConfig{
+		Debug:          args.Debug,
+		Admin:          cfg.Admin,
+		MaxConnections: cfg.MaxConnections,
+		Frontends:      cfg.Frontends,
+		Backends:       cfg.Backends,
+		Discovery:      cfg.Discovery,
+		StateFile:      cfg.StateFile,
+		Capture:        cfg.Capture,
+	})
 	if err != nil {
-		fmt.Fprintf(os.Stderr, "ERROR: Couldn't make load-balancer load server configuration.\n"+
+		fmt.Fprintf(os.Stderr, "ERROR: Couldn't instantiate load-balancer.\n"+
 			"%+v\n", err)
 		os.Exit(1)
 	}
 
+	// stopping on SIGTERM (or SIGINT) lets established
+	// connections finish and saves the state for the
+	// next instance.
+	var (
+		signals = make(chan os.Signal, 1)
+		stopped = make(chan struct{})
+	)
+
+	signal.Notify(signals, syscall.SIGTERM, syscall.SIGINT)
+	go func() {
+		<-signals
+		err := lb.Stop()
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "ERROR: Failed stopping.\n"+
+				"%+v\n", err)
+		}
+		close(stopped)
+	}()
+
 	err = lb.Listen()
 	if err != nil {
-		fmt.Fprintf(os.Stderr, "ERROR: Failed listening on port %d.\n"+
-			"%+v\n", args.Port, err)
+		fmt.Fprintf(os.Stderr, "ERROR: Failed listening.\n"+
+			"%+v\n", err)
 		os.Exit(1)
 	}
+
+	<-stopped
 }